@@ -1,9 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 
 	"rtc-nb/backend/internal/config"
 	"rtc-nb/backend/internal/connections"
@@ -18,6 +25,9 @@ import (
 	"github.com/gorilla/mux"
 )
 
+// shutdownTimeout bounds the whole drain on SIGTERM; keep it under the platform's kill timeout
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 	cfg := config.Load()
 
@@ -26,7 +36,6 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to initialize store: %v", err)
 	}
-	defer dbStore.Close()
 
 	fileStore, err := local.NewLocalFileStore(cfg.FileStorePath)
 	if err != nil {
@@ -34,8 +43,20 @@ func main() {
 	}
 
 	// Initialize websocket hub and handler
-	connManager := connections.NewHub()
-	connManager.StartCleanupTicker() // Stale connections cleanup
+	clientConfig := connections.DefaultClientConfig()
+	if cfg.WSQueueSize > 0 {
+		clientConfig.QueueSize = cfg.WSQueueSize
+	}
+	if clientConfig.Policy, err = connections.ParseSlowConsumerPolicy(cfg.WSSlowConsumerPolicy); err != nil {
+		log.Fatalf("Invalid WS_SLOW_CONSUMER_POLICY: %v", err)
+	}
+	broker, err := newBroker(cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize broker: %v", err)
+	}
+	connManager := connections.NewHub(clientConfig, broker)
+	connManager.StartCleanupTicker()  // Stale connections cleanup
+	connManager.StartPresenceTicker() // Cluster-wide presence, when a broker is configured
 
 	// Initialize the system channel for broadcasting system messages
 	if err := connManager.InitializeChannel("system"); err != nil {
@@ -43,16 +64,42 @@ func main() {
 	}
 
 	// Initialize services
-	chatService := chat.NewService(dbStore, fileStore, connManager)
-	sketchService := sketch.NewService(dbStore, connManager)
+	// Nodes behind a broker share each channel's sequence, so they take one number at a time to keep it ordered
+	seqBlockSize := cfg.SeqBlockSize
+	if broker != nil {
+		if seqBlockSize > 1 {
+			log.Fatalf("Invalid SEQ_BLOCK_SIZE %d: must be 1 when a broker is configured", seqBlockSize)
+		}
+		seqBlockSize = 1
+	}
+	chatService := chat.NewService(dbStore, fileStore, connManager, seqBlockSize)
+	sketchConfig := sketch.DefaultConfig()
+	if cfg.SketchSimplifyTolerance > 0 {
+		sketchConfig.SimplifyTolerance = cfg.SketchSimplifyTolerance
+	}
+	if cfg.SketchCompactInterval > 0 {
+		sketchConfig.CompactInterval = cfg.SketchCompactInterval
+	}
+	sketchService := sketch.NewService(dbStore, fileStore, connManager, sketchConfig)
+	sketchService.StartCompactionTicker() // Shrinks the stored regions of sketches changed since their last compaction
+
+	// Chat messages wait on disk while the database is unavailable
+	chatSpool, err := messaging.OpenSpool(filepath.Join(cfg.FileStorePath, messaging.SpoolDir))
+	if err != nil {
+		log.Fatalf("Failed to open chat spool: %v", err)
+	}
 
-	msgProcessor := messaging.NewProcessor(connManager, chatService, sketchService)
+	msgProcessor := messaging.NewProcessor(connManager, chatService, sketchService, chatSpool)
 
 	wsHandler := websocket.NewHandler(connManager, msgProcessor)
 
 	// Setup router and routes
 	router := mux.NewRouter()
-	api.RegisterRoutes(router, wsHandler, connManager, chatService, sketchService, cfg.FileStorePath, msgProcessor)
+	var internalRouter *mux.Router
+	if cfg.InternalAddr != "" {
+		internalRouter = mux.NewRouter()
+	}
+	api.RegisterRoutes(router, internalRouter, wsHandler, connManager, chatService, sketchService, cfg.FileStorePath, msgProcessor)
 
 	// Determine port
 	port := os.Getenv("PORT")
@@ -61,8 +108,76 @@ func main() {
 	}
 	addr := ":" + port
 
-	log.Printf("Server starting on %s", addr)
-	if err := http.ListenAndServe(addr, router); err != nil {
-		log.Fatal("ListenAndServe: ", err)
+	server := &http.Server{Addr: addr, Handler: router}
+	go func() {
+		log.Printf("Server starting on %s", addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("ListenAndServe: ", err)
+		}
+	}()
+
+	// Operational endpoints listen apart, on an address that is not exposed
+	var internalServer *http.Server
+	if internalRouter != nil {
+		internalServer = &http.Server{Addr: cfg.InternalAddr, Handler: internalRouter}
+		go func() {
+			log.Printf("Internal server starting on %s", cfg.InternalAddr)
+			if err := internalServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal("Internal ListenAndServe: ", err)
+			}
+		}()
+	}
+
+	// Wait for the platform to ask us to stop (SIGTERM on redeploy, SIGINT locally)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	sig := <-stop
+	log.Printf("Received %s, shutting down", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// Stop accepting connections; websockets are hijacked, so the hub closes those
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down HTTP server: %v", err)
+	}
+	if internalServer != nil {
+		if err := internalServer.Shutdown(ctx); err != nil {
+			log.Printf("Error shutting down internal HTTP server: %v", err)
+		}
+	}
+	if err := connManager.Shutdown(ctx); err != nil {
+		log.Printf("Error closing websocket connections: %v", err)
+	}
+	// Nothing produces buffered messages anymore, so persist what is left
+	if err := msgProcessor.Close(ctx); err != nil {
+		log.Printf("Error flushing message buffers: %v", err)
+	}
+	sketchService.Close()
+	if err := chatSpool.Close(); err != nil {
+		log.Printf("Error closing chat spool: %v", err)
+	}
+	if broker != nil {
+		if err := broker.Close(); err != nil {
+			log.Printf("Error closing broker: %v", err)
+		}
+	}
+	if err := dbStore.Close(); err != nil {
+		log.Printf("Error closing store: %v", err)
+	}
+	log.Println("Server stopped")
+}
+
+// newBroker selects the cross-node message bus; nil runs the hub as a single node
+func newBroker(cfg *config.Config) (connections.Broker, error) {
+	switch cfg.Broker {
+	case "", "none":
+		return nil, nil
+	case "memory":
+		return connections.NewLocalBroker(), nil
+	case "postgres":
+		return connections.NewPostgresBroker(cfg.DB, cfg.DatabaseURL)
+	default:
+		return nil, fmt.Errorf("unknown BROKER: %s", cfg.Broker)
 	}
 }
@@ -11,3 +11,5 @@ require (
 	golang.org/x/crypto v0.31.0
 	golang.org/x/image v0.23.0
 )
+
+require golang.org/x/text v0.21.0 // indirect
@@ -8,7 +8,9 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	_ "github.com/lib/pq"
 )
@@ -16,19 +18,92 @@ import (
 // Loads env variables & initializes db
 type Config struct {
 	DB            *sql.DB
+	DatabaseURL   string // Connection string DB was opened with; used for dedicated listener connections
 	FileStorePath string
+
+	// Cross-node message bus: "" for a single node, "postgres" for LISTEN/NOTIFY
+	Broker string
+
+	// Outbound websocket queues; zero values fall back to the hub defaults
+	WSQueueSize          int
+	WSSlowConsumerPolicy string // "drop_oldest" or "disconnect"
+
+	// Channel sequence numbers reserved per database round trip; zero picks a default for the broker
+	SeqBlockSize int
+
+	// Sketch storage; zero values fall back to the sketch service defaults
+	SketchSimplifyTolerance float64       // Pixels
+	SketchCompactInterval   time.Duration // e.g. "10m"
+
+	// Listen address of the unauthenticated operational endpoints, e.g. "127.0.0.1:9090"; empty disables them.
+	// Never expose it publicly.
+	InternalAddr string
 }
 
 func Load() *Config {
 	LoadEnv()
 
+	connStr := postgresConnString()
 	return &Config{
-		DB:            initPostgres(),
-		FileStorePath: os.Getenv("FILESTORE_PATH"),
+		DB:                   initPostgres(connStr),
+		DatabaseURL:          connStr,
+		FileStorePath:        os.Getenv("FILESTORE_PATH"),
+		Broker:               strings.ToLower(os.Getenv("BROKER")),
+		WSQueueSize:          intEnv("WS_QUEUE_SIZE"),
+		WSSlowConsumerPolicy: os.Getenv("WS_SLOW_CONSUMER_POLICY"),
+		SeqBlockSize:         intEnv("SEQ_BLOCK_SIZE"),
+
+		SketchSimplifyTolerance: floatEnv("SKETCH_SIMPLIFY_TOLERANCE"),
+		SketchCompactInterval:   durationEnv("SKETCH_COMPACT_INTERVAL"),
+
+		InternalAddr: os.Getenv("INTERNAL_ADDR"),
+	}
+}
+
+// intEnv reads a positive integer environment variable, returning 0 if unset or invalid
+func intEnv(name string) int {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return 0
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value <= 0 {
+		log.Printf("Ignoring invalid %s=%q", name, raw)
+		return 0
 	}
+	return value
 }
 
-func initPostgres() *sql.DB {
+// floatEnv reads a positive number environment variable, returning 0 if unset or invalid
+func floatEnv(name string) float64 {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return 0
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || value <= 0 {
+		log.Printf("Ignoring invalid %s=%q", name, raw)
+		return 0
+	}
+	return value
+}
+
+// durationEnv reads a positive duration environment variable, returning 0 if unset or invalid
+func durationEnv(name string) time.Duration {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return 0
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil || value <= 0 {
+		log.Printf("Ignoring invalid %s=%q", name, raw)
+		return 0
+	}
+	return value
+}
+
+// postgresConnString builds the connection string from DATABASE_URL or the POSTGRES_* variables
+func postgresConnString() string {
 	connStr := os.Getenv("DATABASE_URL")
 	if connStr == "" {
 		log.Println("DATABASE_URL not found, falling back to individual POSTGRES_* variables (for local dev)")
@@ -55,7 +130,10 @@ func initPostgres() *sql.DB {
 			}
 		}
 	}
+	return connStr
+}
 
+func initPostgres(connStr string) *sql.DB {
 	var err error
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
@@ -0,0 +1,87 @@
+package connections
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+var (
+	ErrBrokerClosed  = errors.New("broker closed")
+	ErrBrokerBacklog = errors.New("broker publish queue full")
+)
+
+// EventKind identifies what a cross-node event asks the receiving hubs to do
+type EventKind string
+
+const (
+	EventChannel    EventKind = "channel"     // Deliver Payload to a channel's clients
+	EventUser       EventKind = "user"        // Deliver Payload to a user's channel sessions
+	EventSystemUser EventKind = "system_user" // Deliver Payload to a user's system sessions
+	EventAll        EventKind = "all"         // Deliver Payload to every system session
+	EventSketch     EventKind = "sketch"      // Deliver Payload to a channel's clients showing SketchID, except Except's
+	EventPresence   EventKind = "presence"    // Replace the origin node's presence snapshot
+)
+
+// Event is the unit a Broker carries between nodes
+type Event struct {
+	Kind     EventKind       `json:"kind"`
+	Origin   string          `json:"origin"`           // Node ID of the publishing hub
+	Target   string          `json:"target,omitempty"` // Channel name or username, depending on Kind
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	Presence *NodePresence   `json:"presence,omitempty"`
+	SketchID string          `json:"sketch_id,omitempty"` // For EventSketch
+	Except   string          `json:"except,omitempty"`    // For EventSketch: the username whose sessions are skipped
+}
+
+// NodePresence is the set of users connected to one node
+type NodePresence struct {
+	Channels map[string][]string `json:"channels"` // channelName -> usernames with a session in it
+	Users    []string            `json:"users"`    // Usernames with at least one system session
+}
+
+// Broker fans hub events out to every node of the cluster. Subscribers receive all
+// events, including the ones their own hub published; hubs skip those by Origin.
+type Broker interface {
+	Publish(event Event) error
+	Subscribe(handler func(Event))
+	Close() error
+}
+
+// LocalBroker connects hubs living in the same process. It is meant for tests and
+// single-binary setups; delivery is synchronous on the publishing goroutine.
+type LocalBroker struct {
+	mu       sync.RWMutex
+	handlers []func(Event)
+	closed   bool
+}
+
+func NewLocalBroker() *LocalBroker {
+	return &LocalBroker{}
+}
+
+func (b *LocalBroker) Publish(event Event) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return ErrBrokerClosed
+	}
+	for _, handler := range b.handlers {
+		handler(event)
+	}
+	return nil
+}
+
+func (b *LocalBroker) Subscribe(handler func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+func (b *LocalBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.handlers = nil
+	return nil
+}
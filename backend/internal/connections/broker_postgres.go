@@ -0,0 +1,246 @@
+package connections
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	notifyChannel     = "rtc_hub_events"
+	maxNotifyPayload  = 7900 // Postgres rejects NOTIFY payloads of 8000 bytes or more
+	eventRefPrefix    = "ref:"
+	outboxSize        = 1024
+	eventRetention    = 5 * time.Minute
+	listenerPingEvery = 90 * time.Second
+)
+
+// PostgresBroker carries hub events between nodes over LISTEN/NOTIFY.
+// Events too large for a NOTIFY payload are stored in broker_events and
+// announced by id; receivers read them back from the table.
+type PostgresBroker struct {
+	db       *sql.DB
+	listener *pq.Listener
+	outbox   chan []byte
+
+	notify      *sql.Stmt // channel, payload
+	insertEvent *sql.Stmt // payload
+	selectEvent *sql.Stmt // id
+	purgeEvents *sql.Stmt // created before
+
+	mu       sync.RWMutex
+	handlers []func(Event)
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+func NewPostgresBroker(db *sql.DB, connStr string) (*PostgresBroker, error) {
+	b := &PostgresBroker{
+		db:     db,
+		outbox: make(chan []byte, outboxSize),
+		done:   make(chan struct{}),
+	}
+
+	var err error
+	if b.notify, err = db.Prepare(`SELECT pg_notify($1, $2)`); err != nil {
+		return nil, fmt.Errorf("prepare notify: %w", err)
+	}
+	if b.insertEvent, err = db.Prepare(`INSERT INTO broker_events (payload) VALUES ($1) RETURNING id`); err != nil {
+		return nil, fmt.Errorf("prepare insert broker event: %w", err)
+	}
+	if b.selectEvent, err = db.Prepare(`SELECT payload FROM broker_events WHERE id = $1`); err != nil {
+		return nil, fmt.Errorf("prepare select broker event: %w", err)
+	}
+	if b.purgeEvents, err = db.Prepare(`DELETE FROM broker_events WHERE created_at < $1`); err != nil {
+		return nil, fmt.Errorf("prepare purge broker events: %w", err)
+	}
+
+	b.listener = pq.NewListener(connStr, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Broker listener event %d: %v", ev, err)
+		}
+	})
+	if err := b.listener.Listen(notifyChannel); err != nil {
+		b.listener.Close()
+		return nil, fmt.Errorf("listen on %s: %w", notifyChannel, err)
+	}
+
+	b.wg.Add(2)
+	go b.publishLoop()
+	go b.listenLoop()
+	return b, nil
+}
+
+// Publish queues the event for delivery; it never waits on the database
+func (b *PostgresBroker) Publish(event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("marshal broker event: %w", err)
+	}
+
+	select {
+	case <-b.done:
+		return ErrBrokerClosed
+	default:
+	}
+
+	select {
+	case b.outbox <- data:
+		return nil
+	default:
+		return ErrBrokerBacklog
+	}
+}
+
+func (b *PostgresBroker) Subscribe(handler func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+// Close stops both loops after flushing already queued events
+func (b *PostgresBroker) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.done)
+		b.wg.Wait()
+		b.listener.Close()
+		b.notify.Close()
+		b.insertEvent.Close()
+		b.selectEvent.Close()
+		b.purgeEvents.Close()
+	})
+	return nil
+}
+
+func (b *PostgresBroker) publishLoop() {
+	defer b.wg.Done()
+
+	purge := time.NewTicker(time.Minute)
+	defer purge.Stop()
+
+	for {
+		select {
+		case data := <-b.outbox:
+			b.send(data)
+		case <-purge.C:
+			if _, err := b.purgeEvents.Exec(time.Now().UTC().Add(-eventRetention)); err != nil {
+				log.Printf("Error purging broker events: %v", err)
+			}
+		case <-b.done:
+			for {
+				select {
+				case data := <-b.outbox:
+					b.send(data)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (b *PostgresBroker) send(data []byte) {
+	payload, err := notifyPayload(data, func(event string) (int64, error) {
+		var id int64
+		err := b.insertEvent.QueryRow(event).Scan(&id)
+		return id, err
+	})
+	if err != nil {
+		log.Printf("Error storing broker event: %v", err)
+		return
+	}
+	if _, err := b.notify.Exec(notifyChannel, payload); err != nil {
+		log.Printf("Error publishing broker event: %v", err)
+	}
+}
+
+// notifyPayload returns data as a NOTIFY payload, handing events too large for one to store
+// and sending a reference to the stored row instead
+func notifyPayload(data []byte, store func(event string) (int64, error)) (string, error) {
+	payload := string(data)
+	if len(payload) <= maxNotifyPayload {
+		return payload, nil
+	}
+	id, err := store(payload)
+	if err != nil {
+		return "", err
+	}
+	return eventRefPrefix + strconv.FormatInt(id, 10), nil
+}
+
+// eventPayload resolves a NOTIFY payload to the event JSON, reading referenced events back with load
+func eventPayload(payload string, load func(id int64) (string, error)) (string, error) {
+	ref, ok := strings.CutPrefix(payload, eventRefPrefix)
+	if !ok {
+		return payload, nil
+	}
+	id, err := strconv.ParseInt(ref, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid event reference %q", ref)
+	}
+	event, err := load(id)
+	if err != nil {
+		return "", fmt.Errorf("load broker event %d: %w", id, err)
+	}
+	return event, nil
+}
+
+func (b *PostgresBroker) listenLoop() {
+	defer b.wg.Done()
+
+	ping := time.NewTicker(listenerPingEvery)
+	defer ping.Stop()
+
+	for {
+		select {
+		case n := <-b.listener.Notify:
+			// A nil notification means the listener reconnected; events sent meanwhile are lost
+			if n == nil {
+				continue
+			}
+			event, err := b.decode(n.Extra)
+			if err != nil {
+				log.Printf("Error decoding broker event: %v", err)
+				continue
+			}
+			b.dispatch(event)
+		case <-ping.C:
+			go b.listener.Ping()
+		case <-b.done:
+			return
+		}
+	}
+}
+
+func (b *PostgresBroker) decode(payload string) (Event, error) {
+	var event Event
+	payload, err := eventPayload(payload, func(id int64) (string, error) {
+		var stored string
+		err := b.selectEvent.QueryRow(id).Scan(&stored)
+		return stored, err
+	})
+	if err != nil {
+		return event, err
+	}
+	if err := json.Unmarshal([]byte(payload), &event); err != nil {
+		return event, err
+	}
+	return event, nil
+}
+
+func (b *PostgresBroker) dispatch(event Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, handler := range b.handlers {
+		handler(event)
+	}
+}
@@ -0,0 +1,198 @@
+package connections
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// SlowConsumerPolicy decides what happens when a client's outbound queue is full
+type SlowConsumerPolicy int
+
+const (
+	DropOldest SlowConsumerPolicy = iota // Discard the oldest queued message to make room
+	Disconnect                           // Close the connection; the client reconnects and replays
+)
+
+func ParseSlowConsumerPolicy(s string) (SlowConsumerPolicy, error) {
+	switch strings.ToLower(s) {
+	case "", "drop_oldest":
+		return DropOldest, nil
+	case "disconnect":
+		return Disconnect, nil
+	default:
+		return DropOldest, fmt.Errorf("unknown slow consumer policy: %s", s)
+	}
+}
+
+func (p SlowConsumerPolicy) String() string {
+	if p == Disconnect {
+		return "disconnect"
+	}
+	return "drop_oldest"
+}
+
+type ClientConfig struct {
+	QueueSize    int                // Outbound messages buffered per connection
+	Policy       SlowConsumerPolicy // Applied when the queue is full
+	WriteTimeout time.Duration      // Per-frame write deadline
+}
+
+func DefaultClientConfig() ClientConfig {
+	return ClientConfig{
+		QueueSize:    256,
+		Policy:       DropOldest,
+		WriteTimeout: 5 * time.Second,
+	}
+}
+
+var ErrClientClosed = errors.New("client connection closed")
+
+// client owns all writes to one websocket connection. Messages are queued by the hub
+// and written by a dedicated goroutine, so a slow peer never blocks anyone else.
+type client struct {
+	conn    *websocket.Conn
+	send    chan []byte
+	cfg     ClientConfig
+	metrics *queueMetrics
+
+	closing   chan []byte // Close frame requested by shutdown; written after the queue drains
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newClient(conn *websocket.Conn, cfg ClientConfig, metrics *queueMetrics) *client {
+	c := &client{
+		conn:    conn,
+		send:    make(chan []byte, cfg.QueueSize),
+		cfg:     cfg,
+		metrics: metrics,
+		closing: make(chan []byte, 1),
+		done:    make(chan struct{}),
+	}
+	go c.writePump()
+	return c
+}
+
+// enqueue queues message without blocking, applying the slow consumer policy if the queue is full
+func (c *client) enqueue(message []byte) {
+	select {
+	case <-c.done:
+		return
+	case c.send <- message:
+		return
+	default:
+	}
+
+	switch c.cfg.Policy {
+	case Disconnect:
+		c.metrics.slowDisconnects.Add(1)
+		c.close()
+	default:
+		// Make room by discarding the oldest message; the writer may have drained one meanwhile
+		select {
+		case <-c.send:
+			c.metrics.dropped.Add(1)
+		default:
+		}
+		select {
+		case c.send <- message:
+		default:
+			c.metrics.dropped.Add(1)
+		}
+	}
+}
+
+// enqueueWait queues message, waiting up to the write timeout for room instead of applying the policy.
+// Used for replays, which must not be thinned out.
+func (c *client) enqueueWait(message []byte) error {
+	timer := time.NewTimer(c.cfg.WriteTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-c.done:
+		return ErrClientClosed
+	case c.send <- message:
+		return nil
+	case <-timer.C:
+		c.metrics.slowDisconnects.Add(1)
+		c.close()
+		return fmt.Errorf("client queue full after %s", c.cfg.WriteTimeout)
+	}
+}
+
+func (c *client) writePump() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case message := <-c.send:
+			if err := c.write(message); err != nil {
+				// The read loop sees the closed connection and unregisters it
+				c.close()
+				return
+			}
+		case frame := <-c.closing:
+			// Deliver what is already queued, then say goodbye
+			for queued := true; queued; {
+				select {
+				case message := <-c.send:
+					if err := c.write(message); err != nil {
+						queued = false
+					}
+				default:
+					queued = false
+				}
+			}
+			c.conn.WriteControl(websocket.CloseMessage, frame, time.Now().Add(c.cfg.WriteTimeout))
+			c.close()
+			return
+		}
+	}
+}
+
+func (c *client) write(message []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteTimeout))
+	return c.conn.WriteMessage(websocket.TextMessage, message)
+}
+
+// shutdown asks the writer to flush the queue and then close the connection with code and text
+func (c *client) shutdown(code int, text string) {
+	select {
+	case c.closing <- websocket.FormatCloseMessage(code, text):
+	default: // Already shutting down
+	}
+}
+
+func (c *client) queueDepth() int {
+	return len(c.send)
+}
+
+func (c *client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// queueMetrics are cumulative counters shared by every client of a hub
+type queueMetrics struct {
+	dropped         atomic.Int64
+	slowDisconnects atomic.Int64
+}
+
+// QueueStats is a snapshot of the hub's outbound queues
+type QueueStats struct {
+	Clients         int    `json:"clients"`
+	QueuedMessages  int    `json:"queued_messages"`
+	MaxQueueDepth   int    `json:"max_queue_depth"`
+	QueueCapacity   int    `json:"queue_capacity"`
+	Policy          string `json:"policy"`
+	DroppedMessages int64  `json:"dropped_messages"`
+	SlowDisconnects int64  `json:"slow_disconnects"`
+}
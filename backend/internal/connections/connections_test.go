@@ -0,0 +1,481 @@
+package connections
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// pipeListener hands out one end of an in-memory pipe to the test server
+type pipeListener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// pipeConns returns both sides of a websocket running over an unbuffered in-memory pipe, so a frame
+// written to one side blocks until the other side reads it.
+func pipeConns(t *testing.T) (server, peer *websocket.Conn) {
+	t.Helper()
+	serverEnd, peerEnd := net.Pipe()
+	listener := &pipeListener{conns: make(chan net.Conn, 1), done: make(chan struct{})}
+	listener.conns <- serverEnd
+
+	upgraded := make(chan *websocket.Conn, 1)
+	httpServer := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		upgraded <- conn
+	})}
+	go httpServer.Serve(listener)
+	t.Cleanup(func() { httpServer.Close() })
+
+	dialer := websocket.Dialer{NetDial: func(string, string) (net.Conn, error) { return peerEnd, nil }}
+	peer, _, err := dialer.Dial("ws://pipe/", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { peer.Close() })
+
+	select {
+	case server = <-upgraded:
+		t.Cleanup(func() { server.Close() })
+		return server, peer
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the server side of the connection")
+		return nil, nil
+	}
+}
+
+// stalledConn returns the server side of a websocket whose peer never reads.
+func stalledConn(t *testing.T) *websocket.Conn {
+	t.Helper()
+	conn, _ := pipeConns(t)
+	return conn
+}
+
+// stalledHub returns a hub with one stalled client in general whose writer is already stuck on a first frame
+func stalledHub(t *testing.T, cfg ClientConfig) (*Hub, *websocket.Conn) {
+	t.Helper()
+	hub := NewHub(cfg, nil)
+	conn := stalledConn(t)
+	hub.mu.Lock()
+	hub.registerClient(conn)
+	hub.mu.Unlock()
+	hub.AddClientToChannel("general", conn)
+
+	hub.NotifyChannel("general", []byte("stuck"))
+	waitFor(t, "the writer to take the first frame", func() bool { return hub.QueueStats().QueuedMessages == 0 })
+	return hub, conn
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestParseSlowConsumerPolicy(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    SlowConsumerPolicy
+		wantErr bool
+	}{
+		{value: "", want: DropOldest},
+		{value: "drop_oldest", want: DropOldest},
+		{value: "DISCONNECT", want: Disconnect},
+		{value: "block", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSlowConsumerPolicy(tt.value)
+		if (err != nil) != tt.wantErr || (!tt.wantErr && got != tt.want) {
+			t.Errorf("ParseSlowConsumerPolicy(%q) = %v, %v; want %v, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestSlowConsumerDropOldest(t *testing.T) {
+	hub, conn := stalledHub(t, ClientConfig{QueueSize: 2, Policy: DropOldest, WriteTimeout: time.Minute})
+
+	for _, msg := range []string{"one", "two"} {
+		hub.NotifyChannel("general", []byte(msg))
+	}
+	stats := hub.QueueStats()
+	if stats.Clients != 1 || stats.QueuedMessages != 2 || stats.MaxQueueDepth != 2 || stats.QueueCapacity != 2 || stats.Policy != "drop_oldest" {
+		t.Fatalf("stats with a full queue = %+v", stats)
+	}
+	if stats.DroppedMessages != 0 {
+		t.Fatalf("dropped %d messages before the queue overflowed", stats.DroppedMessages)
+	}
+
+	for _, msg := range []string{"three", "four", "five"} {
+		hub.NotifyChannel("general", []byte(msg))
+	}
+	stats = hub.QueueStats()
+	if stats.DroppedMessages != 3 || stats.SlowDisconnects != 0 || stats.QueuedMessages != 2 {
+		t.Errorf("stats after overflowing by three = %+v, want 3 dropped, no disconnects, 2 queued", stats)
+	}
+
+	// The newest messages are the ones kept
+	hub.mu.RLock()
+	c := hub.clients[conn]
+	hub.mu.RUnlock()
+	for _, want := range []string{"four", "five"} {
+		if got := <-c.send; !bytes.Equal(got, []byte(want)) {
+			t.Errorf("queued %q, want %q", got, want)
+		}
+	}
+	select {
+	case <-c.done:
+		t.Error("drop_oldest closed the connection")
+	default:
+	}
+}
+
+func TestSlowConsumerDisconnect(t *testing.T) {
+	hub, conn := stalledHub(t, ClientConfig{QueueSize: 2, Policy: Disconnect, WriteTimeout: time.Minute})
+	hub.mu.RLock()
+	c := hub.clients[conn]
+	hub.mu.RUnlock()
+
+	for _, msg := range []string{"one", "two"} {
+		hub.NotifyChannel("general", []byte(msg))
+	}
+	if stats := hub.QueueStats(); stats.SlowDisconnects != 0 || stats.QueuedMessages != 2 {
+		t.Fatalf("stats with a full queue = %+v", stats)
+	}
+
+	hub.NotifyChannel("general", []byte("three"))
+	select {
+	case <-c.done:
+	case <-time.After(time.Second):
+		t.Fatal("overflowing the queue did not close the connection")
+	}
+
+	// Later messages are ignored rather than counted again
+	hub.NotifyChannel("general", []byte("four"))
+	stats := hub.QueueStats()
+	if stats.SlowDisconnects != 1 || stats.DroppedMessages != 0 || stats.Policy != "disconnect" {
+		t.Errorf("stats after the disconnect = %+v, want 1 slow disconnect and nothing dropped", stats)
+	}
+}
+
+func TestSendWaitsForRoom(t *testing.T) {
+	// The client's writer never runs, as if stuck on a frame, so only the test drains its queue
+	cfg := ClientConfig{QueueSize: 1, Policy: DropOldest, WriteTimeout: 50 * time.Millisecond}
+	hub := NewHub(cfg, nil)
+	conn := stalledConn(t)
+	c := &client{conn: conn, send: make(chan []byte, cfg.QueueSize), cfg: cfg, metrics: &hub.metrics, done: make(chan struct{})}
+	hub.mu.Lock()
+	hub.clients[conn] = c
+	hub.mu.Unlock()
+
+	if err := hub.Send(conn, []byte("replay 1")); err != nil {
+		t.Fatalf("Send with room in the queue: %v", err)
+	}
+
+	// A replay waits for room instead of dropping what is queued
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-c.send
+	}()
+	if err := hub.Send(conn, []byte("replay 2")); err != nil {
+		t.Fatalf("Send once the writer made room: %v", err)
+	}
+	if stats := hub.QueueStats(); stats.DroppedMessages != 0 || stats.SlowDisconnects != 0 || stats.QueuedMessages != 1 {
+		t.Fatalf("stats after waiting for room = %+v, want 1 queued and nothing dropped", stats)
+	}
+
+	// A peer that stays stuck past the write timeout is disconnected
+	start := time.Now()
+	if err := hub.Send(conn, []byte("replay 3")); err == nil {
+		t.Fatal("Send to a queue that never drains succeeded")
+	}
+	if waited := time.Since(start); waited < cfg.WriteTimeout {
+		t.Errorf("Send gave up after %v, before the write timeout", waited)
+	}
+	stats := hub.QueueStats()
+	if stats.SlowDisconnects != 1 || stats.DroppedMessages != 0 {
+		t.Errorf("stats after a timed out replay = %+v, want 1 slow disconnect and nothing dropped", stats)
+	}
+	if err := hub.Send(conn, []byte("replay 4")); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("Send after the disconnect = %v, want ErrClientClosed", err)
+	}
+
+	if err := hub.Send(stalledConn(t), []byte("unknown")); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("Send to an unregistered connection = %v, want ErrClientClosed", err)
+	}
+}
+
+// memoryEvents stands in for the broker_events table
+type memoryEvents struct {
+	rows map[int64]string
+	next int64
+}
+
+func (m *memoryEvents) store(event string) (int64, error) {
+	if m.rows == nil {
+		m.rows = make(map[int64]string)
+	}
+	m.next++
+	m.rows[m.next] = event
+	return m.next, nil
+}
+
+func (m *memoryEvents) load(id int64) (string, error) {
+	event, ok := m.rows[id]
+	if !ok {
+		return "", errors.New("no rows in result set")
+	}
+	return event, nil
+}
+
+func TestNotifyPayloadSize(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		wantStore bool
+	}{
+		{name: "small", size: 100},
+		{name: "at the limit", size: maxNotifyPayload},
+		{name: "over the limit", size: maxNotifyPayload + 1, wantStore: true},
+		{name: "far over the limit", size: 10 * maxNotifyPayload, wantStore: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := &memoryEvents{}
+			data := []byte(strings.Repeat("x", tt.size))
+
+			payload, err := notifyPayload(data, events.store)
+			if err != nil {
+				t.Fatalf("notifyPayload: %v", err)
+			}
+			if len(payload) > maxNotifyPayload {
+				t.Errorf("payload is %d bytes, over the %d byte limit", len(payload), maxNotifyPayload)
+			}
+			if stored := len(events.rows) > 0; stored != tt.wantStore {
+				t.Errorf("stored = %v, want %v", stored, tt.wantStore)
+			}
+			if tt.wantStore != strings.HasPrefix(payload, eventRefPrefix) {
+				t.Errorf("payload %.20q... is a reference: %v, want %v", payload, !tt.wantStore, tt.wantStore)
+			}
+
+			got, err := eventPayload(payload, events.load)
+			if err != nil {
+				t.Fatalf("eventPayload: %v", err)
+			}
+			if got != string(data) {
+				t.Errorf("round trip returned %d bytes, want the original %d", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestNotifyPayloadEventRoundTrip(t *testing.T) {
+	events := &memoryEvents{}
+	large := `"` + strings.Repeat("snowman ☃ ", maxNotifyPayload/8) + `"`
+	event := Event{Kind: EventChannel, Origin: "node-a", Target: "general", Payload: json.RawMessage(large)}
+	data, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("marshal event: %v", err)
+	}
+
+	payload, err := notifyPayload(data, events.store)
+	if err != nil {
+		t.Fatalf("notifyPayload: %v", err)
+	}
+	resolved, err := eventPayload(payload, events.load)
+	if err != nil {
+		t.Fatalf("eventPayload: %v", err)
+	}
+	var got Event
+	if err := json.Unmarshal([]byte(resolved), &got); err != nil {
+		t.Fatalf("unmarshal event: %v", err)
+	}
+	if got.Kind != event.Kind || got.Origin != event.Origin || got.Target != event.Target || string(got.Payload) != large {
+		t.Errorf("round trip changed the event")
+	}
+}
+
+func TestNotifyPayloadErrors(t *testing.T) {
+	errStore := errors.New("database unavailable")
+	_, err := notifyPayload([]byte(strings.Repeat("x", maxNotifyPayload+1)), func(string) (int64, error) { return 0, errStore })
+	if !errors.Is(err, errStore) {
+		t.Errorf("notifyPayload error = %v, want %v", err, errStore)
+	}
+
+	events := &memoryEvents{}
+	for _, payload := range []string{eventRefPrefix + "abc", eventRefPrefix} {
+		if _, err := eventPayload(payload, events.load); err == nil {
+			t.Errorf("eventPayload(%q) succeeded, want an invalid reference error", payload)
+		}
+	}
+	// The row may already be purged when a slow node reads the reference
+	if _, err := eventPayload(eventRefPrefix+"42", events.load); err == nil {
+		t.Error("eventPayload of a missing row succeeded")
+	}
+}
+
+func TestShutdownDrainsQueue(t *testing.T) {
+	hub := NewHub(ClientConfig{QueueSize: 8, Policy: DropOldest, WriteTimeout: 5 * time.Second}, nil)
+	conn, peer := pipeConns(t)
+	hub.mu.Lock()
+	hub.registerClient(conn)
+	hub.mu.Unlock()
+	hub.AddClientToChannel("general", conn)
+
+	// The peer is not reading yet, so the first message holds up the rest in the queue
+	want := []string{"one", "two", "three"}
+	for _, msg := range want {
+		hub.NotifyChannel("general", []byte(msg))
+	}
+
+	result := make(chan error, 1)
+	go func() { result <- hub.Shutdown(context.Background()) }()
+
+	for _, msg := range want {
+		_, got, err := peer.ReadMessage()
+		if err != nil {
+			t.Fatalf("read %q: %v", msg, err)
+		}
+		if string(got) != msg {
+			t.Fatalf("read %q, want %q", got, msg)
+		}
+	}
+	_, _, err := peer.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseServiceRestart) {
+		t.Fatalf("after the queue read %v, want a service restart close frame", err)
+	}
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return after the queue drained")
+	}
+	if stats := hub.QueueStats(); stats.DroppedMessages != 0 || stats.SlowDisconnects != 0 {
+		t.Errorf("stats after shutdown = %+v, want nothing dropped", stats)
+	}
+}
+
+func TestShutdownGivesUpOnStalledPeer(t *testing.T) {
+	hub, _ := stalledHub(t, ClientConfig{QueueSize: 2, Policy: DropOldest, WriteTimeout: time.Minute})
+	hub.NotifyChannel("general", []byte("never read"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := hub.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown with a stalled peer = %v, want the context deadline", err)
+	}
+}
+
+// testConns opens websocket connections to a test server and returns the server side of each
+func testConns(t *testing.T, n int) []*websocket.Conn {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	serverConns := make(chan *websocket.Conn, n)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		serverConns <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	conns := make([]*websocket.Conn, n)
+	for i := range conns {
+		clientConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		t.Cleanup(func() { clientConn.Close() })
+		select {
+		case conns[i] = <-serverConns:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the server side of a connection")
+		}
+	}
+	return conns
+}
+
+func TestHubReconnectReplacesSession(t *testing.T) {
+	hub := NewHub(DefaultClientConfig(), nil)
+	conns := testConns(t, 3)
+	stale, fresh, other := conns[0], conns[1], conns[2]
+
+	hub.AddConnection("alice", "tab-1", stale)
+	hub.AddClientToChannel("general", stale)
+	hub.AddConnection("alice", "tab-2", other)
+	hub.AddClientToChannel("general", other)
+
+	// The same tab reconnects before the old socket finished closing
+	hub.AddConnection("alice", "tab-1", fresh)
+	hub.AddClientToChannel("general", fresh)
+
+	if conn, ok := hub.GetConnection("alice", "tab-1"); !ok || conn != fresh {
+		t.Fatalf("session tab-1 holds %p, want the new connection %p", conn, fresh)
+	}
+	if conn, ok := hub.GetConnection("alice", "tab-2"); !ok || conn != other {
+		t.Errorf("session tab-2 was disturbed by the reconnect")
+	}
+	hub.mu.RLock()
+	_, staleInChannel := hub.channels["general"][stale]
+	_, staleClient := hub.clients[stale]
+	hub.mu.RUnlock()
+	if staleInChannel || staleClient {
+		t.Errorf("replaced connection still registered (in channel %v, client %v)", staleInChannel, staleClient)
+	}
+	if !hub.IsUserInChannel("alice", "general") {
+		t.Errorf("alice not in channel after reconnecting")
+	}
+
+	// The old connection's handler cleans up only the connection it owns
+	if current, ok := hub.GetConnection("alice", "tab-1"); ok && current == stale {
+		hub.RemoveConnection("alice", "tab-1")
+	}
+	hub.RemoveClientFromChannel("general", stale)
+	if conn, ok := hub.GetConnection("alice", "tab-1"); !ok || conn != fresh {
+		t.Errorf("cleanup of the replaced connection removed the new one")
+	}
+}
@@ -1,28 +1,77 @@
 package connections
 
 import (
+	"context"
 	"fmt"
+	"log"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
+const (
+	presenceFlushEvery = time.Second      // How often a changed presence snapshot is published
+	presenceHeartbeat  = 15 * time.Second // Unchanged snapshots are republished this often
+	presenceTTL        = 45 * time.Second // Remote snapshots older than this belong to dead nodes
+)
+
+// sessions maps a session ID to its connection; a user has one entry per open tab or device
+type sessions map[string]*websocket.Conn
+
 type Hub struct {
 	mu            sync.RWMutex
-	connections   map[string]*websocket.Conn          // Regular channel connections: username -> connection
-	systemConns   map[string]*websocket.Conn          // System-level connections: username -> connection
+	connections   map[string]sessions                 // Regular channel connections: username -> session ID -> connection
+	systemConns   map[string]sessions                 // System-level connections: username -> session ID -> connection
 	channels      map[string]map[*websocket.Conn]bool // channelName -> user connections: bool
 	connToChannel map[*websocket.Conn]string          // Maps connections to their channel
+	connToUser    map[*websocket.Conn]string          // Maps channel connections to their username
+	connToSketch  map[*websocket.Conn]string          // Maps channel connections to the sketch they show, if any
+	clients       map[*websocket.Conn]*client         // Outbound queue and writer of every registered connection
+
+	clientConfig ClientConfig
+	metrics      queueMetrics
+
+	stop     chan struct{} // Closed by Shutdown to end the background tickers
+	stopOnce sync.Once
+
+	// Cluster state; broker is nil when running as a single node
+	nodeID        string
+	broker        Broker
+	remoteMu      sync.RWMutex
+	remote        map[string]remotePresence // node ID -> last presence snapshot
+	presenceDirty atomic.Bool
+}
+
+type remotePresence struct {
+	presence  NodePresence
+	expiresAt time.Time
 }
 
-func NewHub() *Hub {
-	return &Hub{
-		connections:   make(map[string]*websocket.Conn),
-		systemConns:   make(map[string]*websocket.Conn),
+// NewHub creates a hub. With a broker, notifications also reach clients connected
+// to other nodes and presence queries cover the whole cluster.
+func NewHub(clientConfig ClientConfig, broker Broker) *Hub {
+	h := &Hub{
+		connections:   make(map[string]sessions),
+		systemConns:   make(map[string]sessions),
 		channels:      make(map[string]map[*websocket.Conn]bool),
 		connToChannel: make(map[*websocket.Conn]string),
+		connToUser:    make(map[*websocket.Conn]string),
+		connToSketch:  make(map[*websocket.Conn]string),
+		clients:       make(map[*websocket.Conn]*client),
+		clientConfig:  clientConfig,
+		nodeID:        uuid.NewString(),
+		broker:        broker,
+		remote:        make(map[string]remotePresence),
+		stop:          make(chan struct{}),
 	}
+	if broker != nil {
+		broker.Subscribe(h.handleEvent)
+	}
+	return h
 }
 
 func (h *Hub) InitializeChannel(channelName string) error {
@@ -37,6 +86,11 @@ func (h *Hub) InitializeChannel(channelName string) error {
 
 // NotifyChannel broadcasts a message to all clients in a specific channel
 func (h *Hub) NotifyChannel(channelName string, message []byte) {
+	h.deliverChannel(channelName, message)
+	h.publish(Event{Kind: EventChannel, Target: channelName, Payload: message})
+}
+
+func (h *Hub) deliverChannel(channelName string, message []byte) {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
@@ -53,28 +107,58 @@ func (h *Hub) NotifyChannel(channelName string, message []byte) {
 		return
 	}
 
-	for client := range channelClients {
-		err := client.WriteMessage(websocket.TextMessage, message)
-		if err != nil {
-			// Connection errors will be handled by the cleanup routine
+	for conn := range channelClients {
+		if c, ok := h.clients[conn]; ok {
+			c.enqueue(message)
+		}
+	}
+}
+
+// NotifySketchViewers sends a message to the clients in a channel that show sketchID,
+// skipping the sessions of exceptUsername
+func (h *Hub) NotifySketchViewers(channelName, sketchID, exceptUsername string, message []byte) {
+	h.deliverSketchViewers(channelName, sketchID, exceptUsername, message)
+	h.publish(Event{Kind: EventSketch, Target: channelName, SketchID: sketchID, Except: exceptUsername, Payload: message})
+}
+
+func (h *Hub) deliverSketchViewers(channelName, sketchID, exceptUsername string, message []byte) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for conn := range h.channels[channelName] {
+		if h.connToSketch[conn] != sketchID || h.connToUser[conn] == exceptUsername {
+			continue
+		}
+		if c, ok := h.clients[conn]; ok {
+			c.enqueue(message)
 		}
 	}
 }
 
+// NotifyUser sends a message to every channel session of a user
 func (h *Hub) NotifyUser(username string, message []byte) {
+	h.deliverUser(username, message)
+	h.publish(Event{Kind: EventUser, Target: username, Payload: message})
+}
+
+func (h *Hub) deliverUser(username string, message []byte) {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
-	if conn, ok := h.connections[username]; ok {
-		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-		if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
-			// log.Printf("Error writing message to client: %v", err)
+	for _, conn := range h.connections[username] {
+		if c, ok := h.clients[conn]; ok {
+			c.enqueue(message)
 		}
 	}
 }
 
 // NotifyAll broadcasts a message to all system connections
 func (h *Hub) NotifyAll(message []byte) {
+	h.deliverAll(message)
+	h.publish(Event{Kind: EventAll, Payload: message})
+}
+
+func (h *Hub) deliverAll(message []byte) {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
@@ -85,20 +169,71 @@ func (h *Hub) NotifyAll(message []byte) {
 		return
 	}
 
-	for _, conn := range h.systemConns {
-		err := conn.WriteMessage(websocket.TextMessage, message)
-		if err != nil {
-			// Connection errors will be handled by the cleanup routine
+	for _, userSessions := range h.systemConns {
+		for _, conn := range userSessions {
+			if c, ok := h.clients[conn]; ok {
+				c.enqueue(message)
+			}
+		}
+	}
+}
+
+// Send queues a message for one connection, waiting for room rather than dropping it.
+// Used to replay history to a client that just connected.
+func (h *Hub) Send(conn *websocket.Conn, message []byte) error {
+	h.mu.RLock()
+	c, ok := h.clients[conn]
+	h.mu.RUnlock()
+	if !ok {
+		return ErrClientClosed
+	}
+	return c.enqueueWait(message)
+}
+
+// QueueStats reports the current depth of all outbound queues and the slow consumer counters
+func (h *Hub) QueueStats() QueueStats {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	stats := QueueStats{
+		Clients:         len(h.clients),
+		QueueCapacity:   h.clientConfig.QueueSize,
+		Policy:          h.clientConfig.Policy.String(),
+		DroppedMessages: h.metrics.dropped.Load(),
+		SlowDisconnects: h.metrics.slowDisconnects.Load(),
+	}
+	for _, c := range h.clients {
+		depth := c.queueDepth()
+		stats.QueuedMessages += depth
+		if depth > stats.MaxQueueDepth {
+			stats.MaxQueueDepth = depth
 		}
 	}
+	return stats
+}
+
+// registerClient starts the writer for conn. Callers must hold h.mu.
+func (h *Hub) registerClient(conn *websocket.Conn) {
+	if _, ok := h.clients[conn]; !ok {
+		h.clients[conn] = newClient(conn, h.clientConfig, &h.metrics)
+	}
+}
+
+// unregisterClient stops conn's writer and closes it. Callers must hold h.mu.
+func (h *Hub) unregisterClient(conn *websocket.Conn) {
+	if c, ok := h.clients[conn]; ok {
+		c.close()
+		delete(h.clients, conn)
+	}
 }
 
-func (h *Hub) GetUserChannel(username string) (string, error) {
+// GetUserChannel returns the channel a single session of the user is viewing
+func (h *Hub) GetUserChannel(username, sessionID string) (string, error) {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	userConn, ok := h.connections[username]
+	userConn, ok := h.connections[username][sessionID]
 	if !ok {
-		return "", fmt.Errorf("user not connected: %s", username)
+		return "", fmt.Errorf("session %s not connected for user: %s", sessionID, username)
 	}
 	channelName, ok := h.connToChannel[userConn]
 	if !ok {
@@ -107,6 +242,18 @@ func (h *Hub) GetUserChannel(username string) (string, error) {
 	return channelName, nil
 }
 
+// IsUserInChannel reports whether any of the user's sessions is viewing channelName
+func (h *Hub) IsUserInChannel(username, channelName string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, conn := range h.connections[username] {
+		if h.connToChannel[conn] == channelName {
+			return true
+		}
+	}
+	return false
+}
+
 func (h *Hub) AddClientToChannel(channelName string, userConn *websocket.Conn) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
@@ -115,6 +262,7 @@ func (h *Hub) AddClientToChannel(channelName string, userConn *websocket.Conn) {
 	}
 	h.channels[channelName][userConn] = true
 	h.connToChannel[userConn] = channelName
+	h.presenceDirty.Store(true)
 	// log.Printf("Added client to channel: %s\n", channelName)
 }
 
@@ -125,90 +273,325 @@ func (h *Hub) RemoveClientFromChannel(channelName string, userConn *websocket.Co
 	if conns, ok := h.channels[channelName]; ok {
 		delete(conns, userConn)
 		delete(h.connToChannel, userConn)
+		h.presenceDirty.Store(true)
 	}
 	// log.Printf("Removed client from channel: %s\n", channelName)
 }
 
-func (h *Hub) AddConnection(username string, conn *websocket.Conn) error {
+// SetViewedSketch records the sketch a channel connection shows; an empty sketchID means none
+func (h *Hub) SetViewedSketch(userConn *websocket.Conn, sketchID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.connToUser[userConn]; !ok {
+		return
+	}
+	if sketchID == "" {
+		delete(h.connToSketch, userConn)
+		return
+	}
+	h.connToSketch[userConn] = sketchID
+}
+
+// RemoveUserFromChannel takes every session of the user out of channelName's pool
+func (h *Hub) RemoveUserFromChannel(username, channelName string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, conn := range h.connections[username] {
+		if h.connToChannel[conn] == channelName {
+			delete(h.channels[channelName], conn)
+			delete(h.connToChannel, conn)
+		}
+	}
+	h.presenceDirty.Store(true)
+}
+
+// AddConnection registers a channel session. A reconnect that reuses a session ID replaces the
+// session's old connection, which may still be closing.
+func (h *Hub) AddConnection(username, sessionID string, conn *websocket.Conn) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	if _, exists := h.connections[username]; exists {
-		// log.Printf("Attempt to add connection for user %s failed: connection already exists.", username)
-		return fmt.Errorf("connection already exists for user: %s", username)
+	if existingConn, exists := h.connections[username][sessionID]; exists {
+		h.removeChannelSession(username, sessionID, existingConn)
 	}
 
-	h.connections[username] = conn
+	if _, ok := h.connections[username]; !ok {
+		h.connections[username] = make(sessions)
+	}
+	h.connections[username][sessionID] = conn
+	h.connToUser[conn] = username
+	h.registerClient(conn)
 	// log.Printf("Client Username: %s, connected. Total connections: %d", username, len(h.connections))
-	return nil
 }
 
-func (h *Hub) RemoveConnection(username string) {
+func (h *Hub) RemoveConnection(username, sessionID string) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
-	delete(h.connections, username)
+	if conn, ok := h.connections[username][sessionID]; ok {
+		h.removeChannelSession(username, sessionID, conn)
+	}
 	// log.Printf("Client Username: %s, disconnected.\n", username)
 }
 
-func (h *Hub) GetConnection(username string) (*websocket.Conn, bool) {
+// RemoveUserConnections closes and removes every channel session of the user
+func (h *Hub) RemoveUserConnections(username string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sessionID, conn := range h.connections[username] {
+		h.removeChannelSession(username, sessionID, conn)
+	}
+}
+
+func (h *Hub) GetConnection(username, sessionID string) (*websocket.Conn, bool) {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	conn, ok := h.connections[username]
+	conn, ok := h.connections[username][sessionID]
 	return conn, ok
 }
 
+// removeChannelSession drops one channel session everywhere it is referenced. Callers must hold h.mu.
+func (h *Hub) removeChannelSession(username, sessionID string, conn *websocket.Conn) {
+	h.unregisterClient(conn)
+	if channelName, ok := h.connToChannel[conn]; ok {
+		delete(h.channels[channelName], conn)
+		delete(h.connToChannel, conn)
+	}
+	delete(h.connToUser, conn)
+	delete(h.connToSketch, conn)
+	delete(h.connections[username], sessionID)
+	if len(h.connections[username]) == 0 {
+		delete(h.connections, username)
+	}
+	h.presenceDirty.Store(true)
+}
+
 // System connection methods
-func (h *Hub) AddSystemConnection(username string, conn *websocket.Conn) {
+func (h *Hub) AddSystemConnection(username, sessionID string, conn *websocket.Conn) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	if existingConn, exists := h.systemConns[username]; exists {
+	if existingConn, exists := h.systemConns[username][sessionID]; exists {
 		// log.Printf("Closing existing system connection for user: %s", username)
-		existingConn.Close()
+		h.unregisterClient(existingConn)
 	}
 
-	h.systemConns[username] = conn
+	if _, ok := h.systemConns[username]; !ok {
+		h.systemConns[username] = make(sessions)
+	}
+	h.systemConns[username][sessionID] = conn
+	h.registerClient(conn)
+	h.presenceDirty.Store(true)
 	// log.Printf("System connection added for user: %s (total: %d)", username, len(h.systemConns))
 }
 
-func (h *Hub) RemoveSystemConnection(username string) {
+func (h *Hub) RemoveSystemConnection(username, sessionID string) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
-	delete(h.systemConns, username)
+	if conn, ok := h.systemConns[username][sessionID]; ok {
+		h.removeSystemSession(username, sessionID, conn)
+	}
 	// log.Printf("System connection removed for user: %s (remaining: %d)", username, len(h.systemConns))
 }
 
-func (h *Hub) GetSystemConnection(username string) (*websocket.Conn, bool) {
+func (h *Hub) GetSystemConnection(username, sessionID string) (*websocket.Conn, bool) {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	conn, ok := h.systemConns[username]
+	conn, ok := h.systemConns[username][sessionID]
 	return conn, ok
 }
 
-func (h *Hub) GetOnlineUsersInChannel(channelName string) []string {
+// removeSystemSession drops one system session. Callers must hold h.mu.
+func (h *Hub) removeSystemSession(username, sessionID string, conn *websocket.Conn) {
+	h.unregisterClient(conn)
+	delete(h.systemConns[username], sessionID)
+	if len(h.systemConns[username]) == 0 {
+		delete(h.systemConns, username)
+	}
+	h.presenceDirty.Store(true)
+}
+
+// NotifySystemUser sends a message to every system session of a user
+func (h *Hub) NotifySystemUser(username string, message []byte) {
+	h.deliverSystemUser(username, message)
+	h.publish(Event{Kind: EventSystemUser, Target: username, Payload: message})
+}
+
+func (h *Hub) deliverSystemUser(username string, message []byte) {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
+	for _, conn := range h.systemConns[username] {
+		if c, ok := h.clients[conn]; ok {
+			c.enqueue(message)
+		}
+	}
+}
+
+// GetOnlineUsersInChannel lists each user with at least one session in the channel once,
+// on this node or any other node of the cluster
+func (h *Hub) GetOnlineUsersInChannel(channelName string) []string {
+	h.mu.RLock()
 	usernames := make([]string, 0)
-	if channelConns, ok := h.channels[channelName]; ok {
-		// For each connection in the channel
-		for conn := range channelConns {
-			// Find the username associated with this connection
-			for username, userConn := range h.connections {
-				if userConn == conn {
-					usernames = append(usernames, username)
-					break
-				}
+	seen := make(map[string]bool)
+	for conn := range h.channels[channelName] {
+		username, ok := h.connToUser[conn]
+		if ok && !seen[username] {
+			seen[username] = true
+			usernames = append(usernames, username)
+		}
+	}
+	h.mu.RUnlock()
+
+	h.remoteMu.RLock()
+	defer h.remoteMu.RUnlock()
+	now := time.Now()
+	for _, node := range h.remote {
+		if now.After(node.expiresAt) {
+			continue
+		}
+		for _, username := range node.presence.Channels[channelName] {
+			if !seen[username] {
+				seen[username] = true
+				usernames = append(usernames, username)
 			}
 		}
 	}
 	return usernames
 }
 
+// GetCountOfAllOnlineUsers counts users with at least one live system session in the cluster
 func (h *Hub) GetCountOfAllOnlineUsers() int {
+	h.mu.RLock()
+	online := make(map[string]bool, len(h.systemConns))
+	for username := range h.systemConns {
+		online[username] = true
+	}
+	h.mu.RUnlock()
+
+	h.remoteMu.RLock()
+	defer h.remoteMu.RUnlock()
+	now := time.Now()
+	for _, node := range h.remote {
+		if now.After(node.expiresAt) {
+			continue
+		}
+		for _, username := range node.presence.Users {
+			online[username] = true
+		}
+	}
+	return len(online)
+}
+
+// CLUSTER
+
+// publish forwards a locally delivered notification to the other nodes
+func (h *Hub) publish(event Event) {
+	if h.broker == nil {
+		return
+	}
+	event.Origin = h.nodeID
+	if err := h.broker.Publish(event); err != nil {
+		log.Printf("Error publishing %s event: %v", event.Kind, err)
+	}
+}
+
+// handleEvent applies an event published by another node
+func (h *Hub) handleEvent(event Event) {
+	if event.Origin == h.nodeID {
+		return
+	}
+
+	switch event.Kind {
+	case EventChannel:
+		h.deliverChannel(event.Target, event.Payload)
+	case EventUser:
+		h.deliverUser(event.Target, event.Payload)
+	case EventSystemUser:
+		h.deliverSystemUser(event.Target, event.Payload)
+	case EventAll:
+		h.deliverAll(event.Payload)
+	case EventSketch:
+		h.deliverSketchViewers(event.Target, event.SketchID, event.Except, event.Payload)
+	case EventPresence:
+		if event.Presence == nil {
+			return
+		}
+		h.remoteMu.Lock()
+		_, known := h.remote[event.Origin]
+		h.remote[event.Origin] = remotePresence{
+			presence:  *event.Presence,
+			expiresAt: time.Now().Add(presenceTTL),
+		}
+		h.remoteMu.Unlock()
+		// Introduce ourselves to a node we have not heard from yet instead of waiting for the heartbeat
+		if !known {
+			h.presenceDirty.Store(true)
+		}
+	}
+}
+
+// presenceSnapshot collects the users connected to this node
+func (h *Hub) presenceSnapshot() *NodePresence {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	return len(h.systemConns)
+
+	presence := &NodePresence{
+		Channels: make(map[string][]string, len(h.channels)),
+		Users:    make([]string, 0, len(h.systemConns)),
+	}
+	for channelName, conns := range h.channels {
+		seen := make(map[string]bool)
+		for conn := range conns {
+			if username, ok := h.connToUser[conn]; ok && !seen[username] {
+				seen[username] = true
+				presence.Channels[channelName] = append(presence.Channels[channelName], username)
+			}
+		}
+	}
+	for username := range h.systemConns {
+		presence.Users = append(presence.Users, username)
+	}
+	sort.Strings(presence.Users)
+	return presence
+}
+
+// StartPresenceTicker shares this node's presence with the cluster and forgets nodes
+// that stopped reporting. It does nothing without a broker.
+func (h *Hub) StartPresenceTicker() {
+	if h.broker == nil {
+		return
+	}
+	h.presenceDirty.Store(true)
+	ticker := time.NewTicker(presenceFlushEvery)
+	go func() {
+		defer ticker.Stop()
+		lastPublished := time.Time{}
+		for {
+			select {
+			case <-ticker.C:
+				if h.presenceDirty.Swap(false) || time.Since(lastPublished) >= presenceHeartbeat {
+					h.publish(Event{Kind: EventPresence, Presence: h.presenceSnapshot()})
+					lastPublished = time.Now()
+				}
+				h.pruneRemotePresence()
+			case <-h.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (h *Hub) pruneRemotePresence() {
+	h.remoteMu.Lock()
+	defer h.remoteMu.Unlock()
+	now := time.Now()
+	for nodeID, node := range h.remote {
+		if now.After(node.expiresAt) {
+			delete(h.remote, nodeID)
+		}
+	}
 }
 
 // AUTOMATIC CLEANUP
@@ -216,8 +599,14 @@ func (h *Hub) GetCountOfAllOnlineUsers() int {
 func (h *Hub) StartCleanupTicker() {
 	ticker := time.NewTicker(45 * time.Second)
 	go func() {
-		for range ticker.C {
-			h.cleanupStaleConnections()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				h.cleanupStaleConnections()
+			case <-h.stop:
+				return
+			}
 		}
 	}()
 }
@@ -227,36 +616,21 @@ func (h *Hub) cleanupStaleConnections() {
 	defer h.mu.Unlock()
 
 	// Check regular connections
-	for username, conn := range h.connections {
-		if err := conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(3*time.Second)); err != nil {
-			h.cleanupConnection(username, conn, false)
+	for username, userSessions := range h.connections {
+		for sessionID, conn := range userSessions {
+			if err := conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(3*time.Second)); err != nil {
+				h.removeChannelSession(username, sessionID, conn)
+				// log.Printf("Cleaned up stale channel connection for user: %s", username)
+			}
 		}
 	}
 
 	// Check system connections
-	for username, conn := range h.systemConns {
-		if err := conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(3*time.Second)); err != nil {
-			h.cleanupConnection(username, conn, true)
-		}
-	}
-}
-
-func (h *Hub) cleanupConnection(username string, conn *websocket.Conn, isSystem bool) {
-	conn.Close()
-
-	if isSystem {
-		delete(h.systemConns, username)
-		// log.Printf("Cleaned up stale system connection for user: %s", username)
-	} else {
-		delete(h.connections, username)
-		// log.Printf("Cleaned up stale channel connection for user: %s", username)
-
-		// Clean up from channels
-		for _, clients := range h.channels {
-			if _, ok := clients[conn]; ok {
-				delete(clients, conn)
-				delete(h.connToChannel, conn)
-				// log.Printf("Removed user %s from channel %s during cleanup", username, channelName)
+	for username, userSessions := range h.systemConns {
+		for sessionID, conn := range userSessions {
+			if err := conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(3*time.Second)); err != nil {
+				h.removeSystemSession(username, sessionID, conn)
+				// log.Printf("Cleaned up stale system connection for user: %s", username)
 			}
 		}
 	}
@@ -282,5 +656,38 @@ func (h *Hub) RemoveAllClientsFromChannel(channelName string) {
 
 		// Remove the channel if it's empty
 		delete(h.channels, channelName)
+		h.presenceDirty.Store(true)
 	}
 }
+
+// SHUTDOWN
+
+// Shutdown stops the background tickers and closes every connection with a
+// "server restarting" close frame once its queued messages are written.
+// It returns when all writers finished or ctx expires.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.stopOnce.Do(func() { close(h.stop) })
+
+	h.mu.RLock()
+	clients := make([]*client, 0, len(h.clients))
+	for _, c := range h.clients {
+		clients = append(clients, c)
+	}
+	h.mu.RUnlock()
+
+	for _, c := range clients {
+		c.shutdown(websocket.CloseServiceRestart, "server restarting")
+	}
+
+	// Tell the other nodes right away instead of letting our presence expire
+	h.publish(Event{Kind: EventPresence, Presence: &NodePresence{Channels: map[string][]string{}, Users: []string{}}})
+
+	for _, c := range clients {
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return fmt.Errorf("closing websocket connections: %w", ctx.Err())
+		}
+	}
+	return nil
+}
@@ -2,30 +2,42 @@ package connections
 
 import "github.com/gorilla/websocket"
 
+// Manager tracks websocket connections. A user may hold several sessions at once
+// (one per tab or device), each identified by a client-chosen session ID.
 type Manager interface {
 	// Connection Management
-	AddConnection(username string, conn *websocket.Conn) error
-	RemoveConnection(username string)
-	GetConnection(username string) (*websocket.Conn, bool)
+	AddConnection(username, sessionID string, conn *websocket.Conn)
+	RemoveConnection(username, sessionID string)
+	RemoveUserConnections(username string)
+	GetConnection(username, sessionID string) (*websocket.Conn, bool)
 
 	// System Connection Management
-	AddSystemConnection(username string, conn *websocket.Conn)
-	RemoveSystemConnection(username string)
-	GetSystemConnection(username string) (*websocket.Conn, bool)
+	AddSystemConnection(username, sessionID string, conn *websocket.Conn)
+	RemoveSystemConnection(username, sessionID string)
+	GetSystemConnection(username, sessionID string) (*websocket.Conn, bool)
+	NotifySystemUser(username string, message []byte)
 
 	// Channel Management
 	InitializeChannel(channelName string) error
 	NotifyChannel(channelName string, message []byte)
 	AddClientToChannel(channelName string, userConn *websocket.Conn)
 	RemoveClientFromChannel(channelName string, userConn *websocket.Conn)
+	RemoveUserFromChannel(username, channelName string)
 	RemoveAllClientsFromChannel(channelName string)
+	SetViewedSketch(userConn *websocket.Conn, sketchID string)
+	NotifySketchViewers(channelName, sketchID, exceptUsername string, message []byte)
 
 	// User Management
 	NotifyUser(username string, message []byte)
-	GetUserChannel(username string) (string, error)
+	GetUserChannel(username, sessionID string) (string, error)
+	IsUserInChannel(username, channelName string) bool
 	GetOnlineUsersInChannel(channelName string) []string
 	GetCountOfAllOnlineUsers() int
 
 	// All
 	NotifyAll(message []byte)
+
+	// Outbound queues
+	Send(conn *websocket.Conn, message []byte) error
+	QueueStats() QueueStats
 }
@@ -0,0 +1,39 @@
+package messaging
+
+import "sync"
+
+// AckTracker remembers the highest sequence number each user acknowledged per channel.
+// It is the fallback replay point when a client reconnects without a since parameter.
+type AckTracker struct {
+	mu    sync.Mutex
+	acked map[string]map[string]int64 // channel -> username -> seq
+}
+
+func NewAckTracker() *AckTracker {
+	return &AckTracker{
+		acked: make(map[string]map[string]int64),
+	}
+}
+
+// Ack records seq for username in channelName. Acks never move backwards.
+func (at *AckTracker) Ack(channelName, username string, seq int64) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+
+	users, ok := at.acked[channelName]
+	if !ok {
+		users = make(map[string]int64)
+		at.acked[channelName] = users
+	}
+	if seq > users[username] {
+		users[username] = seq
+	}
+}
+
+func (at *AckTracker) LastAck(channelName, username string) (int64, bool) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+
+	seq, ok := at.acked[channelName][username]
+	return seq, ok
+}
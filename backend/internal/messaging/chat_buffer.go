@@ -2,74 +2,388 @@ package messaging
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"sync"
 	"time"
 
 	"rtc-nb/backend/internal/models"
 	"rtc-nb/backend/internal/services/chat"
+	"rtc-nb/backend/internal/store/database"
 )
 
+// messageInserter is the part of the chat service the buffer writes through
+type messageInserter interface {
+	BatchInsertMessages(ctx context.Context, messages []*models.Message) error
+}
+
 type ChatBuffer struct {
 	messages      chan *models.Message
-	chatService   *chat.Service
+	chatService   messageInserter
 	batchSize     int
 	flushInterval time.Duration
+	onFlush       func(messages []*models.Message) // Called after each successful flush, may be nil
+
+	// Messages the database rejected wait in the spool and are retried with backoff
+	spool *Spool
+
+	// Messages accepted but not yet persisted, so reconnecting clients can replay them too
+	pendingMu sync.Mutex
+	pending   map[string]*models.Message // id -> message
+	spooled   map[string]bool            // ids of pending messages that are safe in the spool
+
+	// Shutdown: closing done makes processMessages drain and flush within shutdownCtx.
+	// Add holds addMu for reading throughout, and done is closed under the write lock, so no Add
+	// can queue a message after drain has emptied the queue.
+	addMu       sync.RWMutex
+	done        chan struct{}
+	stopped     chan struct{}
+	closeOnce   sync.Once
+	shutdownCtx context.Context
+}
+
+// addTimeout bounds how long Add waits for room in a full buffer before spooling the message
+const addTimeout = 2 * time.Second
+
+// Spool replay backs off between these bounds while the database stays unavailable
+const (
+	spoolRetryMin = 1 * time.Second
+	spoolRetryMax = 30 * time.Second
+)
+
+// spoolReplayBatch caps how many spooled messages go into one insert transaction
+const spoolReplayBatch = 100
+
+// ChatBufferStats reports chat messages that are not in the database yet
+type ChatBufferStats struct {
+	Pending int `json:"pending"` // Accepted and awaiting persistence, including spooled messages
+	Spooled int `json:"spooled"` // Held in the on-disk spool until the database accepts them
+}
+
+func NewChatBuffer(chatService *chat.Service, spool *Spool, onFlush func(messages []*models.Message)) *ChatBuffer {
+	return newChatBuffer(chatService, spool, onFlush)
 }
 
-func NewChatBuffer(chatService *chat.Service) *ChatBuffer {
+func newChatBuffer(chatService messageInserter, spool *Spool, onFlush func(messages []*models.Message)) *ChatBuffer {
 	mb := &ChatBuffer{
 		messages:      make(chan *models.Message, 1000),
 		chatService:   chatService,
+		onFlush:       onFlush,
+		spool:         spool,
+		pending:       make(map[string]*models.Message),
+		spooled:       make(map[string]bool),
 		batchSize:     10, // TODO: make more realistic for production
 		flushInterval: 1 * time.Second,
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
 	}
+
+	// Whatever a previous run left in the spool is pending again until replayed
+	leftover, err := spool.Messages()
+	if err != nil {
+		log.Printf("Error reading chat spool: %v", err)
+	}
+	for _, msg := range leftover {
+		mb.pending[msg.ID] = msg
+		mb.spooled[msg.ID] = true
+	}
+	if len(leftover) > 0 {
+		log.Printf("Replaying %d spooled chat messages", len(leftover))
+	}
+
 	go mb.processMessages()
 	return mb
 }
 
 func (cb *ChatBuffer) Add(msg *models.Message) {
+	cb.addMu.RLock()
+	defer cb.addMu.RUnlock()
+
+	select {
+	case <-cb.done:
+		log.Printf("Failed to add message %s in channel %s: buffer closed", msg.ID, msg.ChannelName)
+		return
+	default:
+	}
+
+	cb.pendingMu.Lock()
+	cb.pending[msg.ID] = msg
+	cb.pendingMu.Unlock()
+
 	select {
 	case cb.messages <- msg:
+		return
 	default:
-		log.Printf("Failed to add message: buffer full")
 	}
+
+	// Buffer is full; give the writer a moment to catch up rather than dropping straight away
+	timer := time.NewTimer(addTimeout)
+	defer timer.Stop()
+	select {
+	case cb.messages <- msg:
+	case <-timer.C:
+		// Still full; the spool keeps the message until the replay loop gets to it
+		if err := cb.spoolMessages([]*models.Message{msg}); err != nil {
+			cb.pendingMu.Lock()
+			delete(cb.pending, msg.ID)
+			cb.pendingMu.Unlock()
+			log.Printf("Failed to add message %s (seq %d) in channel %s: buffer full: %v", msg.ID, msg.Seq, msg.ChannelName, err)
+		}
+	}
+}
+
+// Pending returns channelName's messages that are waiting to be persisted, in seq order
+func (cb *ChatBuffer) Pending(channelName string) []*models.Message {
+	cb.pendingMu.Lock()
+	defer cb.pendingMu.Unlock()
+
+	var messages []*models.Message
+	for _, msg := range cb.pending {
+		if msg.ChannelName == channelName {
+			messages = append(messages, msg)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].Seq < messages[j].Seq })
+	return messages
+}
+
+// Persist writes messageID to the database ahead of its batch if it is still pending on this node,
+// so it can be edited, deleted or reacted to straight away. Inserts ignore existing IDs, so the
+// batch or spool replay that later writes it again is harmless. Messages that are not pending here
+// are left alone.
+func (cb *ChatBuffer) Persist(ctx context.Context, messageID string) error {
+	cb.pendingMu.Lock()
+	msg, ok := cb.pending[messageID]
+	cb.pendingMu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	if err := cb.chatService.BatchInsertMessages(ctx, []*models.Message{msg}); err != nil {
+		return fmt.Errorf("%w: %w", models.ErrMessageNotSaved, err)
+	}
+	cb.forget([]*models.Message{msg})
+	return nil
+}
+
+func (cb *ChatBuffer) Stats() ChatBufferStats {
+	cb.pendingMu.Lock()
+	pending := len(cb.pending)
+	cb.pendingMu.Unlock()
+	return ChatBufferStats{Pending: pending, Spooled: cb.spool.Len()}
+}
+
+// Close stops accepting messages and flushes everything buffered, giving up when ctx expires.
+// It first waits for Adds in progress, at most addTimeout.
+func (cb *ChatBuffer) Close(ctx context.Context) error {
+	cb.closeOnce.Do(func() {
+		cb.addMu.Lock()
+		defer cb.addMu.Unlock()
+		cb.shutdownCtx = ctx
+		close(cb.done)
+	})
+
+	select {
+	case <-cb.stopped:
+	case <-ctx.Done():
+		return fmt.Errorf("chat buffer not flushed: %w", ctx.Err())
+	}
+
+	cb.pendingMu.Lock()
+	unsaved := len(cb.pending) - len(cb.spooled)
+	cb.pendingMu.Unlock()
+	if unsaved > 0 {
+		return fmt.Errorf("chat buffer closed with %d unsaved messages", unsaved)
+	}
+	if spooled := cb.spool.Len(); spooled > 0 {
+		log.Printf("Chat buffer closed with %d spooled messages; they will be replayed on the next start", spooled)
+	}
+	return nil
 }
 
 func (cb *ChatBuffer) processMessages() {
+	defer close(cb.stopped)
+
 	batch := make([]*models.Message, 0, cb.batchSize)
 	ticker := time.NewTicker(cb.flushInterval)
 	defer ticker.Stop()
 
+	// retry fires when the spool is due for another replay; nil while nothing is scheduled
+	var retry <-chan time.Time
+	backoff := spoolRetryMin
+	if cb.spool.Len() > 0 {
+		retry = time.After(0)
+	}
+
 	for {
 		select {
 		case msg := <-cb.messages:
 			batch = append(batch, msg)
 			if len(batch) >= cb.batchSize {
-				if err := cb.flush(batch); err != nil {
-					// log.Printf("Error flushing messages: %v", err)
+				if err := cb.store(batch); err != nil {
+					log.Printf("Error storing %d messages: %v", len(batch), err)
 					continue
 				}
 				batch = batch[:0]
 			}
 		case <-ticker.C:
 			if len(batch) > 0 {
-				if err := cb.flush(batch); err != nil {
-					// log.Printf("Error flushing messages: %v", err)
+				if err := cb.store(batch); err != nil {
+					log.Printf("Error storing %d messages: %v", len(batch), err)
 					continue
 				}
 				batch = batch[:0]
 			}
+			if retry == nil && cb.spool.Len() > 0 {
+				retry = time.After(backoff)
+			}
+		case <-retry:
+			retry = nil
+			if err := cb.replaySpool(context.Background()); err != nil {
+				log.Printf("Error replaying chat spool (%d messages), retrying in %s: %v", cb.spool.Len(), backoff, err)
+				retry = time.After(backoff)
+				backoff = min(backoff*2, spoolRetryMax)
+				continue
+			}
+			backoff = spoolRetryMin
+		case <-cb.done:
+			cb.drain(batch)
+			return
 		}
 	}
 }
 
-func (cb *ChatBuffer) flush(messages []*models.Message) error {
-	ctx := context.Background()
+// drain flushes batch and whatever is still queued. What the database rejects is spooled for the
+// next start; only if the spool fails too is the flush retried until the shutdown deadline.
+func (cb *ChatBuffer) drain(batch []*models.Message) {
+	for queued := true; queued; {
+		select {
+		case msg := <-cb.messages:
+			batch = append(batch, msg)
+		default:
+			queued = false
+		}
+	}
 
+	for len(batch) > 0 {
+		err := cb.flush(cb.shutdownCtx, batch)
+		if err == nil {
+			return
+		}
+		spoolErr := cb.spoolMessages(batch)
+		if spoolErr == nil {
+			log.Printf("Spooled %d messages on shutdown after flush failed: %v", len(batch), err)
+			return
+		}
+		log.Printf("Error flushing %d messages on shutdown: %v", len(batch), errors.Join(err, spoolErr))
+		select {
+		case <-cb.shutdownCtx.Done():
+			return
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+// store writes batch to the database, falling back to the spool when the database is unavailable
+func (cb *ChatBuffer) store(batch []*models.Message) error {
+	err := cb.flush(context.Background(), batch)
+	if err == nil {
+		return nil
+	}
+	if spoolErr := cb.spoolMessages(batch); spoolErr != nil {
+		return errors.Join(err, spoolErr)
+	}
+	log.Printf("Spooled %d messages after flush failed: %v", len(batch), err)
+	return nil
+}
+
+// spoolMessages durably records messages that could not be written to the database
+func (cb *ChatBuffer) spoolMessages(messages []*models.Message) error {
+	if err := cb.spool.Append(messages); err != nil {
+		return err
+	}
+	cb.pendingMu.Lock()
+	for _, msg := range messages {
+		cb.spooled[msg.ID] = true
+	}
+	cb.pendingMu.Unlock()
+	return nil
+}
+
+// replaySpool writes spooled messages to the database in batches, removing those that were saved.
+// Inserts ignore existing IDs, so replaying a message that was already saved is harmless.
+// A batch that fails is retried one message at a time: messages the database rejects outright are
+// quarantined so they can't hold up the rest, and any other failure ends the replay until the next retry.
+func (cb *ChatBuffer) replaySpool(ctx context.Context) error {
+	messages, err := cb.spool.Messages()
+	if err != nil {
+		return err
+	}
+
+	saved := make(map[string]bool, len(messages))
+	var rejected []*models.Message
+	var flushErr error
+replay:
+	for start := 0; start < len(messages); start += spoolReplayBatch {
+		batch := messages[start:min(start+spoolReplayBatch, len(messages))]
+		if err := cb.flush(ctx, batch); err == nil {
+			for _, msg := range batch {
+				saved[msg.ID] = true
+			}
+			continue
+		}
+
+		for _, msg := range batch {
+			err := cb.flush(ctx, []*models.Message{msg})
+			switch {
+			case err == nil:
+				saved[msg.ID] = true
+			case database.IsRejectedData(err):
+				log.Printf("Quarantining spooled message %s in channel %s: %v", msg.ID, msg.ChannelName, err)
+				rejected = append(rejected, msg)
+			default:
+				flushErr = err
+				break replay
+			}
+		}
+	}
+
+	if len(rejected) > 0 {
+		if err := cb.spool.Quarantine(rejected); err != nil {
+			return errors.Join(flushErr, err)
+		}
+		cb.forget(rejected)
+	}
+	if len(saved) > 0 {
+		if err := cb.spool.Remove(saved); err != nil {
+			return errors.Join(flushErr, err)
+		}
+		log.Printf("Replayed %d spooled chat messages", len(saved))
+	}
+	return flushErr
+}
+
+// forget drops messages that are saved or quarantined from the pending set
+func (cb *ChatBuffer) forget(messages []*models.Message) {
+	cb.pendingMu.Lock()
+	defer cb.pendingMu.Unlock()
+	for _, msg := range messages {
+		delete(cb.pending, msg.ID)
+		delete(cb.spooled, msg.ID)
+	}
+}
+
+func (cb *ChatBuffer) flush(ctx context.Context, messages []*models.Message) error {
 	// Batch insert to database
 	if err := cb.chatService.BatchInsertMessages(ctx, messages); err != nil {
 		return fmt.Errorf("error during batch size flush: %w", err)
 	}
+	cb.forget(messages)
+
+	if cb.onFlush != nil {
+		cb.onFlush(messages)
+	}
 	return nil
 }
@@ -0,0 +1,608 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+
+	"rtc-nb/backend/internal/connections"
+	"rtc-nb/backend/internal/models"
+)
+
+func equalIDs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// fakeManager records system notifications; the embedded nil Manager panics on anything else
+type fakeManager struct {
+	connections.Manager
+
+	mu     sync.Mutex
+	system map[string][][]byte
+}
+
+func (f *fakeManager) NotifySystemUser(username string, message []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.system == nil {
+		f.system = make(map[string][][]byte)
+	}
+	f.system[username] = append(f.system[username], message)
+}
+
+func TestMessageChannels(t *testing.T) {
+	var messages []*models.Message
+	for _, channelName := range []string{"general", "random", "general", "dm:alice:bob", "random"} {
+		messages = append(messages, &models.Message{ChannelName: channelName})
+	}
+
+	got := messageChannels(messages)
+	if want := []string{"general", "random", "dm:alice:bob"}; !equalIDs(got, want) {
+		t.Errorf("messageChannels = %v, want %v", got, want)
+	}
+	if got := messageChannels(nil); len(got) != 0 {
+		t.Errorf("messageChannels(nil) = %v, want none", got)
+	}
+}
+
+func TestNotifyUnreadCounts(t *testing.T) {
+	manager := &fakeManager{}
+	p := &Processor{connManager: manager}
+
+	p.notifyUnreadCounts("general", map[string]int{"alice": 0, "bob": 3, "carol": 1})
+
+	if len(manager.system["alice"]) != 0 {
+		t.Errorf("alice was notified of an unchanged zero count")
+	}
+	for username, want := range map[string]int{"bob": 3, "carol": 1} {
+		sent := manager.system[username]
+		if len(sent) != 1 {
+			t.Fatalf("%s got %d notifications, want 1", username, len(sent))
+		}
+		var msg models.Message
+		if err := json.Unmarshal(sent[0], &msg); err != nil {
+			t.Fatalf("unmarshal notification: %v", err)
+		}
+		unread := msg.Content.UnreadCount
+		if msg.Type != models.MessageTypeUnreadCount || msg.ChannelName != "system" || msg.Username != username || unread == nil {
+			t.Fatalf("%s got %+v, want an unread count on the system channel", username, msg)
+		}
+		if unread.ChannelName != "general" || unread.Count != want {
+			t.Errorf("%s got count %d in %s, want %d in general", username, unread.Count, unread.ChannelName, want)
+		}
+	}
+}
+
+// seqMessages returns messages of general numbered with seqs
+func seqMessages(seqs ...int64) []*models.Message {
+	messages := make([]*models.Message, len(seqs))
+	for i, seq := range seqs {
+		messages[i] = &models.Message{ID: fmt.Sprintf("seq-%d", seq), ChannelName: "general", Seq: seq}
+	}
+	return messages
+}
+
+func seqsOf(messages []*models.Message) []int64 {
+	seqs := make([]int64, len(messages))
+	for i, msg := range messages {
+		seqs[i] = msg.Seq
+	}
+	return seqs
+}
+
+func TestMergeMissed(t *testing.T) {
+	tests := []struct {
+		name    string
+		stored  []int64
+		pending []int64
+		since   int64
+		want    []int64
+	}{
+		{name: "nothing missed", since: 5},
+		{name: "stored only", stored: []int64{6, 7}, since: 5, want: []int64{6, 7}},
+		{name: "pending only", pending: []int64{4, 5, 6, 7}, since: 5, want: []int64{6, 7}},
+		{name: "pending after stored", stored: []int64{6, 7}, pending: []int64{8, 9}, since: 5, want: []int64{6, 7, 8, 9}},
+		{name: "interleaved", stored: []int64{6, 9}, pending: []int64{7, 8, 10}, since: 5, want: []int64{6, 7, 8, 9, 10}},
+		// A message flushed between the database read and the buffer read shows up in both
+		{name: "flushed between reads", stored: []int64{6, 7, 8}, pending: []int64{8, 9}, since: 5, want: []int64{6, 7, 8, 9}},
+		{name: "gaps between seqs", stored: []int64{6, 70}, pending: []int64{130}, since: 5, want: []int64{6, 70, 130}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := seqsOf(mergeMissed(seqMessages(tt.stored...), seqMessages(tt.pending...), tt.since))
+			if len(got) != len(tt.want) {
+				t.Fatalf("mergeMissed = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("mergeMissed = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeMissedCapsReplay(t *testing.T) {
+	var stored, pending []int64
+	for seq := int64(1); seq <= models.MaxReplayMessages; seq++ {
+		stored = append(stored, seq)
+	}
+	for seq := int64(models.MaxReplayMessages + 1); seq <= models.MaxReplayMessages+10; seq++ {
+		pending = append(pending, seq)
+	}
+
+	got := seqsOf(mergeMissed(seqMessages(stored...), seqMessages(pending...), 0))
+	if len(got) != models.MaxReplayMessages {
+		t.Fatalf("replayed %d messages, want %d", len(got), models.MaxReplayMessages)
+	}
+	// The oldest missed messages come first so the client can ask again from the last one
+	if got[0] != 1 || got[len(got)-1] != models.MaxReplayMessages {
+		t.Errorf("replayed seqs %d through %d, want 1 through %d", got[0], got[len(got)-1], models.MaxReplayMessages)
+	}
+}
+
+func TestChatBufferPending(t *testing.T) {
+	cb := &ChatBuffer{pending: make(map[string]*models.Message)}
+	for _, msg := range seqMessages(9, 3, 7) {
+		cb.pending[msg.ID] = msg
+	}
+	other := &models.Message{ID: "other", ChannelName: "random", Seq: 5}
+	cb.pending[other.ID] = other
+
+	got := seqsOf(cb.Pending("general"))
+	if want := []int64{3, 7, 9}; len(got) != len(want) || got[0] != 3 || got[1] != 7 || got[2] != 9 {
+		t.Errorf("Pending(general) seqs = %v, want %v", got, want)
+	}
+}
+
+func TestAckTracker(t *testing.T) {
+	at := NewAckTracker()
+	if _, ok := at.LastAck("general", "alice"); ok {
+		t.Fatal("LastAck reported an ack before any was recorded")
+	}
+
+	at.Ack("general", "alice", 5)
+	at.Ack("general", "alice", 3) // A late ack never moves the replay point backwards
+	at.Ack("general", "bob", 8)
+	at.Ack("random", "alice", 2)
+
+	tests := []struct {
+		channelName, username string
+		want                  int64
+	}{
+		{"general", "alice", 5},
+		{"general", "bob", 8},
+		{"random", "alice", 2},
+	}
+	for _, tt := range tests {
+		if got, ok := at.LastAck(tt.channelName, tt.username); !ok || got != tt.want {
+			t.Errorf("LastAck(%s, %s) = %d, %v; want %d, true", tt.channelName, tt.username, got, ok, tt.want)
+		}
+	}
+}
+
+func testMessages(n int) []*models.Message {
+	messages := make([]*models.Message, n)
+	for i := range messages {
+		text := fmt.Sprintf("message %d", i)
+		messages[i] = &models.Message{
+			ID:          fmt.Sprintf("msg-%03d", i),
+			ChannelName: "general",
+			Username:    "alice",
+			Type:        models.MessageTypeText,
+			Content:     models.MessageContent{Text: &text},
+			Timestamp:   time.Unix(int64(i), 0).UTC(),
+		}
+	}
+	return messages
+}
+
+func messageIDs(messages []*models.Message) []string {
+	ids := make([]string, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+	return ids
+}
+
+func openTestSpool(t *testing.T, dir string) *Spool {
+	t.Helper()
+	spool, err := OpenSpool(dir)
+	if err != nil {
+		t.Fatalf("OpenSpool: %v", err)
+	}
+	t.Cleanup(func() { spool.Close() })
+	return spool
+}
+
+func TestSpool(t *testing.T) {
+	tests := []struct {
+		name      string
+		append    [][]int // Batches of message indexes to append
+		remove    []int
+		truncated bool // Leave a half-written line at the end of the file before reopening
+		want      []int
+	}{
+		{name: "empty", want: nil},
+		{name: "append keeps order", append: [][]int{{0, 1}, {2}}, want: []int{0, 1, 2}},
+		{name: "remove some", append: [][]int{{0, 1, 2, 3}}, remove: []int{1, 3}, want: []int{0, 2}},
+		{name: "remove all", append: [][]int{{0, 1}}, remove: []int{0, 1}, want: nil},
+		{name: "remove unknown", append: [][]int{{0}}, remove: []int{5}, want: []int{0}},
+		{name: "truncated line is skipped", append: [][]int{{0, 1}}, truncated: true, want: []int{0, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			messages := testMessages(10)
+			spool := openTestSpool(t, dir)
+
+			for _, batch := range tt.append {
+				var toAppend []*models.Message
+				for _, i := range batch {
+					toAppend = append(toAppend, messages[i])
+				}
+				if err := spool.Append(toAppend); err != nil {
+					t.Fatalf("Append: %v", err)
+				}
+			}
+			if tt.remove != nil {
+				ids := make(map[string]bool)
+				for _, i := range tt.remove {
+					ids[messages[i].ID] = true
+				}
+				if err := spool.Remove(ids); err != nil {
+					t.Fatalf("Remove: %v", err)
+				}
+			}
+			if tt.truncated {
+				spool.Close()
+				f, err := os.OpenFile(filepath.Join(dir, spoolFileName), os.O_WRONLY|os.O_APPEND, 0644)
+				if err != nil {
+					t.Fatalf("open spool file: %v", err)
+				}
+				f.WriteString(`{"id":"msg-cut","channel_na`)
+				f.Close()
+				spool = openTestSpool(t, dir)
+
+				// The torn line must be gone, so the next append starts on a line of its own
+				if err := spool.Append([]*models.Message{messages[9]}); err != nil {
+					t.Fatalf("Append: %v", err)
+				}
+				tt.want = append(tt.want, 9)
+			}
+
+			var want []string
+			for _, i := range tt.want {
+				want = append(want, messages[i].ID)
+			}
+
+			got, err := spool.Messages()
+			if err != nil {
+				t.Fatalf("Messages: %v", err)
+			}
+			if !equalIDs(messageIDs(got), want) {
+				t.Errorf("Messages() = %v, want %v", messageIDs(got), want)
+			}
+			if spool.Len() != len(want) {
+				t.Errorf("Len() = %d, want %d", spool.Len(), len(want))
+			}
+
+			// Whatever is spooled must survive a restart
+			spool.Close()
+			reopened := openTestSpool(t, dir)
+			got, err = reopened.Messages()
+			if err != nil {
+				t.Fatalf("Messages after reopen: %v", err)
+			}
+			if !equalIDs(messageIDs(got), want) {
+				t.Errorf("Messages() after reopen = %v, want %v", messageIDs(got), want)
+			}
+		})
+	}
+}
+
+func TestSpoolQuarantine(t *testing.T) {
+	dir := t.TempDir()
+	messages := testMessages(3)
+	spool := openTestSpool(t, dir)
+	if err := spool.Append(messages); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	if err := spool.Quarantine(messages[1:2]); err != nil {
+		t.Fatalf("Quarantine: %v", err)
+	}
+
+	got, err := spool.Messages()
+	if err != nil {
+		t.Fatalf("Messages: %v", err)
+	}
+	if want := []string{"msg-000", "msg-002"}; !equalIDs(messageIDs(got), want) {
+		t.Errorf("Messages() = %v, want %v", messageIDs(got), want)
+	}
+
+	rejected := &Spool{path: filepath.Join(dir, rejectedFileName)}
+	quarantined, err := rejected.read()
+	if err != nil {
+		t.Fatalf("read rejected file: %v", err)
+	}
+	if want := []string{"msg-001"}; !equalIDs(messageIDs(quarantined), want) {
+		t.Errorf("rejected file holds %v, want %v", messageIDs(quarantined), want)
+	}
+}
+
+// fakeInserter fails any batch holding a rejected or unavailable message, the way a single
+// insert transaction would
+type fakeInserter struct {
+	mu          sync.Mutex
+	rejected    map[string]bool // Violate a foreign key
+	unavailable map[string]bool // Fail as if the database were unreachable
+	saved       []string
+}
+
+func (f *fakeInserter) BatchInsertMessages(ctx context.Context, messages []*models.Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, msg := range messages {
+		if f.unavailable[msg.ID] {
+			return errors.New("connection refused")
+		}
+		if f.rejected[msg.ID] {
+			return &pq.Error{Code: "23503", Message: "violates foreign key constraint"}
+		}
+	}
+	f.saved = append(f.saved, messageIDs(messages)...)
+	return nil
+}
+
+func TestReplaySpool(t *testing.T) {
+	const total = 2*spoolReplayBatch + 50
+
+	tests := []struct {
+		name        string
+		rejected    []int
+		unavailable []int
+		wantErr     bool
+		wantSaved   int   // Messages saved, counted from the start of the spool
+		wantSpooled []int // Indexes left in the spool
+		wantBad     []int // Indexes quarantined
+	}{
+		{
+			name:      "every batch succeeds",
+			wantSaved: total,
+		},
+		{
+			name:      "rejected messages are quarantined",
+			rejected:  []int{spoolReplayBatch + 3, total - 1},
+			wantSaved: total,
+			wantBad:   []int{spoolReplayBatch + 3, total - 1},
+		},
+		{
+			name:        "unavailable database stops the replay",
+			unavailable: []int{spoolReplayBatch + 10},
+			wantErr:     true,
+			wantSaved:   spoolReplayBatch + 10,
+			wantSpooled: rangeOf(spoolReplayBatch+10, total),
+		},
+		{
+			name:        "rejected before an outage is still quarantined",
+			rejected:    []int{5},
+			unavailable: []int{spoolReplayBatch + 1},
+			wantErr:     true,
+			wantSaved:   spoolReplayBatch + 1,
+			wantSpooled: rangeOf(spoolReplayBatch+1, total),
+			wantBad:     []int{5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			messages := testMessages(total)
+			spool := openTestSpool(t, dir)
+			if err := spool.Append(messages); err != nil {
+				t.Fatalf("Append: %v", err)
+			}
+
+			inserter := &fakeInserter{rejected: make(map[string]bool), unavailable: make(map[string]bool)}
+			for _, i := range tt.rejected {
+				inserter.rejected[messages[i].ID] = true
+			}
+			for _, i := range tt.unavailable {
+				inserter.unavailable[messages[i].ID] = true
+			}
+
+			// Built by hand rather than with newChatBuffer, so no background replay runs alongside
+			cb := &ChatBuffer{
+				chatService: inserter,
+				spool:       spool,
+				pending:     make(map[string]*models.Message),
+				spooled:     make(map[string]bool),
+			}
+			for _, msg := range messages {
+				cb.pending[msg.ID] = msg
+				cb.spooled[msg.ID] = true
+			}
+
+			err := cb.replaySpool(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("replaySpool() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			bad := make(map[int]bool)
+			for _, i := range tt.wantBad {
+				bad[i] = true
+			}
+			var wantSaved []string
+			for i := 0; i < tt.wantSaved; i++ {
+				if !bad[i] {
+					wantSaved = append(wantSaved, messages[i].ID)
+				}
+			}
+			if !equalIDs(inserter.saved, wantSaved) {
+				t.Errorf("saved %d messages, want %d", len(inserter.saved), len(wantSaved))
+			}
+
+			var wantSpooled []string
+			for _, i := range tt.wantSpooled {
+				wantSpooled = append(wantSpooled, messages[i].ID)
+			}
+			got, err := spool.Messages()
+			if err != nil {
+				t.Fatalf("Messages: %v", err)
+			}
+			if !equalIDs(messageIDs(got), wantSpooled) {
+				t.Errorf("spool holds %v, want %v", messageIDs(got), wantSpooled)
+			}
+			if len(cb.pending) != len(wantSpooled) {
+				t.Errorf("%d messages pending, want %d", len(cb.pending), len(wantSpooled))
+			}
+
+			var wantBad []string
+			for _, i := range tt.wantBad {
+				wantBad = append(wantBad, messages[i].ID)
+			}
+			quarantined, err := (&Spool{path: filepath.Join(dir, rejectedFileName)}).read()
+			if err != nil {
+				t.Fatalf("read rejected file: %v", err)
+			}
+			if !equalIDs(messageIDs(quarantined), wantBad) {
+				t.Errorf("quarantined %v, want %v", messageIDs(quarantined), wantBad)
+			}
+		})
+	}
+}
+
+func TestChatBufferPersist(t *testing.T) {
+	messages := testMessages(3)
+	inserter := &fakeInserter{rejected: make(map[string]bool), unavailable: make(map[string]bool)}
+	inserter.unavailable[messages[2].ID] = true
+	cb := &ChatBuffer{
+		chatService: inserter,
+		pending:     make(map[string]*models.Message),
+		spooled:     make(map[string]bool),
+	}
+	for _, msg := range messages {
+		cb.pending[msg.ID] = msg
+	}
+	cb.spooled[messages[1].ID] = true
+
+	for _, msg := range messages[:2] {
+		if err := cb.Persist(context.Background(), msg.ID); err != nil {
+			t.Fatalf("Persist(%s): %v", msg.ID, err)
+		}
+	}
+	if err := cb.Persist(context.Background(), "not-pending"); err != nil {
+		t.Errorf("Persist of a message that is not pending: %v", err)
+	}
+	if err := cb.Persist(context.Background(), messages[2].ID); !errors.Is(err, models.ErrMessageNotSaved) {
+		t.Errorf("Persist with the database down: error = %v, want %v", err, models.ErrMessageNotSaved)
+	}
+
+	if want := messageIDs(messages[:2]); !equalIDs(inserter.saved, want) {
+		t.Errorf("saved %v, want %v", inserter.saved, want)
+	}
+	if len(cb.pending) != 1 || cb.pending[messages[2].ID] == nil || len(cb.spooled) != 0 {
+		t.Errorf("after Persist %d pending, %d spooled; want only %s pending", len(cb.pending), len(cb.spooled), messages[2].ID)
+	}
+}
+
+func rangeOf(from, to int) []int {
+	var indexes []int
+	for i := from; i < to; i++ {
+		indexes = append(indexes, i)
+	}
+	return indexes
+}
+
+func TestPresenceTrackerSet(t *testing.T) {
+	type set struct {
+		value        string
+		wantAllowed  bool
+		wantReplaced string
+	}
+	tests := []struct {
+		name        string
+		sets        []set // Applied in order within one throttle window, so only the first is allowed
+		wantPresent bool
+		wantValue   string
+	}{
+		{
+			name:        "first update is allowed",
+			sets:        []set{{value: "sketch-1", wantAllowed: true}},
+			wantPresent: true,
+			wantValue:   "sketch-1",
+		},
+		{
+			name:        "throttled refresh keeps the state",
+			sets:        []set{{value: "sketch-1", wantAllowed: true}, {value: "sketch-1"}},
+			wantPresent: true,
+			wantValue:   "sketch-1",
+		},
+		{
+			name:        "throttled change drops the state",
+			sets:        []set{{value: "sketch-1", wantAllowed: true}, {value: "sketch-2", wantReplaced: "sketch-1"}},
+			wantPresent: false,
+		},
+		{
+			name:        "typing refresh",
+			sets:        []set{{value: "", wantAllowed: true}, {value: ""}, {value: ""}},
+			wantPresent: true,
+			wantValue:   "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pt := NewPresenceTracker(time.Hour, time.Hour, func(string, string, string) {})
+			defer pt.Close()
+			for i, s := range tt.sets {
+				allowed, replaced := pt.Set("general", "alice", s.value)
+				if allowed != s.wantAllowed || replaced != s.wantReplaced {
+					t.Errorf("Set #%d = (%v, %q), want (%v, %q)", i, allowed, replaced, s.wantAllowed, s.wantReplaced)
+				}
+			}
+
+			value, present := pt.Clear("general", "alice")
+			if present != tt.wantPresent || value != tt.wantValue {
+				t.Errorf("Clear() = (%q, %v), want (%q, %v)", value, present, tt.wantValue, tt.wantPresent)
+			}
+			if _, present := pt.Clear("general", "alice"); present {
+				t.Errorf("second Clear() found a state")
+			}
+		})
+	}
+}
+
+func TestPresenceTrackerSetReplacesOnceAllowed(t *testing.T) {
+	pt := NewPresenceTracker(time.Hour, time.Millisecond, func(string, string, string) {})
+	defer pt.Close()
+	pt.Set("general", "alice", "sketch-1")
+	time.Sleep(5 * time.Millisecond)
+
+	allowed, replaced := pt.Set("general", "alice", "sketch-2")
+	if !allowed || replaced != "sketch-1" {
+		t.Fatalf("Set() = (%v, %q), want (true, %q)", allowed, replaced, "sketch-1")
+	}
+	if value, _ := pt.Clear("general", "alice"); value != "sketch-2" {
+		t.Errorf("Clear() = %q, want %q", value, "sketch-2")
+	}
+}
@@ -0,0 +1,166 @@
+package messaging
+
+import (
+	"sync"
+	"time"
+
+	"rtc-nb/backend/pkg/utils"
+)
+
+const (
+	typingTTL      = 5 * time.Second // A typing state clears if the client doesn't refresh it within this window
+	typingThrottle = 1 * time.Second // At most one "started" broadcast per user per window
+
+	cursorTTL      = 10 * time.Second      // A cursor is removed if it doesn't move within this window
+	cursorThrottle = 50 * time.Millisecond // At most one broadcast move per user per window
+)
+
+// userLimiter throttles one user's ephemeral updates; unused limiters are dropped once their window passes
+type userLimiter struct {
+	rateLimiter *utils.RateLimiter
+	lastUsed    time.Time
+}
+
+type presence struct {
+	value     string // What the user is present on, e.g. the sketch a cursor is over; empty for typing
+	expiresAt time.Time
+}
+
+// PresenceTracker keeps ephemeral per-channel user states such as "typing" or "cursor on sketch X".
+// Nothing here is persisted; states expire unless refreshed within ttl, and onExpire announces it.
+type PresenceTracker struct {
+	mu       sync.Mutex
+	channels map[string]map[string]presence // channel -> username -> state
+	limiters map[string]*userLimiter        // username -> throttle, kept across set/clear cycles
+	ttl      time.Duration
+	throttle time.Duration
+	onExpire func(channelName, username, value string)
+	stop     chan struct{} // Closed by Close to end expireLoop
+	stopOnce sync.Once
+}
+
+func NewPresenceTracker(ttl, throttle time.Duration, onExpire func(channelName, username, value string)) *PresenceTracker {
+	pt := &PresenceTracker{
+		channels: make(map[string]map[string]presence),
+		limiters: make(map[string]*userLimiter),
+		ttl:      ttl,
+		throttle: throttle,
+		onExpire: onExpire,
+		stop:     make(chan struct{}),
+	}
+	go pt.expireLoop()
+	return pt
+}
+
+// Set records username's state in channelName. It returns false when the update should not be broadcast
+// because the user is throttled, and the value the state had before if it changed, so whoever saw the
+// old value can drop it.
+func (pt *PresenceTracker) Set(channelName, username, value string) (allowed bool, replaced string) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	limiter, ok := pt.limiters[username]
+	if !ok {
+		limiter = &userLimiter{rateLimiter: utils.NewRateLimiter(pt.throttle, 1)}
+		pt.limiters[username] = limiter
+	}
+	limiter.lastUsed = time.Now()
+	allowed = limiter.rateLimiter.Allow()
+
+	users, ok := pt.channels[channelName]
+	if !ok {
+		users = make(map[string]presence)
+		pt.channels[channelName] = users
+	}
+
+	// A throttled refresh still extends the state, but a throttled update never creates or changes one,
+	// so alternating set/clear can't flood the channel either
+	previous, present := users[username]
+	if present && previous.value != value {
+		replaced = previous.value
+	}
+	switch {
+	case allowed:
+		users[username] = presence{value: value, expiresAt: time.Now().Add(pt.ttl)}
+	case present && previous.value == value:
+		previous.expiresAt = time.Now().Add(pt.ttl)
+		users[username] = previous
+	case present:
+		delete(users, username)
+	}
+	if len(users) == 0 {
+		delete(pt.channels, channelName)
+	}
+	return allowed, replaced
+}
+
+// Clear removes username's state in channelName.
+// It returns the value the state had, or false if there was none to announce.
+func (pt *PresenceTracker) Clear(channelName, username string) (string, bool) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	users, ok := pt.channels[channelName]
+	if !ok {
+		return "", false
+	}
+	state, ok := users[username]
+	if !ok {
+		return "", false
+	}
+	delete(users, username)
+	if len(users) == 0 {
+		delete(pt.channels, channelName)
+	}
+	return state.value, true
+}
+
+// Close stops expiring states; states still held are dropped without being announced
+func (pt *PresenceTracker) Close() {
+	pt.stopOnce.Do(func() { close(pt.stop) })
+}
+
+func (pt *PresenceTracker) expireLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			pt.expire()
+		case <-pt.stop:
+			return
+		}
+	}
+}
+
+// expire removes the states that outlived ttl and the limiters nobody used within their window
+func (pt *PresenceTracker) expire() {
+	type expiredState struct{ channelName, username, value string }
+	var expired []expiredState
+
+	pt.mu.Lock()
+	now := time.Now()
+	for channelName, users := range pt.channels {
+		for username, state := range users {
+			if now.After(state.expiresAt) {
+				delete(users, username)
+				expired = append(expired, expiredState{channelName, username, state.value})
+			}
+		}
+		if len(users) == 0 {
+			delete(pt.channels, channelName)
+		}
+	}
+	for username, limiter := range pt.limiters {
+		if now.Sub(limiter.lastUsed) > pt.throttle {
+			delete(pt.limiters, username)
+		}
+	}
+	pt.mu.Unlock()
+
+	// Notify outside the lock; onExpire writes to websockets
+	for _, e := range expired {
+		pt.onExpire(e.channelName, e.username, e.value)
+	}
+}
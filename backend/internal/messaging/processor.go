@@ -1,8 +1,13 @@
 package messaging
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"sort"
+	"strings"
 
 	"rtc-nb/backend/internal/connections"
 	"rtc-nb/backend/internal/models"
@@ -11,19 +16,44 @@ import (
 )
 
 type Processor struct {
-	connManager  connections.Manager
-	chatService  *chat.Service
-	sketchBuffer *SketchBuffer
-	chatBuffer   *ChatBuffer
+	connManager   connections.Manager
+	chatService   *chat.Service
+	sketchService *sketch.Service
+	sketchBuffer  *SketchBuffer
+	chatBuffer    *ChatBuffer
+	typing        *PresenceTracker // Who is typing; the value is unused
+	cursors       *PresenceTracker // Whose cursor is on a sketch; the value is the sketch ID
+	acks          *AckTracker
 }
 
-func NewProcessor(connManager connections.Manager, chatService *chat.Service, sketchService *sketch.Service) *Processor {
-	return &Processor{
-		connManager:  connManager,
-		chatService:  chatService,
-		sketchBuffer: NewSketchBuffer(sketchService),
-		chatBuffer:   NewChatBuffer(chatService),
+// NewProcessor wires up message routing; chat messages the database rejects are kept in chatSpool
+func NewProcessor(connManager connections.Manager, chatService *chat.Service, sketchService *sketch.Service, chatSpool *Spool) *Processor {
+	p := &Processor{
+		connManager:   connManager,
+		chatService:   chatService,
+		sketchService: sketchService,
+		acks:          NewAckTracker(),
 	}
+	p.sketchBuffer = NewSketchBuffer(sketchService, p.broadcastSketchResults)
+	p.chatBuffer = NewChatBuffer(chatService, chatSpool, p.pushUnreadCounts)
+	p.typing = NewPresenceTracker(typingTTL, typingThrottle, func(channelName, username, _ string) {
+		p.broadcastTypingStopped(channelName, username)
+	})
+	p.cursors = NewPresenceTracker(cursorTTL, cursorThrottle, p.broadcastCursorLeft)
+	return p
+}
+
+// Close flushes the chat and sketch buffers to the database, giving up when ctx expires,
+// and stops expiring typing states and cursors
+func (p *Processor) Close(ctx context.Context) error {
+	p.typing.Close()
+	p.cursors.Close()
+	return errors.Join(p.chatBuffer.Close(ctx), p.sketchBuffer.Close(ctx))
+}
+
+// BufferStats reports chat messages that have not reached the database yet
+func (p *Processor) BufferStats() ChatBufferStats {
+	return p.chatBuffer.Stats()
 }
 
 func (p *Processor) ProcessMessage(msg *models.Message) error {
@@ -32,6 +62,96 @@ func (p *Processor) ProcessMessage(msg *models.Message) error {
 		return nil
 	}
 
+	// Only the two participants may post to a direct conversation
+	var directParticipants []string
+	if models.IsDirectChannelName(msg.ChannelName) {
+		participants, err := p.DirectParticipants(msg.ChannelName, msg.Username)
+		if err != nil {
+			return err
+		}
+		directParticipants = participants
+	}
+
+	// Read receipts only concern the sender and are never broadcast
+	if msg.Type == models.MessageTypeReadReceipt {
+		return p.applyReadReceipt(msg)
+	}
+
+	// Acks only update delivery state and are never broadcast
+	if msg.Type == models.MessageTypeAck {
+		p.acks.Ack(msg.ChannelName, msg.Username, msg.Content.Ack.Seq)
+		return nil
+	}
+
+	switch msg.Type {
+	case models.MessageTypeTyping:
+		// Throttled and redundant typing updates are dropped rather than broadcast
+		if !p.applyTyping(msg) {
+			return nil
+		}
+	case models.MessageTypeText, models.MessageTypeImage:
+		// Sending a message ends the sender's typing state
+		p.ClearTyping(msg.ChannelName, msg.Username)
+	}
+
+	// Persisted messages get their channel sequence number before anyone sees them
+	if msg.Type == models.MessageTypeText || msg.Type == models.MessageTypeImage {
+		seq, err := p.chatService.NextChannelSeq(context.Background(), msg.ChannelName)
+		if err != nil {
+			return fmt.Errorf("assign sequence number: %w", err)
+		}
+		msg.Seq = seq
+	}
+
+	// Strokes are attributed by the server; a complete one is logged as an operation under the message ID,
+	// and its paths get IDs before the broadcast so every client can name them in an erase
+	if msg.Type == models.MessageTypeSketch && msg.Content.SketchCmd != nil {
+		cmd := msg.Content.SketchCmd
+		switch cmd.CommandType {
+		case models.SketchCommandTypeUpdate:
+			// Strokes on a locked layer are dropped before anyone sees them
+			if err := p.sketchService.CheckLayerWritable(context.Background(), cmd.SketchID, cmd.LayerID, msg.Username); err != nil {
+				return fmt.Errorf("sketch %s layer %s: %w", cmd.SketchID, cmd.LayerID, err)
+			}
+			cmd.Author = msg.Username
+			if cmd.IsPartial != nil && !*cmd.IsPartial {
+				cmd.OperationID = msg.ID
+				if cmd.Region != nil {
+					cmd.Region.AssignPathIDs()
+				}
+			}
+		case models.SketchCommandTypeUndo, models.SketchCommandTypeRedo:
+			// Applied in order with buffered strokes; the rebuilt region is broadcast afterwards
+			cmd.Author = msg.Username
+			p.sketchBuffer.Add(msg)
+			return nil
+		case models.SketchCommandTypeCursor:
+			// Cursors are throttled and go straight to the sketch's viewers, never near the sketch buffer
+			p.applyCursor(msg)
+			return nil
+		case models.SketchCommandTypeErase:
+			// Applied in order with buffered strokes; the strokes actually removed are broadcast afterwards
+			if err := p.sketchService.CheckLayerWritable(context.Background(), cmd.SketchID, cmd.LayerID, msg.Username); err != nil {
+				return fmt.Errorf("sketch %s layer %s: %w", cmd.SketchID, cmd.LayerID, err)
+			}
+			cmd.Author = msg.Username
+			p.sketchBuffer.Add(msg)
+			return nil
+		}
+	}
+
+	// Edits, deletes and reactions are authorized and applied before anyone is notified
+	switch msg.Type {
+	case models.MessageTypeEdit, models.MessageTypeDelete:
+		if err := p.applyModification(msg); err != nil {
+			return err
+		}
+	case models.MessageTypeReaction:
+		if err := p.applyReaction(msg); err != nil {
+			return err
+		}
+	}
+
 	// Log basic message info for routing
 
 	outgoingMsgBytes, err := json.Marshal(msg)
@@ -56,6 +176,19 @@ func (p *Processor) ProcessMessage(msg *models.Message) error {
 			// log.Printf("Broadcasting message type %d to channel %s", msg.Type, msg.ChannelName)
 		}
 		p.connManager.NotifyChannel(msg.ChannelName, outgoingMsgBytes)
+
+		// Direct messages also reach participants who are not viewing the conversation
+		if msg.Type == models.MessageTypeText || msg.Type == models.MessageTypeImage {
+			for _, participant := range directParticipants {
+				if participant != msg.Username {
+					p.connManager.NotifySystemUser(participant, outgoingMsgBytes)
+				}
+			}
+		}
+	}
+
+	if msg.Type == models.MessageTypeText {
+		p.notifyMentions(msg)
 	}
 
 	// --- Buffer messages that need persistence ---
@@ -93,3 +226,300 @@ func (p *Processor) ProcessMessage(msg *models.Message) error {
 
 	return nil
 }
+
+// PersistPending writes messageID to the database if it is still waiting in this node's chat buffer,
+// for changes made outside the message stream that need its row, such as pinning
+func (p *Processor) PersistPending(ctx context.Context, messageID string) error {
+	return p.chatBuffer.Persist(ctx, messageID)
+}
+
+// DirectParticipants returns the participants of a direct channel, rejecting usernames outside it.
+func (p *Processor) DirectParticipants(channelName, username string) ([]string, error) {
+	participants, err := p.chatService.GetDirectParticipants(context.Background(), channelName)
+	if err != nil {
+		return nil, fmt.Errorf("direct conversation %s: %w", channelName, err)
+	}
+	for _, participant := range participants {
+		if participant == username {
+			return participants, nil
+		}
+	}
+	return nil, fmt.Errorf("direct conversation %s: %w", channelName, models.ErrNotChannelMember)
+}
+
+// MissedMessages returns the persisted messages of channelName after since, including those still
+// waiting in this node's chat buffer, in seq order. Without since, the user's last ack is used; with
+// neither there is nothing to replay. Behind a broker, messages still buffered on other nodes are left
+// out until those nodes flush them, which can take longer than usual while the database is unavailable.
+func (p *Processor) MissedMessages(channelName, username string, since *int64) ([]*models.Message, error) {
+	if since == nil {
+		lastAck, ok := p.acks.LastAck(channelName, username)
+		if !ok {
+			return nil, nil
+		}
+		since = &lastAck
+	}
+
+	stored, err := p.chatService.GetMessagesSince(context.Background(), channelName, *since)
+	if err != nil {
+		return nil, err
+	}
+	return mergeMissed(stored, p.chatBuffer.Pending(channelName), *since), nil
+}
+
+// mergeMissed combines stored and still pending messages after since into one replay in seq order.
+// A message can be flushed between the two reads, so they are merged by ID.
+func mergeMissed(stored, pending []*models.Message, since int64) []*models.Message {
+	seen := make(map[string]bool, len(stored))
+	missed := stored
+	for _, msg := range stored {
+		seen[msg.ID] = true
+	}
+	for _, msg := range pending {
+		if msg.Seq > since && !seen[msg.ID] {
+			missed = append(missed, msg)
+		}
+	}
+	sort.Slice(missed, func(i, j int) bool { return missed[i].Seq < missed[j].Seq })
+
+	if len(missed) > models.MaxReplayMessages {
+		missed = missed[:models.MaxReplayMessages]
+	}
+	return missed
+}
+
+// applyReadReceipt moves the sender's read marker and pushes their new unread count to their system connection
+func (p *Processor) applyReadReceipt(msg *models.Message) error {
+	receipt := msg.Content.ReadReceipt
+	count, err := p.chatService.MarkMessageRead(context.Background(), msg.ChannelName, msg.Username, receipt.MessageID)
+	if err != nil {
+		return fmt.Errorf("mark message %s read: %w", receipt.MessageID, err)
+	}
+	p.notifyUnreadCount(msg.ChannelName, msg.Username, count)
+	return nil
+}
+
+// pushUnreadCounts runs after chat messages are persisted and sends each affected member their new unread count
+func (p *Processor) pushUnreadCounts(messages []*models.Message) {
+	for _, channelName := range messageChannels(messages) {
+		counts, err := p.chatService.GetChannelUnreadCounts(context.Background(), channelName)
+		if err != nil {
+			log.Printf("Error getting unread counts for channel %s: %v", channelName, err)
+			continue
+		}
+		p.notifyUnreadCounts(channelName, counts)
+	}
+}
+
+// messageChannels lists the channels of messages once each, in order of first appearance
+func messageChannels(messages []*models.Message) []string {
+	seen := make(map[string]bool)
+	var channels []string
+	for _, msg := range messages {
+		if !seen[msg.ChannelName] {
+			seen[msg.ChannelName] = true
+			channels = append(channels, msg.ChannelName)
+		}
+	}
+	return channels
+}
+
+// notifyUnreadCounts sends channelName's members their unread counts after new messages were persisted
+func (p *Processor) notifyUnreadCounts(channelName string, counts map[string]int) {
+	for username, count := range counts {
+		// New messages never bring a count down to zero, so zero means nothing changed
+		if count > 0 {
+			p.notifyUnreadCount(channelName, username, count)
+		}
+	}
+}
+
+func (p *Processor) notifyUnreadCount(channelName, username string, count int) {
+	msgBytes, err := json.Marshal(models.NewUnreadCountMessage(channelName, username, count))
+	if err != nil {
+		log.Printf("Error marshaling unread count message: %v", err)
+		return
+	}
+	p.connManager.NotifySystemUser(username, msgBytes)
+}
+
+// applyTyping updates the sender's typing state and reports whether msg should be broadcast
+func (p *Processor) applyTyping(msg *models.Message) bool {
+	if msg.Content.Typing.Action == "stopped" {
+		_, wasTyping := p.typing.Clear(msg.ChannelName, msg.Username)
+		return wasTyping
+	}
+	allowed, _ := p.typing.Set(msg.ChannelName, msg.Username, "")
+	return allowed
+}
+
+// ClearTyping drops username's typing state in channelName, announcing it if they were typing.
+// Called when the user's channel connection closes.
+func (p *Processor) ClearTyping(channelName, username string) {
+	if _, wasTyping := p.typing.Clear(channelName, username); wasTyping {
+		p.broadcastTypingStopped(channelName, username)
+	}
+}
+
+// applyCursor updates the sender's cursor and sends its move, or its leaving, to the other sessions
+// showing the sketch it is on. Throttled moves reach no one.
+func (p *Processor) applyCursor(msg *models.Message) {
+	cmd := msg.Content.SketchCmd
+	if cmd.Cursor.Left {
+		p.ClearCursor(msg.ChannelName, msg.Username)
+		return
+	}
+
+	allowed, leftSketchID := p.cursors.Set(msg.ChannelName, msg.Username, cmd.SketchID)
+	if leftSketchID != "" {
+		p.broadcastCursorLeft(msg.ChannelName, msg.Username, leftSketchID)
+	}
+	if !allowed {
+		return
+	}
+	msgBytes, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Error marshaling sketch cursor: %v", err)
+		return
+	}
+	p.connManager.NotifySketchViewers(msg.ChannelName, cmd.SketchID, msg.Username, msgBytes)
+}
+
+// ClearCursor drops username's cursor in channelName, announcing it if they had one.
+// Called when the sender's cursor leaves the sketch and when the user's channel connection closes.
+func (p *Processor) ClearCursor(channelName, username string) {
+	if sketchID, ok := p.cursors.Clear(channelName, username); ok {
+		p.broadcastCursorLeft(channelName, username, sketchID)
+	}
+}
+
+func (p *Processor) broadcastCursorLeft(channelName, username, sketchID string) {
+	cmd := models.SketchCommand{
+		CommandType: models.SketchCommandTypeCursor,
+		SketchID:    sketchID,
+		Cursor:      &models.SketchCursor{Left: true},
+	}
+	msgBytes, err := json.Marshal(models.NewSketchBroadcastMessage(channelName, username, cmd))
+	if err != nil {
+		log.Printf("Error marshaling sketch cursor: %v", err)
+		return
+	}
+	p.connManager.NotifySketchViewers(channelName, sketchID, username, msgBytes)
+}
+
+func (p *Processor) broadcastTypingStopped(channelName, username string) {
+	msgBytes, err := json.Marshal(models.NewTypingMessage(channelName, username, "stopped"))
+	if err != nil {
+		log.Printf("Error marshaling typing message: %v", err)
+		return
+	}
+	p.connManager.NotifyChannel(channelName, msgBytes)
+}
+
+// broadcastSketchResults sends the regions rebuilt by undo and redo, and the strokes erased, to everyone in the channel
+func (p *Processor) broadcastSketchResults(channelName string, results []*models.SketchCommand) {
+	for _, result := range results {
+		msgBytes, err := json.Marshal(models.NewSketchBroadcastMessage(channelName, result.Author, *result))
+		if err != nil {
+			log.Printf("Error marshaling sketch %s result: %v", result.CommandType, err)
+			continue
+		}
+		p.connManager.NotifyChannel(channelName, msgBytes)
+	}
+}
+
+// notifyMentions records the channel members @mentioned in msg and notifies each of them
+// on their system connection, whichever channel they are currently in
+func (p *Processor) notifyMentions(msg *models.Message) {
+	if msg.Content.Text == nil || !strings.Contains(*msg.Content.Text, "@") {
+		return
+	}
+
+	ctx := context.Background()
+	members, err := p.chatService.GetChannelMembers(ctx, msg.ChannelName)
+	if err != nil {
+		log.Printf("Error getting members for mentions in channel %s: %v", msg.ChannelName, err)
+		return
+	}
+	usernames := make([]string, 0, len(members))
+	for _, member := range members {
+		usernames = append(usernames, member.Username)
+	}
+
+	var mentions []*models.Mention
+	for _, username := range models.ParseMentions(*msg.Content.Text, usernames) {
+		if username == msg.Username {
+			continue
+		}
+		mentions = append(mentions, &models.Mention{
+			MessageID:   msg.ID,
+			ChannelName: msg.ChannelName,
+			Username:    username,
+			MentionedBy: msg.Username,
+			CreatedAt:   msg.Timestamp,
+		})
+	}
+	if len(mentions) == 0 {
+		return
+	}
+
+	if err := p.chatService.CreateMentions(ctx, mentions); err != nil {
+		log.Printf("Error storing mentions for message %s: %v", msg.ID, err)
+		return
+	}
+	for _, mention := range mentions {
+		mention.Message = msg
+		msgBytes, err := json.Marshal(models.NewMentionMessage(mention))
+		if err != nil {
+			log.Printf("Error marshaling mention message: %v", err)
+			continue
+		}
+		p.connManager.NotifySystemUser(mention.Username, msgBytes)
+	}
+}
+
+// applyModification persists an edit or soft delete requested by msg.Username.
+// On success the modification carries the final text so clients can apply it as-is.
+func (p *Processor) applyModification(msg *models.Message) error {
+	ctx := context.Background()
+	mod := msg.Content.Modification
+
+	// A message still waiting in the chat buffer is written first so there is a row to modify
+	if err := p.chatBuffer.Persist(ctx, mod.MessageID); err != nil {
+		return fmt.Errorf("modify message %s: %w", mod.MessageID, err)
+	}
+
+	switch msg.Type {
+	case models.MessageTypeEdit:
+		updated, err := p.chatService.EditMessage(ctx, msg.ChannelName, mod.MessageID, msg.Username, *mod.Text)
+		if err != nil {
+			return fmt.Errorf("edit message %s: %w", mod.MessageID, err)
+		}
+		mod.Text = updated.Content.Text
+	case models.MessageTypeDelete:
+		if _, err := p.chatService.DeleteMessage(ctx, msg.ChannelName, mod.MessageID, msg.Username); err != nil {
+			return fmt.Errorf("delete message %s: %w", mod.MessageID, err)
+		}
+		mod.Text = nil
+	}
+	return nil
+}
+
+// applyReaction toggles msg.Username's reaction and records the outcome on the message
+// so every client in the channel can update its counts from the broadcast.
+func (p *Processor) applyReaction(msg *models.Message) error {
+	ctx := context.Background()
+	reaction := msg.Content.Reaction
+
+	// Reactions reference the message row, so one still waiting in the chat buffer is written first
+	if err := p.chatBuffer.Persist(ctx, reaction.MessageID); err != nil {
+		return fmt.Errorf("toggle reaction on message %s: %w", reaction.MessageID, err)
+	}
+
+	result, err := p.chatService.ToggleReaction(ctx, msg.ChannelName, reaction.MessageID, msg.Username, reaction.Emoji)
+	if err != nil {
+		return fmt.Errorf("toggle reaction on message %s: %w", reaction.MessageID, err)
+	}
+	msg.Content.Reaction = result
+	return nil
+}
@@ -2,11 +2,13 @@ package messaging
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"log/slog"
 	"rtc-nb/backend/internal/models"
 	"rtc-nb/backend/internal/services/sketch"
 	"rtc-nb/backend/pkg/utils"
+	"sync"
 	"time"
 )
 
@@ -16,22 +18,41 @@ type SketchBuffer struct {
 	batchSize     int
 	flushInterval time.Duration
 	rateLimiter   *utils.RateLimiter
+	onApplied     func(channelName string, results []*models.SketchCommand) // Receives undo, redo and erase results, may be nil
+
+	// Shutdown: closing done makes processMessages drain and flush within shutdownCtx
+	done        chan struct{}
+	stopped     chan struct{}
+	closeOnce   sync.Once
+	shutdownCtx context.Context
 }
 
-func NewSketchBuffer(sketchService *sketch.Service) *SketchBuffer {
+func NewSketchBuffer(sketchService *sketch.Service, onApplied func(channelName string, results []*models.SketchCommand)) *SketchBuffer {
 	mb := &SketchBuffer{
 		messages:      make(chan *models.Message, 1000),
 		sketchService: sketchService,
+		onApplied:     onApplied,
 		batchSize:     10, // TODO: make more realistic for production
 		flushInterval: 500 * time.Millisecond,
 		rateLimiter:   utils.NewRateLimiter(100*time.Millisecond, 1),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
 	}
 	go mb.processMessages()
 	return mb
 }
 
 func (sb *SketchBuffer) Add(msg *models.Message) {
-	if !sb.rateLimiter.Allow() {
+	select {
+	case <-sb.done:
+		log.Printf("Sketch buffer closed, dropping update message %s for sketch %s", msg.ID, msg.Content.SketchCmd.SketchID)
+		return
+	default:
+	}
+	// Undo, redo and erase go through the buffer so they apply after the strokes queued before them
+	cmdType := msg.Content.SketchCmd.CommandType
+	isEdit := cmdType == models.SketchCommandTypeUndo || cmdType == models.SketchCommandTypeRedo || cmdType == models.SketchCommandTypeErase
+	if !isEdit && !sb.rateLimiter.Allow() {
 		// log.Printf("WARN: Rate limit exceeded for user %s on sketch buffer. Message ID %s dropped.", msg.Username, msg.ID)
 		return
 	}
@@ -42,7 +63,24 @@ func (sb *SketchBuffer) Add(msg *models.Message) {
 	}
 }
 
+// Close stops accepting updates and flushes everything buffered, giving up when ctx expires
+func (sb *SketchBuffer) Close(ctx context.Context) error {
+	sb.closeOnce.Do(func() {
+		sb.shutdownCtx = ctx
+		close(sb.done)
+	})
+
+	select {
+	case <-sb.stopped:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("sketch buffer not flushed: %w", ctx.Err())
+	}
+}
+
 func (sb *SketchBuffer) processMessages() {
+	defer close(sb.stopped)
+
 	batch := make([]*models.Message, 0, sb.batchSize)
 	ticker := time.NewTicker(sb.flushInterval)
 	defer ticker.Stop()
@@ -72,6 +110,21 @@ func (sb *SketchBuffer) processMessages() {
 				}
 				batch = make([]*models.Message, 0, sb.batchSize)
 			}
+		case <-sb.done:
+			for queued := true; queued; {
+				select {
+				case msg := <-sb.messages:
+					batch = append(batch, msg)
+				default:
+					queued = false
+				}
+			}
+			if len(batch) > 0 {
+				if err := sb.flushContext(sb.shutdownCtx, batch); err != nil {
+					log.Printf("ERROR during shutdown flush: %v", err)
+				}
+			}
+			return
 		}
 	}
 }
@@ -79,17 +132,18 @@ func (sb *SketchBuffer) processMessages() {
 func (sb *SketchBuffer) flush(messages []*models.Message) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
+	return sb.flushContext(ctx, messages)
+}
+
+func (sb *SketchBuffer) flushContext(ctx context.Context, messages []*models.Message) error {
 	updates := make(map[string][]*models.SketchCommand)
+	channels := make(map[string]string) // sketch ID -> channel name
 	processedMsgCount := 0
 
-	// Group update commands by sketch ID
+	// Group update, undo, redo and erase commands by sketch ID, keeping their order
 	for _, msg := range messages {
 		// Basic validation already done in Processor, but double-check here
-		if msg.Type != models.MessageTypeSketch ||
-			msg.Content.SketchCmd == nil ||
-			msg.Content.SketchCmd.CommandType != models.SketchCommandTypeUpdate ||
-			msg.Content.SketchCmd.IsPartial == nil || *msg.Content.SketchCmd.IsPartial ||
-			msg.Content.SketchCmd.Region == nil {
+		if msg.Type != models.MessageTypeSketch || msg.Content.SketchCmd == nil || !isBufferedSketchCommand(msg.Content.SketchCmd) {
 			// log.Printf("WARN: Skipping invalid/non-COMPLETE update message found in sketch buffer flush: MsgID=%s", msg.ID)
 			continue
 		}
@@ -97,6 +151,7 @@ func (sb *SketchBuffer) flush(messages []*models.Message) error {
 		cmd := msg.Content.SketchCmd
 		sketchId := cmd.SketchID
 		updates[sketchId] = append(updates[sketchId], cmd)
+		channels[sketchId] = msg.ChannelName
 		processedMsgCount++
 	}
 
@@ -114,15 +169,32 @@ func (sb *SketchBuffer) flush(messages []*models.Message) error {
 			continue
 		}
 		slog.Debug("Attempting to flush sketch updates", "count", len(commands), "sketchID", sketchID)
-		if err := sb.sketchService.ApplySketchUpdates(ctx, sketchID, commands); err != nil {
+		results, err := sb.sketchService.ApplySketchUpdates(ctx, sketchID, commands)
+		if err != nil {
 			// This is a critical error, updates might be lost.
 			log.Printf("ERROR: Failed to apply %d update(s) for sketch %s. These updates may be lost. Error: %v", len(commands), sketchID, err)
 			if firstError == nil {
 				firstError = err
 			}
-		} else {
-			slog.Debug("Successfully flushed sketch updates", "count", len(commands), "sketchID", sketchID)
+			continue
+		}
+		slog.Debug("Successfully flushed sketch updates", "count", len(commands), "sketchID", sketchID)
+		sb.sketchService.ScheduleThumbnail(sketchID)
+		if len(results) > 0 && sb.onApplied != nil {
+			sb.onApplied(channels[sketchID], results)
 		}
 	}
 	return firstError
 }
+
+// isBufferedSketchCommand reports whether cmd is a complete update, an undo, a redo or an erase
+func isBufferedSketchCommand(cmd *models.SketchCommand) bool {
+	switch cmd.CommandType {
+	case models.SketchCommandTypeUpdate:
+		return cmd.IsPartial != nil && !*cmd.IsPartial && cmd.Region != nil
+	case models.SketchCommandTypeUndo, models.SketchCommandTypeRedo, models.SketchCommandTypeErase:
+		return true
+	default:
+		return false
+	}
+}
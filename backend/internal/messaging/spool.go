@@ -0,0 +1,230 @@
+package messaging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"rtc-nb/backend/internal/models"
+)
+
+const (
+	spoolFileName    = "chat.spool"
+	rejectedFileName = "chat.rejected" // Messages the database will never accept, kept for inspection
+)
+
+// SpoolDir is the spool's directory within the file store. It holds unsaved messages of every
+// channel, so the file server must never serve it.
+const SpoolDir = "spool"
+
+// Spool is an append-only file of chat messages the buffer could not write to the database.
+// Each line holds one JSON-encoded message; the file outlives restarts so nothing is lost
+// to a database outage, and is rewritten without the messages that were replayed.
+type Spool struct {
+	mu    sync.Mutex
+	path  string
+	file  *os.File
+	count int
+}
+
+// OpenSpool opens (or creates) the spool file in dir
+func OpenSpool(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create spool directory %s: %w", dir, err)
+	}
+
+	s := &Spool{path: filepath.Join(dir, spoolFileName)}
+	messages, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+
+	// Rewrite what survived so a line cut short by a crash doesn't swallow the next append
+	if err := s.rewrite(messages); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Append durably records messages; it returns once they are synced to disk
+func (s *Spool) Append(messages []*models.Message) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, msg := range messages {
+		if err := enc.Encode(msg); err != nil {
+			return fmt.Errorf("encode spooled message %s: %w", msg.ID, err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("write spool: %w", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("sync spool: %w", err)
+	}
+	s.count += len(messages)
+	return nil
+}
+
+// Messages returns everything currently spooled, oldest first
+func (s *Spool) Messages() ([]*models.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read()
+}
+
+// Remove drops the messages with the given IDs by rewriting the spool
+func (s *Spool) Remove(ids map[string]bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.removeIDs(ids)
+}
+
+// Quarantine moves messages the database will never accept out of the spool into the rejected file
+// beside it, so they stop holding up the replay of everything spooled after them
+func (s *Spool) Quarantine(messages []*models.Message) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	ids := make(map[string]bool, len(messages))
+	for _, msg := range messages {
+		if err := enc.Encode(msg); err != nil {
+			return fmt.Errorf("encode rejected message %s: %w", msg.ID, err)
+		}
+		ids[msg.ID] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rejectedPath := filepath.Join(filepath.Dir(s.path), rejectedFileName)
+	f, err := os.OpenFile(rejectedPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open rejected spool: %w", err)
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return fmt.Errorf("write rejected spool: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("sync rejected spool: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close rejected spool: %w", err)
+	}
+	return s.removeIDs(ids)
+}
+
+// Len reports how many messages are spooled
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// removeIDs rewrites the spool without the messages with the given IDs. Callers must hold s.mu.
+func (s *Spool) removeIDs(ids map[string]bool) error {
+	messages, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	kept := messages[:0]
+	for _, msg := range messages {
+		if !ids[msg.ID] {
+			kept = append(kept, msg)
+		}
+	}
+	return s.rewrite(kept)
+}
+
+// rewrite replaces the spool's contents with messages and reopens it for appending.
+// Callers must hold s.mu, except during OpenSpool.
+func (s *Spool) rewrite(messages []*models.Message) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, msg := range messages {
+		if err := enc.Encode(msg); err != nil {
+			return fmt.Errorf("encode spooled message %s: %w", msg.ID, err)
+		}
+	}
+
+	// Write next to the spool and swap it in, so a crash leaves one complete file
+	tmpPath := s.path + ".tmp"
+	if err := writeFileSync(tmpPath, buf.Bytes()); err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("replace spool: %w", err)
+	}
+	var err error
+	if s.file, err = os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return fmt.Errorf("open spool: %w", err)
+	}
+	s.count = len(messages)
+	return nil
+}
+
+// read decodes the spool file. Callers must hold s.mu, except during OpenSpool.
+func (s *Spool) read() ([]*models.Message, error) {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read spool: %w", err)
+	}
+
+	var messages []*models.Message
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var msg models.Message
+		if err := json.Unmarshal(line, &msg); err != nil {
+			// Most likely a line cut short by a crash mid-append; the rest of the file is still good
+			log.Printf("Skipping unreadable spool entry: %v", err)
+			continue
+		}
+		messages = append(messages, &msg)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scan spool: %w", err)
+	}
+	return messages, nil
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", path, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("sync %s: %w", path, err)
+	}
+	return f.Close()
+}
@@ -1,8 +1,11 @@
 package models
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"rtc-nb/backend/internal/auth"
+	"strings"
 	"sync"
 	"time"
 )
@@ -13,16 +16,26 @@ var (
 	ErrMemberNotFound   = errors.New("member not found in channel")
 	ErrMemberExists     = errors.New("member already exists in channel")
 	ErrEmptyUsername    = errors.New("username cannot be empty")
+	ErrChannelNotFound  = errors.New("channel not found")
+	ErrNotChannelMember = errors.New("user is not a member of this channel")
+	ErrSelfConversation = errors.New("cannot start a direct conversation with yourself")
+	ErrUserNotFound     = errors.New("user not found")
+	ErrNotChannelAdmin  = errors.New("only channel admins can do this")
 )
 
+// DirectChannelPrefix is reserved for direct conversations; regular channels may not use it
+const DirectChannelPrefix = "dm_"
+
 // Represents a chat room
 type Channel struct {
 	Name           string    `json:"name"`
 	IsPrivate      bool      `json:"is_private"`
+	IsDirect       bool      `json:"is_direct"`
 	Description    *string   `json:"description,omitempty"`
 	HashedPassword *string   `json:"-"` // Never expose in JSON
 	CreatedBy      string    `json:"created_by"`
 	CreatedAt      time.Time `json:"created_at"`
+	UnreadCount    int       `json:"unread_count"` // Relative to the requesting user, only set when listing channels
 
 	mu      sync.RWMutex              `json:"-"`
 	Members map[string]*ChannelMember `json:"members"` // username -> member data
@@ -35,6 +48,29 @@ type ChannelMember struct {
 	JoinedAt time.Time `json:"joined_at"`
 }
 
+// DirectConversation is a user's view of a one-to-one conversation
+type DirectConversation struct {
+	ChannelName   string     `json:"channel_name"`
+	Participant   string     `json:"participant"` // The other user
+	CreatedAt     time.Time  `json:"created_at"`
+	LastMessageAt *time.Time `json:"last_message_at,omitempty"`
+	UnreadCount   int        `json:"unread_count"`
+}
+
+// DirectChannelName returns the deterministic channel name for two users' conversation.
+// The pair is ordered first so both users resolve to the same name, and hashed to fit the channel name column.
+func DirectChannelName(userA, userB string) string {
+	if userB < userA {
+		userA, userB = userB, userA
+	}
+	sum := sha256.Sum256([]byte(userA + "\x00" + userB))
+	return DirectChannelPrefix + hex.EncodeToString(sum[:16])
+}
+
+func IsDirectChannelName(name string) bool {
+	return strings.HasPrefix(name, DirectChannelPrefix)
+}
+
 func NewChannel(name string, creator string, description, password *string) (*Channel, error) {
 	var isPrivate bool
 	if password == nil {
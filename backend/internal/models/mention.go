@@ -0,0 +1,66 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const MaxMentionsPageSize = 100
+
+// Mention records that Username was @mentioned by MentionedBy in a text message
+type Mention struct {
+	MessageID   string     `json:"message_id"`
+	ChannelName string     `json:"channel_name"`
+	Username    string     `json:"username"`
+	MentionedBy string     `json:"mentioned_by"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ReadAt      *time.Time `json:"read_at,omitempty"`
+	Message     *Message   `json:"message,omitempty"` // Populated when listing mentions
+}
+
+// ParseMentions returns the members referenced as @username in text, in order of first appearance.
+// Trailing punctuation is ignored so "@alice," and "@alice!" both mention alice.
+func ParseMentions(text string, members []string) []string {
+	if !strings.Contains(text, "@") {
+		return nil
+	}
+
+	isMember := make(map[string]bool, len(members))
+	for _, member := range members {
+		isMember[member] = true
+	}
+
+	seen := make(map[string]bool)
+	var mentioned []string
+	for _, word := range strings.Fields(text) {
+		if !strings.HasPrefix(word, "@") {
+			continue
+		}
+		name := strings.TrimPrefix(word, "@")
+		if !isMember[name] {
+			name = strings.TrimRight(name, ".,!?:;)'\"")
+		}
+		if isMember[name] && !seen[name] {
+			seen[name] = true
+			mentioned = append(mentioned, name)
+		}
+	}
+	return mentioned
+}
+
+// NewMentionMessage creates a system message notifying the mentioned user.
+// It is only ever sent to that user's system connection.
+func NewMentionMessage(mention *Mention) *Message {
+	return &Message{
+		ID:          uuid.NewString(),
+		ChannelName: "system",
+		Username:    mention.MentionedBy,
+		Type:        MessageTypeMention,
+		Timestamp:   time.Now().UTC(),
+		Content: MessageContent{
+			Mention: mention,
+		},
+	}
+}
@@ -1,8 +1,12 @@
 package models
 
 import (
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 )
@@ -17,6 +21,31 @@ const (
 	MessageTypeMemberUpdate
 	MessageTypeUserStatus
 	MessageTypeSystemUserStatus
+	MessageTypeEdit
+	MessageTypeDelete
+	MessageTypeReaction
+	MessageTypeReadReceipt
+	MessageTypeUnreadCount
+	MessageTypeTyping
+	MessageTypeMention
+	MessageTypePinUpdate
+	MessageTypeAck
+	MessageTypeRejected
+)
+
+const MaxReactionEmojiLength = 32 // bytes, enough for multi-codepoint emoji sequences
+
+const MaxPinnedMessages = 50 // per channel
+
+const MaxReplayMessages = 1000 // Clients further behind than this should reload history instead
+
+var (
+	ErrMessageNotFound      = errors.New("message not found")
+	ErrMessageNotModifiable = errors.New("message cannot be modified")
+	ErrNotMessageOwner      = errors.New("only the author or a channel admin can modify this message")
+	ErrMessageNotPinned     = errors.New("message is not pinned")
+	ErrPinLimitReached      = errors.New("channel has reached the pinned message limit")
+	ErrMessageNotSaved      = errors.New("message is not saved yet, try again shortly")
 )
 
 type ChannelUpdate struct {
@@ -39,47 +68,243 @@ type SystemUserStatus struct {
 	Count int `json:"count"`
 }
 
+// MessageModification references a persisted message being edited or deleted
+type MessageModification struct {
+	MessageID string  `json:"message_id"`
+	Text      *string `json:"text,omitempty"` // Replacement text, edits only
+}
+
+// Reaction toggles an emoji reaction on a persisted message.
+// Action and Count are filled in by the server when broadcasting the result.
+type Reaction struct {
+	MessageID string `json:"message_id"`
+	Emoji     string `json:"emoji"`
+	Action    string `json:"action,omitempty"` // "added", "removed"
+	Count     int    `json:"count"`
+}
+
+// ReactionSummary aggregates one emoji's reactions on a message
+type ReactionSummary struct {
+	Emoji     string   `json:"emoji"`
+	Count     int      `json:"count"`
+	Usernames []string `json:"usernames"`
+}
+
+// PinnedMessage is a message pinned to its channel by an admin
+type PinnedMessage struct {
+	Message  *Message  `json:"message"`
+	PinnedBy string    `json:"pinned_by"`
+	PinnedAt time.Time `json:"pinned_at"`
+}
+
+// PinUpdate announces a pin change to everyone in the channel
+type PinUpdate struct {
+	Action    string   `json:"action"` // "pinned", "unpinned"
+	MessageID string   `json:"message_id"`
+	Message   *Message `json:"message,omitempty"` // The pinned message, "pinned" only
+}
+
+// Ack acknowledges every message up to and including Seq in the sender's channel
+type Ack struct {
+	Seq int64 `json:"seq"`
+}
+
+// Rejection tells the sender that the server refused one of their messages
+type Rejection struct {
+	Type      MessageType `json:"type"`                 // Type of the refused message
+	MessageID string      `json:"message_id,omitempty"` // Message the refused edit, delete or reaction targeted
+	Reason    string      `json:"reason"`
+}
+
+// ReadReceipt moves the sender's read marker in a channel up to MessageID
+type ReadReceipt struct {
+	MessageID string `json:"message_id"`
+}
+
+// UnreadCount is pushed to a single user's system connection when their unread count for a channel changes
+type UnreadCount struct {
+	ChannelName string `json:"channel_name"`
+	Count       int    `json:"count"`
+}
+
+// Typing is an ephemeral indicator that the sender started or stopped typing; it is never persisted
+type Typing struct {
+	Action string `json:"action"` // "started", "stopped"
+}
+
 type SketchCommandType string
 
 const (
-	SketchCommandTypeUpdate SketchCommandType = "UPDATE"
-	SketchCommandTypeClear  SketchCommandType = "CLEAR"
-	SketchCommandTypeDelete SketchCommandType = "DELETE"
-	SketchCommandTypeNew    SketchCommandType = "NEW"
+	SketchCommandTypeUpdate  SketchCommandType = "UPDATE"
+	SketchCommandTypeClear   SketchCommandType = "CLEAR"
+	SketchCommandTypeDelete  SketchCommandType = "DELETE"
+	SketchCommandTypeNew     SketchCommandType = "NEW"
+	SketchCommandTypeUndo    SketchCommandType = "UNDO"    // Undo the sender's latest stroke on the sketch
+	SketchCommandTypeRedo    SketchCommandType = "REDO"    // Redo the sender's most recently undone stroke
+	SketchCommandTypeRestore SketchCommandType = "RESTORE" // Server-sent: the sketch was restored to an earlier version
+	SketchCommandTypeLayers  SketchCommandType = "LAYERS"  // Server-sent: layers were added, changed or reordered
+	SketchCommandTypeErase   SketchCommandType = "ERASE"   // Remove the strokes named in StrokeIDs or touched by the paths in Region
+	SketchCommandTypeCursor  SketchCommandType = "CURSOR"  // Ephemeral: the sender's cursor moved on the sketch or left it; never persisted
+	SketchCommandTypeOpen    SketchCommandType = "OPEN"    // The sending session shows the sketch, so it receives the sketch's cursors
+	SketchCommandTypeClose   SketchCommandType = "CLOSE"   // The sending session stopped showing the sketch
 )
 
+// SketchCursor is where a collaborator's cursor is on a sketch
+type SketchCursor struct {
+	Position Point  `json:"position"`
+	Color    string `json:"color"`          // "#rrggbb"
+	Left     bool   `json:"left,omitempty"` // The cursor left the sketch; also sent by the server when it goes idle
+}
+
 type SketchCommand struct {
 	CommandType SketchCommandType `json:"command_type"`
 	SketchID    string            `json:"sketch_id"`
 	IsPartial   *bool             `json:"is_partial,omitempty"`
 	SketchData  *Sketch           `json:"sketch_data,omitempty"`
 	Region      *Region           `json:"region,omitempty"`
+	LayerID     string            `json:"layer_id,omitempty"`   // Layer an update draws on; empty for the base layer
+	Layers      []SketchLayer     `json:"layers,omitempty"`     // The layer structure, for LAYERS commands
+	StrokeIDs   []string          `json:"stroke_ids,omitempty"` // Strokes to erase; erase results list the strokes removed
+	Regions     []Region          `json:"regions,omitempty"`    // Erase results: regions that lost paths without IDs, to replace whole
+	Cursor      *SketchCursor     `json:"cursor,omitempty"`
+
+	// Set by the server: the stroke a complete update, undo or redo applies to, and who drew it.
+	// Undo and redo results carry the rebuilt region in Region.
+	OperationID string `json:"operation_id,omitempty"`
+	Author      string `json:"author,omitempty"`
 }
 
 type MessageContent struct {
-	Text             *string           `json:"text,omitempty"`
-	FileURL          *string           `json:"file_url,omitempty"`
-	ThumbnailURL     *string           `json:"thumbnail_url,omitempty"`
-	SketchCmd        *SketchCommand    `json:"sketch_cmd,omitempty"`
-	ChannelUpdate    *ChannelUpdate    `json:"channel_update,omitempty"`
-	MemberUpdate     *MemberUpdate     `json:"member_update,omitempty"`
-	UserStatus       *UserStatus       `json:"user_status,omitempty"`
-	SystemUserStatus *SystemUserStatus `json:"system_user_status,omitempty"`
+	Text             *string              `json:"text,omitempty"`
+	FileURL          *string              `json:"file_url,omitempty"`
+	ThumbnailURL     *string              `json:"thumbnail_url,omitempty"`
+	SketchCmd        *SketchCommand       `json:"sketch_cmd,omitempty"`
+	ChannelUpdate    *ChannelUpdate       `json:"channel_update,omitempty"`
+	MemberUpdate     *MemberUpdate        `json:"member_update,omitempty"`
+	UserStatus       *UserStatus          `json:"user_status,omitempty"`
+	SystemUserStatus *SystemUserStatus    `json:"system_user_status,omitempty"`
+	Modification     *MessageModification `json:"modification,omitempty"`
+	Reaction         *Reaction            `json:"reaction,omitempty"`
+	ReadReceipt      *ReadReceipt         `json:"read_receipt,omitempty"`
+	UnreadCount      *UnreadCount         `json:"unread_count,omitempty"`
+	Typing           *Typing              `json:"typing,omitempty"`
+	Mention          *Mention             `json:"mention,omitempty"`
+	PinUpdate        *PinUpdate           `json:"pin_update,omitempty"`
+	Ack              *Ack                 `json:"ack,omitempty"`
+	Rejection        *Rejection           `json:"rejection,omitempty"`
 }
 
 type IncomingMessage struct {
 	ChannelName string         `json:"channel_name"`
 	Type        MessageType    `json:"type"`
 	Content     MessageContent `json:"content"`
+	ReplyTo     *string        `json:"reply_to,omitempty"` // Root message ID when replying in a thread
 }
 
 type Message struct {
-	ID          string         `json:"id"`
-	ChannelName string         `json:"channel_name"`
-	Username    string         `json:"username"`
-	Type        MessageType    `json:"type"`
-	Content     MessageContent `json:"content"`
-	Timestamp   time.Time      `json:"timestamp"`
+	ID          string            `json:"id"`
+	ChannelName string            `json:"channel_name"`
+	Username    string            `json:"username"`
+	Type        MessageType       `json:"type"`
+	Content     MessageContent    `json:"content"`
+	Timestamp   time.Time         `json:"timestamp"`
+	EditedAt    *time.Time        `json:"edited_at,omitempty"`
+	DeletedAt   *time.Time        `json:"deleted_at,omitempty"`
+	ReplyTo     *string           `json:"reply_to,omitempty"`
+	Seq         int64             `json:"seq,omitempty"`         // Per-channel delivery sequence, persisted messages only
+	ReplyCount  int               `json:"reply_count,omitempty"` // Only populated for thread roots read from the store
+	Reactions   []ReactionSummary `json:"reactions,omitempty"`
+}
+
+// MessageThread is a root message together with a page of its replies
+type MessageThread struct {
+	Root    *Message     `json:"root"`
+	Replies *MessagePage `json:"replies"`
+}
+
+const (
+	DefaultMessagePageSize = 50
+	MaxMessagePageSize     = 200
+)
+
+var ErrInvalidCursor = errors.New("invalid message cursor")
+
+// MessageCursor identifies a position in a channel's history.
+// Messages are ordered by (timestamp, id) so the ID breaks timestamp ties.
+type MessageCursor struct {
+	ID        string
+	Timestamp time.Time
+}
+
+// MessagePageRequest describes a page of channel history.
+// At most one of Before/After may be set; with neither, the latest page is returned.
+type MessagePageRequest struct {
+	Before *MessageCursor
+	After  *MessageCursor
+	Limit  int
+}
+
+// MessagePage is a chronologically ordered slice of channel history.
+// NextCursor continues in the direction of the request and is empty when there is nothing more.
+type MessagePage struct {
+	Messages   []*Message `json:"messages"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+	HasMore    bool       `json:"has_more"`
+}
+
+const MaxSearchQueryLength = 200
+
+// MessageSearchQuery filters a full-text search over one channel's text messages.
+// Results are newest-first; Before continues from the previous page's NextCursor.
+type MessageSearchQuery struct {
+	Query  string
+	Author *string
+	From   *time.Time // inclusive
+	To     *time.Time // exclusive
+	Before *MessageCursor
+	Limit  int
+}
+
+// MessageSearchHit is a matching message with its highlighted snippet.
+// The snippet is HTML-escaped with matches wrapped in <mark> tags.
+type MessageSearchHit struct {
+	Message *Message `json:"message"`
+	Snippet string   `json:"snippet"`
+}
+
+type MessageSearchResult struct {
+	Hits       []*MessageSearchHit `json:"hits"`
+	NextCursor string              `json:"next_cursor,omitempty"`
+	HasMore    bool                `json:"has_more"`
+}
+
+func CursorFromMessage(msg *Message) *MessageCursor {
+	return &MessageCursor{ID: msg.ID, Timestamp: msg.Timestamp}
+}
+
+// Encode returns an opaque, URL-safe representation of the cursor.
+func (c *MessageCursor) Encode() string {
+	raw := c.Timestamp.UTC().Format(time.RFC3339Nano) + "|" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func DecodeMessageCursor(encoded string) (*MessageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidCursor
+	}
+	ts, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if _, err := uuid.Parse(parts[1]); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &MessageCursor{ID: parts[1], Timestamp: ts}, nil
 }
 
 func (m *IncomingMessage) Validate() error {
@@ -87,6 +312,15 @@ func (m *IncomingMessage) Validate() error {
 		return errors.New("channel name required")
 	}
 
+	if m.ReplyTo != nil {
+		if m.Type != MessageTypeText && m.Type != MessageTypeImage {
+			return errors.New("only text and image messages can be replies")
+		}
+		if _, err := uuid.Parse(*m.ReplyTo); err != nil {
+			return errors.New("invalid reply_to message ID")
+		}
+	}
+
 	switch m.Type {
 	case MessageTypeText:
 		if m.Content.Text == nil {
@@ -109,12 +343,42 @@ func (m *IncomingMessage) Validate() error {
 			if cmd.Region == nil || cmd.Region.Paths == nil || len(cmd.Region.Paths) == 0 || cmd.IsPartial == nil {
 				return errors.New("region with at least one path, and isPartial flag required for sketch update")
 			}
-		case SketchCommandTypeClear, SketchCommandTypeDelete:
+			for i := range cmd.Region.Paths {
+				if err := cmd.Region.Paths[i].Validate(); err != nil {
+					return fmt.Errorf("invalid path %d: %w", i, err)
+				}
+			}
+		case SketchCommandTypeErase:
+			if len(cmd.StrokeIDs) == 0 && (cmd.Region == nil || len(cmd.Region.Paths) == 0) {
+				return errors.New("stroke IDs or an eraser path required for sketch erase")
+			}
+			if len(cmd.StrokeIDs) > MaxSketchEraseStrokes {
+				return fmt.Errorf("at most %d strokes can be erased at once", MaxSketchEraseStrokes)
+			}
+			if cmd.Region != nil {
+				for i := range cmd.Region.Paths {
+					if cmd.Region.Paths[i].Kind != DrawPathKindFreehand || len(cmd.Region.Paths[i].Points) == 0 {
+						return fmt.Errorf("eraser path %d must be a freehand path with at least one point", i)
+					}
+				}
+			}
+		case SketchCommandTypeCursor:
+			if cmd.Cursor == nil {
+				return errors.New("cursor required for sketch cursor command")
+			}
+			if !cmd.Cursor.Left && !isHexColor(cmd.Cursor.Color) {
+				return errors.New("cursor color must be #rrggbb")
+			}
+		case SketchCommandTypeClear, SketchCommandTypeDelete, SketchCommandTypeUndo, SketchCommandTypeRedo,
+			SketchCommandTypeOpen, SketchCommandTypeClose:
 			break
 		case SketchCommandTypeNew:
 			if cmd.SketchData == nil {
 				return errors.New("sketch data required for new sketch command")
 			}
+		case SketchCommandTypeRestore, SketchCommandTypeLayers:
+			// Restores and layer changes go through their endpoints, which announce them themselves
+			return fmt.Errorf("only the server sends %s sketch commands", cmd.CommandType)
 		default:
 			return errors.New("invalid sketch command type")
 		}
@@ -161,6 +425,51 @@ func (m *IncomingMessage) Validate() error {
 		if m.Content.SystemUserStatus == nil {
 			return errors.New("system user status data required")
 		}
+	case MessageTypeEdit, MessageTypeDelete:
+		// Authorship/admin checks need the store and happen when the modification is applied
+		if m.Content.Modification == nil || m.Content.Modification.MessageID == "" {
+			return errors.New("target message ID required for message modification")
+		}
+		if _, err := uuid.Parse(m.Content.Modification.MessageID); err != nil {
+			return errors.New("invalid target message ID")
+		}
+		if m.Type == MessageTypeEdit {
+			text := m.Content.Modification.Text
+			if text == nil || strings.TrimSpace(*text) == "" {
+				return errors.New("replacement text required for message edit")
+			}
+		}
+	case MessageTypeReaction:
+		reaction := m.Content.Reaction
+		if reaction == nil || reaction.MessageID == "" || reaction.Emoji == "" {
+			return errors.New("target message ID and emoji required for reaction")
+		}
+		if _, err := uuid.Parse(reaction.MessageID); err != nil {
+			return errors.New("invalid target message ID")
+		}
+		if len(reaction.Emoji) > MaxReactionEmojiLength || !utf8.ValidString(reaction.Emoji) || strings.ContainsAny(reaction.Emoji, " \t\n") {
+			return errors.New("invalid reaction emoji")
+		}
+	case MessageTypeReadReceipt:
+		if m.Content.ReadReceipt == nil || m.Content.ReadReceipt.MessageID == "" {
+			return errors.New("message ID required for read receipt")
+		}
+		if _, err := uuid.Parse(m.Content.ReadReceipt.MessageID); err != nil {
+			return errors.New("invalid read receipt message ID")
+		}
+	case MessageTypeAck:
+		if m.Content.Ack == nil || m.Content.Ack.Seq <= 0 {
+			return errors.New("positive sequence number required for ack")
+		}
+	case MessageTypeTyping:
+		if m.Content.Typing == nil {
+			return errors.New("typing data required")
+		}
+		switch m.Content.Typing.Action {
+		case "started", "stopped":
+		default:
+			return errors.New("invalid typing action")
+		}
 	default:
 		return errors.New("invalid message type")
 	}
@@ -168,6 +477,19 @@ func (m *IncomingMessage) Validate() error {
 	return nil
 }
 
+// isHexColor reports whether s is a color of the form #rrggbb
+func isHexColor(s string) bool {
+	if len(s) != 7 || s[0] != '#' {
+		return false
+	}
+	for _, c := range s[1:] {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
 func NewMessage(incoming *IncomingMessage, username string) (*Message, error) {
 	if err := incoming.Validate(); err != nil {
 		return nil, err
@@ -180,6 +502,7 @@ func NewMessage(incoming *IncomingMessage, username string) (*Message, error) {
 		Type:        incoming.Type,
 		Content:     incoming.Content,
 		Timestamp:   time.Now().UTC(),
+		ReplyTo:     incoming.ReplyTo,
 	}, nil
 }
 
@@ -221,6 +544,79 @@ func NewMemberUpdateMessage(channelName, actorUsername, targetUsername, action s
 	}
 }
 
+// NewPinUpdateMessage creates a channel message for pin changes.
+// The actorUsername is the admin who pinned or unpinned the message.
+func NewPinUpdateMessage(channelName, actorUsername, action, messageID string, pinned *Message) *Message {
+	return &Message{
+		ID:          uuid.NewString(),
+		ChannelName: channelName,
+		Username:    actorUsername,
+		Type:        MessageTypePinUpdate,
+		Timestamp:   time.Now().UTC(),
+		Content: MessageContent{
+			PinUpdate: &PinUpdate{
+				Action:    action,
+				MessageID: messageID,
+				Message:   pinned,
+			},
+		},
+	}
+}
+
+// NewUnreadCountMessage creates a system message telling username their unread count for channelName.
+// It is only ever sent to that user's system connection.
+func NewUnreadCountMessage(channelName, username string, count int) *Message {
+	return &Message{
+		ID:          uuid.NewString(),
+		ChannelName: "system",
+		Username:    username,
+		Type:        MessageTypeUnreadCount,
+		Timestamp:   time.Now().UTC(),
+		Content: MessageContent{
+			UnreadCount: &UnreadCount{
+				ChannelName: channelName,
+				Count:       count,
+			},
+		},
+	}
+}
+
+// NewRejectionMessage tells username that their message of type rejected, targeting messageID if any, was refused.
+// It is only ever sent to the connection the refused message came from.
+func NewRejectionMessage(channelName, username string, rejected MessageType, messageID, reason string) *Message {
+	return &Message{
+		ID:          uuid.NewString(),
+		ChannelName: channelName,
+		Username:    username,
+		Type:        MessageTypeRejected,
+		Timestamp:   time.Now().UTC(),
+		Content: MessageContent{
+			Rejection: &Rejection{
+				Type:      rejected,
+				MessageID: messageID,
+				Reason:    reason,
+			},
+		},
+	}
+}
+
+// NewTypingMessage creates a channel message announcing that username started or stopped typing.
+// The server uses it to clear indicators of clients that went quiet or disconnected.
+func NewTypingMessage(channelName, username, action string) *Message {
+	return &Message{
+		ID:          uuid.NewString(),
+		ChannelName: channelName,
+		Username:    username,
+		Type:        MessageTypeTyping,
+		Timestamp:   time.Now().UTC(),
+		Content: MessageContent{
+			Typing: &Typing{
+				Action: action,
+			},
+		},
+	}
+}
+
 // Helper function to create a Sketch command message for broadcasting
 // Used by API handlers after successful operations (Create, Delete, Clear)
 func NewSketchBroadcastMessage(channelName, username string, command SketchCommand) *Message {
@@ -0,0 +1,162 @@
+package models
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestMessageCursorRoundTrip(t *testing.T) {
+	id := uuid.NewString()
+	tests := []struct {
+		name string
+		ts   time.Time
+	}{
+		{name: "utc", ts: time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)},
+		{name: "nanoseconds", ts: time.Date(2024, 3, 1, 12, 30, 0, 123456789, time.UTC)},
+		{name: "other zone", ts: time.Date(2024, 3, 1, 7, 30, 0, 5000, time.FixedZone("EST", -5*3600))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded := CursorFromMessage(&Message{ID: id, Timestamp: tt.ts}).Encode()
+			decoded, err := DecodeMessageCursor(encoded)
+			if err != nil {
+				t.Fatalf("DecodeMessageCursor(%q): %v", encoded, err)
+			}
+			if decoded.ID != id {
+				t.Errorf("ID = %q, want %q", decoded.ID, id)
+			}
+			if !decoded.Timestamp.Equal(tt.ts) {
+				t.Errorf("Timestamp = %v, want %v", decoded.Timestamp, tt.ts)
+			}
+		})
+	}
+}
+
+func TestMessageCursorIsURLSafe(t *testing.T) {
+	cursor := &MessageCursor{ID: uuid.NewString(), Timestamp: time.Now()}
+	for _, r := range cursor.Encode() {
+		if r == '+' || r == '/' || r == '=' {
+			t.Fatalf("cursor %q contains %q", cursor.Encode(), r)
+		}
+	}
+}
+
+func TestDecodeMessageCursorRejectsInvalid(t *testing.T) {
+	encode := func(raw string) string { return base64.RawURLEncoding.EncodeToString([]byte(raw)) }
+	id := uuid.NewString()
+
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{name: "empty", encoded: ""},
+		{name: "not base64", encoded: "!!!"},
+		{name: "no separator", encoded: encode("2024-03-01T12:30:00Z" + id)},
+		{name: "bad timestamp", encoded: encode("yesterday|" + id)},
+		{name: "bad id", encoded: encode("2024-03-01T12:30:00Z|not-a-uuid")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeMessageCursor(tt.encoded); !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("DecodeMessageCursor(%q) error = %v, want ErrInvalidCursor", tt.encoded, err)
+			}
+		})
+	}
+}
+
+func TestReadReceiptValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		receipt *ReadReceipt
+		wantErr bool
+	}{
+		{name: "valid", receipt: &ReadReceipt{MessageID: uuid.NewString()}},
+		{name: "missing receipt", receipt: nil, wantErr: true},
+		{name: "missing message ID", receipt: &ReadReceipt{}, wantErr: true},
+		{name: "invalid message ID", receipt: &ReadReceipt{MessageID: "latest"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &IncomingMessage{
+				ChannelName: "general",
+				Type:        MessageTypeReadReceipt,
+				Content:     MessageContent{ReadReceipt: tt.receipt},
+			}
+			if err := msg.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseMentions(t *testing.T) {
+	members := []string{"alice", "bob", "carol.smith", "dave!"}
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{name: "no mentions", text: "hello everyone", want: nil},
+		{name: "single", text: "hi @alice", want: []string{"alice"}},
+		{name: "order of first appearance", text: "@bob and @alice, then @bob again", want: []string{"bob", "alice"}},
+		{name: "trailing punctuation", text: "thanks @alice! ask @bob? (cc @alice)", want: []string{"alice", "bob"}},
+		{name: "quoted", text: `"@bob"`, want: nil},
+		{name: "closing quote", text: `say hi to @bob"`, want: []string{"bob"}},
+		{name: "dot in username", text: "ping @carol.smith.", want: []string{"carol.smith"}},
+		{name: "punctuation that is part of the name", text: "hey @dave!", want: []string{"dave!"}},
+		{name: "not a member", text: "@mallory @alicex", want: nil},
+		{name: "case sensitive", text: "@Alice", want: nil},
+		{name: "email is not a mention", text: "mail alice@example.com", want: nil},
+		{name: "bare at sign", text: "meet @ noon", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ParseMentions(tt.text, members)
+			if len(got) != len(tt.want) {
+				t.Fatalf("ParseMentions(%q) = %v, want %v", tt.text, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("ParseMentions(%q) = %v, want %v", tt.text, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSketchCommandValidation(t *testing.T) {
+	sketchID := uuid.NewString()
+	tests := []struct {
+		name    string
+		cmd     *SketchCommand
+		wantErr bool
+	}{
+		{name: "new", cmd: &SketchCommand{CommandType: SketchCommandTypeNew, SketchID: sketchID, SketchData: &Sketch{ID: sketchID}}},
+		{name: "new without sketch", cmd: &SketchCommand{CommandType: SketchCommandTypeNew, SketchID: sketchID}, wantErr: true},
+		{name: "undo", cmd: &SketchCommand{CommandType: SketchCommandTypeUndo, SketchID: sketchID}},
+		{name: "restore is server-sent", cmd: &SketchCommand{CommandType: SketchCommandTypeRestore, SketchID: sketchID, SketchData: &Sketch{ID: sketchID}}, wantErr: true},
+		{name: "layers is server-sent", cmd: &SketchCommand{CommandType: SketchCommandTypeLayers, SketchID: sketchID, Layers: []SketchLayer{}}, wantErr: true},
+		{name: "unknown", cmd: &SketchCommand{CommandType: "SELECT", SketchID: sketchID}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &IncomingMessage{
+				ChannelName: "general",
+				Type:        MessageTypeSketch,
+				Content:     MessageContent{SketchCmd: tt.cmd},
+			}
+			if err := msg.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
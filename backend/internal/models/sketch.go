@@ -1,38 +1,276 @@
 package models
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 )
 
+const MaxSketchVersions = 20 // per sketch; the oldest versions are pruned beyond this
+
+const SketchSnapshotInterval = 5 * time.Minute // Minimum time between automatic snapshots of a sketch being drawn on
+
+const (
+	MaxSketchLayers       = 16 // per sketch, not counting the base layer
+	MaxSketchLayerNameLen = 50
+	SketchBaseLayerID     = "" // Targets the sketch's own regions, beneath its layers
+)
+
+var (
+	ErrSketchNotFound          = errors.New("sketch not found")
+	ErrSketchVersionNotFound   = errors.New("sketch version not found")
+	ErrSketchLayerNotFound     = errors.New("sketch layer not found")
+	ErrSketchLayerLocked       = errors.New("sketch layer is locked by its owner")
+	ErrSketchLayerNotOwner     = errors.New("only the layer's owner can lock or unlock it")
+	ErrSketchLayerLimit        = fmt.Errorf("sketch already has the maximum of %d layers", MaxSketchLayers)
+	ErrInvalidSketchLayerName  = fmt.Errorf("layer name must be 1 to %d characters", MaxSketchLayerNameLen)
+	ErrInvalidSketchLayerOrder = errors.New("layer order must list every layer of the sketch exactly once")
+)
+
 type Point struct {
 	X int `json:"x"`
 	Y int `json:"y"`
 }
 
+// Kinds of sketch elements besides freehand paths
+const (
+	DrawPathKindFreehand = ""        // A polyline through Points
+	DrawPathKindRect     = "rect"    // Spans corners Points[0] and Points[1]
+	DrawPathKindEllipse  = "ellipse" // Inscribed in the rectangle spanned by Points[0] and Points[1]
+	DrawPathKindLine     = "line"    // From Points[0] to Points[1]
+	DrawPathKindArrow    = "arrow"   // A line with its head at Points[1]
+	DrawPathKindText     = "text"    // Text with its top-left corner at Points[0]
+)
+
+const (
+	MaxSketchEraseStrokes = 500 // Stroke IDs one erase command may name
+	MaxSketchTextLen      = 500
+	MinSketchFontSize     = 6
+	MaxSketchFontSize     = 200
+	MaxSketchStrokeWidth  = 200
+)
+
+// DrawPath is one element of a sketch: a freehand path, or a shape or text label when Kind is set.
+// Elements keep their drawing order with the paths around them, so erasers work on shapes too.
 type DrawPath struct {
+	ID          string  `json:"id,omitempty"` // Assigned by the server when the stroke is completed; empty for older paths
 	Points      []Point `json:"points"`
 	IsDrawing   bool    `json:"is_drawing"`
 	StrokeWidth int     `json:"stroke_width"`
 	Color       string  `json:"color"`
+	OperationID string  `json:"operation_id,omitempty"` // Stroke that drew the path; empty for paths drawn before the operation log
+	Kind        string  `json:"kind,omitempty"`
+	Fill        string  `json:"fill,omitempty"`      // Fill color of rectangles and ellipses; unfilled when empty
+	Text        string  `json:"text,omitempty"`      // Label of a text element
+	FontSize    int     `json:"font_size,omitempty"` // Pixel size of a text element
+	Seq         int64   `json:"seq,omitempty"`       // Drawing order within the region; 0 for paths stored before paths were numbered
+}
+
+// Validate checks a path has the points and properties its kind needs. Only freehand paths can erase.
+func (p *DrawPath) Validate() error {
+	if p.StrokeWidth < 0 || p.StrokeWidth > MaxSketchStrokeWidth {
+		return fmt.Errorf("stroke width must be between 0 and %d", MaxSketchStrokeWidth)
+	}
+	if p.Kind != DrawPathKindFreehand && !p.IsDrawing {
+		return errors.New("only freehand paths can erase")
+	}
+
+	switch p.Kind {
+	case DrawPathKindFreehand:
+		if len(p.Points) == 0 {
+			return errors.New("path requires at least one point")
+		}
+	case DrawPathKindRect, DrawPathKindEllipse, DrawPathKindLine, DrawPathKindArrow:
+		if len(p.Points) != 2 {
+			return fmt.Errorf("%s requires exactly two points", p.Kind)
+		}
+	case DrawPathKindText:
+		if len(p.Points) != 1 {
+			return errors.New("text requires exactly one point")
+		}
+		if strings.TrimSpace(p.Text) == "" || utf8.RuneCountInString(p.Text) > MaxSketchTextLen {
+			return fmt.Errorf("text must be 1 to %d characters", MaxSketchTextLen)
+		}
+		if p.FontSize < MinSketchFontSize || p.FontSize > MaxSketchFontSize {
+			return fmt.Errorf("font size must be between %d and %d", MinSketchFontSize, MaxSketchFontSize)
+		}
+	default:
+		return fmt.Errorf("unknown path kind %q", p.Kind)
+	}
+
+	if p.Kind != DrawPathKindText && (p.Text != "" || p.FontSize != 0) {
+		return errors.New("only text elements have text and a font size")
+	}
+	if p.Fill != "" && p.Kind != DrawPathKindRect && p.Kind != DrawPathKindEllipse {
+		return errors.New("only rectangles and ellipses can be filled")
+	}
+	return nil
 }
 
 type Region struct {
-	Start Point      `json:"start"`
-	End   Point      `json:"end"`
-	Paths []DrawPath `json:"paths"`
+	Start   Point      `json:"start"`
+	End     Point      `json:"end"`
+	Paths   []DrawPath `json:"paths"`
+	LastSeq int64      `json:"last_seq,omitempty"` // Highest Seq given to a path in the region, even one undone or erased since
+}
+
+// AssignPathIDs gives each path in the region that has no ID a new one
+func (r *Region) AssignPathIDs() {
+	for i := range r.Paths {
+		if r.Paths[i].ID == "" {
+			r.Paths[i].ID = uuid.New().String()
+		}
+	}
 }
 
 type Sketch struct {
-	ID          string            `json:"id"`
-	ChannelName string            `json:"channel_name"`
-	DisplayName string            `json:"display_name"`
-	Width       int               `json:"width"`
-	Height      int               `json:"height"`
-	Regions     map[string]Region `json:"regions"` // key "x,y"
-	CreatedAt   time.Time         `json:"created_at"`
-	CreatedBy   string            `json:"created_by"`
+	ID           string            `json:"id"`
+	ChannelName  string            `json:"channel_name"`
+	DisplayName  string            `json:"display_name"`
+	Width        int               `json:"width"`
+	Height       int               `json:"height"`
+	Regions      map[string]Region `json:"regions"` // key "x,y"
+	CreatedAt    time.Time         `json:"created_at"`
+	CreatedBy    string            `json:"created_by"`
+	ThumbnailURL string            `json:"thumbnail_url,omitempty"` // Rendered preview, refreshed shortly after the sketch changes
+	Layers       []SketchLayer     `json:"layers"`                  // Drawn above Regions, bottom to top
+}
+
+// SketchLayer is a named layer of a sketch. The sketch's own regions form an implicit base layer
+// beneath all layers that is always visible and never locked.
+type SketchLayer struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	Visible   bool              `json:"visible"`
+	Locked    bool              `json:"locked"` // Only CreatedBy may draw on a locked layer or change it
+	CreatedBy string            `json:"created_by"`
+	Regions   map[string]Region `json:"regions,omitempty"` // key "x,y"; omitted when only the layer structure is sent
+}
+
+// SketchLayerUpdate holds the layer properties to change; nil fields are left as they are
+type SketchLayerUpdate struct {
+	Name    *string `json:"name,omitempty"`
+	Visible *bool   `json:"visible,omitempty"`
+	Locked  *bool   `json:"locked,omitempty"`
+}
+
+func NewSketchLayer(name, createdBy string) SketchLayer {
+	return SketchLayer{
+		ID:        uuid.New().String(),
+		Name:      name,
+		Visible:   true,
+		CreatedBy: createdBy,
+		Regions:   make(map[string]Region),
+	}
+}
+
+// CanDraw reports whether username may draw on the layer
+func (l *SketchLayer) CanDraw(username string) bool {
+	return !l.Locked || l.CreatedBy == username
+}
+
+// Layer returns the sketch layer with the given ID, or nil if there is none
+func (s *Sketch) Layer(layerID string) *SketchLayer {
+	for i := range s.Layers {
+		if s.Layers[i].ID == layerID {
+			return &s.Layers[i]
+		}
+	}
+	return nil
+}
+
+// LayerRegions returns the regions drawn on a layer, or the sketch's own for the base layer.
+// It returns nil if the sketch has no such layer.
+func (s *Sketch) LayerRegions(layerID string) map[string]Region {
+	if layerID == SketchBaseLayerID {
+		return s.Regions
+	}
+	layer := s.Layer(layerID)
+	if layer == nil {
+		return nil
+	}
+	if layer.Regions == nil {
+		layer.Regions = make(map[string]Region)
+	}
+	return layer.Regions
+}
+
+// LayerStructure returns the sketch's layers without their regions
+func (s *Sketch) LayerStructure() []SketchLayer {
+	layers := make([]SketchLayer, len(s.Layers))
+	for i, layer := range s.Layers {
+		layer.Regions = nil
+		layers[i] = layer
+	}
+	return layers
+}
+
+// SketchOperation is one committed stroke in a sketch's operation log.
+// Its region holds only the stroke's paths; undone operations are skipped when a region is rebuilt.
+type SketchOperation struct {
+	ID        string     `json:"id"`
+	SketchID  string     `json:"sketch_id"`
+	Username  string     `json:"username"`
+	LayerID   string     `json:"layer_id,omitempty"` // Empty for the base layer
+	Region    Region     `json:"region"`
+	UndoneAt  *time.Time `json:"undone_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Why a sketch version was taken
+const (
+	SketchVersionReasonAuto    = "auto"    // Periodic snapshot while the sketch is drawn on
+	SketchVersionReasonManual  = "manual"  // Requested by a channel member
+	SketchVersionReasonRestore = "restore" // The state replaced by restoring another version
+)
+
+// SketchVersion is a snapshot of a sketch's regions and layers. Both are omitted when listing versions.
+type SketchVersion struct {
+	ID        string            `json:"id"`
+	SketchID  string            `json:"sketch_id"`
+	Regions   map[string]Region `json:"regions,omitempty"`
+	Layers    []SketchLayer     `json:"layers,omitempty"`
+	Reason    string            `json:"reason"`
+	CreatedAt time.Time         `json:"created_at"`
+	CreatedBy string            `json:"created_by"`
+}
+
+func NewSketchVersion(sketchID string, regions map[string]Region, layers []SketchLayer, reason, createdBy string) *SketchVersion {
+	return &SketchVersion{
+		ID:        uuid.New().String(),
+		SketchID:  sketchID,
+		Regions:   regions,
+		Layers:    layers,
+		Reason:    reason,
+		CreatedAt: time.Now().UTC(),
+		CreatedBy: createdBy,
+	}
+}
+
+// SketchStorageStats describes the space a sketch's drawing takes in the database
+type SketchStorageStats struct {
+	SketchID       string            `json:"sketch_id"`
+	StoredBytes    int               `json:"stored_bytes"` // Regions and layers as stored, after database compression
+	Paths          int               `json:"paths"`
+	Points         int               `json:"points"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+	LastCompaction *SketchCompaction `json:"last_compaction,omitempty"` // Omitted until the sketch is first compacted
+}
+
+// SketchCompaction is the stored size of a sketch's regions and layers before and after it was compacted
+type SketchCompaction struct {
+	CompactedAt time.Time `json:"compacted_at"`
+	BytesBefore int       `json:"bytes_before"`
+	BytesAfter  int       `json:"bytes_after"`
+}
+
+// RegionKey identifies the region starting at start within a sketch's regions map
+func RegionKey(start Point) string {
+	return fmt.Sprintf("%d,%d", start.X, start.Y)
 }
 
 func NewSketch(channelName, displayName string, width, height int, createdBy string) *Sketch {
@@ -45,5 +283,6 @@ func NewSketch(channelName, displayName string, width, height int, createdBy str
 		Regions:     make(map[string]Region),
 		CreatedAt:   time.Now().UTC(),
 		CreatedBy:   createdBy,
+		Layers:      []SketchLayer{},
 	}
 }
@@ -86,7 +86,12 @@ func (cm *channelManager) JoinChannel(ctx context.Context, channelName, username
 		return wasAdded, fmt.Errorf("channel not found")
 	}
 
-	if channel.IsPrivate {
+	if channel.IsDirect {
+		// Direct conversations are only joinable by their two participants
+		if _, err := channel.GetMember(username); err != nil {
+			return wasAdded, fmt.Errorf("channel not found")
+		}
+	} else if channel.IsPrivate {
 		if password == nil || *password == "" {
 			return wasAdded, fmt.Errorf("password required for private channel")
 		}
@@ -111,15 +116,6 @@ func (cm *channelManager) JoinChannel(ctx context.Context, channelName, username
 		}
 	}
 
-	// Leave current channel websocket pool before joining new one
-	if conn, ok := cm.connMgr.GetConnection(username); ok {
-		// Determine the *actual* current channel the user is connected to
-		currentUserChannel, userChannelErr := cm.connMgr.GetUserChannel(username)
-		if userChannelErr == nil && currentUserChannel != "" {
-			cm.connMgr.RemoveClientFromChannel(currentUserChannel, conn)
-		} // else: user might not be in a channel or error fetching it, proceed cautiously
-	}
-
 	// Add as member if first time joining
 	if isFirstJoin {
 		isAdmin, err := cm.db.IsUserAdmin(ctx, channelName, username)
@@ -145,9 +141,8 @@ func (cm *channelManager) JoinChannel(ctx context.Context, channelName, username
 		return wasAdded, fmt.Errorf("commit transaction: %w", err)
 	}
 
-	if conn, ok := cm.connMgr.GetConnection(username); ok {
-		cm.connMgr.AddClientToChannel(channelName, conn)
-	}
+	// The session's websocket joins the channel pool when it connects with this channel;
+	// other sessions of the same user stay in whatever channel they are viewing.
 	return wasAdded, nil
 }
 
@@ -159,9 +154,7 @@ func (cm *channelManager) LeaveChannel(ctx context.Context, channelName, usernam
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
-	if conn, ok := cm.connMgr.GetConnection(username); ok {
-		cm.connMgr.RemoveClientFromChannel(channelName, conn)
-	}
+	cm.connMgr.RemoveUserFromChannel(username, channelName)
 	// if err := cm.db.RemoveChannelMember(ctx, channelName, username); err != nil {
 	// 	return fmt.Errorf("remove channel member: %w", err)
 	// }
@@ -279,3 +272,56 @@ func (cm *channelManager) GetChannel(ctx context.Context, channelName string) (*
 
 	return cm.db.GetChannel(ctx, channelName)
 }
+
+// MarkMessageRead moves username's read marker in channelName up to messageID and returns the new unread count.
+// Messages still waiting in the chat buffer aren't in the store yet, so reading one marks the channel read up to now.
+func (cm *channelManager) MarkMessageRead(ctx context.Context, channelName, username, messageID string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	isMember, err := cm.db.IsChannelMember(ctx, channelName, username)
+	if err != nil {
+		return 0, err
+	}
+	if !isMember {
+		return 0, models.ErrNotChannelMember
+	}
+
+	msg, err := cm.db.GetMessage(ctx, messageID)
+	if err != nil {
+		return 0, err
+	}
+	readUpTo := time.Now().UTC()
+	switch {
+	case msg == nil:
+		if err := cm.db.MarkChannelRead(ctx, channelName, username, readUpTo); err != nil {
+			return 0, err
+		}
+	case msg.ChannelName != channelName:
+		return 0, models.ErrMessageNotFound
+	default:
+		readUpTo = msg.Timestamp
+		if err := cm.db.MarkMessageRead(ctx, channelName, username, msg.ID, msg.Timestamp); err != nil {
+			return 0, err
+		}
+	}
+	if err := cm.db.MarkMentionsRead(ctx, channelName, username, readUpTo); err != nil {
+		return 0, err
+	}
+
+	return cm.db.GetUnreadCount(ctx, channelName, username)
+}
+
+// GetUnreadCounts returns username's unread count per channel they belong to
+func (cm *channelManager) GetUnreadCounts(ctx context.Context, username string) (map[string]int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return cm.db.GetUnreadCounts(ctx, username)
+}
+
+// GetChannelUnreadCounts returns the unread count of every member of channelName
+func (cm *channelManager) GetChannelUnreadCounts(ctx context.Context, channelName string) (map[string]int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return cm.db.GetChannelUnreadCounts(ctx, channelName)
+}
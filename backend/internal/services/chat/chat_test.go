@@ -0,0 +1,129 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// fakeSeqStore mimics the channels.last_seq column behind ReserveChannelSeqs
+type fakeSeqStore struct {
+	mu       sync.Mutex
+	lastSeq  map[string]int64
+	reserves int
+	fail     error
+}
+
+func (f *fakeSeqStore) reserve(_ context.Context, channelName string, count, floor int64) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail != nil {
+		return 0, f.fail
+	}
+	f.reserves++
+	last := max(f.lastSeq[channelName], floor) + count
+	f.lastSeq[channelName] = last
+	return last, nil
+}
+
+func TestSeqAllocator(t *testing.T) {
+	store := &fakeSeqStore{lastSeq: map[string]int64{"general": 10}}
+	seqs := newSeqAllocator(4, store.reserve)
+
+	var got []int64
+	for range 9 {
+		seq, err := seqs.next(context.Background(), "general")
+		if err != nil {
+			t.Fatalf("next: %v", err)
+		}
+		got = append(got, seq)
+	}
+	for i, seq := range got {
+		if want := int64(11 + i); seq != want {
+			t.Fatalf("seq %d = %d, want %d (all: %v)", i, seq, want, got)
+		}
+	}
+	if store.reserves != 3 {
+		t.Errorf("reserves = %d, want 3 for 9 numbers in blocks of 4", store.reserves)
+	}
+
+	// Other channels keep their own range
+	if seq, _ := seqs.next(context.Background(), "random"); seq != 1 {
+		t.Errorf("first seq of a new channel = %d, want 1", seq)
+	}
+}
+
+func TestSeqAllocatorKeepsRisingAfterChannelReset(t *testing.T) {
+	store := &fakeSeqStore{lastSeq: map[string]int64{}}
+	seqs := newSeqAllocator(2, store.reserve)
+
+	var last int64
+	for range 2 {
+		last, _ = seqs.next(context.Background(), "general")
+	}
+	// The channel is deleted and recreated, starting its row over at zero
+	store.lastSeq["general"] = 0
+
+	seq, err := seqs.next(context.Background(), "general")
+	if err != nil {
+		t.Fatalf("next: %v", err)
+	}
+	if seq <= last {
+		t.Errorf("seq after reset = %d, want more than %d", seq, last)
+	}
+}
+
+func TestSeqAllocatorConcurrent(t *testing.T) {
+	store := &fakeSeqStore{lastSeq: map[string]int64{}}
+	seqs := newSeqAllocator(8, store.reserve)
+
+	const workers, perWorker = 8, 50
+	results := make(chan int64, workers*perWorker)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range perWorker {
+				seq, err := seqs.next(context.Background(), "general")
+				if err != nil {
+					t.Errorf("next: %v", err)
+					return
+				}
+				results <- seq
+			}
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	seen := make(map[int64]bool)
+	for seq := range results {
+		if seen[seq] {
+			t.Fatalf("seq %d handed out twice", seq)
+		}
+		seen[seq] = true
+	}
+	for seq := int64(1); seq <= workers*perWorker; seq++ {
+		if !seen[seq] {
+			t.Fatalf("seq %d never handed out", seq)
+		}
+	}
+}
+
+func TestSeqAllocatorReserveError(t *testing.T) {
+	errDown := errors.New("database unavailable")
+	store := &fakeSeqStore{lastSeq: map[string]int64{}, fail: errDown}
+	seqs := newSeqAllocator(4, store.reserve)
+
+	if _, err := seqs.next(context.Background(), "general"); !errors.Is(err, errDown) {
+		t.Fatalf("err = %v, want %v", err, errDown)
+	}
+
+	// A failed reservation hands nothing out, so the next one starts cleanly
+	store.fail = nil
+	if seq, err := seqs.next(context.Background(), "general"); err != nil || seq != 1 {
+		t.Errorf("next after recovery = %d, %v; want 1, nil", seq, err)
+	}
+}
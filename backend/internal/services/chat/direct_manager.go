@@ -0,0 +1,92 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"rtc-nb/backend/internal/models"
+	"rtc-nb/backend/internal/store/database"
+)
+
+type directManager struct {
+	db *database.Store
+}
+
+func NewDirectManager(db *database.Store) *directManager {
+	return &directManager{
+		db: db,
+	}
+}
+
+// OpenDirectConversation returns the conversation between username and participant, creating it on first use.
+func (dm *directManager) OpenDirectConversation(ctx context.Context, username, participant string) (*models.DirectConversation, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if username == participant {
+		return nil, models.ErrSelfConversation
+	}
+
+	other, err := dm.db.GetUser(ctx, participant)
+	if err != nil {
+		return nil, fmt.Errorf("get user: %w", err)
+	}
+	if other == nil {
+		return nil, models.ErrUserNotFound
+	}
+
+	channelName := models.DirectChannelName(username, participant)
+	if err := dm.db.CreateDirectChannel(ctx, channelName, username, participant); err != nil {
+		return nil, err
+	}
+
+	conversations, err := dm.db.GetDirectConversations(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	for _, conversation := range conversations {
+		if conversation.ChannelName == channelName {
+			return conversation, nil
+		}
+	}
+	return nil, fmt.Errorf("direct conversation %s missing after creation", channelName)
+}
+
+func (dm *directManager) GetDirectConversations(ctx context.Context, username string) ([]*models.DirectConversation, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return dm.db.GetDirectConversations(ctx, username)
+}
+
+// MarkDirectConversationRead clears username's unread count for the conversation with participant
+func (dm *directManager) MarkDirectConversationRead(ctx context.Context, username, participant string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	channelName := models.DirectChannelName(username, participant)
+	readAt := time.Now().UTC()
+	if err := dm.db.MarkChannelRead(ctx, channelName, username, readAt); err != nil {
+		return err
+	}
+	return dm.db.MarkMentionsRead(ctx, channelName, username, readAt)
+}
+
+// GetDirectParticipants returns the two usernames of a direct channel
+func (dm *directManager) GetDirectParticipants(ctx context.Context, channelName string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	members, err := dm.db.GetChannelMembers(ctx, channelName)
+	if err != nil {
+		return nil, fmt.Errorf("get direct participants: %w", err)
+	}
+	if len(members) == 0 {
+		return nil, models.ErrChannelNotFound
+	}
+
+	usernames := make([]string, 0, len(members))
+	for _, member := range members {
+		usernames = append(usernames, member.Username)
+	}
+	return usernames, nil
+}
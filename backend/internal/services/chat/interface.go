@@ -5,14 +5,11 @@ import (
 	"mime/multipart"
 
 	"rtc-nb/backend/internal/models"
-
-	gorilla_websocket "github.com/gorilla/websocket"
 )
 
 type ChatManager interface {
 
 	// Connection operations (Service level operations)
-	GetUserConnection(username string) (*gorilla_websocket.Conn, bool)
 	ClearUserSession(ctx context.Context, username string) error
 
 	// User operations
@@ -29,11 +26,36 @@ type ChatManager interface {
 	DeleteChannel(ctx context.Context, channelName, username string) error
 	UpdateMemberRole(ctx context.Context, channelName, username string, isAdmin bool, updatedBy string) error
 	GetChannelMembers(ctx context.Context, channelName string) ([]*models.ChannelMember, error)
+	MarkMessageRead(ctx context.Context, channelName, username, messageID string) (int, error)
+	GetUnreadCounts(ctx context.Context, username string) (map[string]int, error)
+	GetChannelUnreadCounts(ctx context.Context, channelName string) (map[string]int, error)
+
+	// Direct conversation operations
+	OpenDirectConversation(ctx context.Context, username, participant string) (*models.DirectConversation, error)
+	GetDirectConversations(ctx context.Context, username string) ([]*models.DirectConversation, error)
+	MarkDirectConversationRead(ctx context.Context, username, participant string) error
+	GetDirectParticipants(ctx context.Context, channelName string) ([]string, error)
 
 	// File operations
 	HandleImageUpload(ctx context.Context, file multipart.File, header *multipart.FileHeader, channelName, username string) (interface{}, error)
 
 	// Message operations
 	BatchInsertMessages(ctx context.Context, messages []*models.Message) error
-	GetMessages(ctx context.Context, channelName string) ([]*models.Message, error)
+	GetMessages(ctx context.Context, channelName string, page models.MessagePageRequest) (*models.MessagePage, error)
+	EditMessage(ctx context.Context, channelName, messageID, username, text string) (*models.Message, error)
+	DeleteMessage(ctx context.Context, channelName, messageID, username string) (*models.Message, error)
+	ToggleReaction(ctx context.Context, channelName, messageID, username, emoji string) (*models.Reaction, error)
+	SearchMessages(ctx context.Context, channelName, username string, query models.MessageSearchQuery) (*models.MessageSearchResult, error)
+	GetThread(ctx context.Context, channelName, messageID, username string, page models.MessagePageRequest) (*models.MessageThread, error)
+	NextChannelSeq(ctx context.Context, channelName string) (int64, error)
+	GetMessagesSince(ctx context.Context, channelName string, since int64) ([]*models.Message, error)
+
+	// Pin operations
+	PinMessage(ctx context.Context, channelName, messageID, username string) (*models.Message, error)
+	UnpinMessage(ctx context.Context, channelName, messageID, username string) error
+	GetPinnedMessages(ctx context.Context, channelName, username string) ([]*models.PinnedMessage, error)
+
+	// Mention operations
+	CreateMentions(ctx context.Context, mentions []*models.Mention) error
+	GetUnreadMentions(ctx context.Context, username string, limit int) ([]*models.Mention, error)
 }
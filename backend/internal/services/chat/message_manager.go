@@ -2,6 +2,7 @@ package chat
 
 import (
 	"context"
+	"fmt"
 	"rtc-nb/backend/internal/connections"
 	"rtc-nb/backend/internal/models"
 	"rtc-nb/backend/internal/store/database"
@@ -11,12 +12,14 @@ import (
 type messageManager struct {
 	db      *database.Store
 	connMgr connections.Manager
+	seqs    *seqAllocator
 }
 
-func NewMessageManager(db *database.Store, connMgr connections.Manager) *messageManager {
+func NewMessageManager(db *database.Store, connMgr connections.Manager, seqBlockSize int) *messageManager {
 	return &messageManager{
 		db:      db,
 		connMgr: connMgr,
+		seqs:    newSeqAllocator(seqBlockSize, db.ReserveChannelSeqs),
 	}
 }
 
@@ -26,8 +29,294 @@ func (mm *messageManager) BatchInsertMessages(ctx context.Context, messages []*m
 	return mm.db.BatchInsertMessages(ctx, messages)
 }
 
-func (mm *messageManager) GetMessages(ctx context.Context, channelName string) ([]*models.Message, error) {
+// GetMessages returns a page of channel history, clamping the limit to sane bounds.
+func (mm *messageManager) GetMessages(ctx context.Context, channelName string, page models.MessagePageRequest) (*models.MessagePage, error) {
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
-	return mm.db.GetMessages(ctx, channelName)
+
+	if page.Before != nil && page.After != nil {
+		return nil, fmt.Errorf("only one of before or after may be set")
+	}
+	if page.Limit <= 0 {
+		page.Limit = models.DefaultMessagePageSize
+	}
+	if page.Limit > models.MaxMessagePageSize {
+		page.Limit = models.MaxMessagePageSize
+	}
+	return mm.db.GetMessages(ctx, channelName, page)
+}
+
+// EditMessage replaces the text of a persisted text message.
+// Only the author or a channel admin may edit.
+func (mm *messageManager) EditMessage(ctx context.Context, channelName, messageID, username, text string) (*models.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	msg, err := mm.authorizeModification(ctx, channelName, messageID, username)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Type != models.MessageTypeText {
+		return nil, models.ErrMessageNotModifiable
+	}
+
+	editedAt := time.Now().UTC()
+	if err := mm.db.UpdateMessageText(ctx, messageID, text, editedAt); err != nil {
+		return nil, err
+	}
+	msg.Content.Text = &text
+	msg.EditedAt = &editedAt
+	return msg, nil
+}
+
+// DeleteMessage soft-deletes a persisted message.
+// Only the author or a channel admin may delete.
+func (mm *messageManager) DeleteMessage(ctx context.Context, channelName, messageID, username string) (*models.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	msg, err := mm.authorizeModification(ctx, channelName, messageID, username)
+	if err != nil {
+		return nil, err
+	}
+
+	deletedAt := time.Now().UTC()
+	if err := mm.db.SoftDeleteMessage(ctx, messageID, deletedAt); err != nil {
+		return nil, err
+	}
+	msg.Content = models.MessageContent{}
+	msg.DeletedAt = &deletedAt
+	return msg, nil
+}
+
+// ToggleReaction flips username's emoji reaction on a persisted, non-deleted message in channelName.
+func (mm *messageManager) ToggleReaction(ctx context.Context, channelName, messageID, username, emoji string) (*models.Reaction, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	msg, err := mm.db.GetMessage(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil || msg.ChannelName != channelName {
+		return nil, models.ErrMessageNotFound
+	}
+	if msg.DeletedAt != nil {
+		return nil, models.ErrMessageNotModifiable
+	}
+
+	added, count, err := mm.db.ToggleReaction(ctx, messageID, username, emoji)
+	if err != nil {
+		return nil, err
+	}
+
+	action := "removed"
+	if added {
+		action = "added"
+	}
+	return &models.Reaction{MessageID: messageID, Emoji: emoji, Action: action, Count: count}, nil
+}
+
+// SearchMessages runs a full-text search in channelName on behalf of username.
+// Private channel history is only searchable by members.
+func (mm *messageManager) SearchMessages(ctx context.Context, channelName, username string, query models.MessageSearchQuery) (*models.MessageSearchResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	if err := mm.authorizeRead(ctx, channelName, username); err != nil {
+		return nil, err
+	}
+
+	if query.Limit <= 0 {
+		query.Limit = models.DefaultMessagePageSize
+	}
+	if query.Limit > models.MaxMessagePageSize {
+		query.Limit = models.MaxMessagePageSize
+	}
+	return mm.db.SearchMessages(ctx, channelName, query)
+}
+
+// authorizeRead checks that channelName exists and, if it is private, that username belongs to it
+func (mm *messageManager) authorizeRead(ctx context.Context, channelName, username string) error {
+	channel, err := mm.db.GetChannel(ctx, channelName)
+	if err != nil {
+		return fmt.Errorf("get channel: %w", err)
+	}
+	if channel == nil {
+		return models.ErrChannelNotFound
+	}
+	if channel.IsPrivate {
+		isMember, err := mm.db.IsChannelMember(ctx, channelName, username)
+		if err != nil {
+			return err
+		}
+		if !isMember {
+			return models.ErrNotChannelMember
+		}
+	}
+	return nil
+}
+
+func (mm *messageManager) authorizeModification(ctx context.Context, channelName, messageID, username string) (*models.Message, error) {
+	msg, err := mm.db.GetMessage(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil || msg.ChannelName != channelName {
+		return nil, models.ErrMessageNotFound
+	}
+	if msg.DeletedAt != nil {
+		return nil, models.ErrMessageNotModifiable
+	}
+
+	if msg.Username == username {
+		return msg, nil
+	}
+	isAdmin, err := mm.db.IsUserAdmin(ctx, channelName, username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check admin status: %w", err)
+	}
+	if !isAdmin {
+		return nil, models.ErrNotMessageOwner
+	}
+	return msg, nil
+}
+
+// GetThread returns a thread root and a forward page of its replies.
+// Asking for a reply's thread resolves to the thread it belongs to.
+func (mm *messageManager) GetThread(ctx context.Context, channelName, messageID, username string, page models.MessagePageRequest) (*models.MessageThread, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	if err := mm.authorizeRead(ctx, channelName, username); err != nil {
+		return nil, err
+	}
+
+	if page.Before != nil {
+		return nil, fmt.Errorf("threads can only be paged forward")
+	}
+	if page.Limit <= 0 {
+		page.Limit = models.DefaultMessagePageSize
+	}
+	if page.Limit > models.MaxMessagePageSize {
+		page.Limit = models.MaxMessagePageSize
+	}
+
+	root, err := mm.db.GetMessage(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if root != nil && root.ReplyTo != nil {
+		root, err = mm.db.GetMessage(ctx, *root.ReplyTo)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if root == nil || root.ChannelName != channelName {
+		return nil, models.ErrMessageNotFound
+	}
+
+	replies, err := mm.db.GetThreadReplies(ctx, root.ID, page)
+	if err != nil {
+		return nil, err
+	}
+	return &models.MessageThread{Root: root, Replies: replies}, nil
+}
+
+// CreateMentions records mentions found in a text message
+func (mm *messageManager) CreateMentions(ctx context.Context, mentions []*models.Mention) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return mm.db.CreateMentions(ctx, mentions)
+}
+
+// GetUnreadMentions lists username's unread mentions, newest first
+func (mm *messageManager) GetUnreadMentions(ctx context.Context, username string, limit int) ([]*models.Mention, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if limit <= 0 || limit > models.MaxMentionsPageSize {
+		limit = models.MaxMentionsPageSize
+	}
+	return mm.db.GetUnreadMentions(ctx, username, limit)
+}
+
+// PinMessage pins a persisted message to its channel and returns it. Only channel admins may pin.
+func (mm *messageManager) PinMessage(ctx context.Context, channelName, messageID, username string) (*models.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if err := mm.requireAdmin(ctx, channelName, username); err != nil {
+		return nil, err
+	}
+
+	msg, err := mm.db.GetMessage(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil || msg.ChannelName != channelName {
+		return nil, models.ErrMessageNotFound
+	}
+	if msg.DeletedAt != nil {
+		return nil, models.ErrMessageNotModifiable
+	}
+
+	count, err := mm.db.CountPinnedMessages(ctx, channelName)
+	if err != nil {
+		return nil, err
+	}
+	if count >= models.MaxPinnedMessages {
+		return nil, models.ErrPinLimitReached
+	}
+
+	if err := mm.db.PinMessage(ctx, channelName, messageID, username, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// UnpinMessage removes a pin. Only channel admins may unpin.
+func (mm *messageManager) UnpinMessage(ctx context.Context, channelName, messageID, username string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if err := mm.requireAdmin(ctx, channelName, username); err != nil {
+		return err
+	}
+	return mm.db.UnpinMessage(ctx, channelName, messageID)
+}
+
+func (mm *messageManager) GetPinnedMessages(ctx context.Context, channelName, username string) ([]*models.PinnedMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if err := mm.authorizeRead(ctx, channelName, username); err != nil {
+		return nil, err
+	}
+	return mm.db.GetPinnedMessages(ctx, channelName)
+}
+
+func (mm *messageManager) requireAdmin(ctx context.Context, channelName, username string) error {
+	isAdmin, err := mm.db.IsUserAdmin(ctx, channelName, username)
+	if err != nil {
+		return fmt.Errorf("failed to check admin status: %w", err)
+	}
+	if !isAdmin {
+		return models.ErrNotChannelAdmin
+	}
+	return nil
+}
+
+// NextChannelSeq hands out the delivery sequence number for the next persisted message in channelName
+func (mm *messageManager) NextChannelSeq(ctx context.Context, channelName string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return mm.seqs.next(ctx, channelName)
+}
+
+// GetMessagesSince returns persisted messages after seq since, oldest first, for replay on reconnect
+func (mm *messageManager) GetMessagesSince(ctx context.Context, channelName string, since int64) ([]*models.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return mm.db.GetMessagesSince(ctx, channelName, since, models.MaxReplayMessages)
 }
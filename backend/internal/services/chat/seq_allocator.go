@@ -0,0 +1,70 @@
+package chat
+
+import (
+	"context"
+	"sync"
+)
+
+// DefaultSeqBlockSize is how many sequence numbers a single node reserves per channel at a time
+const DefaultSeqBlockSize = 64
+
+// seqBlock is the unused part of a channel's reserved range, next through last inclusive
+type seqBlock struct {
+	mu   sync.Mutex
+	next int64
+	last int64
+}
+
+// seqAllocator hands out channel sequence numbers from ranges reserved in the database,
+// so only one message in blockSize pays for a round trip. Numbers left in a range when
+// the process stops are never used, so a channel's seqs can have gaps.
+//
+// Replay sends a client the messages numbered above the last one it saw, so numbers must rise in
+// the order messages are sent. Within one process they do. Nodes sharing a channel through a broker
+// would each draw from their own range, numbering a later message below an earlier one from another
+// node, so they must use a block size of 1.
+type seqAllocator struct {
+	blockSize int64
+	reserve   func(ctx context.Context, channelName string, count, floor int64) (int64, error)
+
+	mu     sync.Mutex
+	blocks map[string]*seqBlock
+}
+
+func newSeqAllocator(blockSize int, reserve func(ctx context.Context, channelName string, count, floor int64) (int64, error)) *seqAllocator {
+	if blockSize <= 0 {
+		blockSize = DefaultSeqBlockSize
+	}
+	return &seqAllocator{
+		blockSize: int64(blockSize),
+		reserve:   reserve,
+		blocks:    make(map[string]*seqBlock),
+	}
+}
+
+// next returns channelName's next sequence number, reserving a new range when the current one runs out
+func (sa *seqAllocator) next(ctx context.Context, channelName string) (int64, error) {
+	sa.mu.Lock()
+	block, ok := sa.blocks[channelName]
+	if !ok {
+		block = &seqBlock{}
+		sa.blocks[channelName] = block
+	}
+	sa.mu.Unlock()
+
+	block.mu.Lock()
+	defer block.mu.Unlock()
+
+	if block.next == 0 || block.next > block.last {
+		// The floor keeps numbers rising even if the channel row was recreated with a lower last_seq
+		last, err := sa.reserve(ctx, channelName, sa.blockSize, block.last)
+		if err != nil {
+			return 0, err
+		}
+		block.next = last - sa.blockSize + 1
+		block.last = last
+	}
+	seq := block.next
+	block.next++
+	return seq, nil
+}
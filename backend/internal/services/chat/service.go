@@ -2,7 +2,6 @@ package chat
 
 import (
 	"context"
-	"time"
 
 	// Image packages for decoding
 	_ "image/gif"
@@ -12,8 +11,6 @@ import (
 	"rtc-nb/backend/internal/connections"
 	"rtc-nb/backend/internal/store/database"
 	"rtc-nb/backend/internal/store/storage"
-
-	gorilla_websocket "github.com/gorilla/websocket"
 )
 
 type Service struct {
@@ -21,38 +18,29 @@ type Service struct {
 	userManager
 	messageManager
 	attachmentManager
+	directManager
 	dbStore    *database.Store
 	fileStorer storage.FileStorer
 	connMgr    connections.Manager
 }
 
-func NewService(dbStore *database.Store, fileStorer storage.FileStorer, connMgr connections.Manager) *Service {
+// NewService builds the chat service; seqBlockSize is how many channel sequence numbers are reserved
+// per database round trip, zero for DefaultSeqBlockSize
+func NewService(dbStore *database.Store, fileStorer storage.FileStorer, connMgr connections.Manager, seqBlockSize int) *Service {
 	return &Service{
 		channelManager:    *NewChannelManager(dbStore, connMgr),
 		userManager:       *NewUserManager(dbStore),
-		messageManager:    *NewMessageManager(dbStore, connMgr),
+		messageManager:    *NewMessageManager(dbStore, connMgr, seqBlockSize),
 		attachmentManager: *NewAttachmentManager(dbStore, fileStorer),
+		directManager:     *NewDirectManager(dbStore),
 		dbStore:           dbStore,
 		fileStorer:        fileStorer,
 		connMgr:           connMgr,
 	}
 }
 
-func (cs *Service) GetUserConnection(username string) (*gorilla_websocket.Conn, bool) {
-	return cs.connMgr.GetConnection(username)
-}
-
-// ClearUserSession clears user session data
+// ClearUserSession closes every websocket session of the user
 func (cs *Service) ClearUserSession(ctx context.Context, username string) error {
-	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
-	if conn, exists := cs.connMgr.GetConnection(username); exists {
-		cs.connMgr.RemoveConnection(username)
-		userChannel, err := cs.dbStore.GetUserChannel(ctx, username)
-		if err != nil {
-			return err
-		}
-		cs.connMgr.RemoveClientFromChannel(userChannel, conn)
-	}
+	cs.connMgr.RemoveUserConnections(username)
 	return nil
 }
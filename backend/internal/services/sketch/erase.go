@@ -0,0 +1,186 @@
+package sketch
+
+import (
+	"image"
+	"math"
+
+	"rtc-nb/backend/internal/models"
+)
+
+// eraseResult reports what eraseStrokes took out of a layer
+type eraseResult struct {
+	removed    int
+	strokeIDs  []string                 // IDs of the removed paths that had one
+	regions    []models.Region          // Regions that lost paths without IDs, as they are now; empty if dropped
+	operations map[string]models.Region // Logged strokes that lost paths, with the paths they have left
+}
+
+// eraseStrokes removes the paths named in ids, and the drawn paths any eraser touches, from a layer's
+// regions. Pixel-erasing paths are only removed by ID, since taking them out brings back what they erased.
+func eraseStrokes(regions map[string]models.Region, ids map[string]bool, erasers []models.DrawPath) eraseResult {
+	result := eraseResult{operations: make(map[string]models.Region)}
+	for key, region := range regions {
+		kept := make([]models.DrawPath, 0, len(region.Paths))
+		touchedOps := make(map[string]bool)
+		lostUnnamed := false
+		for _, path := range region.Paths {
+			if !ids[path.ID] && !(path.IsDrawing && touchesAny(path, erasers)) {
+				kept = append(kept, path)
+				continue
+			}
+			result.removed++
+			if path.ID != "" {
+				result.strokeIDs = append(result.strokeIDs, path.ID)
+			} else {
+				lostUnnamed = true
+			}
+			if path.OperationID != "" {
+				touchedOps[path.OperationID] = true
+			}
+		}
+		if len(kept) == len(region.Paths) {
+			continue
+		}
+
+		region.Paths = kept
+		if len(kept) == 0 {
+			delete(regions, key)
+		} else {
+			regions[key] = region
+		}
+		// Clients can't name paths stored before paths had IDs, so they get the whole region instead
+		if lostUnnamed {
+			result.regions = append(result.regions, region)
+		}
+		for opID := range touchedOps {
+			remaining := models.Region{Start: region.Start, End: region.End, Paths: []models.DrawPath{}}
+			for _, path := range kept {
+				if path.OperationID == opID {
+					remaining.Paths = append(remaining.Paths, path)
+				}
+			}
+			result.operations[opID] = remaining
+		}
+	}
+	return result
+}
+
+func touchesAny(path models.DrawPath, erasers []models.DrawPath) bool {
+	for _, eraser := range erasers {
+		if touches(path, eraser) {
+			return true
+		}
+	}
+	return false
+}
+
+// touches reports whether an eraser path comes within reach of a path's stroke, or enters its filled area
+func touches(path, eraser models.DrawPath) bool {
+	lines, area, reach := hitShape(path)
+	reach += strokeRadius(eraser)
+	eraserLines := strokeLines(eraser)
+
+	for _, line := range lines {
+		for i := range segmentCount(line) {
+			a, b := segment(line, i)
+			for _, eraserLine := range eraserLines {
+				for j := range segmentCount(eraserLine) {
+					c, d := segment(eraserLine, j)
+					if segmentDistance(a, b, c, d) <= reach {
+						return true
+					}
+				}
+			}
+		}
+	}
+
+	if area != nil {
+		for _, eraserLine := range eraserLines {
+			for _, p := range eraserLine {
+				if insidePolygon(p, area) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// hitShape returns the lines of a path an eraser can touch, the area inside it that counts as the path
+// (nil if none), and how far from its lines the path extends
+func hitShape(path models.DrawPath) ([][]vec, []vec, float64) {
+	if path.Kind == models.DrawPathKindText {
+		r := textBounds(path)
+		area := []vec{
+			{float64(r.Min.X), float64(r.Min.Y)}, {float64(r.Max.X), float64(r.Min.Y)},
+			{float64(r.Max.X), float64(r.Max.Y)}, {float64(r.Min.X), float64(r.Max.Y)},
+		}
+		return [][]vec{append(area, area[0])}, area, 0
+	}
+
+	var area []vec
+	if path.Fill != "" {
+		area = fillOutline(path)
+	}
+	return strokeLines(path), area, strokeRadius(path)
+}
+
+// textBounds is the rectangle a text element's lines cover
+func textBounds(path models.DrawPath) image.Rectangle {
+	origin := path.Points[0]
+	size := textSize(path)
+	return image.Rect(origin.X, origin.Y, origin.X+size.X, origin.Y+size.Y)
+}
+
+// segmentCount is how many segments a polyline has; a single point counts as one
+func segmentCount(line []vec) int {
+	return max(len(line)-1, 1)
+}
+
+func segment(line []vec, i int) (vec, vec) {
+	if len(line) == 1 {
+		return line[0], line[0]
+	}
+	return line[i], line[i+1]
+}
+
+// segmentDistance is the shortest distance between segments ab and cd
+func segmentDistance(a, b, c, d vec) float64 {
+	if segmentsCross(a, b, c, d) {
+		return 0
+	}
+	return min(pointSegmentDistance(a, c, d), pointSegmentDistance(b, c, d), pointSegmentDistance(c, a, b), pointSegmentDistance(d, a, b))
+}
+
+func pointSegmentDistance(p, a, b vec) float64 {
+	dx, dy := b.x-a.x, b.y-a.y
+	t := 0.0
+	if lengthSq := dx*dx + dy*dy; lengthSq > 0 {
+		t = math.Max(0, math.Min(1, ((p.x-a.x)*dx+(p.y-a.y)*dy)/lengthSq))
+	}
+	return math.Hypot(p.x-(a.x+t*dx), p.y-(a.y+t*dy))
+}
+
+// segmentsCross reports whether ab and cd cross at a single point inside both
+func segmentsCross(a, b, c, d vec) bool {
+	d1, d2 := cross(c, d, a), cross(c, d, b)
+	d3, d4 := cross(a, b, c), cross(a, b, d)
+	return d1*d2 < 0 && d3*d4 < 0
+}
+
+// cross is positive when p lies left of the line from a to b, negative when right
+func cross(a, b, p vec) float64 {
+	return (b.x-a.x)*(p.y-a.y) - (b.y-a.y)*(p.x-a.x)
+}
+
+// insidePolygon tests p against a closed polygon with the even-odd rule
+func insidePolygon(p vec, polygon []vec) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a.y > p.y) != (b.y > p.y) && p.x < a.x+(p.y-a.y)*(b.x-a.x)/(b.y-a.y) {
+			inside = !inside
+		}
+	}
+	return inside
+}
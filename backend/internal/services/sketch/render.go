@@ -0,0 +1,493 @@
+package sketch
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"rtc-nb/backend/internal/models"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/vector"
+)
+
+// Export formats accepted by ExportSketch
+const (
+	ExportFormatPNG = "png"
+	ExportFormatSVG = "svg"
+)
+
+var ErrUnsupportedExportFormat = errors.New("unsupported export format, expected png or svg")
+
+// capSegments is how many edges approximate the round caps and joins of a stroke
+const capSegments = 16
+
+// ellipseSegments is how many edges approximate an ellipse
+const ellipseSegments = 64
+
+// minArrowHead is the shortest an arrow's barbs get, for thin arrows
+const minArrowHead = 10
+
+// ThumbnailWidth is the width of rendered sketch thumbnails; the height keeps the sketch's aspect ratio
+const ThumbnailWidth = 200
+
+// ExportContentType returns the MIME type of an export format
+func ExportContentType(format string) string {
+	if format == ExportFormatSVG {
+		return "image/svg+xml"
+	}
+	return "image/png"
+}
+
+// RenderPNG rasterizes a sketch the way the canvas draws it: round caps and joins, paths in order,
+// and erasing paths (IsDrawing false) clearing what is under them on their layer to transparent.
+// Hidden layers are left out.
+func RenderPNG(w io.Writer, sketch *models.Sketch) error {
+	if err := png.Encode(w, renderImage(sketch)); err != nil {
+		return fmt.Errorf("encode png: %w", err)
+	}
+	return nil
+}
+
+// RenderThumbnail rasterizes a sketch like RenderPNG and scales it down to ThumbnailWidth.
+// Sketches narrower than that are encoded at their own size.
+func RenderThumbnail(w io.Writer, sketch *models.Sketch) error {
+	img := renderImage(sketch)
+	if sketch.Width > ThumbnailWidth {
+		height := max(sketch.Height*ThumbnailWidth/sketch.Width, 1)
+		thumb := image.NewRGBA(image.Rect(0, 0, ThumbnailWidth, height))
+		xdraw.ApproxBiLinear.Scale(thumb, thumb.Rect, img, img.Bounds(), draw.Src, nil)
+		img = thumb
+	}
+	if err := png.Encode(w, img); err != nil {
+		return fmt.Errorf("encode thumbnail: %w", err)
+	}
+	return nil
+}
+
+func renderImage(sketch *models.Sketch) *image.RGBA {
+	bounds := image.Rect(0, 0, sketch.Width, sketch.Height)
+	layers := visibleLayers(sketch)
+	if len(layers) == 1 {
+		return renderLayer(bounds, layers[0])
+	}
+
+	// Each layer erases only its own paths, so layers are rendered apart and stacked
+	canvas := image.NewRGBA(bounds)
+	for _, regions := range layers {
+		draw.Draw(canvas, bounds, renderLayer(bounds, regions), image.Point{}, draw.Over)
+	}
+	return canvas
+}
+
+func renderLayer(rect image.Rectangle, regions map[string]models.Region) *image.RGBA {
+	canvas := image.NewRGBA(rect)
+	for _, path := range orderedPaths(regions) {
+		if len(path.Points) == 0 {
+			continue
+		}
+		if path.Kind == models.DrawPathKindText {
+			drawText(canvas, path)
+			continue
+		}
+		bounds := pathBounds(path).Intersect(canvas.Bounds())
+		if bounds.Empty() {
+			continue
+		}
+
+		if fill := fillOutline(path); fill != nil && path.Fill != "" {
+			z := vector.NewRasterizer(bounds.Dx(), bounds.Dy())
+			addPolygon(z, fill, bounds.Min)
+			drawMask(canvas, bounds, z, image.NewUniform(parseColor(path.Fill)))
+		}
+
+		// Rasterize the stroke into a mask covering only its bounding box
+		z := vector.NewRasterizer(bounds.Dx(), bounds.Dy())
+		for _, line := range strokeLines(path) {
+			addStroke(z, line, strokeRadius(path), bounds.Min)
+		}
+		if path.IsDrawing {
+			drawMask(canvas, bounds, z, image.NewUniform(parseColor(path.Color)))
+		} else {
+			eraseMask(canvas, bounds, z)
+		}
+	}
+	return canvas
+}
+
+// RenderSVG writes a sketch as SVG polylines, one group per visible layer. Erasing paths mask out
+// everything drawn before them on their layer.
+func RenderSVG(w io.Writer, sketch *models.Sketch) error {
+	var defs, layers strings.Builder
+	masks := 0
+	for _, regions := range visibleLayers(sketch) {
+		var body strings.Builder
+		for _, path := range orderedPaths(regions) {
+			if len(path.Points) == 0 {
+				continue
+			}
+			if path.IsDrawing {
+				body.WriteString(svgElement(path, path.Color))
+				continue
+			}
+
+			masks++
+			fmt.Fprintf(&defs, `<mask id="erase%d" maskUnits="userSpaceOnUse" x="0" y="0" width="%d" height="%d"><rect width="%d" height="%d" fill="white"/>%s</mask>`,
+				masks, sketch.Width, sketch.Height, sketch.Width, sketch.Height, svgElement(path, "#000000"))
+			wrapped := fmt.Sprintf(`<g mask="url(#erase%d)">%s</g>`, masks, body.String())
+			body.Reset()
+			body.WriteString(wrapped)
+		}
+		fmt.Fprintf(&layers, `<g>%s</g>`, body.String())
+	}
+
+	_, err := fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d"><defs>%s</defs>%s</svg>`,
+		sketch.Width, sketch.Height, sketch.Width, sketch.Height, defs.String(), layers.String())
+	return err
+}
+
+// visibleLayers returns the regions of the base layer and each visible layer, bottom to top
+func visibleLayers(sketch *models.Sketch) []map[string]models.Region {
+	layers := []map[string]models.Region{sketch.Regions}
+	for _, layer := range sketch.Layers {
+		if layer.Visible {
+			layers = append(layers, layer.Regions)
+		}
+	}
+	return layers
+}
+
+// orderedPaths flattens regions top to bottom, left to right, keeping each region's path order
+func orderedPaths(regionsByKey map[string]models.Region) []models.DrawPath {
+	regions := make([]models.Region, 0, len(regionsByKey))
+	for _, region := range regionsByKey {
+		regions = append(regions, region)
+	}
+	sort.Slice(regions, func(i, j int) bool {
+		if regions[i].Start.Y != regions[j].Start.Y {
+			return regions[i].Start.Y < regions[j].Start.Y
+		}
+		return regions[i].Start.X < regions[j].Start.X
+	})
+
+	var paths []models.DrawPath
+	for _, region := range regions {
+		paths = append(paths, region.Paths...)
+	}
+	return paths
+}
+
+// drawMask paints src over canvas through the shape rasterized in z, which covers bounds
+func drawMask(canvas *image.RGBA, bounds image.Rectangle, z *vector.Rasterizer, src image.Image) {
+	draw.DrawMask(canvas, bounds, src, image.Point{}, rasterMask(bounds, z), image.Point{}, draw.Over)
+}
+
+// eraseMask fades canvas towards transparent by the coverage of the shape rasterized in z,
+// like the canvas's destination-out compositing
+func eraseMask(canvas *image.RGBA, bounds image.Rectangle, z *vector.Rasterizer) {
+	mask := rasterMask(bounds, z)
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			a := mask.AlphaAt(x, y).A
+			if a == 0 {
+				continue
+			}
+			i := canvas.PixOffset(bounds.Min.X+x, bounds.Min.Y+y)
+			for c := i; c < i+4; c++ {
+				canvas.Pix[c] = uint8(uint32(canvas.Pix[c]) * uint32(0xff-a) / 0xff)
+			}
+		}
+	}
+}
+
+func rasterMask(bounds image.Rectangle, z *vector.Rasterizer) *image.Alpha {
+	mask := image.NewAlpha(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	z.Draw(mask, mask.Bounds(), image.Opaque, image.Point{})
+	return mask
+}
+
+// vec is a point in canvas coordinates
+type vec struct{ x, y float64 }
+
+func toVec(p models.Point) vec {
+	return vec{float64(p.X), float64(p.Y)}
+}
+
+// strokeLines returns the polylines a path's outline is stroked along
+func strokeLines(path models.DrawPath) [][]vec {
+	switch path.Kind {
+	case models.DrawPathKindRect, models.DrawPathKindEllipse:
+		outline := fillOutline(path)
+		return [][]vec{append(outline, outline[0])}
+	case models.DrawPathKindLine:
+		return [][]vec{{toVec(path.Points[0]), toVec(path.Points[1])}}
+	case models.DrawPathKindArrow:
+		from, to := toVec(path.Points[0]), toVec(path.Points[1])
+		lines := [][]vec{{from, to}}
+		if head := arrowHead(path, from, to); head != nil {
+			lines = append(lines, head)
+		}
+		return lines
+	default:
+		line := make([]vec, len(path.Points))
+		for i, p := range path.Points {
+			line[i] = toVec(p)
+		}
+		return [][]vec{line}
+	}
+}
+
+// fillOutline returns the closed outline of a rectangle or ellipse, or nil for other kinds
+func fillOutline(path models.DrawPath) []vec {
+	a, b := toVec(path.Points[0]), toVec(path.Points[len(path.Points)-1])
+	switch path.Kind {
+	case models.DrawPathKindRect:
+		return []vec{a, {b.x, a.y}, b, {a.x, b.y}}
+	case models.DrawPathKindEllipse:
+		cx, cy := (a.x+b.x)/2, (a.y+b.y)/2
+		rx, ry := math.Abs(b.x-a.x)/2, math.Abs(b.y-a.y)/2
+		outline := make([]vec, ellipseSegments)
+		for i := range outline {
+			angle := 2 * math.Pi * float64(i) / ellipseSegments
+			outline[i] = vec{cx + rx*math.Cos(angle), cy + ry*math.Sin(angle)}
+		}
+		return outline
+	default:
+		return nil
+	}
+}
+
+// arrowHead returns the two barbs of an arrow pointing at to, or nil if the arrow has no length
+func arrowHead(path models.DrawPath, from, to vec) []vec {
+	if from == to {
+		return nil
+	}
+	length := math.Max(3*float64(path.StrokeWidth), minArrowHead)
+	angle := math.Atan2(to.y-from.y, to.x-from.x)
+	barb := func(offset float64) vec {
+		return vec{to.x - length*math.Cos(angle+offset), to.y - length*math.Sin(angle+offset)}
+	}
+	return []vec{barb(math.Pi / 6), to, barb(-math.Pi / 6)}
+}
+
+func strokeRadius(path models.DrawPath) float64 {
+	return math.Max(float64(path.StrokeWidth), 1) / 2
+}
+
+// pathBounds is the pixel rectangle a path's stroke and fill can touch
+func pathBounds(path models.DrawPath) image.Rectangle {
+	r := int(math.Ceil(strokeRadius(path))) + 1
+	var bounds image.Rectangle
+	for _, line := range strokeLines(path) {
+		for _, p := range line {
+			x, y := int(math.Floor(p.x)), int(math.Floor(p.y))
+			bounds = bounds.Union(image.Rect(x, y, x+2, y+2))
+		}
+	}
+	return bounds.Inset(-r)
+}
+
+// addStroke outlines a round-capped polyline as a disc at every point and a rectangle along every
+// segment. All shapes wind the same way, so overlaps add up instead of cancelling out.
+func addStroke(z *vector.Rasterizer, line []vec, radius float64, origin image.Point) {
+	ox, oy := float64(origin.X), float64(origin.Y)
+
+	for _, p := range line {
+		cx, cy := p.x-ox, p.y-oy
+		z.MoveTo(float32(cx+radius), float32(cy))
+		for i := 1; i < capSegments; i++ {
+			angle := 2 * math.Pi * float64(i) / capSegments
+			z.LineTo(float32(cx+radius*math.Cos(angle)), float32(cy+radius*math.Sin(angle)))
+		}
+		z.ClosePath()
+	}
+
+	for i := 1; i < len(line); i++ {
+		ax, ay := line[i-1].x-ox, line[i-1].y-oy
+		bx, by := line[i].x-ox, line[i].y-oy
+		length := math.Hypot(bx-ax, by-ay)
+		if length == 0 {
+			continue
+		}
+		// Offset perpendicular to the segment, on the side that matches the discs' winding
+		nx, ny := -(by-ay)/length*radius, (bx-ax)/length*radius
+		z.MoveTo(float32(ax-nx), float32(ay-ny))
+		z.LineTo(float32(bx-nx), float32(by-ny))
+		z.LineTo(float32(bx+nx), float32(by+ny))
+		z.LineTo(float32(ax+nx), float32(ay+ny))
+		z.ClosePath()
+	}
+}
+
+// addPolygon adds a closed polygon for filling
+func addPolygon(z *vector.Rasterizer, outline []vec, origin image.Point) {
+	ox, oy := float64(origin.X), float64(origin.Y)
+	z.MoveTo(float32(outline[0].x-ox), float32(outline[0].y-oy))
+	for _, p := range outline[1:] {
+		z.LineTo(float32(p.x-ox), float32(p.y-oy))
+	}
+	z.ClosePath()
+}
+
+var (
+	labelFontOnce sync.Once
+	labelFont     *opentype.Font
+	labelFontErr  error
+)
+
+// labelFace returns the Go font at a text element's size. The caller closes it.
+func labelFace(path models.DrawPath) (font.Face, error) {
+	labelFontOnce.Do(func() {
+		labelFont, labelFontErr = opentype.Parse(goregular.TTF)
+	})
+	if labelFontErr != nil {
+		return nil, labelFontErr
+	}
+	return opentype.NewFace(labelFont, &opentype.FaceOptions{Size: float64(path.FontSize), DPI: 72, Hinting: font.HintingNone})
+}
+
+// textSize is the width of a text element's longest line and the height of all its lines
+func textSize(path models.DrawPath) image.Point {
+	face, err := labelFace(path)
+	if err != nil {
+		return image.Point{}
+	}
+	defer face.Close()
+
+	lines := strings.Split(path.Text, "\n")
+	var width fixed.Int26_6
+	for _, line := range lines {
+		width = max(width, font.MeasureString(face, line))
+	}
+	return image.Pt(width.Ceil(), (face.Metrics().Height * fixed.Int26_6(len(lines))).Ceil())
+}
+
+// drawText draws a text element's lines with their top-left corner at its point, in the Go font
+func drawText(canvas *image.RGBA, path models.DrawPath) {
+	face, err := labelFace(path)
+	if err != nil {
+		return
+	}
+	defer face.Close()
+
+	metrics := face.Metrics()
+	d := font.Drawer{Dst: canvas, Src: image.NewUniform(parseColor(path.Color)), Face: face}
+	origin := path.Points[0]
+	for i, line := range strings.Split(path.Text, "\n") {
+		d.Dot = fixed.P(origin.X, origin.Y)
+		d.Dot.Y += metrics.Ascent + fixed.Int26_6(i)*metrics.Height
+		d.DrawString(line)
+	}
+}
+
+// svgElement writes a path as SVG in the given stroke color
+func svgElement(path models.DrawPath, stroke string) string {
+	width := formatFloat(math.Max(float64(path.StrokeWidth), 1))
+	fill := "none"
+	if path.Fill != "" {
+		fill = svgColor(path.Fill)
+	}
+
+	switch path.Kind {
+	case models.DrawPathKindRect:
+		a, b := path.Points[0], path.Points[1]
+		return fmt.Sprintf(`<rect x="%d" y="%d" width="%d" height="%d" fill="%s" stroke="%s" stroke-width="%s" stroke-linejoin="round"/>`,
+			min(a.X, b.X), min(a.Y, b.Y), abs(b.X-a.X), abs(b.Y-a.Y), fill, svgColor(stroke), width)
+	case models.DrawPathKindEllipse:
+		a, b := toVec(path.Points[0]), toVec(path.Points[1])
+		return fmt.Sprintf(`<ellipse cx="%s" cy="%s" rx="%s" ry="%s" fill="%s" stroke="%s" stroke-width="%s"/>`,
+			formatFloat((a.x+b.x)/2), formatFloat((a.y+b.y)/2), formatFloat(math.Abs(b.x-a.x)/2), formatFloat(math.Abs(b.y-a.y)/2), fill, svgColor(stroke), width)
+	case models.DrawPathKindLine, models.DrawPathKindArrow:
+		var lines strings.Builder
+		for _, line := range strokeLines(path) {
+			lines.WriteString(svgPolyline(line, stroke, width))
+		}
+		return lines.String()
+	case models.DrawPathKindText:
+		p := path.Points[0]
+		var lines strings.Builder
+		for i, line := range strings.Split(path.Text, "\n") {
+			dy := "0"
+			if i > 0 {
+				dy = "1.2em"
+			}
+			fmt.Fprintf(&lines, `<tspan x="%d" dy="%s">%s</tspan>`, p.X, dy, html.EscapeString(line))
+		}
+		return fmt.Sprintf(`<text x="%d" y="%d" font-family="Go, sans-serif" font-size="%d" fill="%s" dominant-baseline="text-before-edge" xml:space="preserve">%s</text>`,
+			p.X, p.Y, path.FontSize, svgColor(stroke), lines.String())
+	}
+
+	if len(path.Points) == 1 {
+		p := path.Points[0]
+		return fmt.Sprintf(`<circle cx="%d" cy="%d" r="%s" fill="%s"/>`, p.X, p.Y, formatFloat(math.Max(float64(path.StrokeWidth), 1)/2), svgColor(stroke))
+	}
+	return svgPolyline(strokeLines(path)[0], stroke, width)
+}
+
+func svgPolyline(line []vec, stroke, width string) string {
+	points := make([]string, len(line))
+	for i, p := range line {
+		points[i] = formatFloat(p.x) + "," + formatFloat(p.y)
+	}
+	return fmt.Sprintf(`<polyline points="%s" fill="none" stroke="%s" stroke-width="%s" stroke-linecap="round" stroke-linejoin="round"/>`,
+		strings.Join(points, " "), svgColor(stroke), width)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// svgColor normalizes a path color the way parseColor reads it
+func svgColor(value string) string {
+	c := parseColor(value)
+	if c.A == 0xff {
+		return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+	}
+	return fmt.Sprintf("rgba(%d,%d,%d,%s)", c.R, c.G, c.B, formatFloat(float64(c.A)/0xff))
+}
+
+// formatFloat writes f with at most two decimals
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(math.Round(f*100)/100, 'f', -1, 64)
+}
+
+// parseColor reads the #rgb, #rrggbb and #rrggbbaa colors the color picker produces; anything else is black
+func parseColor(value string) color.NRGBA {
+	black := color.NRGBA{A: 0xff}
+	hex, ok := strings.CutPrefix(strings.TrimSpace(value), "#")
+	if !ok {
+		return black
+	}
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	if len(hex) != 8 {
+		return black
+	}
+
+	n, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return black
+	}
+	return color.NRGBA{R: uint8(n >> 24), G: uint8(n >> 16), B: uint8(n >> 8), A: uint8(n)}
+}
@@ -1,26 +1,278 @@
 package sketch
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
+	"database/sql"
+	"errors"
 	"fmt"
+	"log/slog"
 	"rtc-nb/backend/internal/auth"
 	"rtc-nb/backend/internal/connections"
 	"rtc-nb/backend/internal/models"
 	"rtc-nb/backend/internal/store/database"
+	"rtc-nb/backend/internal/store/storage"
+	"sort"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
 )
 
 const MaxSketchesPerChannel = 8
 
+const (
+	thumbnailDelay = 3 * time.Second     // Quiet period after the last change before a thumbnail is re-rendered
+	thumbnailDir   = "sketch-thumbnails" // File store directory for rendered thumbnails
+)
+
+const (
+	compactBatchSize = 20          // Sketches compacted per tick at most
+	compactIdle      = time.Minute // Sketches drawn on more recently wait for a later tick
+)
+
+// Config tunes how sketches are stored
+type Config struct {
+	SimplifyTolerance float64       // Pixels a freehand path may move when simplified before it is stored
+	CompactInterval   time.Duration // Time between compactions of the sketches changed since their last one
+}
+
+func DefaultConfig() Config {
+	return Config{
+		SimplifyTolerance: 1,
+		CompactInterval:   10 * time.Minute,
+	}
+}
+
 // TODO: More sophisticated error & context handling
 type Service struct {
-	dbStore *database.Store
-	connMgr connections.Manager
+	dbStore    *database.Store
+	fileStorer storage.FileStorer
+	connMgr    connections.Manager
+	config     Config
+
+	thumbMu      sync.Mutex             // Guards thumbTimers and closed
+	thumbTimers  map[string]*time.Timer // sketch ID -> pending thumbnail refresh
+	closed       bool
+	stop         chan struct{} // Closed by Close to end the compaction ticker
+	backgroundMu sync.Mutex    // Serializes thumbnail renders and compactions so they don't compete with the buffers for the database
+
+	// Layers as last read from the database, so checking every stroke frame against its layer's lock
+	// doesn't cost a query. Any change to a sketch's layers drops its entries and bumps layerVersion,
+	// which keeps a read that raced the change from caching what it saw.
+	layerMu      sync.Mutex
+	layerCache   map[string]map[string]*models.SketchLayer // sketch ID -> layer ID -> layer without its regions, nil if it doesn't exist
+	layerVersion uint64
+}
+
+func NewService(dbStore *database.Store, fileStorer storage.FileStorer, connMgr connections.Manager, config Config) *Service {
+	return &Service{
+		dbStore:     dbStore,
+		fileStorer:  fileStorer,
+		connMgr:     connMgr,
+		config:      config,
+		thumbTimers: make(map[string]*time.Timer),
+		stop:        make(chan struct{}),
+		layerCache:  make(map[string]map[string]*models.SketchLayer),
+	}
+}
+
+// ScheduleThumbnail re-renders a sketch's thumbnail once it has gone thumbnailDelay without changes.
+// Calling it again before then pushes the render back, so a burst of strokes renders once.
+func (s *Service) ScheduleThumbnail(sketchID string) {
+	s.thumbMu.Lock()
+	defer s.thumbMu.Unlock()
+	if s.closed {
+		return
+	}
+	if timer, ok := s.thumbTimers[sketchID]; ok {
+		timer.Reset(thumbnailDelay)
+		return
+	}
+	s.thumbTimers[sketchID] = time.AfterFunc(thumbnailDelay, func() {
+		s.thumbMu.Lock()
+		delete(s.thumbTimers, sketchID)
+		s.thumbMu.Unlock()
+		s.refreshThumbnail(sketchID)
+	})
+}
+
+// Close drops pending thumbnail refreshes, stops compacting, and waits for a running render or compaction
+// to finish. Thumbnails left stale are re-rendered on the sketch's next change.
+func (s *Service) Close() {
+	s.thumbMu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.stop)
+	}
+	for sketchID, timer := range s.thumbTimers {
+		timer.Stop()
+		delete(s.thumbTimers, sketchID)
+	}
+	s.thumbMu.Unlock()
+
+	s.backgroundMu.Lock()
+	defer s.backgroundMu.Unlock()
+}
+
+// refreshThumbnail renders a sketch's current state into a new thumbnail file and replaces the old one
+func (s *Service) refreshThumbnail(sketchID string) {
+	s.backgroundMu.Lock()
+	defer s.backgroundMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	sketch, err := s.dbStore.GetSketch(ctx, sketchID)
+	if err != nil {
+		slog.Error("Failed to load sketch for thumbnail", "sketchID", sketchID, "error", err)
+		return
+	}
+	if sketch == nil {
+		return // Deleted since the refresh was scheduled
+	}
+
+	var buf bytes.Buffer
+	if err := RenderThumbnail(&buf, sketch); err != nil {
+		slog.Error("Failed to render sketch thumbnail", "sketchID", sketchID, "error", err)
+		return
+	}
+	url, err := s.fileStorer.SaveFile(ctx, thumbnailDir, buf.Bytes(), ExportFormatPNG)
+	if err != nil {
+		slog.Error("Failed to save sketch thumbnail", "sketchID", sketchID, "error", err)
+		return
+	}
+	if err := s.dbStore.UpdateSketchThumbnail(ctx, sketchID, url); err != nil {
+		if !errors.Is(err, models.ErrSketchNotFound) {
+			slog.Error("Failed to update sketch thumbnail", "sketchID", sketchID, "error", err)
+		}
+		s.deleteThumbnail(ctx, url)
+		return
+	}
+	s.deleteThumbnail(ctx, sketch.ThumbnailURL)
+}
+
+// deleteThumbnail removes a thumbnail file; failures only leave an orphaned file behind
+func (s *Service) deleteThumbnail(ctx context.Context, url string) {
+	if url == "" {
+		return
+	}
+	if err := s.fileStorer.DeleteFile(ctx, url); err != nil {
+		slog.Warn("Failed to delete sketch thumbnail", "url", url, "error", err)
+	}
+}
+
+// StartCompactionTicker compacts the sketches changed since their last compaction every CompactInterval, until Close
+func (s *Service) StartCompactionTicker() {
+	ticker := time.NewTicker(s.config.CompactInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.compactPending()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// compactPending compacts a batch of sketches due for compaction; the rest wait for the next tick
+func (s *Service) compactPending() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	sketchIDs, err := s.dbStore.GetSketchesToCompact(ctx, compactIdle, compactBatchSize)
+	if err != nil {
+		slog.Error("Failed to find sketches to compact", "error", err)
+		return
+	}
+	for _, sketchID := range sketchIDs {
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		if err := s.compactSketch(ctx, sketchID); err != nil && !errors.Is(err, models.ErrSketchNotFound) {
+			slog.Error("Failed to compact sketch", "sketchID", sketchID, "error", err)
+		}
+	}
+}
+
+// compactSketch simplifies every freehand path of a sketch, drops its empty regions and rewrites it in the
+// current storage encoding, recording its stored size before and after. Paths stored before simplification
+// or the encoding shrink the most; the operation log keeps the strokes as they were logged.
+func (s *Service) compactSketch(ctx context.Context, sketchID string) error {
+	s.backgroundMu.Lock()
+	defer s.backgroundMu.Unlock()
+
+	tx, err := s.dbStore.BeginTx(ctx)
+	if err != nil {
+		return fmt.Errorf("begin transaction for compaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	sketchMeta, regionsJSON, err := s.dbStore.GetSketchForUpdate(ctx, tx, sketchID)
+	if err != nil {
+		return err
+	}
+	if sketchMeta == nil {
+		return models.ErrSketchNotFound
+	}
+	if sketchMeta.Regions, err = decodeRegions(sketchID, regionsJSON); err != nil {
+		return err
+	}
+	before, err := s.dbStore.GetSketchStoredSizeWithTx(ctx, tx, sketchID)
+	if err != nil {
+		return err
+	}
+
+	dropped := simplifyRegions(sketchMeta.Regions, s.config.SimplifyTolerance)
+	for i := range sketchMeta.Layers {
+		dropped += simplifyRegions(sketchMeta.Layers[i].Regions, s.config.SimplifyTolerance)
+	}
+	if err := s.dbStore.UpdateSketchWithTx(ctx, tx, sketchMeta); err != nil {
+		return err
+	}
+
+	after, err := s.dbStore.GetSketchStoredSizeWithTx(ctx, tx, sketchID)
+	if err != nil {
+		return err
+	}
+	if err := s.dbStore.SetSketchCompactedWithTx(ctx, tx, sketchID, before, after); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit compaction: %w", err)
+	}
+
+	slog.Debug("Compacted sketch", "sketchID", sketchID, "droppedPoints", dropped, "bytesBefore", before, "bytesAfter", after)
+	return nil
 }
 
-func NewService(dbStore *database.Store, connMgr connections.Manager) *Service {
-	return &Service{dbStore: dbStore, connMgr: connMgr}
+// GetStorageStats returns how much space a sketch takes in the database, and what its last compaction saved
+func (s *Service) GetStorageStats(ctx context.Context, sketch *models.Sketch) (*models.SketchStorageStats, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	stats, err := s.dbStore.GetSketchStorageStats(ctx, sketch.ID)
+	if err != nil {
+		return nil, err
+	}
+	if stats == nil {
+		return nil, models.ErrSketchNotFound
+	}
+
+	stats.Paths, stats.Points = countPoints(sketch.Regions)
+	for _, layer := range sketch.Layers {
+		paths, points := countPoints(layer.Regions)
+		stats.Paths += paths
+		stats.Points += points
+	}
+	return stats, nil
 }
 
 func (s *Service) CreateSketch(ctx context.Context, channelName, displayName string, width, height int, createdBy string) (*models.Sketch, error) {
@@ -72,44 +324,82 @@ func (s *Service) GetSketches(ctx context.Context, channelName string) ([]*model
 	return s.dbStore.GetSketches(ctx, channelName)
 }
 
-// ApplySketchUpdates atomically fetches a sketch, appends paths from commands, and updates it.
-func (s *Service) ApplySketchUpdates(ctx context.Context, sketchID string, commands []*models.SketchCommand) error {
+// ApplySketchUpdates atomically fetches a sketch, applies commands in order, and updates it.
+// Updates append their paths to their layer, simplified, logging the stroke when it carries an operation ID;
+// updates to missing layers, or locked layers their author does not own, are dropped. Undo and redo
+// rebuild the affected region, and erases remove strokes from their layer. It returns the undo, redo
+// and erase results for broadcasting.
+func (s *Service) ApplySketchUpdates(ctx context.Context, sketchID string, commands []*models.SketchCommand) ([]*models.SketchCommand, error) {
 	ctx, cancel := context.WithTimeout(ctx, 20*time.Second) // Increased timeout for Tx
 	defer cancel()
 
 	tx, err := s.dbStore.BeginTx(ctx)
 	if err != nil {
-		return fmt.Errorf("begin transaction for apply updates: %w", err)
+		return nil, fmt.Errorf("begin transaction for apply updates: %w", err)
 	}
 	defer tx.Rollback() // Rollback is safe even if Commit succeeds
 
 	// 1. Get sketch metadata and raw regions JSON, locking the row
 	sketchMeta, regionsJSON, err := s.dbStore.GetSketchForUpdate(ctx, tx, sketchID)
 	if err != nil {
-		return fmt.Errorf("get sketch for update failed: %w", err)
+		return nil, fmt.Errorf("get sketch for update failed: %w", err)
 	}
 	if sketchMeta == nil {
-		return fmt.Errorf("sketch %s not found during update", sketchID)
+		return nil, fmt.Errorf("sketch %s not found during update", sketchID)
 	}
 
 	// 2. Unmarshal current regions
-	currentRegions := make(map[string]models.Region)
-	if len(regionsJSON) > 0 && string(regionsJSON) != "null" { // Handle empty/null JSON
-		if err := json.Unmarshal(regionsJSON, &currentRegions); err != nil {
-			return fmt.Errorf("failed to unmarshal current regions for sketch %s: %w", sketchID, err)
-		}
+	currentRegions, err := decodeRegions(sketchID, regionsJSON)
+	if err != nil {
+		return nil, err
 	}
+	sketchMeta.Regions = currentRegions
 
-	// 3. Merge paths from commands
+	// 3. Merge paths from commands, undoing and redoing strokes along the way
+	var results []*models.SketchCommand
 	for _, cmd := range commands {
-		if cmd == nil || cmd.Region == nil {
+		if cmd == nil {
+			continue
+		}
+		if cmd.CommandType == models.SketchCommandTypeUndo || cmd.CommandType == models.SketchCommandTypeRedo {
+			result, err := s.applyUndoRedo(ctx, tx, sketchMeta, cmd)
+			if err != nil {
+				return nil, err
+			}
+			if result != nil {
+				results = append(results, result)
+			}
+			continue
+		}
+		if cmd.CommandType == models.SketchCommandTypeErase {
+			result, err := s.applyErase(ctx, tx, sketchMeta, cmd)
+			if err != nil {
+				return nil, err
+			}
+			if result != nil {
+				results = append(results, result)
+			}
+			continue
+		}
+		if cmd.Region == nil {
 			// log.Printf("Skipping nil command or region for sketch %s", sketchID)
 			continue
 		}
+		layerRegions := sketchMeta.LayerRegions(cmd.LayerID)
+		if layerRegions == nil {
+			slog.Warn("Dropping sketch update for missing layer", "sketchID", sketchID, "layerID", cmd.LayerID)
+			continue
+		}
+		if layer := sketchMeta.Layer(cmd.LayerID); layer != nil && !layer.CanDraw(cmd.Author) {
+			slog.Warn("Dropping sketch update for locked layer", "sketchID", sketchID, "layerID", cmd.LayerID, "author", cmd.Author)
+			continue
+		}
 		cmdRegion := cmd.Region
-		key := fmt.Sprintf("%d,%d", cmdRegion.Start.X, cmdRegion.Start.Y)
+		cmdRegion.AssignPathIDs()
+		simplifyRegion(cmdRegion, s.config.SimplifyTolerance)
+		key := models.RegionKey(cmdRegion.Start)
 
-		targetRegion, ok := currentRegions[key]
+		targetRegion, ok := layerRegions[key]
 		if !ok {
 			// If region doesn't exist in the map yet, create it.
 			targetRegion = models.Region{
@@ -122,6 +412,26 @@ func (s *Service) ApplySketchUpdates(ctx context.Context, sketchID string, comma
 			targetRegion.End = cmdRegion.End
 		}
 
+		// Paths are numbered in drawing order, so undo and redo can put them back where they were.
+		// Numbering follows the clock, so it stays ahead of the paths of a region emptied and dropped since.
+		seq := max(targetRegion.LastSeq, time.Now().UnixMicro())
+		for i := range cmdRegion.Paths {
+			seq++
+			cmdRegion.Paths[i].Seq = seq
+		}
+		targetRegion.LastSeq = seq
+
+		// Logged strokes tag their paths so undo can take them out again
+		if cmd.OperationID != "" {
+			for i := range cmdRegion.Paths {
+				cmdRegion.Paths[i].OperationID = cmd.OperationID
+			}
+			op := &models.SketchOperation{ID: cmd.OperationID, SketchID: sketchID, Username: cmd.Author, LayerID: cmd.LayerID, Region: *cmdRegion}
+			if err := s.dbStore.InsertSketchOperationWithTx(ctx, tx, op); err != nil {
+				return nil, err
+			}
+		}
+
 		// Append paths from the command to the target region
 		if len(cmdRegion.Paths) > 0 {
 			targetRegion.Paths = append(targetRegion.Paths, cmdRegion.Paths...)
@@ -130,30 +440,505 @@ func (s *Service) ApplySketchUpdates(ctx context.Context, sketchID string, comma
 			// log.Printf("Command for region %s sketch %s had no paths to append", key, sketchID)
 		}
 
-		currentRegions[key] = targetRegion
+		layerRegions[key] = targetRegion
 	}
 
-	// 4. Assign merged regions back to the sketch metadata object
-	sketchMeta.Regions = currentRegions
-
-	// Log before attempting the database update
+	// 4. The merged regions and layers are already in the sketch metadata object
 
 	// 5. Update the sketch in the database within the transaction
 	if err := s.dbStore.UpdateSketchWithTx(ctx, tx, sketchMeta); err != nil {
 		// Log includes sketchID and error already
-		return fmt.Errorf("update sketch with tx failed for sketch %s: %w", sketchID, err)
+		return nil, fmt.Errorf("update sketch with tx failed for sketch %s: %w", sketchID, err)
+	}
+
+	// 6. Snapshot the result if the sketch has not been versioned for a while
+	lastVersion, err := s.dbStore.GetLastSketchVersionTimeWithTx(ctx, tx, sketchID)
+	if err != nil {
+		return nil, err
+	}
+	if lastVersion == nil || time.Since(*lastVersion) >= models.SketchSnapshotInterval {
+		author := ""
+		if last := commands[len(commands)-1]; last != nil {
+			author = last.Author
+		}
+		version := models.NewSketchVersion(sketchID, currentRegions, sketchMeta.Layers, models.SketchVersionReasonAuto, author)
+		if err := s.dbStore.InsertSketchVersionWithTx(ctx, tx, version, models.MaxSketchVersions); err != nil {
+			return nil, err
+		}
 	}
 
-	// 6. Commit the transaction
+	// 7. Commit the transaction
 	if err := tx.Commit(); err != nil {
 		// log.Printf("ERROR: ApplySketchUpdates(%s): Failed to commit transaction: %v", sketchID, err)
-		return fmt.Errorf("failed to commit transaction: %w", err)
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
 	// log.Printf("Successfully applied %d commands for sketch %s", len(commands), sketchID)
+	return results, nil
+}
+
+// SnapshotSketch stores the sketch's current regions as a new version
+func (s *Service) SnapshotSketch(ctx context.Context, sketchID, username string) (*models.SketchVersion, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	tx, err := s.dbStore.BeginTx(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("begin transaction for snapshot: %w", err)
+	}
+	defer tx.Rollback()
+
+	sketchMeta, regionsJSON, err := s.dbStore.GetSketchForUpdate(ctx, tx, sketchID)
+	if err != nil {
+		return nil, fmt.Errorf("get sketch for snapshot failed: %w", err)
+	}
+	if sketchMeta == nil {
+		return nil, models.ErrSketchNotFound
+	}
+	regions, err := decodeRegions(sketchID, regionsJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	version := models.NewSketchVersion(sketchID, regions, sketchMeta.Layers, models.SketchVersionReasonManual, username)
+	if err := s.dbStore.InsertSketchVersionWithTx(ctx, tx, version, models.MaxSketchVersions); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return version, nil
+}
+
+// GetSketchVersions lists a sketch's versions, newest first, without their regions
+func (s *Service) GetSketchVersions(ctx context.Context, sketchID string) ([]*models.SketchVersion, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	return s.dbStore.GetSketchVersions(ctx, sketchID)
+}
+
+// GetSketchVersion returns a version of sketchID including its regions
+func (s *Service) GetSketchVersion(ctx context.Context, sketchID, versionID string) (*models.SketchVersion, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	if _, err := uuid.Parse(versionID); err != nil {
+		return nil, models.ErrSketchVersionNotFound
+	}
+
+	version, err := s.dbStore.GetSketchVersion(ctx, versionID)
+	if err != nil {
+		return nil, err
+	}
+	if version == nil || version.SketchID != sketchID {
+		return nil, models.ErrSketchVersionNotFound
+	}
+	return version, nil
+}
+
+// RestoreSketchVersion replaces the sketch's regions and layers with those of a version and returns the restored sketch.
+// The replaced state is snapshotted first so the restore can itself be reverted. Restored paths become the
+// new baseline: the operation log is emptied, so strokes from before the restore can no longer be undone.
+func (s *Service) RestoreSketchVersion(ctx context.Context, sketchID, versionID, username string) (*models.Sketch, error) {
+	version, err := s.GetSketchVersion(ctx, sketchID, versionID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	tx, err := s.dbStore.BeginTx(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("begin transaction for restore: %w", err)
+	}
+	defer tx.Rollback()
+
+	sketchMeta, regionsJSON, err := s.dbStore.GetSketchForUpdate(ctx, tx, sketchID)
+	if err != nil {
+		return nil, fmt.Errorf("get sketch for restore failed: %w", err)
+	}
+	if sketchMeta == nil {
+		return nil, models.ErrSketchNotFound
+	}
+	currentRegions, err := decodeRegions(sketchID, regionsJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	replaced := models.NewSketchVersion(sketchID, currentRegions, sketchMeta.Layers, models.SketchVersionReasonRestore, username)
+	if err := s.dbStore.InsertSketchVersionWithTx(ctx, tx, replaced, models.MaxSketchVersions); err != nil {
+		return nil, err
+	}
+
+	clearOperationIDs(version.Regions)
+	for _, layer := range version.Layers {
+		clearOperationIDs(layer.Regions)
+	}
+	sketchMeta.Regions = version.Regions
+	sketchMeta.Layers = version.Layers
+	if err := s.dbStore.UpdateSketchWithTx(ctx, tx, sketchMeta); err != nil {
+		return nil, fmt.Errorf("update sketch with tx failed for sketch %s: %w", sketchID, err)
+	}
+	if err := s.dbStore.DeleteSketchOperationsWithTx(ctx, tx, sketchID); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	s.forgetLayers(sketchID)
+	s.ScheduleThumbnail(sketchID)
+	return sketchMeta, nil
+}
+
+// clearOperationIDs detaches paths from the strokes that drew them, so undo leaves them in place
+func clearOperationIDs(regions map[string]models.Region) {
+	for key, region := range regions {
+		for i := range region.Paths {
+			region.Paths[i].OperationID = ""
+		}
+		regions[key] = region
+	}
+}
+
+// decodeRegions decodes a sketch's regions column, treating empty or null JSON as no regions
+func decodeRegions(sketchID string, regionsJSON []byte) (map[string]models.Region, error) {
+	if len(regionsJSON) == 0 || string(regionsJSON) == "null" {
+		return make(map[string]models.Region), nil
+	}
+	regions, err := database.DecodeSketchRegions(regionsJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode current regions for sketch %s: %w", sketchID, err)
+	}
+	return regions, nil
+}
+
+// applyUndoRedo undoes the author's latest stroke, or redoes the one they undid last, and rebuilds
+// its region on its layer. Authors may undo and redo their own strokes on layers locked since.
+// It returns the command to broadcast, or nil if there was nothing to do.
+func (s *Service) applyUndoRedo(ctx context.Context, tx *sql.Tx, sketch *models.Sketch, cmd *models.SketchCommand) (*models.SketchCommand, error) {
+	sketchID := sketch.ID
+	undo := cmd.CommandType == models.SketchCommandTypeUndo
+	op, err := s.dbStore.GetLastSketchOperationWithTx(ctx, tx, sketchID, cmd.Author, !undo)
+	if err != nil {
+		return nil, err
+	}
+	if op == nil {
+		return nil, nil
+	}
+	regions := sketch.LayerRegions(op.LayerID)
+	if regions == nil {
+		return nil, fmt.Errorf("sketch %s has no layer %s for operation %s", sketchID, op.LayerID, op.ID)
+	}
+	if err := s.dbStore.SetSketchOperationUndoneWithTx(ctx, tx, op.ID, undo); err != nil {
+		return nil, err
+	}
+
+	key := models.RegionKey(op.Region.Start)
+	active, err := s.dbStore.GetActiveSketchOperationsWithTx(ctx, tx, sketchID, op.LayerID, key)
+	if err != nil {
+		return nil, err
+	}
+	region := rebuildRegion(regions[key], op.Region.Start, op.Region.End, active)
+	if len(region.Paths) == 0 {
+		delete(regions, key)
+	} else {
+		regions[key] = region
+	}
+
+	return &models.SketchCommand{
+		CommandType: cmd.CommandType,
+		SketchID:    sketchID,
+		OperationID: op.ID,
+		Author:      op.Username,
+		Region:      &region,
+		LayerID:     op.LayerID,
+	}, nil
+}
+
+// rebuildRegion rebuilds a region from the paths in it that no logged stroke drew and the paths of the
+// strokes that are not undone, in the order they were drawn. Paths stored before paths were numbered
+// come first, unlogged ones ahead of logged ones in log order, as they were drawn before any numbered path.
+func rebuildRegion(current models.Region, start, end models.Point, active []*models.SketchOperation) models.Region {
+	region := models.Region{Start: start, End: end, LastSeq: current.LastSeq, Paths: []models.DrawPath{}}
+	for _, path := range current.Paths {
+		if path.OperationID == "" {
+			region.Paths = append(region.Paths, path)
+		}
+	}
+	for _, activeOp := range active {
+		region.Paths = append(region.Paths, activeOp.Region.Paths...)
+	}
+	sort.SliceStable(region.Paths, func(i, j int) bool { return region.Paths[i].Seq < region.Paths[j].Seq })
+	return region
+}
+
+// applyErase removes the strokes an erase command names, and the drawn paths its eraser paths touch,
+// from the command's layer, and takes them out of the operation log so undo cannot bring them back.
+// It returns the command to broadcast, or nil if nothing was erased.
+func (s *Service) applyErase(ctx context.Context, tx *sql.Tx, sketch *models.Sketch, cmd *models.SketchCommand) (*models.SketchCommand, error) {
+	regions := sketch.LayerRegions(cmd.LayerID)
+	if regions == nil {
+		slog.Warn("Dropping sketch erase for missing layer", "sketchID", sketch.ID, "layerID", cmd.LayerID)
+		return nil, nil
+	}
+	if layer := sketch.Layer(cmd.LayerID); layer != nil && !layer.CanDraw(cmd.Author) {
+		slog.Warn("Dropping sketch erase for locked layer", "sketchID", sketch.ID, "layerID", cmd.LayerID, "author", cmd.Author)
+		return nil, nil
+	}
+
+	ids := make(map[string]bool, len(cmd.StrokeIDs))
+	for _, id := range cmd.StrokeIDs {
+		if id != "" {
+			ids[id] = true
+		}
+	}
+	var erasers []models.DrawPath
+	if cmd.Region != nil {
+		erasers = cmd.Region.Paths
+	}
+
+	erased := eraseStrokes(regions, ids, erasers)
+	if erased.removed == 0 {
+		return nil, nil
+	}
+	for opID, region := range erased.operations {
+		if err := s.dbStore.UpdateSketchOperationRegionWithTx(ctx, tx, opID, region); err != nil {
+			return nil, err
+		}
+	}
+
+	return &models.SketchCommand{
+		CommandType: models.SketchCommandTypeErase,
+		SketchID:    sketch.ID,
+		Author:      cmd.Author,
+		LayerID:     cmd.LayerID,
+		StrokeIDs:   erased.strokeIDs,
+		Regions:     erased.regions,
+	}, nil
+}
+
+// CheckLayerWritable returns an error unless username may draw on a sketch layer. The base layer is always writable.
+func (s *Service) CheckLayerWritable(ctx context.Context, sketchID, layerID, username string) error {
+	if layerID == models.SketchBaseLayerID {
+		return nil
+	}
+
+	layer, err := s.getLayer(ctx, sketchID, layerID)
+	if err != nil {
+		return err
+	}
+	if layer == nil {
+		return models.ErrSketchLayerNotFound
+	}
+	if !layer.CanDraw(username) {
+		return models.ErrSketchLayerLocked
+	}
 	return nil
 }
 
+// getLayer returns a sketch layer, without its regions, from the cache, reading it from the database on a miss
+func (s *Service) getLayer(ctx context.Context, sketchID, layerID string) (*models.SketchLayer, error) {
+	s.layerMu.Lock()
+	layer, ok := s.layerCache[sketchID][layerID]
+	version := s.layerVersion
+	s.layerMu.Unlock()
+	if ok {
+		return layer, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	layer, err := s.dbStore.GetSketchLayer(ctx, sketchID, layerID)
+	if err != nil {
+		return nil, err
+	}
+	if layer != nil {
+		layer.Regions = nil // Only ownership and the lock are checked; the paths can be large
+	}
+
+	s.layerMu.Lock()
+	defer s.layerMu.Unlock()
+	if s.layerVersion == version {
+		if s.layerCache[sketchID] == nil {
+			s.layerCache[sketchID] = make(map[string]*models.SketchLayer)
+		}
+		s.layerCache[sketchID][layerID] = layer
+	}
+	return layer, nil
+}
+
+// forgetLayers drops a sketch's cached layers once they have changed
+func (s *Service) forgetLayers(sketchID string) {
+	s.layerMu.Lock()
+	defer s.layerMu.Unlock()
+	delete(s.layerCache, sketchID)
+	s.layerVersion++
+}
+
+// CreateLayer adds an empty, visible layer on top of the sketch's layers and returns the new layer structure
+func (s *Service) CreateLayer(ctx context.Context, sketchID, name, username string) ([]models.SketchLayer, error) {
+	name, err := validateLayerName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.updateLayers(ctx, sketchID, func(sketch *models.Sketch) error {
+		if len(sketch.Layers) >= models.MaxSketchLayers {
+			return models.ErrSketchLayerLimit
+		}
+		sketch.Layers = append(sketch.Layers, models.NewSketchLayer(name, username))
+		return nil
+	})
+}
+
+// UpdateLayer renames, shows or hides, and locks or unlocks a layer, returning the new layer structure.
+// Only the layer's owner may lock or unlock it, or change it while it is locked.
+func (s *Service) UpdateLayer(ctx context.Context, sketchID, layerID, username string, update models.SketchLayerUpdate) ([]models.SketchLayer, error) {
+	var name string
+	if update.Name != nil {
+		var err error
+		if name, err = validateLayerName(*update.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	return s.updateLayers(ctx, sketchID, func(sketch *models.Sketch) error {
+		layer := sketch.Layer(layerID)
+		if layer == nil {
+			return models.ErrSketchLayerNotFound
+		}
+		if layer.CreatedBy != username {
+			if update.Locked != nil {
+				return models.ErrSketchLayerNotOwner
+			}
+			if layer.Locked {
+				return models.ErrSketchLayerLocked
+			}
+		}
+
+		if update.Name != nil {
+			layer.Name = name
+		}
+		if update.Visible != nil {
+			layer.Visible = *update.Visible
+		}
+		if update.Locked != nil {
+			layer.Locked = *update.Locked
+		}
+		return nil
+	})
+}
+
+// ReorderLayers stacks the sketch's layers in the given order, bottom to top, and returns the new layer structure.
+// layerIDs must name every layer exactly once.
+func (s *Service) ReorderLayers(ctx context.Context, sketchID string, layerIDs []string) ([]models.SketchLayer, error) {
+	return s.updateLayers(ctx, sketchID, func(sketch *models.Sketch) error {
+		if len(layerIDs) != len(sketch.Layers) {
+			return models.ErrInvalidSketchLayerOrder
+		}
+		reordered := make([]models.SketchLayer, 0, len(layerIDs))
+		seen := make(map[string]bool, len(layerIDs))
+		for _, id := range layerIDs {
+			layer := sketch.Layer(id)
+			if layer == nil || seen[id] {
+				return models.ErrInvalidSketchLayerOrder
+			}
+			seen[id] = true
+			reordered = append(reordered, *layer)
+		}
+		sketch.Layers = reordered
+		return nil
+	})
+}
+
+// updateLayers applies change to a sketch locked for update, saves it and returns its layer structure
+func (s *Service) updateLayers(ctx context.Context, sketchID string, change func(sketch *models.Sketch) error) ([]models.SketchLayer, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	tx, err := s.dbStore.BeginTx(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("begin transaction for layer update: %w", err)
+	}
+	defer tx.Rollback()
+
+	sketchMeta, regionsJSON, err := s.dbStore.GetSketchForUpdate(ctx, tx, sketchID)
+	if err != nil {
+		return nil, fmt.Errorf("get sketch for layer update failed: %w", err)
+	}
+	if sketchMeta == nil {
+		return nil, models.ErrSketchNotFound
+	}
+	if sketchMeta.Regions, err = decodeRegions(sketchID, regionsJSON); err != nil {
+		return nil, err
+	}
+
+	if err := change(sketchMeta); err != nil {
+		return nil, err
+	}
+	if err := s.dbStore.UpdateSketchWithTx(ctx, tx, sketchMeta); err != nil {
+		return nil, fmt.Errorf("update sketch with tx failed for sketch %s: %w", sketchID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	s.forgetLayers(sketchID)
+
+	// Visibility and order change how the sketch renders
+	s.ScheduleThumbnail(sketchID)
+	return sketchMeta.LayerStructure(), nil
+}
+
+func validateLayerName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > models.MaxSketchLayerNameLen {
+		return "", models.ErrInvalidSketchLayerName
+	}
+	return name, nil
+}
+
+// ExportSketch renders a sketch as PNG or SVG
+func (s *Service) ExportSketch(ctx context.Context, sketchID, format string) ([]byte, error) {
+	sketch, err := s.GetSketch(ctx, sketchID)
+	if err != nil {
+		return nil, err
+	}
+	if sketch == nil {
+		return nil, models.ErrSketchNotFound
+	}
+
+	var buf bytes.Buffer
+	switch format {
+	case ExportFormatPNG:
+		err = RenderPNG(&buf, sketch)
+	case ExportFormatSVG:
+		err = RenderSVG(&buf, sketch)
+	default:
+		return nil, ErrUnsupportedExportFormat
+	}
+	if err != nil {
+		return nil, fmt.Errorf("render sketch %s: %w", sketchID, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// SaveSketchExport renders a sketch and stores it in the file store, returning the file's URL
+func (s *Service) SaveSketchExport(ctx context.Context, sketchID, format string) (string, error) {
+	data, err := s.ExportSketch(ctx, sketchID, format)
+	if err != nil {
+		return "", err
+	}
+	url, err := s.fileStorer.SaveFile(ctx, "exports", data, format)
+	if err != nil {
+		return "", fmt.Errorf("save sketch export: %w", err)
+	}
+	return url, nil
+}
+
 func (s *Service) DeleteSketch(ctx context.Context, ID string) error {
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
@@ -170,27 +955,27 @@ func (s *Service) DeleteSketch(ctx context.Context, ID string) error {
 	}
 
 	// Verify user is in the sketch's channel
-	userChannel, err := s.connMgr.GetUserChannel(claims.Username)
-	if err != nil || userChannel != sketch.ChannelName {
+	if !s.connMgr.IsUserInChannel(claims.Username, sketch.ChannelName) {
 		return fmt.Errorf("unauthorized")
 	}
 
-	// Check if user is the creator
-	if sketch.CreatedBy == claims.Username {
-		return s.dbStore.DeleteSketch(ctx, ID)
-	}
-
-	// If not creator, check if user is channel admin
-	isAdmin, err := s.dbStore.IsUserAdmin(ctx, sketch.ChannelName, claims.Username)
-	if err != nil {
-		return fmt.Errorf("failed to check admin status: %w", err)
+	// Only the creator or a channel admin may delete the sketch
+	if sketch.CreatedBy != claims.Username {
+		isAdmin, err := s.dbStore.IsUserAdmin(ctx, sketch.ChannelName, claims.Username)
+		if err != nil {
+			return fmt.Errorf("failed to check admin status: %w", err)
+		}
+		if !isAdmin {
+			return fmt.Errorf("unauthorized: only sketch creator or channel admin can delete sketches")
+		}
 	}
 
-	if isAdmin {
-		return s.dbStore.DeleteSketch(ctx, ID)
+	if err := s.dbStore.DeleteSketch(ctx, ID); err != nil {
+		return err
 	}
-
-	return fmt.Errorf("unauthorized: only sketch creator or channel admin can delete sketches")
+	s.forgetLayers(ID)
+	s.deleteThumbnail(ctx, sketch.ThumbnailURL)
+	return nil
 }
 
 func (s *Service) ClearSketch(ctx context.Context, ID string) error {
@@ -208,8 +993,7 @@ func (s *Service) ClearSketch(ctx context.Context, ID string) error {
 	}
 
 	// Verify user is in the sketch's channel
-	userChannel, err := s.connMgr.GetUserChannel(claims.Username)
-	if err != nil || userChannel != sketch.ChannelName {
+	if !s.connMgr.IsUserInChannel(claims.Username, sketch.ChannelName) {
 		return fmt.Errorf("unauthorized")
 	}
 
@@ -217,6 +1001,7 @@ func (s *Service) ClearSketch(ctx context.Context, ID string) error {
 	if err := s.dbStore.ClearSketchRegions(ctx, ID); err != nil {
 		return fmt.Errorf("failed to clear sketch regions: %w", err)
 	}
+	s.ScheduleThumbnail(ID)
 
 	return nil
 }
@@ -0,0 +1,83 @@
+package sketch
+
+import (
+	"rtc-nb/backend/internal/models"
+)
+
+// simplifyRegions simplifies the freehand paths of every region and drops regions left without paths.
+// It returns how many points were dropped.
+func simplifyRegions(regions map[string]models.Region, tolerance float64) int {
+	dropped := 0
+	for key, region := range regions {
+		if len(region.Paths) == 0 {
+			delete(regions, key)
+			continue
+		}
+		dropped += simplifyRegion(&region, tolerance)
+		regions[key] = region
+	}
+	return dropped
+}
+
+// simplifyRegion simplifies the freehand paths of a region in place and returns how many points were dropped.
+// Shapes and text keep their points, which define them exactly.
+func simplifyRegion(region *models.Region, tolerance float64) int {
+	dropped := 0
+	for i := range region.Paths {
+		path := &region.Paths[i]
+		if path.Kind != models.DrawPathKindFreehand {
+			continue
+		}
+		simplified := simplifyPoints(path.Points, tolerance)
+		dropped += len(path.Points) - len(simplified)
+		path.Points = simplified
+	}
+	return dropped
+}
+
+// simplifyPoints drops the points of a polyline that lie within tolerance pixels of the line kept in
+// their place (Ramer–Douglas–Peucker). The first and last points are always kept.
+func simplifyPoints(points []models.Point, tolerance float64) []models.Point {
+	if len(points) < 3 || tolerance <= 0 {
+		return points
+	}
+
+	keep := make([]bool, len(points))
+	keep[0], keep[len(points)-1] = true, true
+	spans := [][2]int{{0, len(points) - 1}}
+	for len(spans) > 0 {
+		first, last := spans[len(spans)-1][0], spans[len(spans)-1][1]
+		spans = spans[:len(spans)-1]
+
+		farthest, farthestDist := -1, tolerance
+		a, b := toVec(points[first]), toVec(points[last])
+		for i := first + 1; i < last; i++ {
+			if d := pointSegmentDistance(toVec(points[i]), a, b); d > farthestDist {
+				farthest, farthestDist = i, d
+			}
+		}
+		if farthest >= 0 {
+			keep[farthest] = true
+			spans = append(spans, [2]int{first, farthest}, [2]int{farthest, last})
+		}
+	}
+
+	simplified := make([]models.Point, 0, len(points))
+	for i, p := range points {
+		if keep[i] {
+			simplified = append(simplified, p)
+		}
+	}
+	return simplified
+}
+
+// countPoints returns how many paths and points the regions hold
+func countPoints(regions map[string]models.Region) (paths, points int) {
+	for _, region := range regions {
+		paths += len(region.Paths)
+		for _, path := range region.Paths {
+			points += len(path.Points)
+		}
+	}
+	return paths, points
+}
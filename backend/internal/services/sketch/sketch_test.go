@@ -0,0 +1,542 @@
+package sketch
+
+import (
+	"bytes"
+	"encoding/xml"
+	"image"
+	"image/color"
+	"image/png"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"rtc-nb/backend/internal/models"
+)
+
+func pts(coords ...int) []models.Point {
+	points := make([]models.Point, 0, len(coords)/2)
+	for i := 0; i+1 < len(coords); i += 2 {
+		points = append(points, models.Point{X: coords[i], Y: coords[i+1]})
+	}
+	return points
+}
+
+func TestSimplifyPoints(t *testing.T) {
+	tests := []struct {
+		name      string
+		points    []models.Point
+		tolerance float64
+		want      []models.Point
+	}{
+		{name: "empty", points: pts(), tolerance: 1, want: pts()},
+		{name: "single point", points: pts(5, 5), tolerance: 1, want: pts(5, 5)},
+		{name: "two points", points: pts(0, 0, 10, 10), tolerance: 1, want: pts(0, 0, 10, 10)},
+		{name: "straight line collapses to its endpoints", points: pts(0, 0, 1, 0, 2, 0, 3, 0, 4, 0), tolerance: 1, want: pts(0, 0, 4, 0)},
+		{name: "jitter within tolerance", points: pts(0, 0, 5, 1, 10, 0, 15, -1, 20, 0), tolerance: 1, want: pts(0, 0, 20, 0)},
+		{name: "jitter beyond tolerance", points: pts(0, 0, 5, 2, 10, 0), tolerance: 1, want: pts(0, 0, 5, 2, 10, 0)},
+		{name: "corner is kept", points: pts(0, 0, 5, 0, 10, 0, 10, 5, 10, 10), tolerance: 1, want: pts(0, 0, 10, 0, 10, 10)},
+		{name: "zero tolerance keeps everything", points: pts(0, 0, 1, 0, 2, 0), tolerance: 0, want: pts(0, 0, 1, 0, 2, 0)},
+		{name: "closed loop keeps its endpoints", points: pts(0, 0, 10, 0, 10, 10, 0, 10, 0, 0), tolerance: 1, want: pts(0, 0, 10, 0, 10, 10, 0, 10, 0, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := simplifyPoints(tt.points, tt.tolerance)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("simplifyPoints() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSimplifyRegions(t *testing.T) {
+	line := pts(0, 0, 1, 0, 2, 0, 3, 0)
+	regions := map[string]models.Region{
+		"0,0": {Paths: []models.DrawPath{
+			{Points: append([]models.Point(nil), line...)},
+			{Kind: models.DrawPathKindLine, Points: pts(0, 0, 3, 0)},
+			{Kind: models.DrawPathKindText, Points: pts(1, 1), Text: "hi"},
+		}},
+		"1,0": {Paths: []models.DrawPath{}},
+	}
+
+	dropped := simplifyRegions(regions, 1)
+	if dropped != 2 {
+		t.Errorf("dropped %d points, want 2", dropped)
+	}
+	if _, ok := regions["1,0"]; ok {
+		t.Errorf("region without paths was kept")
+	}
+	paths := regions["0,0"].Paths
+	if want := pts(0, 0, 3, 0); !reflect.DeepEqual(paths[0].Points, want) {
+		t.Errorf("freehand path = %v, want %v", paths[0].Points, want)
+	}
+	if want := pts(0, 0, 3, 0); !reflect.DeepEqual(paths[1].Points, want) {
+		t.Errorf("line = %v, want %v", paths[1].Points, want)
+	}
+	if want := pts(1, 1); !reflect.DeepEqual(paths[2].Points, want) {
+		t.Errorf("text = %v, want %v", paths[2].Points, want)
+	}
+
+	if gotPaths, gotPoints := countPoints(regions); gotPaths != 3 || gotPoints != 5 {
+		t.Errorf("countPoints() = %d, %d; want 3, 5", gotPaths, gotPoints)
+	}
+}
+
+func TestRebuildRegionKeepsDrawingOrder(t *testing.T) {
+	// Paths are told apart by color, as they carry nothing else of their own
+	path := func(color, opID string, seq int64, drawing bool) models.DrawPath {
+		return models.DrawPath{OperationID: opID, Seq: seq, IsDrawing: drawing, Points: pts(0, 0, 5, 5), StrokeWidth: 2, Color: color}
+	}
+	legacy := path("legacy", "", 0, true)
+	a := path("a", "op-a", 10, true)
+	eraser := path("eraser", "", 11, false) // Unlogged eraser between two logged strokes
+	b := path("b", "op-b", 12, true)
+	loggedEraser := path("logged-eraser", "op-e", 13, false)
+	c := path("c", "op-c", 14, true)
+
+	ops := map[string]*models.SketchOperation{}
+	for _, p := range []models.DrawPath{a, b, loggedEraser, c} {
+		ops[p.OperationID] = &models.SketchOperation{ID: p.OperationID, Region: models.Region{Paths: []models.DrawPath{p}}}
+	}
+	activeOps := func(ids ...string) []*models.SketchOperation {
+		active := make([]*models.SketchOperation, len(ids))
+		for i, id := range ids {
+			active[i] = ops[id]
+		}
+		return active
+	}
+	current := models.Region{Paths: []models.DrawPath{legacy, a, eraser, b, loggedEraser, c}, LastSeq: 14}
+
+	tests := []struct {
+		name   string
+		active []*models.SketchOperation
+		want   []string
+	}{
+		{name: "nothing undone", active: activeOps("op-a", "op-b", "op-e", "op-c"), want: []string{"legacy", "a", "eraser", "b", "logged-eraser", "c"}},
+		{name: "first stroke undone", active: activeOps("op-b", "op-e", "op-c"), want: []string{"legacy", "eraser", "b", "logged-eraser", "c"}},
+		{name: "logged eraser undone", active: activeOps("op-a", "op-b", "op-c"), want: []string{"legacy", "a", "eraser", "b", "c"}},
+		{name: "everything undone", active: activeOps(), want: []string{"legacy", "eraser"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Undo rebuilds from the current region; redo from the one the undo left behind
+			undone := rebuildRegion(current, current.Start, current.End, tt.active)
+			if got := pathColors(undone); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rebuilt region = %v, want %v", got, tt.want)
+			}
+			if undone.LastSeq != current.LastSeq {
+				t.Errorf("LastSeq = %d, want %d", undone.LastSeq, current.LastSeq)
+			}
+
+			redone := rebuildRegion(undone, current.Start, current.End, activeOps("op-a", "op-b", "op-e", "op-c"))
+			if got, want := pathColors(redone), pathColors(current); !reflect.DeepEqual(got, want) {
+				t.Errorf("region after redo = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func pathIDs(region models.Region) []string {
+	ids := make([]string, len(region.Paths))
+	for i, path := range region.Paths {
+		ids[i] = path.ID
+	}
+	return ids
+}
+
+func pathColors(region models.Region) []string {
+	colors := make([]string, len(region.Paths))
+	for i, path := range region.Paths {
+		colors[i] = path.Color
+	}
+	return colors
+}
+
+// renderSketch is a 40x40 sketch with the given base layer paths in a single region
+func renderSketch(paths ...models.DrawPath) *models.Sketch {
+	return &models.Sketch{
+		Width:   40,
+		Height:  40,
+		Regions: map[string]models.Region{"0,0": {Start: pts(0, 0)[0], End: pts(40, 40)[0], Paths: paths}},
+	}
+}
+
+func decodePNG(t *testing.T, sketch *models.Sketch) image.Image {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := RenderPNG(&buf, sketch); err != nil {
+		t.Fatalf("RenderPNG: %v", err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatalf("decode png: %v", err)
+	}
+	return img
+}
+
+func nrgbaAt(img image.Image, x, y int) color.NRGBA {
+	return color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+}
+
+func TestRenderPNG(t *testing.T) {
+	red := models.DrawPath{Points: pts(5, 10, 35, 10), IsDrawing: true, StrokeWidth: 4, Color: "#ff0000"}
+	eraser := models.DrawPath{Points: pts(20, 0, 20, 40), IsDrawing: false, StrokeWidth: 6}
+	box := models.DrawPath{Kind: models.DrawPathKindRect, Points: pts(5, 25, 15, 35), IsDrawing: true, StrokeWidth: 2, Color: "#0000ff", Fill: "#00ff00"}
+
+	tests := []struct {
+		name   string
+		sketch *models.Sketch
+		checks map[image.Point]color.NRGBA
+	}{
+		{
+			name:   "stroke",
+			sketch: renderSketch(red),
+			checks: map[image.Point]color.NRGBA{
+				{10, 10}: {R: 0xff, A: 0xff},
+				{10, 30}: {},
+			},
+		},
+		{
+			name:   "eraser clears what is under it",
+			sketch: renderSketch(red, eraser),
+			checks: map[image.Point]color.NRGBA{
+				{10, 10}: {R: 0xff, A: 0xff},
+				{20, 10}: {},
+				{30, 10}: {R: 0xff, A: 0xff},
+			},
+		},
+		{
+			name:   "strokes drawn after an eraser stay",
+			sketch: renderSketch(eraser, red),
+			checks: map[image.Point]color.NRGBA{
+				{20, 10}: {R: 0xff, A: 0xff},
+			},
+		},
+		{
+			name:   "filled rectangle",
+			sketch: renderSketch(box),
+			checks: map[image.Point]color.NRGBA{
+				{10, 30}: {G: 0xff, A: 0xff},
+				{5, 30}:  {B: 0xff, A: 0xff},
+				{25, 30}: {},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := decodePNG(t, tt.sketch)
+			if size := img.Bounds().Size(); size != image.Pt(40, 40) {
+				t.Fatalf("size = %v, want 40x40", size)
+			}
+			for p, want := range tt.checks {
+				if got := nrgbaAt(img, p.X, p.Y); got != want {
+					t.Errorf("pixel %v = %v, want %v", p, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderPNGLayers(t *testing.T) {
+	sketch := renderSketch(models.DrawPath{Points: pts(5, 10, 35, 10), IsDrawing: true, StrokeWidth: 4, Color: "#ff0000"})
+	layerRegions := func(paths ...models.DrawPath) map[string]models.Region {
+		return map[string]models.Region{"0,0": {Start: pts(0, 0)[0], End: pts(40, 40)[0], Paths: paths}}
+	}
+	sketch.Layers = []models.SketchLayer{
+		// An eraser on a layer leaves the layers beneath it alone
+		{ID: "top", Visible: true, Regions: layerRegions(
+			models.DrawPath{Points: pts(10, 30, 30, 30), IsDrawing: true, StrokeWidth: 4, Color: "#0000ff"},
+			models.DrawPath{Points: pts(20, 0, 20, 40), StrokeWidth: 6},
+		)},
+		{ID: "hidden", Visible: false, Regions: layerRegions(
+			models.DrawPath{Points: pts(5, 20, 35, 20), IsDrawing: true, StrokeWidth: 4, Color: "#00ff00"},
+		)},
+	}
+
+	img := decodePNG(t, sketch)
+	checks := map[image.Point]color.NRGBA{
+		{20, 10}: {R: 0xff, A: 0xff}, // Base stroke under the top layer's eraser
+		{12, 30}: {B: 0xff, A: 0xff}, // Top layer stroke
+		{20, 30}: {},                 // Erased on the top layer
+		{20, 20}: {},                 // Hidden layer
+	}
+	for p, want := range checks {
+		if got := nrgbaAt(img, p.X, p.Y); got != want {
+			t.Errorf("pixel %v = %v, want %v", p, got, want)
+		}
+	}
+}
+
+func TestRenderThumbnail(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		want          image.Point
+	}{
+		{name: "scaled down", width: 800, height: 400, want: image.Pt(ThumbnailWidth, 100)},
+		{name: "narrow sketch keeps its size", width: 120, height: 90, want: image.Pt(120, 90)},
+		{name: "very wide keeps one row", width: 4000, height: 5, want: image.Pt(ThumbnailWidth, 1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := RenderThumbnail(&buf, &models.Sketch{Width: tt.width, Height: tt.height}); err != nil {
+				t.Fatalf("RenderThumbnail: %v", err)
+			}
+			cfg, err := png.DecodeConfig(&buf)
+			if err != nil {
+				t.Fatalf("decode png: %v", err)
+			}
+			if got := image.Pt(cfg.Width, cfg.Height); got != tt.want {
+				t.Errorf("size = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderSVG(t *testing.T) {
+	sketch := renderSketch(
+		models.DrawPath{Points: pts(5, 10, 35, 10), IsDrawing: true, StrokeWidth: 4, Color: "#f00"},
+		models.DrawPath{Points: pts(20, 0, 20, 40), StrokeWidth: 6},
+		models.DrawPath{Kind: models.DrawPathKindText, Points: pts(2, 30), IsDrawing: true, Color: "#0000ff80", Text: "a<b\n& c", FontSize: 12},
+	)
+	sketch.Layers = []models.SketchLayer{
+		{ID: "hidden", Visible: false, Regions: map[string]models.Region{"0,0": {Paths: []models.DrawPath{
+			{Points: pts(1, 1, 2, 2), IsDrawing: true, StrokeWidth: 1, Color: "#123456"},
+		}}}},
+	}
+
+	var buf bytes.Buffer
+	if err := RenderSVG(&buf, sketch); err != nil {
+		t.Fatalf("RenderSVG: %v", err)
+	}
+	svg := buf.String()
+
+	if err := xml.Unmarshal(buf.Bytes(), new(struct{})); err != nil {
+		t.Fatalf("output is not well-formed XML: %v", err)
+	}
+	for _, want := range []string{
+		`width="40" height="40" viewBox="0 0 40 40"`,
+		`<polyline points="5,10 35,10" fill="none" stroke="#ff0000" stroke-width="4"`,
+		// The eraser masks the stroke drawn before it, but not the text drawn after
+		`<mask id="erase1"`,
+		`<polyline points="20,0 20,40" fill="none" stroke="#000000" stroke-width="6"`,
+		`<g mask="url(#erase1)"><polyline points="5,10 35,10"`,
+		`</g><text x="2" y="30"`,
+		`fill="rgba(0,0,255,0.5)"`,
+		`<tspan x="2" dy="0">a&lt;b</tspan><tspan x="2" dy="1.2em">&amp; c</tspan>`,
+	} {
+		if !strings.Contains(svg, want) {
+			t.Errorf("svg is missing %s\n%s", want, svg)
+		}
+	}
+	if strings.Contains(svg, "#123456") {
+		t.Error("svg includes a hidden layer")
+	}
+}
+
+func TestParseColor(t *testing.T) {
+	tests := []struct {
+		value string
+		want  color.NRGBA
+	}{
+		{"#ff8000", color.NRGBA{R: 0xff, G: 0x80, A: 0xff}},
+		{"#f80", color.NRGBA{R: 0xff, G: 0x88, A: 0xff}},
+		{"#ff800080", color.NRGBA{R: 0xff, G: 0x80, A: 0x80}},
+		{" #FF8000 ", color.NRGBA{R: 0xff, G: 0x80, A: 0xff}},
+		{"red", color.NRGBA{A: 0xff}},
+		{"#ff80", color.NRGBA{A: 0xff}},
+		{"#gg0000", color.NRGBA{A: 0xff}},
+		{"", color.NRGBA{A: 0xff}},
+	}
+	for _, tt := range tests {
+		if got := parseColor(tt.value); got != tt.want {
+			t.Errorf("parseColor(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+// eraserAt is a freehand eraser of the given width through points
+func eraserAt(width int, coords ...int) models.DrawPath {
+	return models.DrawPath{Points: pts(coords...), StrokeWidth: width}
+}
+
+func TestTouches(t *testing.T) {
+	line := models.DrawPath{Points: pts(0, 0, 100, 0), IsDrawing: true, StrokeWidth: 4}
+	tests := []struct {
+		name   string
+		path   models.DrawPath
+		eraser models.DrawPath
+		want   bool
+	}{
+		{name: "crossing", path: line, eraser: eraserAt(2, 50, -20, 50, 20), want: true},
+		// Stroke radius 2 plus eraser radius 1 reaches 3 pixels from the line
+		{name: "within reach", path: line, eraser: eraserAt(2, 0, 3, 100, 3), want: true},
+		{name: "just out of reach", path: line, eraser: eraserAt(2, 0, 4, 100, 4)},
+		{name: "past the end", path: line, eraser: eraserAt(2, 104, -10, 104, 10)},
+		{name: "single point eraser", path: line, eraser: eraserAt(2, 30, 1), want: true},
+		{name: "single point stroke", path: models.DrawPath{Points: pts(10, 10), IsDrawing: true, StrokeWidth: 2}, eraser: eraserAt(2, 11, 11), want: true},
+		{
+			name:   "inside a filled rectangle",
+			path:   models.DrawPath{Kind: models.DrawPathKindRect, Points: pts(0, 0, 50, 50), IsDrawing: true, StrokeWidth: 2, Fill: "#00ff00"},
+			eraser: eraserAt(2, 20, 20, 30, 30),
+			want:   true,
+		},
+		{
+			name:   "inside an unfilled rectangle",
+			path:   models.DrawPath{Kind: models.DrawPathKindRect, Points: pts(0, 0, 50, 50), IsDrawing: true, StrokeWidth: 2},
+			eraser: eraserAt(2, 20, 20, 30, 30),
+		},
+		{
+			name:   "across a rectangle's edge",
+			path:   models.DrawPath{Kind: models.DrawPathKindRect, Points: pts(0, 0, 50, 50), IsDrawing: true, StrokeWidth: 2},
+			eraser: eraserAt(2, 40, 25, 60, 25),
+			want:   true,
+		},
+		{
+			name:   "inside a filled ellipse",
+			path:   models.DrawPath{Kind: models.DrawPathKindEllipse, Points: pts(0, 0, 40, 20), IsDrawing: true, StrokeWidth: 2, Fill: "#00ff00"},
+			eraser: eraserAt(2, 20, 10),
+			want:   true,
+		},
+		{
+			name:   "corner outside a filled ellipse",
+			path:   models.DrawPath{Kind: models.DrawPathKindEllipse, Points: pts(0, 0, 40, 20), IsDrawing: true, StrokeWidth: 2, Fill: "#00ff00"},
+			eraser: eraserAt(2, 1, 1),
+		},
+		{
+			name:   "over text",
+			path:   models.DrawPath{Kind: models.DrawPathKindText, Points: pts(10, 10), IsDrawing: true, Text: "hello", FontSize: 20},
+			eraser: eraserAt(2, 15, 20),
+			want:   true,
+		},
+		{
+			name:   "beside text",
+			path:   models.DrawPath{Kind: models.DrawPathKindText, Points: pts(10, 10), IsDrawing: true, Text: "hello", FontSize: 20},
+			eraser: eraserAt(2, 15, 60),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := touches(tt.path, tt.eraser); got != tt.want {
+				t.Errorf("touches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEraseStrokes(t *testing.T) {
+	stroke := func(id, opID string, coords ...int) models.DrawPath {
+		return models.DrawPath{ID: id, OperationID: opID, Points: pts(coords...), IsDrawing: true, StrokeWidth: 2}
+	}
+	newRegions := func() map[string]models.Region {
+		return map[string]models.Region{
+			"0,0": {Start: pts(0, 0)[0], End: pts(100, 100)[0], Paths: []models.DrawPath{
+				stroke("a", "op1", 10, 10, 90, 10),
+				stroke("b", "op1", 10, 50, 90, 50),
+				{ID: "pixel", OperationID: "op2", Points: pts(50, 0, 50, 100), StrokeWidth: 4}, // Pixel eraser
+				stroke("c", "", 10, 90, 90, 90),
+			}},
+			"100,0": {Start: pts(100, 0)[0], End: pts(200, 100)[0], Paths: []models.DrawPath{
+				stroke("d", "op3", 110, 10, 190, 10),
+			}},
+		}
+	}
+
+	t.Run("by id", func(t *testing.T) {
+		regions := newRegions()
+		result := eraseStrokes(regions, map[string]bool{"b": true, "pixel": true}, nil)
+
+		if result.removed != 2 || !reflect.DeepEqual(sortedCopy(result.strokeIDs), []string{"b", "pixel"}) {
+			t.Fatalf("removed %d %v, want b and pixel", result.removed, result.strokeIDs)
+		}
+		if got := pathIDs(regions["0,0"]); !reflect.DeepEqual(got, []string{"a", "c"}) {
+			t.Errorf("region keeps %v, want [a c]", got)
+		}
+		// op1 keeps a; op2 has nothing left
+		if got := pathIDs(result.operations["op1"]); !reflect.DeepEqual(got, []string{"a"}) {
+			t.Errorf("op1 keeps %v, want [a]", got)
+		}
+		if op2, ok := result.operations["op2"]; !ok || len(op2.Paths) != 0 {
+			t.Errorf("op2 = %+v, %v; want an emptied operation", op2, ok)
+		}
+		if _, ok := result.operations["op3"]; ok {
+			t.Error("untouched op3 was reported")
+		}
+	})
+
+	t.Run("by eraser", func(t *testing.T) {
+		regions := newRegions()
+		// Crosses a, b and the pixel eraser; only drawn paths are removed by touch
+		result := eraseStrokes(regions, nil, []models.DrawPath{eraserAt(2, 30, 0, 30, 60)})
+
+		if result.removed != 2 {
+			t.Fatalf("removed %d paths (%v), want 2", result.removed, result.strokeIDs)
+		}
+		if got := pathIDs(regions["0,0"]); !reflect.DeepEqual(got, []string{"pixel", "c"}) {
+			t.Errorf("region keeps %v, want [pixel c]", got)
+		}
+		if op1, ok := result.operations["op1"]; !ok || len(op1.Paths) != 0 {
+			t.Errorf("op1 = %+v, %v; want an emptied operation", op1, ok)
+		}
+	})
+
+	t.Run("emptied region is dropped", func(t *testing.T) {
+		regions := newRegions()
+		result := eraseStrokes(regions, map[string]bool{"d": true}, nil)
+
+		if _, ok := regions["100,0"]; ok {
+			t.Error("region with no paths left was kept")
+		}
+		if len(regions["0,0"].Paths) != 4 {
+			t.Errorf("untouched region has %d paths, want 4", len(regions["0,0"].Paths))
+		}
+		if op3, ok := result.operations["op3"]; !ok || len(op3.Paths) != 0 {
+			t.Errorf("op3 = %+v, %v; want an emptied operation", op3, ok)
+		}
+	})
+
+	t.Run("paths without IDs send their regions", func(t *testing.T) {
+		regions := newRegions()
+		legacy := regions["100,0"]
+		legacy.Paths = append(legacy.Paths, stroke("", "", 110, 90, 190, 90))
+		regions["100,0"] = legacy
+		// Crosses a, b and the unnamed path at the bottom of the second region
+		result := eraseStrokes(regions, nil, []models.DrawPath{eraserAt(2, 30, 0, 30, 60), eraserAt(2, 150, 80, 150, 100)})
+
+		if result.removed != 3 || !reflect.DeepEqual(sortedCopy(result.strokeIDs), []string{"a", "b"}) {
+			t.Fatalf("removed %d %v, want a, b and the unnamed path", result.removed, result.strokeIDs)
+		}
+		// Only the region that lost an unnamed path is sent whole, as it is after the erase
+		if len(result.regions) != 1 || models.RegionKey(result.regions[0].Start) != "100,0" {
+			t.Fatalf("regions = %+v, want only 100,0", result.regions)
+		}
+		if got := pathIDs(result.regions[0]); !reflect.DeepEqual(got, []string{"d"}) {
+			t.Errorf("sent region holds %v, want [d]", got)
+		}
+	})
+
+	t.Run("nothing hit", func(t *testing.T) {
+		regions := newRegions()
+		result := eraseStrokes(regions, map[string]bool{"missing": true}, []models.DrawPath{eraserAt(2, 0, 70, 5, 70)})
+
+		if result.removed != 0 || len(result.operations) != 0 {
+			t.Errorf("removed %d, operations %v; want nothing", result.removed, result.operations)
+		}
+		if !reflect.DeepEqual(regions, newRegions()) {
+			t.Error("regions changed")
+		}
+	})
+}
+
+func sortedCopy(values []string) []string {
+	sorted := append([]string(nil), values...)
+	sort.Strings(sorted)
+	return sorted
+}
@@ -0,0 +1,280 @@
+package database
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"rtc-nb/backend/internal/models"
+
+	"github.com/google/uuid"
+)
+
+func TestSketchRegionEncoding(t *testing.T) {
+	tests := []struct {
+		name       string
+		points     []models.Point
+		wantDeltas []int
+	}{
+		{name: "no points", points: []models.Point{}, wantDeltas: nil},
+		{name: "single point", points: []models.Point{{X: 12, Y: 34}}, wantDeltas: []int{12, 34}},
+		{
+			name:       "forward stroke",
+			points:     []models.Point{{X: 10, Y: 10}, {X: 12, Y: 11}, {X: 15, Y: 11}},
+			wantDeltas: []int{10, 10, 2, 1, 3, 0},
+		},
+		{
+			name:       "negative deltas",
+			points:     []models.Point{{X: 50, Y: 40}, {X: 45, Y: 42}, {X: 30, Y: 10}},
+			wantDeltas: []int{50, 40, -5, 2, -15, -32},
+		},
+		{
+			name:       "negative coordinates",
+			points:     []models.Point{{X: -3, Y: -7}, {X: 0, Y: 0}},
+			wantDeltas: []int{-3, -7, 3, 7},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			region := models.Region{
+				Start: models.Point{X: 0, Y: 0},
+				End:   models.Point{X: 100, Y: 100},
+				Paths: []models.DrawPath{{ID: "p1", Points: tt.points, StrokeWidth: 2, Color: "#000000", OperationID: "op1"}},
+			}
+
+			stored := encodeRegion(region)
+			if got := stored.Paths[0].Deltas; len(got) != len(tt.wantDeltas) || (len(got) > 0 && !reflect.DeepEqual(got, tt.wantDeltas)) {
+				t.Errorf("deltas = %v, want %v", got, tt.wantDeltas)
+			}
+
+			regionJSON, err := marshalRegion(region)
+			if err != nil {
+				t.Fatalf("marshalRegion: %v", err)
+			}
+			decoded, err := unmarshalRegion(regionJSON)
+			if err != nil {
+				t.Fatalf("unmarshalRegion: %v", err)
+			}
+			if !reflect.DeepEqual(decoded, region) {
+				t.Errorf("round trip = %+v, want %+v", decoded, region)
+			}
+		})
+	}
+}
+
+func TestDecodeSketchRegions(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		want    map[string]models.Region
+		wantErr bool
+	}{
+		{
+			name: "delta encoded",
+			json: `{"0,0":{"start":{"x":0,"y":0},"end":{"x":9,"y":9},"paths":[{"d":[5,5,-1,2],"is_drawing":false,"stroke_width":1,"color":"#ff0000"}]}}`,
+			want: map[string]models.Region{"0,0": {
+				End:   models.Point{X: 9, Y: 9},
+				Paths: []models.DrawPath{{Points: []models.Point{{X: 5, Y: 5}, {X: 4, Y: 7}}, StrokeWidth: 1, Color: "#ff0000"}},
+			}},
+		},
+		{
+			name: "legacy points",
+			json: `{"0,0":{"start":{"x":0,"y":0},"end":{"x":9,"y":9},"paths":[{"points":[{"x":1,"y":2},{"x":3,"y":4}],"is_drawing":false,"stroke_width":3,"color":"#00ff00"}]}}`,
+			want: map[string]models.Region{"0,0": {
+				End:   models.Point{X: 9, Y: 9},
+				Paths: []models.DrawPath{{Points: []models.Point{{X: 1, Y: 2}, {X: 3, Y: 4}}, StrokeWidth: 3, Color: "#00ff00"}},
+			}},
+		},
+		{
+			name: "path without points",
+			json: `{"0,0":{"start":{"x":0,"y":0},"end":{"x":9,"y":9},"paths":[{"kind":"text","text":"hi","stroke_width":1,"color":"#000000"}]}}`,
+			want: map[string]models.Region{"0,0": {
+				End:   models.Point{X: 9, Y: 9},
+				Paths: []models.DrawPath{{Points: []models.Point{}, Kind: "text", Text: "hi", StrokeWidth: 1, Color: "#000000"}},
+			}},
+		},
+		{
+			name:    "odd number of deltas",
+			json:    `{"0,0":{"start":{"x":0,"y":0},"end":{"x":9,"y":9},"paths":[{"d":[1,2,3],"stroke_width":1,"color":"#000000"}]}}`,
+			wantErr: true,
+		},
+		{
+			name:    "not JSON",
+			json:    `{"0,0":`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeSketchRegions([]byte(tt.json))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecodeSketchRegions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DecodeSketchRegions() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshalRegionsOmitsPointObjects(t *testing.T) {
+	regions := map[string]models.Region{"0,0": {
+		Paths: []models.DrawPath{{Points: []models.Point{{X: 1, Y: 1}, {X: 2, Y: 2}}, StrokeWidth: 1, Color: "#000000"}},
+	}}
+
+	regionsJSON, err := marshalRegions(regions)
+	if err != nil {
+		t.Fatalf("marshalRegions: %v", err)
+	}
+	var raw map[string]struct {
+		Paths []map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(regionsJSON, &raw); err != nil {
+		t.Fatalf("unmarshal stored regions: %v", err)
+	}
+	path := raw["0,0"].Paths[0]
+	if _, ok := path["points"]; ok {
+		t.Errorf("stored path still has point objects: %s", regionsJSON)
+	}
+	if _, ok := path["d"]; !ok {
+		t.Errorf("stored path has no deltas: %s", regionsJSON)
+	}
+}
+
+func TestSketchLayersEncoding(t *testing.T) {
+	layers := []models.SketchLayer{
+		{ID: "base", Name: "Base", Visible: true, CreatedBy: "alice", Regions: map[string]models.Region{}},
+		{ID: "top", Name: "Top", Locked: true, CreatedBy: "bob", Regions: map[string]models.Region{"1,0": {
+			Start: models.Point{X: 100, Y: 0},
+			End:   models.Point{X: 200, Y: 100},
+			Paths: []models.DrawPath{{Points: []models.Point{{X: 150, Y: 50}, {X: 140, Y: 20}}, StrokeWidth: 4, Color: "#123456"}},
+		}}},
+	}
+
+	layersJSON, err := marshalSketchLayers(layers)
+	if err != nil {
+		t.Fatalf("marshalSketchLayers: %v", err)
+	}
+	got, err := unmarshalSketchLayers(layersJSON)
+	if err != nil {
+		t.Fatalf("unmarshalSketchLayers: %v", err)
+	}
+	if !reflect.DeepEqual(got, layers) {
+		t.Errorf("round trip = %+v, want %+v", got, layers)
+	}
+
+	empty, err := unmarshalSketchLayers(nil)
+	if err != nil || len(empty) != 0 {
+		t.Errorf("unmarshalSketchLayers(nil) = %v, %v; want no layers", empty, err)
+	}
+}
+
+// pageMessages returns n messages one second apart, in the order the query returned them
+func pageMessages(n int, newestFirst bool) []*models.Message {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	messages := make([]*models.Message, n)
+	for i := range messages {
+		offset := i
+		if newestFirst {
+			offset = n - 1 - i
+		}
+		messages[i] = &models.Message{ID: uuid.NewString(), Timestamp: start.Add(time.Duration(offset) * time.Second)}
+	}
+	return messages
+}
+
+func TestBuildMessagePage(t *testing.T) {
+	tests := []struct {
+		name        string
+		rows        int
+		limit       int
+		forward     bool
+		wantCount   int
+		wantHasMore bool
+	}{
+		{name: "backward, more rows", rows: 4, limit: 3, wantCount: 3, wantHasMore: true},
+		{name: "backward, last page", rows: 3, limit: 3, wantCount: 3},
+		{name: "forward, more rows", rows: 4, limit: 3, forward: true, wantCount: 3, wantHasMore: true},
+		{name: "forward, last page", rows: 2, limit: 3, forward: true, wantCount: 2},
+		{name: "empty", rows: 0, limit: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows := pageMessages(tt.rows, !tt.forward)
+			page := buildMessagePage(rows, tt.limit, tt.forward)
+
+			if len(page.Messages) != tt.wantCount || page.HasMore != tt.wantHasMore {
+				t.Fatalf("got %d messages, has more %v; want %d, %v", len(page.Messages), page.HasMore, tt.wantCount, tt.wantHasMore)
+			}
+			for i := 1; i < len(page.Messages); i++ {
+				if !page.Messages[i-1].Timestamp.Before(page.Messages[i].Timestamp) {
+					t.Fatalf("messages not in chronological order at %d", i)
+				}
+			}
+			if !tt.wantHasMore {
+				if page.NextCursor != "" {
+					t.Errorf("NextCursor = %q on the last page", page.NextCursor)
+				}
+				return
+			}
+
+			// The cursor continues from the edge in the direction of the request
+			cursor, err := models.DecodeMessageCursor(page.NextCursor)
+			if err != nil {
+				t.Fatalf("DecodeMessageCursor: %v", err)
+			}
+			edge := page.Messages[0]
+			if tt.forward {
+				edge = page.Messages[len(page.Messages)-1]
+			}
+			if cursor.ID != edge.ID || !cursor.Timestamp.Equal(edge.Timestamp) {
+				t.Errorf("cursor = %+v, want the page edge %s at %v", cursor, edge.ID, edge.Timestamp)
+			}
+		})
+	}
+}
+
+func TestBuildMessagePageWalksHistory(t *testing.T) {
+	// Seven messages read newest first three at a time, the way the history endpoint pages backward
+	history := pageMessages(7, false)
+	var seen []string
+	var before *models.MessageCursor
+	for range 4 {
+		var rows []*models.Message
+		for i := len(history) - 1; i >= 0 && len(rows) < 4; i-- {
+			msg := history[i]
+			if before != nil && !msg.Timestamp.Before(before.Timestamp) {
+				continue
+			}
+			rows = append(rows, msg)
+		}
+
+		page := buildMessagePage(rows, 3, false)
+		var ids []string
+		for _, msg := range page.Messages {
+			ids = append(ids, msg.ID)
+		}
+		seen = append(ids, seen...)
+		if !page.HasMore {
+			break
+		}
+		cursor, err := models.DecodeMessageCursor(page.NextCursor)
+		if err != nil {
+			t.Fatalf("DecodeMessageCursor: %v", err)
+		}
+		before = cursor
+	}
+
+	if len(seen) != len(history) {
+		t.Fatalf("walked %d messages, want %d", len(seen), len(history))
+	}
+	for i, msg := range history {
+		if seen[i] != msg.ID {
+			t.Fatalf("message %d = %s, want %s", i, seen[i], msg.ID)
+		}
+	}
+}
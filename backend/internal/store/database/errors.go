@@ -36,3 +36,10 @@ func IsStringTooLong(err error) bool {
 	pgErr, ok := IsPgError(err)
 	return ok && pgErr.Code == stringTooLong
 }
+
+// IsRejectedData reports whether the database refused the data itself, with a data exception or
+// a constraint violation, so retrying the same rows cannot succeed
+func IsRejectedData(err error) bool {
+	pgErr, ok := IsPgError(err)
+	return ok && (pgErr.Code.Class() == "22" || pgErr.Code.Class() == "23")
+}
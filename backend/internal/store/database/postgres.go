@@ -5,9 +5,15 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"html"
 	"log"
 	"rtc-nb/backend/internal/models"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
 type Store struct {
@@ -70,7 +76,7 @@ func (s *Store) BatchInsertMessages(ctx context.Context, messages []*models.Mess
 			return fmt.Errorf("failed to marshal message content: %w", err)
 		}
 
-		_, err = tx.StmtContext(ctx, s.statements.InsertMessage).ExecContext(ctx, msg.ID, msg.ChannelName, msg.Username, msg.Type, contentJSON, msg.Timestamp)
+		_, err = tx.StmtContext(ctx, s.statements.InsertMessage).ExecContext(ctx, msg.ID, msg.ChannelName, msg.Username, msg.Type, contentJSON, msg.Timestamp, msg.ReplyTo, msg.Seq)
 		if err != nil {
 			return fmt.Errorf("failed to insert message: %w", err)
 		}
@@ -83,30 +89,325 @@ func (s *Store) BatchInsertMessages(ctx context.Context, messages []*models.Mess
 	return nil
 }
 
-func (s *Store) GetMessages(ctx context.Context, channelName string) ([]*models.Message, error) {
-	rows, err := s.statements.SelectMessages.QueryContext(ctx, channelName)
+// GetMessages returns one page of a channel's history in chronological order.
+// One extra row is fetched to determine whether another page exists.
+func (s *Store) GetMessages(ctx context.Context, channelName string, page models.MessagePageRequest) (*models.MessagePage, error) {
+	var (
+		rows *sql.Rows
+		err  error
+	)
+	switch {
+	case page.After != nil:
+		rows, err = s.statements.SelectMessagesAfter.QueryContext(ctx, channelName, page.After.Timestamp, page.After.ID, page.Limit+1)
+	case page.Before != nil:
+		rows, err = s.statements.SelectMessagesBefore.QueryContext(ctx, channelName, page.Before.Timestamp, page.Before.ID, page.Limit+1)
+	default:
+		rows, err = s.statements.SelectMessages.QueryContext(ctx, channelName, page.Limit+1)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to query messages: %w", err)
 	}
 	defer rows.Close()
 
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	result := buildMessagePage(messages, page.Limit, page.After != nil)
+	if err := s.attachReactions(ctx, result.Messages); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetThreadReplies returns a chronological page of replies to rootID, starting after page.After.
+func (s *Store) GetThreadReplies(ctx context.Context, rootID string, page models.MessagePageRequest) (*models.MessagePage, error) {
+	after := &models.MessageCursor{ID: uuid.Nil.String()} // Before every real reply
+	if page.After != nil {
+		after = page.After
+	}
+
+	rows, err := s.statements.SelectThreadReplies.QueryContext(ctx, rootID, after.Timestamp, after.ID, page.Limit+1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query thread replies: %w", err)
+	}
+	defer rows.Close()
+
+	replies, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	result := buildMessagePage(replies, page.Limit, true)
+	if err := s.attachReactions(ctx, result.Messages); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// buildMessagePage trims the look-ahead row and orders messages chronologically.
+// Backward (newest-first) query results are reversed.
+func buildMessagePage(messages []*models.Message, limit int, forward bool) *models.MessagePage {
+	result := &models.MessagePage{}
+	if len(messages) > limit {
+		result.HasMore = true
+		messages = messages[:limit]
+	}
+
+	if !forward {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+
+	if result.HasMore && len(messages) > 0 {
+		edge := messages[0]
+		if forward {
+			edge = messages[len(messages)-1]
+		}
+		result.NextCursor = models.CursorFromMessage(edge).Encode()
+	}
+
+	result.Messages = messages
+	return result
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanMessage reads the messageColumns of a row; extra receives any trailing columns.
+func scanMessage(row rowScanner, extra ...any) (*models.Message, error) {
+	msg := &models.Message{}
+	var contentJSON []byte
+	dest := []any{&msg.ID, &msg.ChannelName, &msg.Username, &msg.Type, &contentJSON, &msg.Timestamp, &msg.EditedAt, &msg.DeletedAt, &msg.ReplyTo, &msg.Seq, &msg.ReplyCount}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Deleted messages keep their row for history but never expose their content
+	if msg.DeletedAt != nil {
+		return msg, nil
+	}
+
+	if err := json.Unmarshal(contentJSON, &msg.Content); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal message content: %w", err)
+	}
+	return msg, nil
+}
+
+func scanMessages(rows *sql.Rows) ([]*models.Message, error) {
 	messages := []*models.Message{}
 	for rows.Next() {
-		msg := &models.Message{}
-		var contentJSON []byte
-		err := rows.Scan(&msg.ID, &msg.ChannelName, &msg.Username, &msg.Type, &contentJSON, &msg.Timestamp)
+		msg, err := scanMessage(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan message row: %w", err)
 		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate message rows: %w", err)
+	}
+	return messages, nil
+}
+
+// ReserveChannelSeqs reserves count delivery sequence numbers for channelName, all above floor,
+// and returns the last of them
+func (s *Store) ReserveChannelSeqs(ctx context.Context, channelName string, count, floor int64) (int64, error) {
+	var last int64
+	err := s.statements.ReserveChannelSeqs.QueryRowContext(ctx, channelName, count, floor).Scan(&last)
+	if err == sql.ErrNoRows {
+		return 0, models.ErrChannelNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to reserve channel seqs: %w", err)
+	}
+	return last, nil
+}
+
+// GetMessagesSince returns up to limit of channelName's persisted messages with seq greater than since, in seq order
+func (s *Store) GetMessagesSince(ctx context.Context, channelName string, since int64, limit int) ([]*models.Message, error) {
+	rows, err := s.statements.SelectMessagesSince.QueryContext(ctx, channelName, since, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages since %d: %w", since, err)
+	}
+	defer rows.Close()
 
-		err = json.Unmarshal(contentJSON, &msg.Content)
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.attachReactions(ctx, messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// SearchMessages runs a full-text search over a channel's non-deleted messages, newest first.
+func (s *Store) SearchMessages(ctx context.Context, channelName string, query models.MessageSearchQuery) (*models.MessageSearchResult, error) {
+	var beforeTimestamp *time.Time
+	var beforeID *string
+	if query.Before != nil {
+		beforeTimestamp, beforeID = &query.Before.Timestamp, &query.Before.ID
+	}
+
+	rows, err := s.statements.SearchMessages.QueryContext(ctx, channelName, query.Query, query.Author,
+		query.From, query.To, beforeTimestamp, beforeID, query.Limit+1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search messages: %w", err)
+	}
+	defer rows.Close()
+
+	result := &models.MessageSearchResult{Hits: []*models.MessageSearchHit{}}
+	messages := []*models.Message{}
+	for rows.Next() {
+		var snippet string
+		msg, err := scanMessage(rows, &snippet)
 		if err != nil {
-			return nil, fmt.Errorf("failed to unmarshal message content: %w", err)
+			return nil, fmt.Errorf("failed to scan search row: %w", err)
 		}
+		result.Hits = append(result.Hits, &models.MessageSearchHit{Message: msg, Snippet: highlightSnippet(snippet)})
 		messages = append(messages, msg)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate search rows: %w", err)
+	}
 
-	return messages, nil
+	if len(result.Hits) > query.Limit {
+		result.HasMore = true
+		result.Hits = result.Hits[:query.Limit]
+		messages = messages[:query.Limit]
+		result.NextCursor = models.CursorFromMessage(messages[len(messages)-1]).Encode()
+	}
+
+	if err := s.attachReactions(ctx, messages); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// highlightSnippet escapes user text before turning the placeholder markers into real tags
+func highlightSnippet(snippet string) string {
+	escaped := html.EscapeString(snippet)
+	escaped = strings.ReplaceAll(escaped, searchHighlightStart, "<mark>")
+	return strings.ReplaceAll(escaped, searchHighlightStop, "</mark>")
+}
+
+// GetMessage returns a single message by ID, or nil if it does not exist.
+func (s *Store) GetMessage(ctx context.Context, messageID string) (*models.Message, error) {
+	msg, err := scanMessage(s.statements.SelectMessageByID.QueryRowContext(ctx, messageID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get message: %w", err)
+	}
+	if err := s.attachReactions(ctx, []*models.Message{msg}); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (s *Store) UpdateMessageText(ctx context.Context, messageID, text string, editedAt time.Time) error {
+	result, err := s.statements.UpdateMessageText.ExecContext(ctx, messageID, text, editedAt)
+	if err != nil {
+		return fmt.Errorf("failed to update message: %w", err)
+	}
+	return requireRowAffected(result, messageID)
+}
+
+// SoftDeleteMessage marks a message deleted without removing its row.
+func (s *Store) SoftDeleteMessage(ctx context.Context, messageID string, deletedAt time.Time) error {
+	result, err := s.statements.SoftDeleteMessage.ExecContext(ctx, messageID, deletedAt)
+	if err != nil {
+		return fmt.Errorf("failed to delete message: %w", err)
+	}
+	return requireRowAffected(result, messageID)
+}
+
+// ToggleReaction adds the user's emoji reaction to a message, or removes it if already present.
+// It reports whether the reaction was added and the emoji's resulting count.
+func (s *Store) ToggleReaction(ctx context.Context, messageID, username, emoji string) (bool, int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.StmtContext(ctx, s.statements.DeleteReaction).ExecContext(ctx, messageID, username, emoji)
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to delete reaction: %w", err)
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	added := removed == 0
+	if added {
+		if _, err := tx.StmtContext(ctx, s.statements.InsertReaction).ExecContext(ctx, messageID, username, emoji); err != nil {
+			if IsForeignKeyViolation(err) {
+				return false, 0, fmt.Errorf("%w: %s", models.ErrMessageNotFound, messageID)
+			}
+			return false, 0, fmt.Errorf("failed to insert reaction: %w", err)
+		}
+	}
+
+	var count int
+	if err := tx.StmtContext(ctx, s.statements.CountReaction).QueryRowContext(ctx, messageID, emoji).Scan(&count); err != nil {
+		return false, 0, fmt.Errorf("failed to count reactions: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return added, count, nil
+}
+
+// attachReactions loads aggregated reactions for all messages in a single query
+func (s *Store) attachReactions(ctx context.Context, messages []*models.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	byID := make(map[string]*models.Message, len(messages))
+	ids := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		byID[msg.ID] = msg
+		ids = append(ids, msg.ID)
+	}
+
+	rows, err := s.statements.SelectMessagesReactions.QueryContext(ctx, pq.Array(ids))
+	if err != nil {
+		return fmt.Errorf("failed to query reactions: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID string
+		var summary models.ReactionSummary
+		if err := rows.Scan(&messageID, &summary.Emoji, &summary.Count, pq.Array(&summary.Usernames)); err != nil {
+			return fmt.Errorf("failed to scan reaction row: %w", err)
+		}
+		if msg, ok := byID[messageID]; ok {
+			msg.Reactions = append(msg.Reactions, summary)
+		}
+	}
+	return rows.Err()
+}
+
+func requireRowAffected(result sql.Result, messageID string) error {
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("%w: %s", models.ErrMessageNotFound, messageID)
+	}
+	return nil
 }
 
 func (s *Store) Close() error {
@@ -203,6 +504,7 @@ func (s *Store) GetChannel(ctx context.Context, channelName string) (*models.Cha
 	err := s.statements.SelectChannel.QueryRowContext(ctx, channelName).Scan(
 		&channel.Name,
 		&channel.IsPrivate,
+		&channel.IsDirect,
 		&channel.Description,
 		&channel.HashedPassword,
 		&channel.CreatedBy,
@@ -217,6 +519,114 @@ func (s *Store) GetChannel(ctx context.Context, channelName string) (*models.Cha
 	return channel, err
 }
 
+// CreateDirectChannel creates the direct channel for two users if it doesn't exist yet
+// and makes sure both are members. It is idempotent.
+func (s *Store) CreateDirectChannel(ctx context.Context, channelName, createdBy, participant string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.StmtContext(ctx, s.statements.InsertDirectChannel).ExecContext(ctx, channelName, createdBy); err != nil {
+		return fmt.Errorf("failed to create direct channel: %w", err)
+	}
+
+	for _, username := range []string{createdBy, participant} {
+		if _, err := tx.StmtContext(ctx, s.statements.AddChannelMember).ExecContext(ctx, channelName, username, false); err != nil {
+			if IsForeignKeyViolation(err) {
+				return fmt.Errorf("invalid participant username: %w", err)
+			}
+			return fmt.Errorf("failed to add direct channel participant: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// GetDirectConversations lists username's direct conversations, most recently active first
+func (s *Store) GetDirectConversations(ctx context.Context, username string) ([]*models.DirectConversation, error) {
+	rows, err := s.statements.SelectDirectConversations.QueryContext(ctx, username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query direct conversations: %w", err)
+	}
+	defer rows.Close()
+
+	conversations := []*models.DirectConversation{}
+	for rows.Next() {
+		dc := &models.DirectConversation{}
+		if err := rows.Scan(&dc.ChannelName, &dc.Participant, &dc.CreatedAt, &dc.LastMessageAt, &dc.UnreadCount); err != nil {
+			return nil, fmt.Errorf("failed to scan direct conversation row: %w", err)
+		}
+		conversations = append(conversations, dc)
+	}
+	return conversations, rows.Err()
+}
+
+func (s *Store) MarkChannelRead(ctx context.Context, channelName, username string, readAt time.Time) error {
+	result, err := s.statements.MarkChannelRead.ExecContext(ctx, channelName, username, readAt)
+	if err != nil {
+		return fmt.Errorf("failed to mark channel read: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return models.ErrNotChannelMember
+	}
+	return nil
+}
+
+// MarkMessageRead moves username's read marker in channelName forward to the given message.
+// Markers already past the message are left untouched.
+func (s *Store) MarkMessageRead(ctx context.Context, channelName, username, messageID string, timestamp time.Time) error {
+	if _, err := s.statements.MarkMessageRead.ExecContext(ctx, channelName, username, messageID, timestamp); err != nil {
+		return fmt.Errorf("failed to mark message read: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) GetUnreadCount(ctx context.Context, channelName, username string) (int, error) {
+	var count int
+	if err := s.statements.SelectUnreadCount.QueryRowContext(ctx, channelName, username).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to get unread count: %w", err)
+	}
+	return count, nil
+}
+
+// GetUnreadCounts returns username's unread count for every channel they are a member of, keyed by channel name
+func (s *Store) GetUnreadCounts(ctx context.Context, username string) (map[string]int, error) {
+	return s.queryUnreadCounts(ctx, s.statements.SelectUnreadCounts, username)
+}
+
+// GetChannelUnreadCounts returns every member's unread count for channelName, keyed by username
+func (s *Store) GetChannelUnreadCounts(ctx context.Context, channelName string) (map[string]int, error) {
+	return s.queryUnreadCounts(ctx, s.statements.SelectChannelUnreadCounts, channelName)
+}
+
+func (s *Store) queryUnreadCounts(ctx context.Context, stmt *sql.Stmt, arg string) (map[string]int, error) {
+	rows, err := stmt.QueryContext(ctx, arg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query unread counts: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var key string
+		var count int
+		if err := rows.Scan(&key, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan unread count: %w", err)
+		}
+		counts[key] = count
+	}
+	return counts, rows.Err()
+}
+
 func (s *Store) GetChannels(ctx context.Context) ([]*models.Channel, error) {
 
 	rows, err := s.statements.SelectChannels.QueryContext(ctx)
@@ -351,6 +761,138 @@ func (s *Store) IsUserAdmin(ctx context.Context, channelName string, username st
 	return isAdmin, nil
 }
 
+// PinMessage pins messageID in channelName. Pinning an already pinned message is a no-op.
+func (s *Store) PinMessage(ctx context.Context, channelName, messageID, pinnedBy string, pinnedAt time.Time) error {
+	if _, err := s.statements.InsertPin.ExecContext(ctx, channelName, messageID, pinnedBy, pinnedAt); err != nil {
+		return fmt.Errorf("failed to pin message: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) UnpinMessage(ctx context.Context, channelName, messageID string) error {
+	result, err := s.statements.DeletePin.ExecContext(ctx, channelName, messageID)
+	if err != nil {
+		return fmt.Errorf("failed to unpin message: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return models.ErrMessageNotPinned
+	}
+	return nil
+}
+
+func (s *Store) CountPinnedMessages(ctx context.Context, channelName string) (int, error) {
+	var count int
+	if err := s.statements.CountPins.QueryRowContext(ctx, channelName).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count pinned messages: %w", err)
+	}
+	return count, nil
+}
+
+// GetPinnedMessages returns channelName's pinned messages, most recently pinned first
+func (s *Store) GetPinnedMessages(ctx context.Context, channelName string) ([]*models.PinnedMessage, error) {
+	rows, err := s.statements.SelectPins.QueryContext(ctx, channelName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pinned messages: %w", err)
+	}
+	defer rows.Close()
+
+	pins := []*models.PinnedMessage{}
+	messages := []*models.Message{}
+	for rows.Next() {
+		pin := &models.PinnedMessage{}
+		var pinnedBy sql.NullString
+		msg, err := scanMessage(rows, &pinnedBy, &pin.PinnedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan pinned message row: %w", err)
+		}
+		pin.Message = msg
+		pin.PinnedBy = pinnedBy.String
+		pins = append(pins, pin)
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate pinned message rows: %w", err)
+	}
+
+	if err := s.attachReactions(ctx, messages); err != nil {
+		return nil, err
+	}
+	return pins, nil
+}
+
+// CreateMentions stores mention records in a single transaction, ignoring duplicates
+func (s *Store) CreateMentions(ctx context.Context, mentions []*models.Mention) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt := tx.StmtContext(ctx, s.statements.InsertMention)
+	for _, mention := range mentions {
+		if _, err := stmt.ExecContext(ctx, mention.MessageID, mention.ChannelName, mention.Username, mention.MentionedBy, mention.CreatedAt); err != nil {
+			return fmt.Errorf("failed to insert mention: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// GetUnreadMentions returns username's unread mentions with their messages, newest first
+func (s *Store) GetUnreadMentions(ctx context.Context, username string, limit int) ([]*models.Mention, error) {
+	rows, err := s.statements.SelectUnreadMentions.QueryContext(ctx, username, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query unread mentions: %w", err)
+	}
+	defer rows.Close()
+
+	mentions := []*models.Mention{}
+	messages := []*models.Message{}
+	for rows.Next() {
+		mention := &models.Mention{}
+		msg, err := scanMessage(rows, &mention.Username, &mention.MentionedBy, &mention.CreatedAt, &mention.ReadAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan mention row: %w", err)
+		}
+		mention.MessageID = msg.ID
+		mention.ChannelName = msg.ChannelName
+		mention.Message = msg
+		mentions = append(mentions, mention)
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate mention rows: %w", err)
+	}
+
+	if err := s.attachReactions(ctx, messages); err != nil {
+		return nil, err
+	}
+	return mentions, nil
+}
+
+// MarkMentionsRead marks username's mentions in channelName up to and including upTo as read
+func (s *Store) MarkMentionsRead(ctx context.Context, channelName, username string, upTo time.Time) error {
+	if _, err := s.statements.MarkMentionsRead.ExecContext(ctx, channelName, username, upTo, time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to mark mentions read: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) IsChannelMember(ctx context.Context, channelName string, username string) (bool, error) {
+	var isMember bool
+	if err := s.statements.IsChannelMember.QueryRowContext(ctx, channelName, username).Scan(&isMember); err != nil {
+		return false, fmt.Errorf("query IsChannelMember: %w", err)
+	}
+	return isMember, nil
+}
+
 func (s *Store) GetUserChannel(ctx context.Context, username string) (string, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -369,9 +911,9 @@ func (s *Store) GetUserChannel(ctx context.Context, username string) (string, er
 func (s *Store) CreateSketch(ctx context.Context, sketch *models.Sketch) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	regionsJSON, err := json.Marshal(sketch.Regions)
+	regionsJSON, err := marshalRegions(sketch.Regions)
 	if err != nil {
-		return fmt.Errorf("failed to marshal regions: %w", err)
+		return err
 	}
 	_, err = s.statements.InsertSketch.ExecContext(ctx, sketch.ID, sketch.ChannelName, sketch.DisplayName, sketch.Width, sketch.Height, regionsJSON, sketch.CreatedBy)
 
@@ -381,13 +923,17 @@ func (s *Store) CreateSketch(ctx context.Context, sketch *models.Sketch) error {
 	return nil
 }
 
-// UpdateSketchWithTx updates the sketch regions within a given transaction.
-// It marshals the sketch.Regions map (which should contain merged paths)
+// UpdateSketchWithTx updates the sketch regions and layers within a given transaction.
+// It encodes the sketch.Regions map (which should contain merged paths)
 // back into JSON for storage.
 func (s *Store) UpdateSketchWithTx(ctx context.Context, tx *sql.Tx, sketch *models.Sketch) error {
-	updatedRegionsJSON, err := json.Marshal(sketch.Regions)
+	updatedRegionsJSON, err := marshalRegions(sketch.Regions)
 	if err != nil {
-		return fmt.Errorf("failed to marshal updated regions: %w", err)
+		return err
+	}
+	layersJSON, err := marshalSketchLayers(sketch.Layers)
+	if err != nil {
+		return err
 	}
 
 	// Use the transaction's prepared statement if available, otherwise use the general one
@@ -396,7 +942,7 @@ func (s *Store) UpdateSketchWithTx(ctx context.Context, tx *sql.Tx, sketch *mode
 		stmt = tx.StmtContext(ctx, stmt)
 	}
 
-	_, err = stmt.ExecContext(ctx, sketch.ID, updatedRegionsJSON)
+	_, err = stmt.ExecContext(ctx, sketch.ID, updatedRegionsJSON, layersJSON)
 	if err != nil {
 		return fmt.Errorf("update sketch regions: %w", err)
 	}
@@ -404,10 +950,10 @@ func (s *Store) UpdateSketchWithTx(ctx context.Context, tx *sql.Tx, sketch *mode
 	return nil
 }
 
-// GetSketchForUpdate retrieves sketch metadata and raw regions JSON within a transaction, locking the row.
+// GetSketchForUpdate retrieves sketch metadata, layers and raw regions JSON within a transaction, locking the row.
 func (s *Store) GetSketchForUpdate(ctx context.Context, tx *sql.Tx, sketchID string) (*models.Sketch, []byte, error) {
 	sketch := &models.Sketch{}
-	var regionsJSON []byte
+	var regionsJSON, layersJSON []byte
 
 	// Use the prepared statement within the transaction
 	stmt := s.statements.SelectSketchForUpdate
@@ -426,6 +972,7 @@ func (s *Store) GetSketchForUpdate(ctx context.Context, tx *sql.Tx, sketchID str
 		&regionsJSON,
 		&sketch.CreatedAt,
 		&sketch.CreatedBy,
+		&layersJSON,
 	)
 
 	if err == sql.ErrNoRows {
@@ -434,9 +981,12 @@ func (s *Store) GetSketchForUpdate(ctx context.Context, tx *sql.Tx, sketchID str
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to get sketch for update: %w", err)
 	}
+	if sketch.Layers, err = unmarshalSketchLayers(layersJSON); err != nil {
+		return nil, nil, err
+	}
 
 	// Initialize the Regions map, but don't unmarshal here.
-	// The caller (service layer) will unmarshal the raw bytes.
+	// The caller (service layer) will decode the raw bytes with DecodeSketchRegions.
 	sketch.Regions = make(map[string]models.Region)
 
 	return sketch, regionsJSON, nil
@@ -449,7 +999,8 @@ func (s *Store) GetSketch(ctx context.Context, sketchID string) (*models.Sketch,
 	sketch := &models.Sketch{
 		Regions: make(map[string]models.Region),
 	}
-	var regionsJSON []byte
+	var regionsJSON, layersJSON []byte
+	var thumbnailURL sql.NullString
 	err := s.statements.SelectSketchByID.QueryRowContext(ctx, sketchID).Scan(
 		&sketch.ID,
 		&sketch.ChannelName,
@@ -459,6 +1010,8 @@ func (s *Store) GetSketch(ctx context.Context, sketchID string) (*models.Sketch,
 		&regionsJSON,
 		&sketch.CreatedAt,
 		&sketch.CreatedBy,
+		&thumbnailURL,
+		&layersJSON,
 	)
 	if err != nil {
 		// Check specifically for ErrNoRows to return nil sketch instead of error
@@ -468,10 +1021,14 @@ func (s *Store) GetSketch(ctx context.Context, sketchID string) (*models.Sketch,
 		return nil, fmt.Errorf("failed to get sketch: %w", err)
 	}
 
-	if err := json.Unmarshal(regionsJSON, &sketch.Regions); err != nil {
+	if sketch.Regions, err = DecodeSketchRegions(regionsJSON); err != nil {
 		// Log the problematic JSON on unmarshal failure
 		log.Printf("ERROR: GetSketch(%s): Failed to unmarshal regions JSON: %v. JSON: %s", sketchID, err, string(regionsJSON))
-		return nil, fmt.Errorf("failed to unmarshal regions: %w", err)
+		return nil, err
+	}
+	sketch.ThumbnailURL = thumbnailURL.String
+	if sketch.Layers, err = unmarshalSketchLayers(layersJSON); err != nil {
+		return nil, err
 	}
 
 	return sketch, nil
@@ -491,16 +1048,125 @@ func (s *Store) GetSketches(ctx context.Context, channelName string) ([]*models.
 	for rows.Next() {
 		sketch := &models.Sketch{
 			Regions: make(map[string]models.Region), // Initialize with empty regions map
+			Layers:  []models.SketchLayer{},
 		}
-		err := rows.Scan(&sketch.ID, &sketch.ChannelName, &sketch.DisplayName, &sketch.Width, &sketch.Height, &sketch.CreatedAt, &sketch.CreatedBy)
+		var thumbnailURL sql.NullString
+		err := rows.Scan(&sketch.ID, &sketch.ChannelName, &sketch.DisplayName, &sketch.Width, &sketch.Height, &sketch.CreatedAt, &sketch.CreatedBy, &thumbnailURL)
 		if err != nil {
 			return nil, err
 		}
+		sketch.ThumbnailURL = thumbnailURL.String
 		sketches = append(sketches, sketch)
 	}
 	return sketches, nil
 }
 
+func (s *Store) UpdateSketchThumbnail(ctx context.Context, sketchID, thumbnailURL string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, err := s.statements.UpdateSketchThumbnail.ExecContext(ctx, sketchID, thumbnailURL)
+	if err != nil {
+		return fmt.Errorf("failed to update sketch thumbnail: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return models.ErrSketchNotFound
+	}
+	return nil
+}
+
+// GetSketchLayer returns a sketch layer without its regions, or nil if the sketch has no such layer
+func (s *Store) GetSketchLayer(ctx context.Context, sketchID, layerID string) (*models.SketchLayer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var layerJSON []byte
+	err := s.statements.SelectSketchLayer.QueryRowContext(ctx, sketchID, layerID).Scan(&layerJSON)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sketch layer: %w", err)
+	}
+
+	layer := &models.SketchLayer{}
+	if err := json.Unmarshal(layerJSON, layer); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal sketch layer: %w", err)
+	}
+	return layer, nil
+}
+
+// GetSketchStorageStats returns a sketch's stored size and last compaction, without its path counts,
+// or nil if the sketch does not exist
+func (s *Store) GetSketchStorageStats(ctx context.Context, sketchID string) (*models.SketchStorageStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := &models.SketchStorageStats{SketchID: sketchID}
+	var compactedAt sql.NullTime
+	var bytesBefore, bytesAfter sql.NullInt64
+	err := s.statements.SelectSketchStorage.QueryRowContext(ctx, sketchID).Scan(&stats.StoredBytes, &stats.UpdatedAt, &compactedAt, &bytesBefore, &bytesAfter)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sketch storage stats: %w", err)
+	}
+	if compactedAt.Valid {
+		stats.LastCompaction = &models.SketchCompaction{
+			CompactedAt: compactedAt.Time,
+			BytesBefore: int(bytesBefore.Int64),
+			BytesAfter:  int(bytesAfter.Int64),
+		}
+	}
+	return stats, nil
+}
+
+// GetSketchStoredSizeWithTx returns the stored size of a sketch's regions and layers, as changed so far in tx
+func (s *Store) GetSketchStoredSizeWithTx(ctx context.Context, tx *sql.Tx, sketchID string) (int, error) {
+	var size int
+	err := tx.StmtContext(ctx, s.statements.SelectSketchStoredSize).QueryRowContext(ctx, sketchID).Scan(&size)
+	if err == sql.ErrNoRows {
+		return 0, models.ErrSketchNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get sketch stored size: %w", err)
+	}
+	return size, nil
+}
+
+// SetSketchCompactedWithTx records that a sketch was compacted from bytesBefore to bytesAfter
+func (s *Store) SetSketchCompactedWithTx(ctx context.Context, tx *sql.Tx, sketchID string, bytesBefore, bytesAfter int) error {
+	if _, err := tx.StmtContext(ctx, s.statements.SetSketchCompacted).ExecContext(ctx, sketchID, bytesBefore, bytesAfter); err != nil {
+		return fmt.Errorf("failed to record sketch compaction: %w", err)
+	}
+	return nil
+}
+
+// GetSketchesToCompact returns up to limit sketches changed since their last compaction and left alone for idle
+func (s *Store) GetSketchesToCompact(ctx context.Context, idle time.Duration, limit int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rows, err := s.statements.SelectSketchesToCompact.QueryContext(ctx, idle.Seconds(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sketches to compact: %w", err)
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan sketch to compact: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate sketches to compact: %w", err)
+	}
+	return ids, nil
+}
+
 func (s *Store) DeleteSketch(ctx context.Context, sketchID string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -508,11 +1174,19 @@ func (s *Store) DeleteSketch(ctx context.Context, sketchID string) error {
 	return err
 }
 
+// ClearSketchRegions empties a sketch and each of its layers, keeping the layers themselves,
+// and its operation log, so nothing cleared can be redone
 func (s *Store) ClearSketchRegions(ctx context.Context, sketchID string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	result, err := s.statements.ClearSketchRegions.ExecContext(ctx, sketchID)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.StmtContext(ctx, s.statements.ClearSketchRegions).ExecContext(ctx, sketchID)
 	if err != nil {
 		return fmt.Errorf("failed to clear sketch regions: %w", err)
 	}
@@ -526,9 +1200,225 @@ func (s *Store) ClearSketchRegions(ctx context.Context, sketchID string) error {
 		return fmt.Errorf("no sketch found with id: %s", sketchID)
 	}
 
+	if _, err := tx.StmtContext(ctx, s.statements.DeleteSketchOperations).ExecContext(ctx, sketchID); err != nil {
+		return fmt.Errorf("failed to delete sketch operations: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// InsertSketchOperationWithTx logs a committed stroke and discards its author's redo history for the sketch
+func (s *Store) InsertSketchOperationWithTx(ctx context.Context, tx *sql.Tx, op *models.SketchOperation) error {
+	regionJSON, err := marshalRegion(op.Region)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.StmtContext(ctx, s.statements.InsertSketchOperation).ExecContext(ctx, op.ID, op.SketchID, op.Username, op.LayerID, models.RegionKey(op.Region.Start), regionJSON)
+	if err != nil {
+		return fmt.Errorf("failed to insert sketch operation: %w", err)
+	}
+
+	_, err = tx.StmtContext(ctx, s.statements.DeleteUndoneSketchOperations).ExecContext(ctx, op.SketchID, op.Username)
+	if err != nil {
+		return fmt.Errorf("failed to discard undone sketch operations: %w", err)
+	}
+	return nil
+}
+
+// GetLastSketchOperationWithTx returns username's latest stroke on a sketch that is not undone,
+// or with undone set, the one they undid most recently. It returns nil if there is none.
+func (s *Store) GetLastSketchOperationWithTx(ctx context.Context, tx *sql.Tx, sketchID, username string, undone bool) (*models.SketchOperation, error) {
+	stmt := s.statements.SelectLastSketchOperation
+	if undone {
+		stmt = s.statements.SelectLastUndoneSketchOperation
+	}
+
+	op, err := scanSketchOperation(tx.StmtContext(ctx, stmt).QueryRowContext(ctx, sketchID, username))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last sketch operation: %w", err)
+	}
+	return op, nil
+}
+
+// SetSketchOperationUndoneWithTx marks a stroke undone, or with undone false, redoes it
+func (s *Store) SetSketchOperationUndoneWithTx(ctx context.Context, tx *sql.Tx, operationID string, undone bool) error {
+	stmt := s.statements.RedoSketchOperation
+	if undone {
+		stmt = s.statements.UndoSketchOperation
+	}
+
+	if _, err := tx.StmtContext(ctx, stmt).ExecContext(ctx, operationID); err != nil {
+		return fmt.Errorf("failed to update sketch operation: %w", err)
+	}
 	return nil
 }
 
+// GetActiveSketchOperationsWithTx returns the strokes of one region of a layer that are not undone, in log order
+func (s *Store) GetActiveSketchOperationsWithTx(ctx context.Context, tx *sql.Tx, sketchID, layerID, regionKey string) ([]*models.SketchOperation, error) {
+	rows, err := tx.StmtContext(ctx, s.statements.SelectActiveSketchOperations).QueryContext(ctx, sketchID, layerID, regionKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sketch operations: %w", err)
+	}
+	defer rows.Close()
+
+	ops := []*models.SketchOperation{}
+	for rows.Next() {
+		op, err := scanSketchOperation(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan sketch operation: %w", err)
+		}
+		ops = append(ops, op)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate sketch operations: %w", err)
+	}
+	return ops, nil
+}
+
+// UpdateSketchOperationRegionWithTx replaces the paths a logged stroke left in its region after some were erased.
+// A stroke with no paths left is removed from the log, so undo skips it.
+func (s *Store) UpdateSketchOperationRegionWithTx(ctx context.Context, tx *sql.Tx, operationID string, region models.Region) error {
+	if len(region.Paths) == 0 {
+		if _, err := tx.StmtContext(ctx, s.statements.DeleteSketchOperation).ExecContext(ctx, operationID); err != nil {
+			return fmt.Errorf("failed to delete sketch operation: %w", err)
+		}
+		return nil
+	}
+
+	regionJSON, err := marshalRegion(region)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.StmtContext(ctx, s.statements.UpdateSketchOperationRegion).ExecContext(ctx, operationID, regionJSON); err != nil {
+		return fmt.Errorf("failed to update sketch operation region: %w", err)
+	}
+	return nil
+}
+
+// DeleteSketchOperationsWithTx empties a sketch's operation log
+func (s *Store) DeleteSketchOperationsWithTx(ctx context.Context, tx *sql.Tx, sketchID string) error {
+	if _, err := tx.StmtContext(ctx, s.statements.DeleteSketchOperations).ExecContext(ctx, sketchID); err != nil {
+		return fmt.Errorf("failed to delete sketch operations: %w", err)
+	}
+	return nil
+}
+
+// InsertSketchVersionWithTx stores a snapshot and prunes the sketch's versions down to keep
+func (s *Store) InsertSketchVersionWithTx(ctx context.Context, tx *sql.Tx, version *models.SketchVersion, keep int) error {
+	regionsJSON, err := marshalRegions(version.Regions)
+	if err != nil {
+		return err
+	}
+	layersJSON, err := marshalSketchLayers(version.Layers)
+	if err != nil {
+		return err
+	}
+
+	createdBy := sql.NullString{String: version.CreatedBy, Valid: version.CreatedBy != ""}
+	_, err = tx.StmtContext(ctx, s.statements.InsertSketchVersion).ExecContext(ctx, version.ID, version.SketchID, regionsJSON, layersJSON, version.Reason, version.CreatedAt, createdBy)
+	if err != nil {
+		return fmt.Errorf("failed to insert sketch version: %w", err)
+	}
+
+	if _, err := tx.StmtContext(ctx, s.statements.PruneSketchVersions).ExecContext(ctx, version.SketchID, keep); err != nil {
+		return fmt.Errorf("failed to prune sketch versions: %w", err)
+	}
+	return nil
+}
+
+// GetLastSketchVersionTimeWithTx returns when the sketch's newest version was taken, or nil if it has none
+func (s *Store) GetLastSketchVersionTimeWithTx(ctx context.Context, tx *sql.Tx, sketchID string) (*time.Time, error) {
+	var last sql.NullTime
+	if err := tx.StmtContext(ctx, s.statements.SelectLastSketchVersionTime).QueryRowContext(ctx, sketchID).Scan(&last); err != nil {
+		return nil, fmt.Errorf("failed to get last sketch version time: %w", err)
+	}
+	if !last.Valid {
+		return nil, nil
+	}
+	return &last.Time, nil
+}
+
+// GetSketchVersions lists a sketch's versions, newest first, without their regions
+func (s *Store) GetSketchVersions(ctx context.Context, sketchID string) ([]*models.SketchVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rows, err := s.statements.SelectSketchVersions.QueryContext(ctx, sketchID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sketch versions: %w", err)
+	}
+	defer rows.Close()
+
+	versions := []*models.SketchVersion{}
+	for rows.Next() {
+		version, err := scanSketchVersion(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan sketch version: %w", err)
+		}
+		versions = append(versions, version)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate sketch versions: %w", err)
+	}
+	return versions, nil
+}
+
+// GetSketchVersion returns one version with its regions and layers, or nil if it does not exist
+func (s *Store) GetSketchVersion(ctx context.Context, versionID string) (*models.SketchVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var regionsJSON, layersJSON []byte
+	version, err := scanSketchVersion(s.statements.SelectSketchVersion.QueryRowContext(ctx, versionID), &regionsJSON, &layersJSON)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sketch version: %w", err)
+	}
+
+	if version.Regions, err = DecodeSketchRegions(regionsJSON); err != nil {
+		return nil, err
+	}
+	if version.Layers, err = unmarshalSketchLayers(layersJSON); err != nil {
+		return nil, err
+	}
+	return version, nil
+}
+
+// scanSketchVersion reads a version row without its regions; extra receives any trailing columns.
+func scanSketchVersion(row rowScanner, extra ...any) (*models.SketchVersion, error) {
+	version := &models.SketchVersion{}
+	var createdBy sql.NullString
+	dest := []any{&version.ID, &version.SketchID, &version.Reason, &version.CreatedAt, &createdBy}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	version.CreatedBy = createdBy.String
+	return version, nil
+}
+
+func scanSketchOperation(row rowScanner) (*models.SketchOperation, error) {
+	op := &models.SketchOperation{}
+	var regionJSON []byte
+	if err := row.Scan(&op.ID, &op.SketchID, &op.Username, &op.LayerID, &regionJSON, &op.UndoneAt, &op.CreatedAt); err != nil {
+		return nil, err
+	}
+	region, err := unmarshalRegion(regionJSON)
+	if err != nil {
+		return nil, err
+	}
+	op.Region = region
+	return op, nil
+}
+
 func (s *Store) BeginTx(ctx context.Context) (*sql.Tx, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
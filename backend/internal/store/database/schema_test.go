@@ -64,6 +64,7 @@ func TestChannelStructAlignment(t *testing.T) {
 	expectedFields := map[string]string{
 		"name":            "string",
 		"is_private":      "bool",
+		"is_direct":       "bool",
 		"description":     "*string",
 		"hashed_password": "*string",
 		"created_by":      "string",
@@ -194,8 +195,48 @@ func TestPreparedStatements(t *testing.T) {
 		},
 		{
 			name:           "SelectMessages",
-			statement:      `SELECT id, channel_name, username, message_type, content, timestamp`,
-			expectedFields: []string{"id", "channel_name", "username", "message_type", "content", "timestamp"},
+			statement:      `SELECT id, channel_name, username, message_type, content, timestamp, edited_at, deleted_at`,
+			expectedFields: []string{"id", "channel_name", "username", "message_type", "content", "timestamp", "edited_at", "deleted_at"},
+			table:          "messages",
+		},
+		// Reaction statements
+		{
+			name:           "InsertReaction",
+			statement:      `INSERT INTO message_reactions (message_id, username, emoji)`,
+			expectedFields: []string{"message_id", "username", "emoji"},
+			table:          "message_reactions",
+		},
+		// Pin statements
+		{
+			name:           "InsertPin",
+			statement:      `INSERT INTO pinned_messages (channel_name, message_id, pinned_by, pinned_at)`,
+			expectedFields: []string{"channel_name", "message_id", "pinned_by", "pinned_at"},
+			table:          "pinned_messages",
+		},
+		// Mention statements
+		{
+			name:           "InsertMention",
+			statement:      `INSERT INTO message_mentions (message_id, channel_name, username, mentioned_by, created_at)`,
+			expectedFields: []string{"message_id", "channel_name", "username", "mentioned_by", "created_at"},
+			table:          "message_mentions",
+		},
+		// Sketch operation statements
+		{
+			name:           "InsertSketchOperation",
+			statement:      `INSERT INTO sketch_operations (id, sketch_id, username, layer_id, region_key, region)`,
+			expectedFields: []string{"id", "sketch_id", "username", "layer_id", "region_key", "region"},
+			table:          "sketch_operations",
+		},
+		{
+			name:           "InsertSketchVersion",
+			statement:      `INSERT INTO sketch_versions (id, sketch_id, regions, layers, reason, created_at, created_by)`,
+			expectedFields: []string{"id", "sketch_id", "regions", "layers", "reason", "created_at", "created_by"},
+			table:          "sketch_versions",
+		},
+		{
+			name:           "SoftDeleteMessage",
+			statement:      `UPDATE messages SET deleted_at = $2 WHERE id = $1 AND deleted_at IS NULL`,
+			expectedFields: []string{"deleted_at"},
 			table:          "messages",
 		},
 	}
@@ -231,7 +272,9 @@ func TestStatementParameterCount(t *testing.T) {
 		{"UpdateUser", `SET hashed_password = $2 WHERE username = $1`, 2},
 		{"InsertChannel", `VALUES ($1, $2, $3, $4, $5)`, 5},
 		{"AddChannelMember", `VALUES ($1, $2, $3)`, 3},
-		{"InsertMessage", `VALUES ($1, $2, $3, $4, $5)`, 5},
+		{"InsertMessage", `VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, 8},
+		{"InsertReaction", `VALUES ($1, $2, $3)`, 3},
+		{"MarkMessageRead", `SET last_read_message_id = $3, last_read_at = $4 WHERE channel_name = $1 AND username = $2`, 4},
 	}
 
 	for _, tt := range tests {
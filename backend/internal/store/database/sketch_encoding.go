@@ -0,0 +1,162 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"rtc-nb/backend/internal/models"
+)
+
+// Sketch paths are stored with their points delta-encoded: the first point as is, then each point as its
+// offset from the one before, so the points of a stroke become a short list of small numbers. Points are
+// whole pixels already, so nothing is lost. Paths stored before the encoding keep their point objects
+// and still decode.
+
+// storedPath is a DrawPath as kept in the database
+type storedPath struct {
+	models.DrawPath
+	Points []models.Point `json:"points,omitempty"` // Only in paths stored before the encoding; shadows DrawPath.Points
+	Deltas []int          `json:"d,omitempty"`      // x0, y0, dx1, dy1, ...
+}
+
+type storedRegion struct {
+	Start   models.Point `json:"start"`
+	End     models.Point `json:"end"`
+	Paths   []storedPath `json:"paths"`
+	LastSeq int64        `json:"last_seq,omitempty"`
+}
+
+// storedLayer is a SketchLayer as kept in the layers column, with its regions always present
+type storedLayer struct {
+	models.SketchLayer
+	Regions map[string]storedRegion `json:"regions"`
+}
+
+func encodeRegion(region models.Region) storedRegion {
+	stored := storedRegion{Start: region.Start, End: region.End, LastSeq: region.LastSeq, Paths: make([]storedPath, len(region.Paths))}
+	for i, path := range region.Paths {
+		deltas := make([]int, 0, 2*len(path.Points))
+		var prev models.Point
+		for _, p := range path.Points {
+			deltas = append(deltas, p.X-prev.X, p.Y-prev.Y)
+			prev = p
+		}
+		path.Points = nil
+		stored.Paths[i] = storedPath{DrawPath: path, Deltas: deltas}
+	}
+	return stored
+}
+
+func decodeRegion(stored storedRegion) (models.Region, error) {
+	region := models.Region{Start: stored.Start, End: stored.End, LastSeq: stored.LastSeq, Paths: make([]models.DrawPath, len(stored.Paths))}
+	for i, sp := range stored.Paths {
+		path := sp.DrawPath
+		path.Points = sp.Points
+		if len(sp.Deltas) > 0 {
+			if len(sp.Deltas)%2 != 0 {
+				return models.Region{}, fmt.Errorf("path %d has an odd number of point deltas", i)
+			}
+			path.Points = make([]models.Point, 0, len(sp.Deltas)/2)
+			var p models.Point
+			for j := 0; j < len(sp.Deltas); j += 2 {
+				p.X += sp.Deltas[j]
+				p.Y += sp.Deltas[j+1]
+				path.Points = append(path.Points, p)
+			}
+		}
+		if path.Points == nil {
+			path.Points = []models.Point{}
+		}
+		region.Paths[i] = path
+	}
+	return region, nil
+}
+
+func encodeRegions(regions map[string]models.Region) map[string]storedRegion {
+	stored := make(map[string]storedRegion, len(regions))
+	for key, region := range regions {
+		stored[key] = encodeRegion(region)
+	}
+	return stored
+}
+
+func decodeRegions(stored map[string]storedRegion) (map[string]models.Region, error) {
+	regions := make(map[string]models.Region, len(stored))
+	for key, sr := range stored {
+		region, err := decodeRegion(sr)
+		if err != nil {
+			return nil, fmt.Errorf("region %s: %w", key, err)
+		}
+		regions[key] = region
+	}
+	return regions, nil
+}
+
+// marshalRegions encodes a regions map for a regions column
+func marshalRegions(regions map[string]models.Region) ([]byte, error) {
+	regionsJSON, err := json.Marshal(encodeRegions(regions))
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal regions: %w", err)
+	}
+	return regionsJSON, nil
+}
+
+// DecodeSketchRegions reads a regions column, as returned raw by GetSketchForUpdate
+func DecodeSketchRegions(regionsJSON []byte) (map[string]models.Region, error) {
+	stored := make(map[string]storedRegion)
+	if err := json.Unmarshal(regionsJSON, &stored); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal regions: %w", err)
+	}
+	return decodeRegions(stored)
+}
+
+// marshalRegion encodes a single region for an operation's region column
+func marshalRegion(region models.Region) ([]byte, error) {
+	regionJSON, err := json.Marshal(encodeRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal region: %w", err)
+	}
+	return regionJSON, nil
+}
+
+func unmarshalRegion(regionJSON []byte) (models.Region, error) {
+	var stored storedRegion
+	if err := json.Unmarshal(regionJSON, &stored); err != nil {
+		return models.Region{}, fmt.Errorf("failed to unmarshal region: %w", err)
+	}
+	return decodeRegion(stored)
+}
+
+// marshalSketchLayers stores layers as a JSON array, keeping an empty layer's regions as {}
+func marshalSketchLayers(layers []models.SketchLayer) ([]byte, error) {
+	stored := make([]storedLayer, len(layers))
+	for i, layer := range layers {
+		stored[i] = storedLayer{SketchLayer: layer, Regions: encodeRegions(layer.Regions)}
+	}
+	layersJSON, err := json.Marshal(stored)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal sketch layers: %w", err)
+	}
+	return layersJSON, nil
+}
+
+// unmarshalSketchLayers reads a layers column, giving every layer a regions map
+func unmarshalSketchLayers(layersJSON []byte) ([]models.SketchLayer, error) {
+	stored := []storedLayer{}
+	if len(layersJSON) > 0 {
+		if err := json.Unmarshal(layersJSON, &stored); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal sketch layers: %w", err)
+		}
+	}
+	layers := make([]models.SketchLayer, len(stored))
+	for i, sl := range stored {
+		layer := sl.SketchLayer
+		regions, err := decodeRegions(sl.Regions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode layer %s: %w", layer.ID, err)
+		}
+		layer.Regions = regions
+		layers[i] = layer
+	}
+	return layers, nil
+}
@@ -11,6 +11,7 @@ type Statements struct {
 	DeleteUser *sql.Stmt // username
 
 	InsertChannel        *sql.Stmt // name, is_private, description, created_by, hashed_password
+	InsertDirectChannel  *sql.Stmt // name, created_by
 	SelectChannel        *sql.Stmt // name
 	SelectChannels       *sql.Stmt
 	UpdateChannel        *sql.Stmt // name, is_private, description, hashed_password
@@ -19,18 +20,74 @@ type Statements struct {
 	AddChannelMember     *sql.Stmt // channel_name, username, is_admin, joined_at
 	RemoveChannelMember  *sql.Stmt // channel_name, username
 	IsUserAdmin          *sql.Stmt // channel_name, username
-
-	InsertMessage  *sql.Stmt // id, channel_name, username, message_type, content, timestamp
-	SelectMessages *sql.Stmt // channel_name
+	IsChannelMember      *sql.Stmt // channel_name, username
+	MarkChannelRead      *sql.Stmt // channel_name, username, last_read_at
+	MarkMessageRead      *sql.Stmt // channel_name, username, message_id, message_timestamp
+
+	SelectUnreadCount         *sql.Stmt // channel_name, username
+	SelectUnreadCounts        *sql.Stmt // username
+	SelectChannelUnreadCounts *sql.Stmt // channel_name
+
+	SelectDirectConversations *sql.Stmt // username
+
+	InsertMessage        *sql.Stmt // id, channel_name, username, message_type, content, timestamp, reply_to, seq
+	ReserveChannelSeqs   *sql.Stmt // channel_name, count, floor
+	SelectMessagesSince  *sql.Stmt // channel_name, seq, limit
+	SelectMessages       *sql.Stmt // channel_name, limit
+	SelectMessagesBefore *sql.Stmt // channel_name, timestamp, id, limit
+	SelectMessagesAfter  *sql.Stmt // channel_name, timestamp, id, limit
+	SelectMessageByID    *sql.Stmt // id
+	UpdateMessageText    *sql.Stmt // id, text, edited_at
+	SoftDeleteMessage    *sql.Stmt // id, deleted_at
+	SelectThreadReplies  *sql.Stmt // reply_to, timestamp, id, limit
+
+	InsertReaction          *sql.Stmt // message_id, username, emoji
+	DeleteReaction          *sql.Stmt // message_id, username, emoji
+	CountReaction           *sql.Stmt // message_id, emoji
+	SelectMessagesReactions *sql.Stmt // message_ids
+
+	SearchMessages *sql.Stmt // channel_name, query, author, from, to, before_timestamp, before_id, limit
+
+	InsertPin  *sql.Stmt // channel_name, message_id, pinned_by, pinned_at
+	DeletePin  *sql.Stmt // channel_name, message_id
+	CountPins  *sql.Stmt // channel_name
+	SelectPins *sql.Stmt // channel_name
+
+	InsertMention        *sql.Stmt // message_id, channel_name, username, mentioned_by, created_at
+	SelectUnreadMentions *sql.Stmt // username, limit
+	MarkMentionsRead     *sql.Stmt // channel_name, username, up_to, read_at
 
 	SelectUserChannel *sql.Stmt // username
 
-	InsertSketch        *sql.Stmt // id, channel_name, width, height, regions
-	SelectSketchByID    *sql.Stmt // id
-	SelectSketches      *sql.Stmt // channel_name
-	UpdateSketchRegions *sql.Stmt // id, regions
-	DeleteSketch        *sql.Stmt // id
-	ClearSketchRegions  *sql.Stmt // id
+	InsertSketch            *sql.Stmt // id, channel_name, width, height, regions
+	SelectSketchByID        *sql.Stmt // id
+	SelectSketches          *sql.Stmt // channel_name
+	UpdateSketchRegions     *sql.Stmt // id, regions, layers
+	DeleteSketch            *sql.Stmt // id
+	ClearSketchRegions      *sql.Stmt // id
+	UpdateSketchThumbnail   *sql.Stmt // id, thumbnail_url
+	SelectSketchLayer       *sql.Stmt // id, layer_id
+	SelectSketchStorage     *sql.Stmt // id
+	SelectSketchStoredSize  *sql.Stmt // id
+	SetSketchCompacted      *sql.Stmt // id, compacted_from_bytes, compacted_to_bytes
+	SelectSketchesToCompact *sql.Stmt // idle_seconds, limit
+
+	InsertSketchOperation           *sql.Stmt // id, sketch_id, username, layer_id, region_key, region
+	DeleteUndoneSketchOperations    *sql.Stmt // sketch_id, username
+	DeleteSketchOperations          *sql.Stmt // sketch_id
+	SelectLastSketchOperation       *sql.Stmt // sketch_id, username
+	SelectLastUndoneSketchOperation *sql.Stmt // sketch_id, username
+	UndoSketchOperation             *sql.Stmt // id
+	RedoSketchOperation             *sql.Stmt // id
+	SelectActiveSketchOperations    *sql.Stmt // sketch_id, layer_id, region_key
+	UpdateSketchOperationRegion     *sql.Stmt // id, region
+	DeleteSketchOperation           *sql.Stmt // id
+
+	InsertSketchVersion         *sql.Stmt // id, sketch_id, regions, layers, reason, created_at, created_by
+	PruneSketchVersions         *sql.Stmt // sketch_id, keep
+	SelectLastSketchVersionTime *sql.Stmt // sketch_id
+	SelectSketchVersions        *sql.Stmt // sketch_id
+	SelectSketchVersion         *sql.Stmt // id
 
 	UpdateChannelMemberRole *sql.Stmt // channel_name, username, is_admin
 	GetChannelAdmins        *sql.Stmt // channel_name
@@ -39,6 +96,24 @@ type Statements struct {
 	SelectSketchForUpdate *sql.Stmt // id
 }
 
+// messageColumns is the column list of every message SELECT, in scanMessage order.
+// Queries must alias messages as m.
+const messageColumns = `m.id, m.channel_name, m.username, m.message_type, m.content, m.timestamp, m.edited_at, m.deleted_at, m.reply_to, m.seq,
+            (SELECT COUNT(*) FROM messages r WHERE r.reply_to = m.id AND r.deleted_at IS NULL) AS reply_count`
+
+// unreadMessageCondition matches messages m that member me has not read yet: other users'
+// live messages after the read marker, or after joining when nothing has been read.
+// A marker without a message ID (read "up to now") covers every message at that timestamp.
+const unreadMessageCondition = `m.channel_name = me.channel_name AND m.username <> me.username AND m.deleted_at IS NULL
+            AND CASE WHEN me.last_read_message_id IS NULL THEN m.timestamp > COALESCE(me.last_read_at, me.joined_at)
+                ELSE (m.timestamp, m.id) > (me.last_read_at, me.last_read_message_id) END`
+
+// Search highlight placeholders, replaced with <mark> tags after the snippet is HTML-escaped
+const (
+	searchHighlightStart = "[[hl]]"
+	searchHighlightStop  = "[[/hl]]"
+)
+
 func PrepareStatements(db *sql.DB) (*Statements, error) {
 	s := &Statements{}
 	var statements []*sql.Stmt
@@ -82,18 +157,39 @@ func PrepareStatements(db *sql.DB) (*Statements, error) {
 		return nil, fmt.Errorf("prepare insert channel: %w", err)
 	}
 
+	// Direct channels are private without a password; only their two members may use them
+	if s.InsertDirectChannel, err = prepare(`
+        INSERT INTO channels (name, is_private, is_direct, created_by) 
+        VALUES ($1, true, true, $2)
+        ON CONFLICT (name) DO NOTHING`); err != nil {
+		return nil, fmt.Errorf("prepare insert direct channel: %w", err)
+	}
+
 	if s.SelectChannel, err = prepare(`
-        SELECT name, is_private, description, hashed_password, created_by, created_at 
+        SELECT name, is_private, is_direct, description, hashed_password, created_by, created_at 
         FROM channels WHERE name = $1`); err != nil {
 		return nil, fmt.Errorf("prepare select channel: %w", err)
 	}
 
 	if s.SelectChannels, err = prepare(`
         SELECT name, is_private, description, created_by, created_at 
-        FROM channels`); err != nil {
+        FROM channels
+        WHERE is_direct = false`); err != nil {
 		return nil, fmt.Errorf("prepare select channels: %w", err)
 	}
 
+	if s.SelectDirectConversations, err = prepare(`
+        SELECT c.name, other.username, c.created_at,
+            (SELECT MAX(m.timestamp) FROM messages m WHERE m.channel_name = c.name) AS last_message_at,
+            (SELECT COUNT(*) FROM messages m WHERE ` + unreadMessageCondition + `) AS unread_count
+        FROM channel_member me
+        JOIN channels c ON c.name = me.channel_name AND c.is_direct
+        JOIN channel_member other ON other.channel_name = c.name AND other.username <> me.username
+        WHERE me.username = $1
+        ORDER BY last_message_at DESC NULLS LAST, c.created_at DESC`); err != nil {
+		return nil, fmt.Errorf("prepare select direct conversations: %w", err)
+	}
+
 	if s.DeleteChannel, err = prepare(`
         DELETE FROM channels WHERE name = $1`); err != nil {
 		return nil, fmt.Errorf("prepare delete channel: %w", err)
@@ -124,21 +220,140 @@ func PrepareStatements(db *sql.DB) (*Statements, error) {
 		return nil, fmt.Errorf("prepare remove channel member: %w", err)
 	}
 
-	// Prepare message statements
+	// Prepare message statements; inserts ignore known IDs so spooled messages can be replayed safely
 	if s.InsertMessage, err = prepare(`
-        INSERT INTO messages (id, channel_name, username, message_type, content, timestamp) 
-        VALUES ($1, $2, $3, $4, $5, $6)`); err != nil {
+        INSERT INTO messages (id, channel_name, username, message_type, content, timestamp, reply_to, seq) 
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8) 
+        ON CONFLICT (id) DO NOTHING`); err != nil {
 		return nil, fmt.Errorf("prepare insert message: %w", err)
 	}
 
+	// Sequence numbers are reserved in ranges from the channel row so they stay unique across processes
+	if s.ReserveChannelSeqs, err = prepare(`
+        UPDATE channels SET last_seq = GREATEST(last_seq, $3) + $2 
+        WHERE name = $1 
+        RETURNING last_seq`); err != nil {
+		return nil, fmt.Errorf("prepare reserve channel seqs: %w", err)
+	}
+
+	// Replay includes thread replies and deleted messages so clients can reconcile everything they missed
+	if s.SelectMessagesSince, err = prepare(`
+        SELECT ` + messageColumns + `
+        FROM messages m
+        WHERE m.channel_name = $1 AND m.seq > $2
+        ORDER BY m.seq
+        LIMIT $3`); err != nil {
+		return nil, fmt.Errorf("prepare select messages since: %w", err)
+	}
+
+	// Message pages are keyed on (timestamp, id); newest-first pages are reversed by the caller.
+	// Channel history only lists thread roots, replies are fetched per thread.
 	if s.SelectMessages, err = prepare(`
-        SELECT id, channel_name, username, message_type, content, timestamp 
-        FROM messages 
-        WHERE channel_name = $1 
-        ORDER BY timestamp`); err != nil {
+        SELECT ` + messageColumns + `
+        FROM messages m 
+        WHERE m.channel_name = $1 AND m.reply_to IS NULL 
+        ORDER BY m.timestamp DESC, m.id DESC
+        LIMIT $2`); err != nil {
 		return nil, fmt.Errorf("prepare select messages: %w", err)
 	}
 
+	if s.SelectMessagesBefore, err = prepare(`
+        SELECT ` + messageColumns + `
+        FROM messages m 
+        WHERE m.channel_name = $1 AND m.reply_to IS NULL AND (m.timestamp, m.id) < ($2, $3)
+        ORDER BY m.timestamp DESC, m.id DESC
+        LIMIT $4`); err != nil {
+		return nil, fmt.Errorf("prepare select messages before: %w", err)
+	}
+
+	if s.SelectMessagesAfter, err = prepare(`
+        SELECT ` + messageColumns + `
+        FROM messages m 
+        WHERE m.channel_name = $1 AND m.reply_to IS NULL AND (m.timestamp, m.id) > ($2, $3)
+        ORDER BY m.timestamp ASC, m.id ASC
+        LIMIT $4`); err != nil {
+		return nil, fmt.Errorf("prepare select messages after: %w", err)
+	}
+
+	if s.SelectMessageByID, err = prepare(`
+        SELECT ` + messageColumns + `
+        FROM messages m 
+        WHERE m.id = $1`); err != nil {
+		return nil, fmt.Errorf("prepare select message by id: %w", err)
+	}
+
+	if s.SelectThreadReplies, err = prepare(`
+        SELECT ` + messageColumns + `
+        FROM messages m 
+        WHERE m.reply_to = $1 AND (m.timestamp, m.id) > ($2, $3)
+        ORDER BY m.timestamp ASC, m.id ASC
+        LIMIT $4`); err != nil {
+		return nil, fmt.Errorf("prepare select thread replies: %w", err)
+	}
+
+	if s.UpdateMessageText, err = prepare(`
+        UPDATE messages 
+        SET content = jsonb_set(content, '{text}', to_jsonb($2::text)), edited_at = $3 
+        WHERE id = $1 AND deleted_at IS NULL`); err != nil {
+		return nil, fmt.Errorf("prepare update message text: %w", err)
+	}
+
+	if s.SoftDeleteMessage, err = prepare(`
+        UPDATE messages 
+        SET deleted_at = $2 
+        WHERE id = $1 AND deleted_at IS NULL`); err != nil {
+		return nil, fmt.Errorf("prepare soft delete message: %w", err)
+	}
+
+	// Full-text search over message text; the tsvector expression must match idx_messages_content_fts.
+	// Nullable filters are skipped when NULL. Highlights use placeholder markers the store escapes.
+	if s.SearchMessages, err = prepare(`
+        SELECT ` + messageColumns + `,
+            ts_headline('english', COALESCE(m.content->>'text', ''), q,
+                'StartSel=` + searchHighlightStart + `, StopSel=` + searchHighlightStop + `, MaxFragments=2, MaxWords=20, MinWords=5') AS snippet
+        FROM messages m, websearch_to_tsquery('english', $2) q
+        WHERE m.channel_name = $1 
+            AND m.deleted_at IS NULL
+            AND to_tsvector('english', COALESCE(m.content->>'text', '')) @@ q
+            AND ($3::varchar IS NULL OR m.username = $3)
+            AND ($4::timestamp IS NULL OR m.timestamp >= $4)
+            AND ($5::timestamp IS NULL OR m.timestamp < $5)
+            AND ($6::timestamp IS NULL OR (m.timestamp, m.id) < ($6, $7::uuid))
+        ORDER BY m.timestamp DESC, m.id DESC
+        LIMIT $8`); err != nil {
+		return nil, fmt.Errorf("prepare search messages: %w", err)
+	}
+
+	// Prepare reaction statements
+	if s.InsertReaction, err = prepare(`
+        INSERT INTO message_reactions (message_id, username, emoji) 
+        VALUES ($1, $2, $3)
+        ON CONFLICT (message_id, username, emoji) DO NOTHING`); err != nil {
+		return nil, fmt.Errorf("prepare insert reaction: %w", err)
+	}
+
+	if s.DeleteReaction, err = prepare(`
+        DELETE FROM message_reactions 
+        WHERE message_id = $1 AND username = $2 AND emoji = $3`); err != nil {
+		return nil, fmt.Errorf("prepare delete reaction: %w", err)
+	}
+
+	if s.CountReaction, err = prepare(`
+        SELECT COUNT(*) 
+        FROM message_reactions 
+        WHERE message_id = $1 AND emoji = $2`); err != nil {
+		return nil, fmt.Errorf("prepare count reaction: %w", err)
+	}
+
+	if s.SelectMessagesReactions, err = prepare(`
+        SELECT message_id, emoji, COUNT(*), array_agg(username ORDER BY created_at) 
+        FROM message_reactions 
+        WHERE message_id = ANY($1::uuid[])
+        GROUP BY message_id, emoji
+        ORDER BY message_id, MIN(created_at)`); err != nil {
+		return nil, fmt.Errorf("prepare select messages reactions: %w", err)
+	}
+
 	if s.SelectUserChannel, err = prepare(`
         SELECT channel_name 
         FROM channel_member 
@@ -155,6 +370,110 @@ func PrepareStatements(db *sql.DB) (*Statements, error) {
 		return nil, fmt.Errorf("prepare IsUserAdmin statement: %w", err)
 	}
 
+	if s.IsChannelMember, err = prepare(`
+        SELECT EXISTS(
+            SELECT 1 FROM channel_member 
+            WHERE channel_name = $1 AND username = $2)`); err != nil {
+		return nil, fmt.Errorf("prepare IsChannelMember statement: %w", err)
+	}
+
+	if s.MarkChannelRead, err = prepare(`
+        UPDATE channel_member 
+        SET last_read_at = $3, last_read_message_id = NULL 
+        WHERE channel_name = $1 AND username = $2`); err != nil {
+		return nil, fmt.Errorf("prepare mark channel read: %w", err)
+	}
+
+	// Read markers only move forward; a marker without a message ID sorts after every message at its timestamp
+	if s.MarkMessageRead, err = prepare(`
+        UPDATE channel_member 
+        SET last_read_message_id = $3, last_read_at = $4 
+        WHERE channel_name = $1 AND username = $2
+            AND (last_read_at IS NULL 
+                OR ($4::timestamp, $3::uuid) > (last_read_at, COALESCE(last_read_message_id, 'ffffffff-ffff-ffff-ffff-ffffffffffff'::uuid)))`); err != nil {
+		return nil, fmt.Errorf("prepare mark message read: %w", err)
+	}
+
+	if s.SelectUnreadCount, err = prepare(`
+        SELECT COUNT(m.id) 
+        FROM channel_member me 
+        LEFT JOIN messages m ON ` + unreadMessageCondition + `
+        WHERE me.channel_name = $1 AND me.username = $2`); err != nil {
+		return nil, fmt.Errorf("prepare select unread count: %w", err)
+	}
+
+	if s.SelectUnreadCounts, err = prepare(`
+        SELECT me.channel_name, COUNT(m.id) 
+        FROM channel_member me 
+        LEFT JOIN messages m ON ` + unreadMessageCondition + `
+        WHERE me.username = $1
+        GROUP BY me.channel_name`); err != nil {
+		return nil, fmt.Errorf("prepare select unread counts: %w", err)
+	}
+
+	if s.SelectChannelUnreadCounts, err = prepare(`
+        SELECT me.username, COUNT(m.id) 
+        FROM channel_member me 
+        LEFT JOIN messages m ON ` + unreadMessageCondition + `
+        WHERE me.channel_name = $1
+        GROUP BY me.username`); err != nil {
+		return nil, fmt.Errorf("prepare select channel unread counts: %w", err)
+	}
+
+	// Prepare pin statements
+	if s.InsertPin, err = prepare(`
+        INSERT INTO pinned_messages (channel_name, message_id, pinned_by, pinned_at) 
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (channel_name, message_id) DO NOTHING`); err != nil {
+		return nil, fmt.Errorf("prepare insert pin: %w", err)
+	}
+
+	if s.DeletePin, err = prepare(`
+        DELETE FROM pinned_messages WHERE channel_name = $1 AND message_id = $2`); err != nil {
+		return nil, fmt.Errorf("prepare delete pin: %w", err)
+	}
+
+	if s.CountPins, err = prepare(`
+        SELECT COUNT(*) FROM pinned_messages WHERE channel_name = $1`); err != nil {
+		return nil, fmt.Errorf("prepare count pins: %w", err)
+	}
+
+	// Soft-deleted messages stay pinned but are hidden until unpinned
+	if s.SelectPins, err = prepare(`
+        SELECT ` + messageColumns + `, p.pinned_by, p.pinned_at
+        FROM pinned_messages p
+        JOIN messages m ON m.id = p.message_id
+        WHERE p.channel_name = $1 AND m.deleted_at IS NULL
+        ORDER BY p.pinned_at DESC`); err != nil {
+		return nil, fmt.Errorf("prepare select pins: %w", err)
+	}
+
+	// Prepare mention statements
+	if s.InsertMention, err = prepare(`
+        INSERT INTO message_mentions (message_id, channel_name, username, mentioned_by, created_at) 
+        VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (message_id, username) DO NOTHING`); err != nil {
+		return nil, fmt.Errorf("prepare insert mention: %w", err)
+	}
+
+	// Mentions only list once their message has been flushed from the chat buffer
+	if s.SelectUnreadMentions, err = prepare(`
+        SELECT ` + messageColumns + `, mm.username, mm.mentioned_by, mm.created_at, mm.read_at
+        FROM message_mentions mm
+        JOIN messages m ON m.id = mm.message_id
+        WHERE mm.username = $1 AND mm.read_at IS NULL AND m.deleted_at IS NULL
+        ORDER BY mm.created_at DESC
+        LIMIT $2`); err != nil {
+		return nil, fmt.Errorf("prepare select unread mentions: %w", err)
+	}
+
+	if s.MarkMentionsRead, err = prepare(`
+        UPDATE message_mentions 
+        SET read_at = $4 
+        WHERE channel_name = $1 AND username = $2 AND read_at IS NULL AND created_at <= $3`); err != nil {
+		return nil, fmt.Errorf("prepare mark mentions read: %w", err)
+	}
+
 	// Prepare sketch statements
 	if s.InsertSketch, err = prepare(`
         INSERT INTO sketches (id, channel_name, display_name, width, height, regions, created_by) 
@@ -163,14 +482,14 @@ func PrepareStatements(db *sql.DB) (*Statements, error) {
 	}
 
 	if s.SelectSketchByID, err = prepare(`
-        SELECT id, channel_name, display_name, width, height, regions, created_at, created_by 
+        SELECT id, channel_name, display_name, width, height, regions, created_at, created_by, thumbnail_url, layers 
         FROM sketches 
         WHERE id = $1`); err != nil {
 		return nil, fmt.Errorf("prepare select sketch: %w", err)
 	}
 
 	if s.SelectSketches, err = prepare(`
-        SELECT id, channel_name, display_name, width, height, created_at, created_by 
+        SELECT id, channel_name, display_name, width, height, created_at, created_by, thumbnail_url 
         FROM sketches
 		WHERE channel_name = $1`); err != nil {
 		return nil, fmt.Errorf("prepare select sketches: %w", err)
@@ -178,11 +497,58 @@ func PrepareStatements(db *sql.DB) (*Statements, error) {
 
 	if s.UpdateSketchRegions, err = prepare(`
         UPDATE sketches 
-        SET regions = $2
+        SET regions = $2, layers = $3, updated_at = clock_timestamp()
         WHERE id = $1`); err != nil {
 		return nil, fmt.Errorf("prepare update sketch regions: %w", err)
 	}
 
+	if s.UpdateSketchThumbnail, err = prepare(`
+        UPDATE sketches 
+        SET thumbnail_url = $2
+        WHERE id = $1`); err != nil {
+		return nil, fmt.Errorf("prepare update sketch thumbnail: %w", err)
+	}
+
+	// One layer of a sketch without its regions
+	if s.SelectSketchLayer, err = prepare(`
+        SELECT layer - 'regions' 
+        FROM sketches, jsonb_array_elements(layers) AS layer 
+        WHERE id = $1 AND layer->>'id' = $2`); err != nil {
+		return nil, fmt.Errorf("prepare select sketch layer: %w", err)
+	}
+
+	// pg_column_size is the size as stored, after TOAST compression
+	if s.SelectSketchStorage, err = prepare(`
+        SELECT pg_column_size(regions) + pg_column_size(layers), updated_at, compacted_at, compacted_from_bytes, compacted_to_bytes 
+        FROM sketches 
+        WHERE id = $1`); err != nil {
+		return nil, fmt.Errorf("prepare select sketch storage: %w", err)
+	}
+
+	if s.SelectSketchStoredSize, err = prepare(`
+        SELECT pg_column_size(regions) + pg_column_size(layers) FROM sketches WHERE id = $1`); err != nil {
+		return nil, fmt.Errorf("prepare select sketch stored size: %w", err)
+	}
+
+	// clock_timestamp keeps compacted_at after the updated_at the compaction itself set
+	if s.SetSketchCompacted, err = prepare(`
+        UPDATE sketches 
+        SET compacted_at = clock_timestamp(), compacted_from_bytes = $2, compacted_to_bytes = $3
+        WHERE id = $1`); err != nil {
+		return nil, fmt.Errorf("prepare set sketch compacted: %w", err)
+	}
+
+	// Sketches changed since their last compaction that nobody has drawn on for a while, stalest first
+	if s.SelectSketchesToCompact, err = prepare(`
+        SELECT id 
+        FROM sketches 
+        WHERE (compacted_at IS NULL OR updated_at > compacted_at) 
+          AND updated_at < clock_timestamp() - make_interval(secs => $1) 
+        ORDER BY updated_at 
+        LIMIT $2`); err != nil {
+		return nil, fmt.Errorf("prepare select sketches to compact: %w", err)
+	}
+
 	if s.DeleteSketch, err = prepare(`
         DELETE FROM sketches WHERE id = $1`); err != nil {
 		return nil, fmt.Errorf("prepare delete sketch: %w", err)
@@ -190,20 +556,131 @@ func PrepareStatements(db *sql.DB) (*Statements, error) {
 
 	if s.ClearSketchRegions, err = prepare(`
         UPDATE sketches 
-        SET regions = '{}'::jsonb 
+        SET regions = '{}'::jsonb, 
+            layers = (
+                SELECT COALESCE(jsonb_agg(layer || '{"regions": {}}'::jsonb ORDER BY position), '[]'::jsonb) 
+                FROM jsonb_array_elements(layers) WITH ORDINALITY AS l(layer, position)
+            ), 
+            updated_at = clock_timestamp() 
     	WHERE id = $1`); err != nil {
 		return nil, fmt.Errorf("prepare clear sketch regions: %w", err)
 	}
 
 	// Prepare SelectSketchForUpdate
 	if s.SelectSketchForUpdate, err = prepare(`
-        SELECT id, channel_name, display_name, width, height, regions, created_at, created_by 
+        SELECT id, channel_name, display_name, width, height, regions, created_at, created_by, layers 
         FROM sketches 
         WHERE id = $1
 		FOR UPDATE`); err != nil {
 		return nil, fmt.Errorf("prepare select sketch for update: %w", err)
 	}
 
+	// Sketch operation log statements
+	if s.InsertSketchOperation, err = prepare(`
+        INSERT INTO sketch_operations (id, sketch_id, username, layer_id, region_key, region) 
+        VALUES ($1, $2, $3, $4, $5, $6) 
+        ON CONFLICT (id) DO NOTHING`); err != nil {
+		return nil, fmt.Errorf("prepare insert sketch operation: %w", err)
+	}
+
+	// A new stroke ends the author's redo history
+	if s.DeleteUndoneSketchOperations, err = prepare(`
+        DELETE FROM sketch_operations 
+        WHERE sketch_id = $1 AND username = $2 AND undone_at IS NOT NULL`); err != nil {
+		return nil, fmt.Errorf("prepare delete undone sketch operations: %w", err)
+	}
+
+	if s.DeleteSketchOperations, err = prepare(`
+        DELETE FROM sketch_operations WHERE sketch_id = $1`); err != nil {
+		return nil, fmt.Errorf("prepare delete sketch operations: %w", err)
+	}
+
+	if s.SelectLastSketchOperation, err = prepare(`
+        SELECT id, sketch_id, username, layer_id, region, undone_at, created_at 
+        FROM sketch_operations 
+        WHERE sketch_id = $1 AND username = $2 AND undone_at IS NULL 
+        ORDER BY seq DESC 
+        LIMIT 1`); err != nil {
+		return nil, fmt.Errorf("prepare select last sketch operation: %w", err)
+	}
+
+	if s.SelectLastUndoneSketchOperation, err = prepare(`
+        SELECT id, sketch_id, username, layer_id, region, undone_at, created_at 
+        FROM sketch_operations 
+        WHERE sketch_id = $1 AND username = $2 AND undone_at IS NOT NULL 
+        ORDER BY undone_at DESC, seq DESC 
+        LIMIT 1`); err != nil {
+		return nil, fmt.Errorf("prepare select last undone sketch operation: %w", err)
+	}
+
+	// clock_timestamp keeps several undos in one transaction in order
+	if s.UndoSketchOperation, err = prepare(`
+        UPDATE sketch_operations SET undone_at = clock_timestamp() WHERE id = $1`); err != nil {
+		return nil, fmt.Errorf("prepare undo sketch operation: %w", err)
+	}
+
+	if s.RedoSketchOperation, err = prepare(`
+        UPDATE sketch_operations SET undone_at = NULL WHERE id = $1`); err != nil {
+		return nil, fmt.Errorf("prepare redo sketch operation: %w", err)
+	}
+
+	if s.SelectActiveSketchOperations, err = prepare(`
+        SELECT id, sketch_id, username, layer_id, region, undone_at, created_at 
+        FROM sketch_operations 
+        WHERE sketch_id = $1 AND layer_id = $2 AND region_key = $3 AND undone_at IS NULL 
+        ORDER BY seq`); err != nil {
+		return nil, fmt.Errorf("prepare select active sketch operations: %w", err)
+	}
+
+	if s.UpdateSketchOperationRegion, err = prepare(`
+        UPDATE sketch_operations SET region = $2 WHERE id = $1`); err != nil {
+		return nil, fmt.Errorf("prepare update sketch operation region: %w", err)
+	}
+
+	if s.DeleteSketchOperation, err = prepare(`
+        DELETE FROM sketch_operations WHERE id = $1`); err != nil {
+		return nil, fmt.Errorf("prepare delete sketch operation: %w", err)
+	}
+
+	// Sketch version statements
+	if s.InsertSketchVersion, err = prepare(`
+        INSERT INTO sketch_versions (id, sketch_id, regions, layers, reason, created_at, created_by) 
+        VALUES ($1, $2, $3, $4, $5, $6, $7)`); err != nil {
+		return nil, fmt.Errorf("prepare insert sketch version: %w", err)
+	}
+
+	// Keeps the newest versions of a sketch and deletes the rest
+	if s.PruneSketchVersions, err = prepare(`
+        DELETE FROM sketch_versions 
+        WHERE sketch_id = $1 AND id NOT IN (
+            SELECT id FROM sketch_versions 
+            WHERE sketch_id = $1 
+            ORDER BY created_at DESC 
+            LIMIT $2
+        )`); err != nil {
+		return nil, fmt.Errorf("prepare prune sketch versions: %w", err)
+	}
+
+	if s.SelectLastSketchVersionTime, err = prepare(`
+        SELECT MAX(created_at) FROM sketch_versions WHERE sketch_id = $1`); err != nil {
+		return nil, fmt.Errorf("prepare select last sketch version time: %w", err)
+	}
+
+	if s.SelectSketchVersions, err = prepare(`
+        SELECT id, sketch_id, reason, created_at, created_by 
+        FROM sketch_versions 
+        WHERE sketch_id = $1 
+        ORDER BY created_at DESC`); err != nil {
+		return nil, fmt.Errorf("prepare select sketch versions: %w", err)
+	}
+
+	if s.SelectSketchVersion, err = prepare(`
+        SELECT id, sketch_id, reason, created_at, created_by, regions, layers 
+        FROM sketch_versions 
+        WHERE id = $1`); err != nil {
+		return nil, fmt.Errorf("prepare select sketch version: %w", err)
+	}
+
 	// Role change statements
 	if s.UpdateChannelMemberRole, err = prepare(`
         UPDATE channel_member 
@@ -233,7 +710,35 @@ func (s *Statements) CloseStatements() error {
 		s.SelectChannelMembers,
 		s.AddChannelMember,
 		s.InsertMessage,
+		s.ReserveChannelSeqs,
+		s.SelectMessagesSince,
 		s.SelectMessages,
+		s.SelectMessagesBefore,
+		s.SelectMessagesAfter,
+		s.SelectMessageByID,
+		s.UpdateMessageText,
+		s.SoftDeleteMessage,
+		s.SelectThreadReplies,
+		s.InsertReaction,
+		s.DeleteReaction,
+		s.CountReaction,
+		s.SelectMessagesReactions,
+		s.SearchMessages,
+		s.InsertPin,
+		s.DeletePin,
+		s.CountPins,
+		s.SelectPins,
+		s.InsertMention,
+		s.SelectUnreadMentions,
+		s.MarkMentionsRead,
+		s.IsChannelMember,
+		s.MarkChannelRead,
+		s.MarkMessageRead,
+		s.SelectUnreadCount,
+		s.SelectUnreadCounts,
+		s.SelectChannelUnreadCounts,
+		s.InsertDirectChannel,
+		s.SelectDirectConversations,
 		s.SelectUserChannel,
 		s.IsUserAdmin,
 		s.InsertSketch,
@@ -241,6 +746,28 @@ func (s *Statements) CloseStatements() error {
 		s.SelectSketches,
 		s.UpdateSketchRegions,
 		s.DeleteSketch,
+		s.ClearSketchRegions,
+		s.UpdateSketchThumbnail,
+		s.SelectSketchLayer,
+		s.SelectSketchStorage,
+		s.SelectSketchStoredSize,
+		s.SetSketchCompacted,
+		s.SelectSketchesToCompact,
+		s.InsertSketchOperation,
+		s.DeleteUndoneSketchOperations,
+		s.DeleteSketchOperations,
+		s.SelectLastSketchOperation,
+		s.SelectLastUndoneSketchOperation,
+		s.UndoSketchOperation,
+		s.RedoSketchOperation,
+		s.SelectActiveSketchOperations,
+		s.UpdateSketchOperationRegion,
+		s.DeleteSketchOperation,
+		s.InsertSketchVersion,
+		s.PruneSketchVersions,
+		s.SelectLastSketchVersionTime,
+		s.SelectSketchVersions,
+		s.SelectSketchVersion,
 		s.UpdateChannelMemberRole,
 		s.GetChannelAdmins,
 		s.SelectSketchForUpdate,
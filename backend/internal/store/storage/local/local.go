@@ -63,6 +63,39 @@ func (ls *LocalFileStore) SaveImage(ctx context.Context, img image.Image) (strin
 	return imgURL, thumbURL, nil
 }
 
+// Returns the public path of the saved file
+func (ls *LocalFileStore) SaveFile(ctx context.Context, dir string, data []byte, ext string) (string, error) {
+	if dir == "" || strings.ContainsAny(dir, `/\.`) {
+		return "", fmt.Errorf("invalid directory %q", dir)
+	}
+	if err := os.MkdirAll(filepath.Join(ls.basePath, dir), 0755); err != nil {
+		return "", fmt.Errorf("create directory %s: %w", dir, err)
+	}
+
+	filename := uuid.New().String() + "." + strings.TrimPrefix(ext, ".")
+	if err := os.WriteFile(filepath.Join(ls.basePath, dir, filename), data, 0644); err != nil {
+		return "", fmt.Errorf("save file: %w", err)
+	}
+	return strings.Join([]string{ls.publicPath, dir, filename}, "/"), nil
+}
+
+// Deletes a file saved under basePath; a file that is already gone is not an error
+func (ls *LocalFileStore) DeleteFile(ctx context.Context, url string) error {
+	rel, ok := strings.CutPrefix(url, ls.publicPath+"/")
+	if !ok {
+		return fmt.Errorf("not a stored file: %s", url)
+	}
+	rel = filepath.Clean(filepath.FromSlash(rel))
+	if !filepath.IsLocal(rel) {
+		return fmt.Errorf("not a stored file: %s", url)
+	}
+
+	if err := os.Remove(filepath.Join(ls.basePath, rel)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("delete file: %w", err)
+	}
+	return nil
+}
+
 // Resizes the image to standard width, keep aspect ratio
 func saveImage(img image.Image, path string) (image.Image, error) {
 	// Create destination file
@@ -8,4 +8,8 @@ import (
 
 type FileStorer interface {
 	SaveImage(ctx context.Context, img image.Image) (string, string, error)
+	// SaveFile stores data in dir under a generated name with the given extension and returns its public URL
+	SaveFile(ctx context.Context, dir string, data []byte, ext string) (string, error)
+	// DeleteFile removes a file by the public URL SaveFile returned
+	DeleteFile(ctx context.Context, url string) error
 }
@@ -2,6 +2,7 @@ package websocket
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -10,6 +11,7 @@ import (
 	"rtc-nb/backend/internal/messaging"
 	"rtc-nb/backend/internal/models"
 	"rtc-nb/backend/pkg/api/responses"
+	"strconv"
 
 	"time"
 
@@ -62,6 +64,26 @@ func (h *Handler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 	// log.Printf("Channel websocket connection for user %s to channel %s", claims.Username, channelName)
 
+	// Optional replay point: the last sequence number the client saw before reconnecting
+	var since *int64
+	if raw := r.URL.Query().Get("since"); raw != "" {
+		seq, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || seq < 0 {
+			http.Error(w, "Invalid since parameter", http.StatusBadRequest)
+			return
+		}
+		since = &seq
+	}
+
+	sessionID := sessionIDFromRequest(r)
+
+	if models.IsDirectChannelName(channelName) {
+		if _, err := h.msgProcessor.DirectParticipants(channelName, claims.Username); err != nil {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
 	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Error during WebSocket connection upgrade: %v", err)
@@ -70,22 +92,31 @@ func (h *Handler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Register user connection
-	err = h.connMgr.AddConnection(claims.Username, conn)
-	if err != nil {
-		log.Printf("Duplicate WebSocket connection attempt for user %s in channel %s. Closing new connection. Error: %v", claims.Username, channelName, err)
-		conn.Close()
-		return
-	}
+	h.connMgr.AddConnection(claims.Username, sessionID, conn)
+	// Presence is per user: only the first session in a channel announces the user
+	alreadyOnline := h.connMgr.IsUserInChannel(claims.Username, channelName)
 	h.connMgr.AddClientToChannel(channelName, conn)
+	// Replay after joining so nothing falls between the replay and live delivery; clients drop duplicate seqs
+	h.replayMissedMessages(conn, channelName, claims.Username, since)
 	// log.Printf("Added user %s to channel %s", claims.Username, channelName)
-	h.broadcastUserStatus(channelName, claims.Username, "online")
+	if !alreadyOnline {
+		h.broadcastUserStatus(channelName, claims.Username, "online")
+	}
 
 	// Cleanup on disconnect
 	defer func() {
 		// log.Printf("Removed user %s from channel %s", claims.Username, channelName)
-		h.connMgr.RemoveConnection(claims.Username)
+		// A reconnect with the same session ID may already have replaced this connection
+		if current, ok := h.connMgr.GetConnection(claims.Username, sessionID); ok && current == conn {
+			h.connMgr.RemoveConnection(claims.Username, sessionID)
+		}
 		h.connMgr.RemoveClientFromChannel(channelName, conn)
-		h.broadcastUserStatus(channelName, claims.Username, "offline")
+		// and only the last session to leave takes the user offline
+		if !h.connMgr.IsUserInChannel(claims.Username, channelName) {
+			h.msgProcessor.ClearTyping(channelName, claims.Username)
+			h.msgProcessor.ClearCursor(channelName, claims.Username)
+			h.broadcastUserStatus(channelName, claims.Username, "offline")
+		}
 		conn.Close()
 	}()
 
@@ -111,9 +142,91 @@ func (h *Handler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
+		// Opening and closing a sketch only change what this session receives
+		if cmd := outgoingMsg.Content.SketchCmd; outgoingMsg.Type == models.MessageTypeSketch && cmd != nil {
+			switch cmd.CommandType {
+			case models.SketchCommandTypeOpen:
+				h.connMgr.SetViewedSketch(conn, cmd.SketchID)
+				continue
+			case models.SketchCommandTypeClose:
+				h.connMgr.SetViewedSketch(conn, "")
+				continue
+			}
+		}
+
 		err = h.msgProcessor.ProcessMessage(outgoingMsg)
 		if err != nil {
 			log.Printf("Error processing message: %v", err)
+			h.sendRejection(conn, outgoingMsg, err)
+		}
+	}
+}
+
+// rejectionReasons are the refusals a sender is told about as they are; anything else gets a generic reason
+var rejectionReasons = []error{
+	models.ErrMessageNotFound,
+	models.ErrMessageNotModifiable,
+	models.ErrNotMessageOwner,
+	models.ErrMessageNotSaved,
+	models.ErrNotChannelMember,
+	models.ErrSketchLayerNotFound,
+	models.ErrSketchLayerLocked,
+}
+
+// sendRejection tells the sender's connection that msg was refused, so the client can undo
+// whatever it showed before the server confirmed it
+func (h *Handler) sendRejection(conn *websocket.Conn, msg *models.Message, err error) {
+	reason := "message could not be processed"
+	for _, known := range rejectionReasons {
+		if errors.Is(err, known) {
+			reason = known.Error()
+			break
+		}
+	}
+
+	var messageID string
+	switch {
+	case msg.Content.Modification != nil:
+		messageID = msg.Content.Modification.MessageID
+	case msg.Content.Reaction != nil:
+		messageID = msg.Content.Reaction.MessageID
+	}
+
+	msgBytes, err := json.Marshal(models.NewRejectionMessage(msg.ChannelName, msg.Username, msg.Type, messageID, reason))
+	if err != nil {
+		log.Printf("Error marshaling rejection message: %v", err)
+		return
+	}
+	if err := h.connMgr.Send(conn, msgBytes); err != nil {
+		log.Printf("Error sending rejection to %s in channel %s: %v", msg.Username, msg.ChannelName, err)
+	}
+}
+
+// sessionIDFromRequest returns the client's session ID (one per tab or device),
+// generating one for clients that do not send it
+func sessionIDFromRequest(r *http.Request) string {
+	if sessionID := r.URL.Query().Get("session"); sessionID != "" {
+		return sessionID
+	}
+	return uuid.NewString()
+}
+
+func (h *Handler) replayMissedMessages(conn *websocket.Conn, channelName, username string, since *int64) {
+	missed, err := h.msgProcessor.MissedMessages(channelName, username, since)
+	if err != nil {
+		log.Printf("Error loading missed messages for %s in channel %s: %v", username, channelName, err)
+		return
+	}
+
+	for _, msg := range missed {
+		msgBytes, err := json.Marshal(msg)
+		if err != nil {
+			log.Printf("Error marshaling replayed message: %v", err)
+			continue
+		}
+		if err := h.connMgr.Send(conn, msgBytes); err != nil {
+			log.Printf("Stopped replay for %s in channel %s: %v", username, channelName, err)
+			return
 		}
 	}
 }
@@ -158,6 +271,8 @@ func (h *Handler) HandleSystemWebSocket(w http.ResponseWriter, r *http.Request)
 	username := claims.Username
 	// log.Printf("Handling system WebSocket connection for user: %s", username)
 
+	sessionID := sessionIDFromRequest(r)
+
 	// Upgrade HTTP connection to WebSocket
 	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -166,11 +281,14 @@ func (h *Handler) HandleSystemWebSocket(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Register the system connection (separate from channel connections)
-	h.connMgr.AddSystemConnection(username, conn)
+	h.connMgr.AddSystemConnection(username, sessionID, conn)
 	h.broadcastSystemUserCount()
 	defer func() {
 		// log.Printf("Closing system WebSocket connection for user: %s", username)
-		h.connMgr.RemoveSystemConnection(username)
+		// A reconnect with the same session ID may already have replaced this connection
+		if current, ok := h.connMgr.GetSystemConnection(username, sessionID); ok && current == conn {
+			h.connMgr.RemoveSystemConnection(username, sessionID)
+		}
 		h.broadcastSystemUserCount()
 		conn.Close()
 	}()
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -13,7 +14,9 @@ import (
 	"rtc-nb/backend/internal/services/sketch"
 	"rtc-nb/backend/pkg/api/responses"
 	"rtc-nb/backend/pkg/utils"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -169,12 +172,7 @@ func (h *Handlers) LogoutHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get WebSocket connection and disconnect if exists
-	if conn, exists := h.chatService.GetUserConnection(claims.Username); exists {
-		conn.Close()
-	}
-
-	// Clear any Redis data (if needed)
+	// Disconnect every websocket session of the user
 	ctx := r.Context()
 	if err := h.chatService.ClearUserSession(ctx, claims.Username); err != nil {
 		log.Printf("Error clearing user session: %v", err)
@@ -255,6 +253,9 @@ func (h *Handlers) CreateChannelHandler(w http.ResponseWriter, r *http.Request)
 	} else if strings.ToLower(channelName) == "system" {
 		responses.SendError(w, "'system' is a reserved channel name", http.StatusBadRequest)
 		return
+	} else if strings.HasPrefix(strings.ToLower(channelName), models.DirectChannelPrefix) {
+		responses.SendError(w, fmt.Sprintf("'%s' is a reserved channel name prefix", models.DirectChannelPrefix), http.StatusBadRequest)
+		return
 	}
 
 	claims, ok := auth.ClaimsFromContext(r.Context())
@@ -303,6 +304,21 @@ func (h *Handlers) GetChannelsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	claims, ok := auth.ClaimsFromContext(ctx)
+	if !ok {
+		responses.SendError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	unreadCounts, err := h.chatService.GetUnreadCounts(ctx, claims.Username)
+	if err != nil {
+		log.Printf("Error getting unread counts: %v", err)
+		responses.SendError(w, "Failed to get channels", http.StatusInternalServerError)
+		return
+	}
+	for _, channel := range channels {
+		channel.UnreadCount = unreadCounts[channel.Name]
+	}
+
 	responses.SendSuccess(w, channels, http.StatusOK)
 }
 
@@ -559,13 +575,7 @@ func (h *Handlers) GetSketchHandler(w http.ResponseWriter, r *http.Request) {
 	sketchId := vars["sketchId"]
 
 	// Validate channel membership
-	userChannel, err := h.connMgr.GetUserChannel(claims.Username)
-	if err != nil {
-		responses.SendError(w, "Unauthorized: Could not verify user channel connection", http.StatusUnauthorized)
-		return
-	}
-
-	if userChannel != channelName {
+	if !h.connMgr.IsUserInChannel(claims.Username, channelName) {
 		responses.SendError(w, "Not a member of this channel", http.StatusUnauthorized)
 		return
 	}
@@ -596,13 +606,7 @@ func (h *Handlers) GetSketchesHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate channel membership
-	userChannel, err := h.connMgr.GetUserChannel(claims.Username)
-	if err != nil {
-		responses.SendError(w, "Unauthorized: Could not verify user channel connection", http.StatusUnauthorized)
-		return
-	}
-
-	if userChannel != channelName {
+	if !h.connMgr.IsUserInChannel(claims.Username, channelName) {
 		responses.SendError(w, "Not a member of this channel", http.StatusUnauthorized)
 		return
 	}
@@ -721,6 +725,299 @@ func (h *Handlers) ClearSketchHandler(w http.ResponseWriter, r *http.Request) {
 	responses.SendSuccess(w, "Success", http.StatusOK)
 }
 
+// sketchRequest resolves the sketch named in a channel sketch route and checks the caller may see it.
+// On failure it has already written the error response.
+func (h *Handlers) sketchRequest(w http.ResponseWriter, r *http.Request) (string, *models.Sketch, bool) {
+	vars := mux.Vars(r)
+	channelName := vars["channelName"]
+	sketchID := vars["sketchId"]
+	if channelName == "" || sketchID == "" {
+		responses.SendError(w, "Channel name and sketch ID required", http.StatusBadRequest)
+		return "", nil, false
+	}
+
+	claims, ok := auth.ClaimsFromContext(r.Context())
+	if !ok {
+		responses.SendError(w, "Unauthorized", http.StatusUnauthorized)
+		return "", nil, false
+	}
+
+	if !h.connMgr.IsUserInChannel(claims.Username, channelName) {
+		responses.SendError(w, "Not a member of this channel", http.StatusUnauthorized)
+		return "", nil, false
+	}
+
+	sketch, err := h.sketchService.GetSketch(r.Context(), sketchID)
+	if err != nil {
+		log.Printf("Error getting sketch %s: %v", sketchID, err)
+		responses.SendError(w, "Failed to get sketch", http.StatusInternalServerError)
+		return "", nil, false
+	}
+	if sketch == nil || sketch.ChannelName != channelName {
+		responses.SendError(w, "Sketch not found", http.StatusNotFound)
+		return "", nil, false
+	}
+	return claims.Username, sketch, true
+}
+
+func (h *Handlers) GetSketchVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	_, sketch, ok := h.sketchRequest(w, r)
+	if !ok {
+		return
+	}
+
+	versions, err := h.sketchService.GetSketchVersions(r.Context(), sketch.ID)
+	if err != nil {
+		log.Printf("Error getting versions of sketch %s: %v", sketch.ID, err)
+		responses.SendError(w, "Failed to get sketch versions", http.StatusInternalServerError)
+		return
+	}
+
+	responses.SendSuccess(w, versions, http.StatusOK)
+}
+
+// CreateSketchVersionHandler snapshots the sketch's current state on demand
+func (h *Handlers) CreateSketchVersionHandler(w http.ResponseWriter, r *http.Request) {
+	username, sketch, ok := h.sketchRequest(w, r)
+	if !ok {
+		return
+	}
+
+	version, err := h.sketchService.SnapshotSketch(r.Context(), sketch.ID, username)
+	if err != nil {
+		h.sendSketchVersionError(w, "snapshot", err)
+		return
+	}
+
+	responses.SendSuccess(w, version, http.StatusCreated)
+}
+
+func (h *Handlers) GetSketchVersionHandler(w http.ResponseWriter, r *http.Request) {
+	_, sketch, ok := h.sketchRequest(w, r)
+	if !ok {
+		return
+	}
+
+	version, err := h.sketchService.GetSketchVersion(r.Context(), sketch.ID, mux.Vars(r)["versionId"])
+	if err != nil {
+		h.sendSketchVersionError(w, "get", err)
+		return
+	}
+
+	responses.SendSuccess(w, version, http.StatusOK)
+}
+
+// RestoreSketchVersionHandler rolls the sketch back to a version and sends the restored sketch to the channel
+func (h *Handlers) RestoreSketchVersionHandler(w http.ResponseWriter, r *http.Request) {
+	username, sketch, ok := h.sketchRequest(w, r)
+	if !ok {
+		return
+	}
+
+	restored, err := h.sketchService.RestoreSketchVersion(r.Context(), sketch.ID, mux.Vars(r)["versionId"], username)
+	if err != nil {
+		h.sendSketchVersionError(w, "restore", err)
+		return
+	}
+
+	// Broadcast RESTORE sketch command with the full sketch via WebSocket
+	broadcastCmd := models.SketchCommand{
+		CommandType: models.SketchCommandTypeRestore,
+		SketchID:    restored.ID,
+		SketchData:  restored,
+	}
+	broadcastMsg := models.NewSketchBroadcastMessage(restored.ChannelName, username, broadcastCmd)
+	if broadcastErr := h.msgProcessor.ProcessMessage(broadcastMsg); broadcastErr != nil {
+		log.Printf("Error broadcasting restore sketch message for sketch %s in channel %s: %v", restored.ID, restored.ChannelName, broadcastErr)
+		// Log error but don't fail the API response, restore was successful
+	}
+
+	responses.SendSuccess(w, restored, http.StatusOK)
+}
+
+// CreateSketchLayerHandler adds a layer on top of the sketch's layers
+func (h *Handlers) CreateSketchLayerHandler(w http.ResponseWriter, r *http.Request) {
+	username, sketch, ok := h.sketchRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		responses.SendError(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	layers, err := h.sketchService.CreateLayer(r.Context(), sketch.ID, req.Name, username)
+	if err != nil {
+		h.sendSketchLayerError(w, "create", err)
+		return
+	}
+
+	h.broadcastSketchLayers(sketch, username, layers)
+	responses.SendSuccess(w, layers, http.StatusCreated)
+}
+
+// UpdateSketchLayerHandler renames, hides or shows, and locks or unlocks a layer
+func (h *Handlers) UpdateSketchLayerHandler(w http.ResponseWriter, r *http.Request) {
+	username, sketch, ok := h.sketchRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req models.SketchLayerUpdate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		responses.SendError(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	layers, err := h.sketchService.UpdateLayer(r.Context(), sketch.ID, mux.Vars(r)["layerId"], username, req)
+	if err != nil {
+		h.sendSketchLayerError(w, "update", err)
+		return
+	}
+
+	h.broadcastSketchLayers(sketch, username, layers)
+	responses.SendSuccess(w, layers, http.StatusOK)
+}
+
+// ReorderSketchLayersHandler restacks a sketch's layers in the order given, bottom to top
+func (h *Handlers) ReorderSketchLayersHandler(w http.ResponseWriter, r *http.Request) {
+	username, sketch, ok := h.sketchRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		LayerIDs []string `json:"layer_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		responses.SendError(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	layers, err := h.sketchService.ReorderLayers(r.Context(), sketch.ID, req.LayerIDs)
+	if err != nil {
+		h.sendSketchLayerError(w, "reorder", err)
+		return
+	}
+
+	h.broadcastSketchLayers(sketch, username, layers)
+	responses.SendSuccess(w, layers, http.StatusOK)
+}
+
+// broadcastSketchLayers sends a sketch's new layer structure to its channel
+func (h *Handlers) broadcastSketchLayers(sketch *models.Sketch, username string, layers []models.SketchLayer) {
+	broadcastCmd := models.SketchCommand{
+		CommandType: models.SketchCommandTypeLayers,
+		SketchID:    sketch.ID,
+		Layers:      layers,
+	}
+	broadcastMsg := models.NewSketchBroadcastMessage(sketch.ChannelName, username, broadcastCmd)
+	if broadcastErr := h.msgProcessor.ProcessMessage(broadcastMsg); broadcastErr != nil {
+		log.Printf("Error broadcasting layers of sketch %s in channel %s: %v", sketch.ID, sketch.ChannelName, broadcastErr)
+		// Log error but don't fail the API response, the layers were saved
+	}
+}
+
+func (h *Handlers) sendSketchLayerError(w http.ResponseWriter, action string, err error) {
+	switch {
+	case errors.Is(err, models.ErrSketchNotFound), errors.Is(err, models.ErrSketchLayerNotFound):
+		responses.SendError(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, models.ErrSketchLayerLocked), errors.Is(err, models.ErrSketchLayerNotOwner):
+		responses.SendError(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, models.ErrSketchLayerLimit):
+		responses.SendError(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, models.ErrInvalidSketchLayerName), errors.Is(err, models.ErrInvalidSketchLayerOrder):
+		responses.SendError(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("Error trying to %s sketch layer: %v", action, err)
+		responses.SendError(w, fmt.Sprintf("Failed to %s sketch layer", action), http.StatusInternalServerError)
+	}
+}
+
+// ExportSketchHandler renders a sketch as PNG or SVG. It downloads the file, or with save=true
+// stores it in the file store and returns its URL.
+func (h *Handlers) ExportSketchHandler(w http.ResponseWriter, r *http.Request) {
+	_, sketchModel, ok := h.sketchRequest(w, r)
+	if !ok {
+		return
+	}
+
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format == "" {
+		format = sketch.ExportFormatPNG
+	}
+
+	if r.URL.Query().Get("save") == "true" {
+		url, err := h.sketchService.SaveSketchExport(r.Context(), sketchModel.ID, format)
+		if err != nil {
+			h.sendSketchExportError(w, sketchModel.ID, err)
+			return
+		}
+		responses.SendSuccess(w, map[string]string{"url": url}, http.StatusCreated)
+		return
+	}
+
+	data, err := h.sketchService.ExportSketch(r.Context(), sketchModel.ID, format)
+	if err != nil {
+		h.sendSketchExportError(w, sketchModel.ID, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", sketch.ExportContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="sketch-%s.%s"`, sketchModel.ID, format))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(data); err != nil {
+		log.Printf("Error writing export of sketch %s: %v", sketchModel.ID, err)
+	}
+}
+
+// GetSketchStatsHandler reports how much space the sketch takes in the database and what its last compaction saved
+func (h *Handlers) GetSketchStatsHandler(w http.ResponseWriter, r *http.Request) {
+	_, sketchModel, ok := h.sketchRequest(w, r)
+	if !ok {
+		return
+	}
+
+	stats, err := h.sketchService.GetStorageStats(r.Context(), sketchModel)
+	if errors.Is(err, models.ErrSketchNotFound) {
+		responses.SendError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting storage stats of sketch %s: %v", sketchModel.ID, err)
+		responses.SendError(w, "Failed to get sketch stats", http.StatusInternalServerError)
+		return
+	}
+
+	responses.SendSuccess(w, stats, http.StatusOK)
+}
+
+func (h *Handlers) sendSketchExportError(w http.ResponseWriter, sketchID string, err error) {
+	switch {
+	case errors.Is(err, sketch.ErrUnsupportedExportFormat):
+		responses.SendError(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, models.ErrSketchNotFound):
+		responses.SendError(w, err.Error(), http.StatusNotFound)
+	default:
+		log.Printf("Error exporting sketch %s: %v", sketchID, err)
+		responses.SendError(w, "Failed to export sketch", http.StatusInternalServerError)
+	}
+}
+
+func (h *Handlers) sendSketchVersionError(w http.ResponseWriter, action string, err error) {
+	switch {
+	case errors.Is(err, models.ErrSketchNotFound), errors.Is(err, models.ErrSketchVersionNotFound):
+		responses.SendError(w, err.Error(), http.StatusNotFound)
+	default:
+		log.Printf("Error trying to %s sketch version: %v", action, err)
+		responses.SendError(w, fmt.Sprintf("Failed to %s sketch version", action), http.StatusInternalServerError)
+	}
+}
+
 func (h *Handlers) GetMessagesHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	channelName := vars["channelName"]
@@ -729,7 +1026,18 @@ func (h *Handlers) GetMessagesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	messages, err := h.chatService.GetMessages(r.Context(), channelName)
+	page, err := parseMessagePageRequest(r)
+	if err != nil {
+		responses.SendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if models.IsDirectChannelName(channelName) && !h.isDirectParticipant(r, channelName) {
+		responses.SendError(w, "Not a participant in this conversation", http.StatusForbidden)
+		return
+	}
+
+	messages, err := h.chatService.GetMessages(r.Context(), channelName, page)
 	if err != nil {
 		log.Printf("Error getting messages: %v", err)
 		responses.SendError(w, "Failed to get messages", http.StatusInternalServerError)
@@ -739,6 +1047,404 @@ func (h *Handlers) GetMessagesHandler(w http.ResponseWriter, r *http.Request) {
 	responses.SendSuccess(w, messages, http.StatusOK)
 }
 
+func (h *Handlers) GetThreadHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channelName := vars["channelName"]
+	messageID := vars["messageId"]
+	if channelName == "" || messageID == "" {
+		responses.SendError(w, "Channel name and message ID required", http.StatusBadRequest)
+		return
+	}
+
+	claims, ok := auth.ClaimsFromContext(r.Context())
+	if !ok {
+		responses.SendError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	page, err := parseMessagePageRequest(r)
+	if err != nil {
+		responses.SendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if page.Before != nil {
+		responses.SendError(w, "Threads only support the after cursor", http.StatusBadRequest)
+		return
+	}
+
+	if models.IsDirectChannelName(channelName) && !h.isDirectParticipant(r, channelName) {
+		responses.SendError(w, "Not a participant in this conversation", http.StatusForbidden)
+		return
+	}
+
+	thread, err := h.chatService.GetThread(r.Context(), channelName, messageID, claims.Username, page)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrMessageNotFound):
+			responses.SendError(w, "Message not found", http.StatusNotFound)
+		case errors.Is(err, models.ErrChannelNotFound):
+			responses.SendError(w, "Channel not found", http.StatusNotFound)
+		case errors.Is(err, models.ErrNotChannelMember):
+			responses.SendError(w, "Not a member of this channel", http.StatusForbidden)
+		default:
+			log.Printf("Error getting thread: %v", err)
+			responses.SendError(w, "Failed to get thread", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	responses.SendSuccess(w, thread, http.StatusOK)
+}
+
+func (h *Handlers) SearchMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	channelName := mux.Vars(r)["channelName"]
+	if channelName == "" {
+		responses.SendError(w, "Channel name required", http.StatusBadRequest)
+		return
+	}
+
+	claims, ok := auth.ClaimsFromContext(r.Context())
+	if !ok {
+		responses.SendError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query, err := parseMessageSearchQuery(r)
+	if err != nil {
+		responses.SendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.chatService.SearchMessages(r.Context(), channelName, claims.Username, query)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrChannelNotFound):
+			responses.SendError(w, "Channel not found", http.StatusNotFound)
+		case errors.Is(err, models.ErrNotChannelMember):
+			responses.SendError(w, "Not a member of this channel", http.StatusForbidden)
+		default:
+			log.Printf("Error searching messages: %v", err)
+			responses.SendError(w, "Failed to search messages", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	responses.SendSuccess(w, result, http.StatusOK)
+}
+
+// parseMessageSearchQuery reads q, author, from, to, before and limit from the query string.
+// Dates accept RFC 3339 timestamps or plain YYYY-MM-DD days.
+func parseMessageSearchQuery(r *http.Request) (models.MessageSearchQuery, error) {
+	var query models.MessageSearchQuery
+	params := r.URL.Query()
+
+	query.Query = strings.TrimSpace(params.Get("q"))
+	if query.Query == "" {
+		return query, fmt.Errorf("search query required")
+	}
+	if len(query.Query) > models.MaxSearchQueryLength {
+		return query, fmt.Errorf("search query cannot exceed %d characters", models.MaxSearchQueryLength)
+	}
+
+	if author := params.Get("author"); author != "" {
+		query.Author = &author
+	}
+
+	for _, bound := range []struct {
+		name string
+		dst  **time.Time
+	}{{"from", &query.From}, {"to", &query.To}} {
+		value := params.Get(bound.name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			if t, err = time.Parse(time.DateOnly, value); err != nil {
+				return query, fmt.Errorf("invalid %s date", bound.name)
+			}
+		}
+		t = t.UTC()
+		*bound.dst = &t
+	}
+
+	page, err := parseMessagePageRequest(r)
+	if err != nil {
+		return query, err
+	}
+	if page.After != nil {
+		return query, fmt.Errorf("search results only support the before cursor")
+	}
+	query.Before = page.Before
+	query.Limit = page.Limit
+	return query, nil
+}
+
+// parseMessagePageRequest reads the before/after cursors and limit from the query string
+func parseMessagePageRequest(r *http.Request) (models.MessagePageRequest, error) {
+	var page models.MessagePageRequest
+	query := r.URL.Query()
+
+	before, after := query.Get("before"), query.Get("after")
+	if before != "" && after != "" {
+		return page, fmt.Errorf("only one of before or after may be provided")
+	}
+	if before != "" {
+		cursor, err := models.DecodeMessageCursor(before)
+		if err != nil {
+			return page, err
+		}
+		page.Before = cursor
+	}
+	if after != "" {
+		cursor, err := models.DecodeMessageCursor(after)
+		if err != nil {
+			return page, err
+		}
+		page.After = cursor
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return page, fmt.Errorf("limit must be a positive integer")
+		}
+		page.Limit = n
+	}
+	return page, nil
+}
+
+func (h *Handlers) GetDirectConversationsHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := auth.ClaimsFromContext(r.Context())
+	if !ok {
+		responses.SendError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	conversations, err := h.chatService.GetDirectConversations(r.Context(), claims.Username)
+	if err != nil {
+		log.Printf("Error getting direct conversations: %v", err)
+		responses.SendError(w, "Failed to get direct conversations", http.StatusInternalServerError)
+		return
+	}
+
+	responses.SendSuccess(w, conversations, http.StatusOK)
+}
+
+func (h *Handlers) OpenDirectConversationHandler(w http.ResponseWriter, r *http.Request) {
+	participant := mux.Vars(r)["username"]
+	if participant == "" {
+		responses.SendError(w, "Username required", http.StatusBadRequest)
+		return
+	}
+
+	claims, ok := auth.ClaimsFromContext(r.Context())
+	if !ok {
+		responses.SendError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	conversation, err := h.chatService.OpenDirectConversation(r.Context(), claims.Username, participant)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrSelfConversation):
+			responses.SendError(w, "Cannot open a conversation with yourself", http.StatusBadRequest)
+		case errors.Is(err, models.ErrUserNotFound):
+			responses.SendError(w, "User not found", http.StatusNotFound)
+		default:
+			log.Printf("Error opening direct conversation: %v", err)
+			responses.SendError(w, "Failed to open direct conversation", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	responses.SendSuccess(w, conversation, http.StatusOK)
+}
+
+func (h *Handlers) MarkDirectConversationReadHandler(w http.ResponseWriter, r *http.Request) {
+	participant := mux.Vars(r)["username"]
+	if participant == "" {
+		responses.SendError(w, "Username required", http.StatusBadRequest)
+		return
+	}
+
+	claims, ok := auth.ClaimsFromContext(r.Context())
+	if !ok {
+		responses.SendError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.chatService.MarkDirectConversationRead(r.Context(), claims.Username, participant); err != nil {
+		if errors.Is(err, models.ErrNotChannelMember) {
+			responses.SendError(w, "Conversation not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error marking direct conversation read: %v", err)
+		responses.SendError(w, "Failed to mark conversation read", http.StatusInternalServerError)
+		return
+	}
+
+	responses.SendSuccess(w, "Conversation marked read", http.StatusOK)
+}
+
+// isDirectParticipant reports whether the requesting user is one of the two participants of channelName
+func (h *Handlers) isDirectParticipant(r *http.Request, channelName string) bool {
+	claims, ok := auth.ClaimsFromContext(r.Context())
+	if !ok {
+		return false
+	}
+	participants, err := h.chatService.GetDirectParticipants(r.Context(), channelName)
+	if err != nil {
+		return false
+	}
+	for _, participant := range participants {
+		if participant == claims.Username {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Handlers) GetPinnedMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	channelName := mux.Vars(r)["channelName"]
+	if channelName == "" {
+		responses.SendError(w, "Channel name required", http.StatusBadRequest)
+		return
+	}
+
+	claims, ok := auth.ClaimsFromContext(r.Context())
+	if !ok {
+		responses.SendError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	pins, err := h.chatService.GetPinnedMessages(r.Context(), channelName, claims.Username)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrChannelNotFound):
+			responses.SendError(w, "Channel not found", http.StatusNotFound)
+		case errors.Is(err, models.ErrNotChannelMember):
+			responses.SendError(w, "Not a member of this channel", http.StatusForbidden)
+		default:
+			log.Printf("Error getting pinned messages: %v", err)
+			responses.SendError(w, "Failed to get pinned messages", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	responses.SendSuccess(w, pins, http.StatusOK)
+}
+
+func (h *Handlers) PinMessageHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channelName := vars["channelName"]
+	messageID := vars["messageId"]
+	if channelName == "" || messageID == "" {
+		responses.SendError(w, "Channel name and message ID required", http.StatusBadRequest)
+		return
+	}
+
+	claims, ok := auth.ClaimsFromContext(r.Context())
+	if !ok {
+		responses.SendError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// A message sent moments ago may still be waiting in the chat buffer
+	if err := h.msgProcessor.PersistPending(r.Context(), messageID); err != nil {
+		h.sendPinError(w, "pin", err)
+		return
+	}
+
+	msg, err := h.chatService.PinMessage(r.Context(), channelName, messageID, claims.Username)
+	if err != nil {
+		h.sendPinError(w, "pin", err)
+		return
+	}
+
+	// Broadcast PinUpdate channel message
+	pinUpdateMsg := models.NewPinUpdateMessage(channelName, claims.Username, "pinned", messageID, msg)
+	if err := h.msgProcessor.ProcessMessage(pinUpdateMsg); err != nil {
+		log.Printf("Error broadcasting pin update for message %s in channel %s: %v", messageID, channelName, err)
+		// Log error but continue, pin was successful
+	}
+
+	responses.SendSuccess(w, msg, http.StatusOK)
+}
+
+func (h *Handlers) UnpinMessageHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channelName := vars["channelName"]
+	messageID := vars["messageId"]
+	if channelName == "" || messageID == "" {
+		responses.SendError(w, "Channel name and message ID required", http.StatusBadRequest)
+		return
+	}
+
+	claims, ok := auth.ClaimsFromContext(r.Context())
+	if !ok {
+		responses.SendError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.chatService.UnpinMessage(r.Context(), channelName, messageID, claims.Username); err != nil {
+		h.sendPinError(w, "unpin", err)
+		return
+	}
+
+	// Broadcast PinUpdate channel message
+	pinUpdateMsg := models.NewPinUpdateMessage(channelName, claims.Username, "unpinned", messageID, nil)
+	if err := h.msgProcessor.ProcessMessage(pinUpdateMsg); err != nil {
+		log.Printf("Error broadcasting unpin update for message %s in channel %s: %v", messageID, channelName, err)
+		// Log error but continue, unpin was successful
+	}
+
+	responses.SendSuccess(w, "Message unpinned", http.StatusOK)
+}
+
+func (h *Handlers) sendPinError(w http.ResponseWriter, action string, err error) {
+	switch {
+	case errors.Is(err, models.ErrNotChannelAdmin):
+		responses.SendError(w, fmt.Sprintf("Only channel admins can %s messages", action), http.StatusForbidden)
+	case errors.Is(err, models.ErrMessageNotFound), errors.Is(err, models.ErrMessageNotPinned):
+		responses.SendError(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, models.ErrMessageNotModifiable), errors.Is(err, models.ErrPinLimitReached):
+		responses.SendError(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, models.ErrMessageNotSaved):
+		responses.SendError(w, models.ErrMessageNotSaved.Error(), http.StatusServiceUnavailable)
+	default:
+		log.Printf("Error trying to %s message: %v", action, err)
+		responses.SendError(w, fmt.Sprintf("Failed to %s message", action), http.StatusInternalServerError)
+	}
+}
+
+func (h *Handlers) GetMentionsHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := auth.ClaimsFromContext(r.Context())
+	if !ok {
+		responses.SendError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	limit := models.MaxMentionsPageSize
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 {
+			responses.SendError(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	mentions, err := h.chatService.GetUnreadMentions(r.Context(), claims.Username, limit)
+	if err != nil {
+		log.Printf("Error getting mentions: %v", err)
+		responses.SendError(w, "Failed to get mentions", http.StatusInternalServerError)
+		return
+	}
+
+	responses.SendSuccess(w, mentions, http.StatusOK)
+}
+
 func (h *Handlers) UpdateChannelMemberRole(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	channelName := vars["channelName"]
@@ -787,6 +1493,16 @@ func (h *Handlers) GetAllOnlineUsersHandler(w http.ResponseWriter, r *http.Reque
 	responses.SendSuccess(w, onlineUsers, http.StatusOK)
 }
 
+// GetConnectionStatsHandler reports outbound websocket queue depth and slow consumer counters
+func (h *Handlers) GetConnectionStatsHandler(w http.ResponseWriter, r *http.Request) {
+	responses.SendSuccess(w, h.connMgr.QueueStats(), http.StatusOK)
+}
+
+// GetBufferStatsHandler reports chat messages awaiting persistence, including those spooled to disk
+func (h *Handlers) GetBufferStatsHandler(w http.ResponseWriter, r *http.Request) {
+	responses.SendSuccess(w, h.msgProcessor.BufferStats(), http.StatusOK)
+}
+
 func (h *Handlers) GetOnlineUsersInChannelHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	channelName := vars["channelName"]
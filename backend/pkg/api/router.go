@@ -3,8 +3,10 @@ package api
 import (
 	"log"
 	"net/http"
-	"os"            // Import os package
+	"os" // Import os package
+	"path"
 	"path/filepath" // Import path/filepath package
+	"strings"
 
 	"github.com/gorilla/mux"
 
@@ -18,7 +20,9 @@ import (
 	"rtc-nb/backend/pkg/api/middleware"
 )
 
-func RegisterRoutes(router *mux.Router, wsh *websocket.Handler, connManager connections.Manager, chatService chat.ChatManager, sketchService *sketch.Service,
+// RegisterRoutes registers the public routes on router and the operational ones on internalRouter,
+// which is served only on the internal listener; a nil internalRouter leaves them out
+func RegisterRoutes(router, internalRouter *mux.Router, wsh *websocket.Handler, connManager connections.Manager, chatService chat.ChatManager, sketchService *sketch.Service,
 	fileStorePath string, msgProcessor *messaging.Processor) {
 
 	// Define the directory where frontend build output is located
@@ -57,9 +61,20 @@ func RegisterRoutes(router *mux.Router, wsh *websocket.Handler, connManager conn
 	protected.HandleFunc("/channels/{channelName}/members/{username}/role", handlers.UpdateChannelMemberRole).Methods("PATCH")
 	protected.HandleFunc("/channels/{channelName}/members", handlers.GetChannelMembersHandler).Methods("GET")
 
+	// Direct conversation routes
+	protected.HandleFunc("/dms", handlers.GetDirectConversationsHandler).Methods("GET")
+	protected.HandleFunc("/dms/{username}", handlers.OpenDirectConversationHandler).Methods("POST")
+	protected.HandleFunc("/dms/{username}/read", handlers.MarkDirectConversationReadHandler).Methods("POST")
+
 	// -- Messages routes
 	protected.HandleFunc("/upload", handlers.UploadHandler).Methods("POST")
 	protected.HandleFunc("/getMessages/{channelName}", handlers.GetMessagesHandler).Methods("GET")
+	protected.HandleFunc("/channels/{channelName}/messages/search", handlers.SearchMessagesHandler).Methods("GET")
+	protected.HandleFunc("/channels/{channelName}/messages/{messageId}/thread", handlers.GetThreadHandler).Methods("GET")
+	protected.HandleFunc("/channels/{channelName}/pins", handlers.GetPinnedMessagesHandler).Methods("GET")
+	protected.HandleFunc("/channels/{channelName}/pins/{messageId}", handlers.PinMessageHandler).Methods("POST")
+	protected.HandleFunc("/channels/{channelName}/pins/{messageId}", handlers.UnpinMessageHandler).Methods("DELETE")
+	protected.HandleFunc("/mentions", handlers.GetMentionsHandler).Methods("GET")
 
 	// Auth routes
 	protected.HandleFunc("/validateToken", handlers.ValidateTokenHandler).Methods("GET")
@@ -70,10 +85,25 @@ func RegisterRoutes(router *mux.Router, wsh *websocket.Handler, connManager conn
 	protected.HandleFunc("/onlineUsers/{channelName}", handlers.GetOnlineUsersInChannelHandler).Methods("GET")
 	protected.HandleFunc("/onlineUsersCount", handlers.GetAllOnlineUsersHandler).Methods("GET")
 
+	// Operational stats cover every channel, so they stay off the public listener
+	if internalRouter != nil {
+		internalRouter.HandleFunc("/connectionStats", handlers.GetConnectionStatsHandler).Methods("GET")
+		internalRouter.HandleFunc("/bufferStats", handlers.GetBufferStatsHandler).Methods("GET")
+	}
+
 	// Sketch routes
 	protected.HandleFunc("/createSketch", handlers.CreateSketchHandler).Methods("POST")
 	protected.HandleFunc("/channels/{channelName}/sketches/{sketchId}", handlers.GetSketchHandler).Methods("GET")
 	protected.HandleFunc("/channels/{channelName}/sketches", handlers.GetSketchesHandler).Methods("GET")
+	protected.HandleFunc("/channels/{channelName}/sketches/{sketchId}/export", handlers.ExportSketchHandler).Methods("GET")
+	protected.HandleFunc("/channels/{channelName}/sketches/{sketchId}/stats", handlers.GetSketchStatsHandler).Methods("GET")
+	protected.HandleFunc("/channels/{channelName}/sketches/{sketchId}/layers", handlers.CreateSketchLayerHandler).Methods("POST")
+	protected.HandleFunc("/channels/{channelName}/sketches/{sketchId}/layers/order", handlers.ReorderSketchLayersHandler).Methods("PUT")
+	protected.HandleFunc("/channels/{channelName}/sketches/{sketchId}/layers/{layerId}", handlers.UpdateSketchLayerHandler).Methods("PATCH")
+	protected.HandleFunc("/channels/{channelName}/sketches/{sketchId}/versions", handlers.GetSketchVersionsHandler).Methods("GET")
+	protected.HandleFunc("/channels/{channelName}/sketches/{sketchId}/versions", handlers.CreateSketchVersionHandler).Methods("POST")
+	protected.HandleFunc("/channels/{channelName}/sketches/{sketchId}/versions/{versionId}", handlers.GetSketchVersionHandler).Methods("GET")
+	protected.HandleFunc("/channels/{channelName}/sketches/{sketchId}/versions/{versionId}/restore", handlers.RestoreSketchVersionHandler).Methods("POST")
 	protected.HandleFunc("/deleteSketch/{sketchId}", handlers.DeleteSketchHandler).Methods("DELETE")
 	protected.HandleFunc("/clearSketch", handlers.ClearSketchHandler).Methods("POST")
 
@@ -86,6 +116,11 @@ func RegisterRoutes(router *mux.Router, wsh *websocket.Handler, connManager conn
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
+		// The chat spool shares the file store but holds other channels' unsaved messages
+		if cleaned := path.Clean("/" + r.URL.Path); cleaned == "/"+messaging.SpoolDir || strings.HasPrefix(cleaned, "/"+messaging.SpoolDir+"/") {
+			http.NotFound(w, r)
+			return
+		}
 		uploadFileServer.ServeHTTP(w, r)
 	})
 	// Serve uploaded files from /api/files/ (Requires token in query param)
@@ -26,10 +26,16 @@ export const channelApi = {
     return res.data;
   },
 
-  // Fetch messages for a channel
-  fetchMessages: async (channelName: string, token: string): Promise<APIResponse<IncomingMessage[]>> => {
+  // Fetch a page of messages for a channel (latest page unless a `before` cursor is given).
+  // The server sends next_cursor and has_more; axiosInstance camelCases them.
+  fetchMessages: async (
+    channelName: string,
+    token: string,
+    before?: string
+  ): Promise<APIResponse<{ messages: IncomingMessage[]; nextCursor?: string; hasMore: boolean }>> => {
     const res = await axiosInstance.get(`${BASE_URL}/getMessages/${encodeURIComponent(channelName)}`, {
       headers: { Authorization: `Bearer ${token}` },
+      params: before ? { before } : undefined,
     });
     if (!res.data.success) {
       throw new Error((res.data as APIErrorResponse).error.message || "Failed to get messages");
@@ -7,9 +7,11 @@ import { useWebSocketContext } from "../../hooks/useWebSocketContext";
 
 export const MessageList = () => {
   const { state: systemState } = useSystemContext();
-  const { state: channelState } = useChannelContext();
+  const { state: channelState, actions: channelActions } = useChannelContext();
   const { state: wsState } = useWebSocketContext();
   const messageContainerRef = useRef<HTMLDivElement>(null);
+  // Scroll height and oldest message before loading older ones, so the view can stay where it was
+  const beforeOlderRef = useRef<{ height: number; firstId?: string } | null>(null);
 
   const channelConnected = wsState ? wsState.channelConnected : false;
 
@@ -34,6 +36,12 @@ export const MessageList = () => {
 
   useEffect(() => {
     const container = messageContainerRef.current;
+    const beforeOlder = beforeOlderRef.current;
+    beforeOlderRef.current = null;
+    if (container && beforeOlder && channelState.messages[0]?.id !== beforeOlder.firstId) {
+      container.scrollTop += container.scrollHeight - beforeOlder.height;
+      return;
+    }
     if (container) {
       container.scrollTo({
         top: container.scrollHeight,
@@ -49,6 +57,14 @@ export const MessageList = () => {
     }
   }, [systemState.currentChannel]);
 
+  const loadOlderMessages = async () => {
+    const container = messageContainerRef.current;
+    if (container) {
+      beforeOlderRef.current = { height: container.scrollHeight, firstId: channelState.messages[0]?.id };
+    }
+    await channelActions.fetchOlderMessages();
+  };
+
   if (!systemState.currentChannel) {
     return <div className="flex-1 flex items-center justify-center text-text-light/50">No channel selected</div>;
   }
@@ -67,6 +83,16 @@ export const MessageList = () => {
           scrollbar-thin scrollbar-thumb-primary/20 scrollbar-track-surface-dark 
           scrollbar-hover:scrollbar-thumb-primary/30"
       >
+        {channelState.hasOlderMessages && (
+          <button
+            type="button"
+            onClick={loadOlderMessages}
+            className="self-center px-2.5 py-1 text-xs bg-surface-light/10 hover:bg-primary/20 text-text-light/70 rounded-lg transition-colors disabled:opacity-50 disabled:cursor-not-allowed"
+            disabled={channelState.loadingOlderMessages}
+          >
+            {channelState.loadingOlderMessages ? "Loading..." : "Load older messages"}
+          </button>
+        )}
         {channelState.messages.map((message) => (
           <MessageItem key={message.id} message={message} onImageLoad={handleImageLoad} />
         ))}
@@ -3,6 +3,7 @@ import { Sketch } from "../../types/interfaces";
 import helpers from "../../utils/helpers";
 import { Dropdown } from "../Generic/Dropdown";
 import { Modal } from "../Generic/Modal";
+import { useAuthContext } from "../../hooks/useAuthContext";
 
 interface SketchListProps {
   sketches: Sketch[];
@@ -14,6 +15,7 @@ interface SketchListProps {
 const SketchList = ({ sketches, onSelect, onDelete, isLoading = false }: SketchListProps) => {
   const [isOpen, setIsOpen] = useState(false);
   const [confirmDeleteSketchID, setConfirmDeleteSketchID] = useState<string | null>(null);
+  const { token } = useAuthContext().state;
 
   // Mount/Unmount logging
   useEffect(() => {
@@ -25,6 +27,10 @@ const SketchList = ({ sketches, onSelect, onDelete, isLoading = false }: SketchL
     }
   }, []);
 
+  const cleanAuthPath = (path: string) => {
+    return `${path.replace(/^\/*(files\/)?/, "")}?token=${token}`;
+  };
+
   const handleSelect = (sketch: Sketch) => {
     if (!sketch.id || !sketch.channelName) {
       console.error("Invalid sketch data:", sketch);
@@ -65,6 +71,14 @@ const SketchList = ({ sketches, onSelect, onDelete, isLoading = false }: SketchL
             key={sketch.id}
             className="flex items-center justify-between py-2 px-3 hover:bg-surface-dark/50 rounded-md transition-colors"
           >
+            {sketch.thumbnailUrl && (
+              <img
+                src={cleanAuthPath(sketch.thumbnailUrl)}
+                alt={sketch.displayName}
+                className="w-12 h-12 mr-2 object-contain rounded bg-white/90 cursor-pointer"
+                onClick={() => handleSelect(sketch)}
+              />
+            )}
             <div className="flex-1 flex-row gap-1 cursor-pointer text-sm truncate" onClick={() => handleSelect(sketch)}>
               <span className="flex font-medium text-text-light truncate">{sketch.displayName}</span>
               <span className="flex text-xs text-text-light/50 truncate">by {sketch.createdBy}</span>
@@ -9,12 +9,15 @@ export interface ChannelContext {
   state: {
     messages: IncomingMessage[];
     members: EnhancedChannelMember[];
+    hasOlderMessages: boolean;
+    loadingOlderMessages: boolean;
   };
   actions: {
     setMessages: Dispatch<SetStateAction<IncomingMessage[]>>;
     setMembers: Dispatch<SetStateAction<EnhancedChannelMember[]>>;
     updateMemberOnlineStatus: (username: string, isOnline: boolean) => void;
     uploadFile: (file: File) => Promise<{ imagePath: string; thumbnailPath: string } | null>;
+    fetchOlderMessages: () => Promise<void>;
   };
 }
 
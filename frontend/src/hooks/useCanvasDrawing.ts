@@ -1,6 +1,6 @@
 import { useRef, useCallback, useState } from "react";
 import { type MutableRefObject } from "react";
-import { Point, DrawPath } from "../types/interfaces";
+import { Point, DrawPath, DrawPathKind } from "../types/interfaces";
 
 interface CanvasState {
   width: number;
@@ -90,11 +90,65 @@ const useCanvasDrawing = (): UseCanvasDrawingReturn => {
     ctx.stroke();
   }, []);
 
+  // Draw a shape or text element; these always draw, never erase
+  const drawShape = useCallback((ctx: CanvasRenderingContext2D, path: DrawPath) => {
+    const [a, b] = path.points;
+    ctx.strokeStyle = path.color;
+    ctx.fillStyle = path.color;
+    ctx.lineWidth = path.strokeWidth;
+    ctx.lineCap = "round";
+    ctx.lineJoin = "round";
+
+    if (path.kind === DrawPathKind.Text) {
+      ctx.font = `${path.fontSize ?? 16}px sans-serif`;
+      ctx.textBaseline = "top";
+      const lineHeight = (path.fontSize ?? 16) * 1.2;
+      (path.text ?? "").split("\n").forEach((line, i) => ctx.fillText(line, a.x, a.y + i * lineHeight));
+      return;
+    }
+    if (!b) return;
+
+    ctx.beginPath();
+    switch (path.kind) {
+      case DrawPathKind.Rect:
+        ctx.rect(Math.min(a.x, b.x), Math.min(a.y, b.y), Math.abs(b.x - a.x), Math.abs(b.y - a.y));
+        break;
+      case DrawPathKind.Ellipse:
+        ctx.ellipse((a.x + b.x) / 2, (a.y + b.y) / 2, Math.abs(b.x - a.x) / 2, Math.abs(b.y - a.y) / 2, 0, 0, 2 * Math.PI);
+        break;
+      case DrawPathKind.Line:
+      case DrawPathKind.Arrow: {
+        ctx.moveTo(a.x, a.y);
+        ctx.lineTo(b.x, b.y);
+        if (path.kind === DrawPathKind.Arrow && (a.x !== b.x || a.y !== b.y)) {
+          // Barbs match the server's rendering: 30 degrees, at least 10px long
+          const length = Math.max(3 * path.strokeWidth, 10);
+          const angle = Math.atan2(b.y - a.y, b.x - a.x);
+          for (const offset of [Math.PI / 6, -Math.PI / 6]) {
+            ctx.moveTo(b.x, b.y);
+            ctx.lineTo(b.x - length * Math.cos(angle + offset), b.y - length * Math.sin(angle + offset));
+          }
+        }
+        break;
+      }
+    }
+    if (path.fill) {
+      ctx.fillStyle = path.fill;
+      ctx.fill();
+    }
+    ctx.stroke();
+  }, []);
+
   // Draw a complete path with multiple points
   const drawPath = useCallback((path: DrawPath) => {
     const ctx = ctxRef.current;
     if (!ctx || !path.points || path.points.length === 0) return;
 
+    if (path.kind) {
+      drawShape(ctx, path);
+      return;
+    }
+
     // Set style and width for the entire path
     // Use the path's color if drawing. Erase color is irrelevant due to destination-out.
     ctx.strokeStyle = path.isDrawing ? path.color : "#000000";
@@ -126,7 +180,7 @@ const useCanvasDrawing = (): UseCanvasDrawingReturn => {
       // Stroke the path for lines with 2+ points
       ctx.stroke();
     }
-  }, []);
+  }, [drawShape]);
 
   // Redraw all paths on the canvas
   const redrawCanvas = useCallback(
@@ -135,7 +189,8 @@ const useCanvasDrawing = (): UseCanvasDrawingReturn => {
       if (!ctx) return;
 
       paths.forEach((path) => {
-        if (path.points.length < 2) return;
+        // Text elements are anchored at a single point
+        if (path.points.length < 2 && path.kind !== DrawPathKind.Text) return;
         drawPath(path);
       });
     },
@@ -117,7 +117,7 @@ export const useSketchManager = ({ channelName }: UseSketchManagerProps) => {
     if (canvas) {
       // Only proceed if canvas element exists
       if (sketch) {
-        const { width, height, regions } = sketch;
+        const { width, height, regions, layers } = sketch;
 
         // Initialize canvas only if dimensions mismatch
         if (canvas.width !== width || canvas.height !== height) {
@@ -131,7 +131,9 @@ export const useSketchManager = ({ channelName }: UseSketchManagerProps) => {
         }
 
         // --- Two-Pass Rendering --- //
-        const allPaths = regions ? Object.values(regions).flatMap((r) => r.paths || []) : [];
+        // The sketch's own regions are the base layer, drawn beneath its visible layers
+        const layerRegions = [regions ?? {}, ...(layers ?? []).filter((l) => l.visible).map((l) => l.regions)];
+        const allPaths = layerRegions.flatMap((lr) => Object.values(lr).flatMap((r) => r.paths || []));
         const drawPaths = allPaths.filter((p) => p.isDrawing);
         const erasePaths = allPaths.filter((p) => !p.isDrawing);
         const ctx = canvasRef.current?.getContext("2d");
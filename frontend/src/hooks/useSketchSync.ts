@@ -122,6 +122,18 @@ export const useSketchSync = ({ channelName, sketchId, callbacks }: UseSketchSyn
     [sendSketchCommand]
   );
 
+  // Tell the server which sketch this session shows, so it forwards that sketch's cursors.
+  // The server forgets on reconnect, so announce again whenever the channel connects.
+  const channelConnected = wsService.state.channelConnected;
+  useEffect(() => {
+    if (!sketchId || !channelConnected) return;
+
+    sendSketchCommand({ commandType: SketchCommandType.Open, sketchId });
+    return () => {
+      sendSketchCommand({ commandType: SketchCommandType.Close, sketchId });
+    };
+  }, [sketchId, channelConnected, sendSketchCommand]);
+
   // --- Incoming Message Handler --- // Focuses ONLY on UPDATE commands
 
   const handleIncomingSketchMessage = useCallback(
@@ -1,4 +1,4 @@
-import { useState, useEffect, useCallback, useMemo } from "react";
+import { useState, useEffect, useCallback, useMemo, useRef } from "react";
 import { ChannelContext, EnhancedChannelMember } from "../contexts/channelContext";
 import { IncomingMessage, ChannelMemberSchema, IncomingMessageSchema, APIErrorResponse } from "../types/interfaces";
 import { z } from "zod";
@@ -17,17 +17,22 @@ const OnlineUserSchema = z.string();
 export const ChannelProvider = ({ children }: ChannelProviderProps) => {
   const [messages, setMessages] = useState<IncomingMessage[]>([]);
   const [members, setMembers] = useState<EnhancedChannelMember[]>([]);
+  const [olderCursor, setOlderCursor] = useState<string | undefined>(undefined); // Cursor of the page before the oldest loaded
+  const [loadingOlderMessages, setLoadingOlderMessages] = useState(false);
   const { showError } = useNotification();
 
   const { state: authState } = useAuthContext();
   const token = authState.token;
   const systemContext = useSystemContext();
   const currentChannel = systemContext.state.currentChannel;
+  const currentChannelNameRef = useRef(currentChannel?.name);
 
   // Clear messages/members when changing channels
   useEffect(() => {
     setMessages([]);
     setMembers([]);
+    setOlderCursor(undefined);
+    currentChannelNameRef.current = currentChannel?.name;
   }, [currentChannel?.name]);
 
   const updateMemberOnlineStatus = useCallback((username: string, isOnline: boolean) => {
@@ -79,14 +84,42 @@ export const ChannelProvider = ({ children }: ChannelProviderProps) => {
       if (!response.success) {
         throw new Error((response as APIErrorResponse).error.message || "Failed to load messages");
       }
-      const parsedMessages = z.array(IncomingMessageSchema).parse(response.data);
+      const parsedMessages = z.array(IncomingMessageSchema).parse(response.data.messages);
       setMessages(parsedMessages);
+      setOlderCursor(response.data.hasMore ? response.data.nextCursor : undefined);
     } catch (error) {
       setMessages([]);
+      setOlderCursor(undefined);
       throw error;
     }
   }, [currentChannel, token]);
 
+  // Prepend the page before the oldest loaded message
+  const fetchOlderMessages = useCallback(async () => {
+    if (!currentChannel || !token || !olderCursor || loadingOlderMessages) return;
+    const channelName = currentChannel.name;
+    setLoadingOlderMessages(true);
+    try {
+      const response = await channelApi.fetchMessages(channelName, token, olderCursor);
+      if (!response.success) {
+        throw new Error((response as APIErrorResponse).error.message || "Failed to load older messages");
+      }
+      if (currentChannelNameRef.current !== channelName) return; // Switched channels meanwhile
+      const parsedMessages = z.array(IncomingMessageSchema).parse(response.data.messages);
+      setMessages((prev) => {
+        const loaded = new Set(prev.map((message) => message.id));
+        return [...parsedMessages.filter((message) => !loaded.has(message.id)), ...prev];
+      });
+      setOlderCursor(response.data.hasMore ? response.data.nextCursor : undefined);
+    } catch (error) {
+      const message = error instanceof Error ? error.message : "Failed to load older messages";
+      console.error("Loading older messages failed:", error);
+      showError(message);
+    } finally {
+      setLoadingOlderMessages(false);
+    }
+  }, [currentChannel, token, olderCursor, loadingOlderMessages, showError]);
+
   // --- Upload File ---
   const uploadFile = useCallback(
     async (file: File): Promise<{ imagePath: string; thumbnailPath: string }> => {
@@ -135,6 +168,8 @@ export const ChannelProvider = ({ children }: ChannelProviderProps) => {
       state: {
         messages,
         members,
+        hasOlderMessages: olderCursor !== undefined,
+        loadingOlderMessages,
       },
       actions: {
         setMessages,
@@ -143,9 +178,20 @@ export const ChannelProvider = ({ children }: ChannelProviderProps) => {
         uploadFile,
         fetchMembers,
         fetchMessages,
+        fetchOlderMessages,
       },
     }),
-    [messages, members, updateMemberOnlineStatus, uploadFile, fetchMembers, fetchMessages]
+    [
+      messages,
+      members,
+      olderCursor,
+      loadingOlderMessages,
+      updateMemberOnlineStatus,
+      uploadFile,
+      fetchMembers,
+      fetchMessages,
+      fetchOlderMessages,
+    ]
   );
 
   return <ChannelContext.Provider value={contextValue}>{children}</ChannelContext.Provider>;
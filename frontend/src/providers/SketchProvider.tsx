@@ -314,6 +314,25 @@ export const SketchProvider: React.FC<{ children: React.ReactNode }> = ({ childr
       const currentChannelName = systemContext.state.currentChannel?.name;
 
       if (message.channelName !== currentChannelName) return;
+
+      // Undo, redo, restore, layer changes and erases come from the server, including for our own actions
+      if (
+        cmd.commandType === SketchCommandType.Undo ||
+        cmd.commandType === SketchCommandType.Redo ||
+        cmd.commandType === SketchCommandType.Restore ||
+        cmd.commandType === SketchCommandType.Layers ||
+        cmd.commandType === SketchCommandType.Erase
+      ) {
+        if (state.currentSketch?.id === cmd.sketchId && currentChannelName) {
+          actions.loadSketch(currentChannelName, cmd.sketchId).catch((err) => {
+            console.error(`[SketchProvider] WS: Failed to reload sketch on ${cmd.commandType} command:`, err);
+            showError(
+              `Error reloading sketch after WS update: ${err instanceof Error ? err.message : "Unknown error"}`
+            );
+          });
+        }
+        return;
+      }
       if (sender === authState.username) return;
 
       if (import.meta.env.DEV)
@@ -361,6 +380,10 @@ export const SketchProvider: React.FC<{ children: React.ReactNode }> = ({ childr
         case SketchCommandType.Update:
           break;
 
+        // Cursors are ephemeral and never change the sketch itself
+        case SketchCommandType.Cursor:
+          break;
+
         default:
           console.warn(`[SketchProvider] Unhandled sketch command type via WS: ${cmd.commandType}`);
       }
@@ -32,6 +32,8 @@ export class WebSocketService {
 
   private protocol = window.location.protocol === "https:" ? "wss:" : "ws:";
   private baseUrl = `${this.protocol}//${window.location.host}${BASE_URL}/ws`;
+  // Identifies this tab to the server, so a user can hold several sessions at once
+  private sessionId = crypto.randomUUID();
 
   // Use WeakMap to track intentionally closed sockets without modifying the socket object itself
   private closingIntentionallyMap = new WeakMap<WebSocket, boolean>();
@@ -110,7 +112,7 @@ export class WebSocketService {
     // Increment attempts for *this specific* connection attempt cycle
     this.connectionAttempts.system++;
 
-    const socket = new WebSocket(`${this.baseUrl}/system`, ["Authentication", this.currentToken]);
+    const socket = new WebSocket(`${this.baseUrl}/system?session=${this.sessionId}`, ["Authentication", this.currentToken]);
     this.systemSocket = socket;
 
     socket.onopen = () => {
@@ -262,7 +264,7 @@ export class WebSocketService {
     this.connectionAttempts.channel++;
     this.lastChannelConnectionAttemptTimestamp = Date.now(); // Track time for quick close detection
 
-    const socket = new WebSocket(`${this.baseUrl}/${this.currentChannelName}`, ["Authentication", this.currentToken]);
+    const socket = new WebSocket(`${this.baseUrl}/${this.currentChannelName}?session=${this.sessionId}`, ["Authentication", this.currentToken]);
     this.channelSocket = socket;
 
     socket.onopen = () => {
@@ -9,6 +9,16 @@ export enum MessageType {
   MemberUpdate = 4,
   UserStatus = 5,
   SystemUserStatus = 6,
+  Edit = 7,
+  Delete = 8,
+  Reaction = 9,
+  ReadReceipt = 10,
+  UnreadCount = 11,
+  Typing = 12,
+  Mention = 13,
+  PinUpdate = 14,
+  Ack = 15,
+  Rejected = 16, // Server-sent to the sender only: one of their messages was refused
 }
 
 export enum SketchCommandType {
@@ -16,6 +26,14 @@ export enum SketchCommandType {
   Clear = "CLEAR",
   Delete = "DELETE",
   New = "NEW",
+  Undo = "UNDO",
+  Redo = "REDO",
+  Restore = "RESTORE",
+  Layers = "LAYERS",
+  Erase = "ERASE",
+  Cursor = "CURSOR",
+  Open = "OPEN", // Sent when this session starts showing a sketch, so it receives that sketch's cursors
+  Close = "CLOSE",
   // Select = "SELECT",
 }
 
@@ -36,11 +54,24 @@ export const PointSchema = z.object({
   y: z.number(),
 });
 
+export enum DrawPathKind {
+  Rect = "rect",
+  Ellipse = "ellipse",
+  Line = "line",
+  Arrow = "arrow",
+  Text = "text",
+}
+
 export const DrawPathSchema = z.object({
+  id: z.string().optional(), // Set by the server once the stroke is complete
   points: z.array(PointSchema),
   isDrawing: z.boolean(),
   strokeWidth: z.number().min(1).default(1),
   color: z.string(),
+  kind: z.nativeEnum(DrawPathKind).optional(), // Freehand when absent
+  fill: z.string().optional(),
+  text: z.string().optional(),
+  fontSize: z.number().optional(),
 });
 
 export const RegionSchema = z.object({
@@ -49,6 +80,15 @@ export const RegionSchema = z.object({
   paths: z.array(DrawPathSchema),
 });
 
+export const SketchLayerSchema = z.object({
+  id: z.string().uuid(),
+  name: z.string().min(1),
+  visible: z.boolean(),
+  locked: z.boolean(),
+  createdBy: z.string(),
+  regions: z.record(z.string(), RegionSchema).default({}),
+});
+
 export const SketchSchema = z.object({
   id: z.string().uuid(),
   channelName: z.string().min(1),
@@ -58,6 +98,14 @@ export const SketchSchema = z.object({
   regions: z.record(z.string(), RegionSchema).default({}),
   createdAt: z.string().min(1).datetime(),
   createdBy: z.string().min(1),
+  thumbnailUrl: z.string().optional(),
+  layers: z.array(SketchLayerSchema).default([]),
+});
+
+export const SketchCursorSchema = z.object({
+  position: PointSchema,
+  color: z.string(),
+  left: z.boolean().optional(), // The cursor left the sketch or went idle
 });
 
 export const SketchCommandSchema = z
@@ -67,6 +115,13 @@ export const SketchCommandSchema = z
     region: RegionSchema.optional(),
     isPartial: z.boolean().optional(),
     sketchData: SketchSchema.optional(),
+    operationId: z.string().uuid().optional(),
+    author: z.string().optional(),
+    layerId: z.string().uuid().optional(),
+    layers: z.array(SketchLayerSchema).optional(),
+    strokeIds: z.array(z.string()).optional(),
+    regions: z.array(RegionSchema).optional(), // Erase results: regions that lost paths without IDs, to replace whole
+    cursor: SketchCursorSchema.optional(),
   })
   .refine(
     (data) => {
@@ -74,9 +129,23 @@ export const SketchCommandSchema = z
         case SketchCommandType.Update:
           return data.region !== undefined && data.isPartial !== undefined;
         case SketchCommandType.New:
+        case SketchCommandType.Restore:
           return data.sketchData !== undefined;
+        case SketchCommandType.Cursor:
+          return data.cursor !== undefined;
+        case SketchCommandType.Erase:
+          return (
+            (data.strokeIds?.length ?? 0) > 0 ||
+            (data.region?.paths.length ?? 0) > 0 ||
+            (data.regions?.length ?? 0) > 0
+          );
         case SketchCommandType.Clear:
         case SketchCommandType.Delete:
+        case SketchCommandType.Undo:
+        case SketchCommandType.Redo:
+        case SketchCommandType.Layers:
+        case SketchCommandType.Open:
+        case SketchCommandType.Close:
           // case SketchCommandType.Select:
           return true;
         default:
@@ -92,6 +161,7 @@ export type Point = z.infer<typeof PointSchema>;
 export type DrawPath = z.infer<typeof DrawPathSchema>;
 export type Region = z.infer<typeof RegionSchema>;
 export type Sketch = z.infer<typeof SketchSchema>;
+export type SketchCursor = z.infer<typeof SketchCursorSchema>;
 export type SketchCommand = z.infer<typeof SketchCommandSchema>;
 
 // ============= Channel Types =============
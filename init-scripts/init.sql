@@ -9,6 +9,8 @@ CREATE TABLE users (
 CREATE TABLE channels (
     name VARCHAR(50) PRIMARY KEY,
     is_private BOOLEAN NOT NULL DEFAULT false,
+    is_direct BOOLEAN NOT NULL DEFAULT false,  -- One-to-one conversation, hidden from the channel list
+    last_seq BIGINT NOT NULL DEFAULT 0,       -- Last message sequence number handed out in this channel
     description TEXT,                  -- Optional
     hashed_password VARCHAR(100),      -- Optional
     created_by VARCHAR(50) NOT NULL REFERENCES users(username),
@@ -21,6 +23,8 @@ CREATE TABLE channel_member (
     username VARCHAR(50) REFERENCES users(username) ON DELETE CASCADE,
     is_admin BOOLEAN NOT NULL DEFAULT false,
     joined_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_read_at TIMESTAMP,            -- Read marker timestamp; messages after it are unread
+    last_read_message_id UUID,         -- Read marker message; NULL when marked read up to last_read_at
     PRIMARY KEY (channel_name, username)
 );
 
@@ -31,7 +35,40 @@ CREATE TABLE messages (
     username VARCHAR(50) REFERENCES users(username) ON DELETE CASCADE,
     message_type INTEGER NOT NULL,
     content JSONB NOT NULL,
-    timestamp TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+    timestamp TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    edited_at TIMESTAMP,               -- Set when the author/admin edits the text
+    deleted_at TIMESTAMP,              -- Soft delete marker; content is hidden once set
+    reply_to UUID,                     -- Thread root; no FK so a reply can never block a batch insert
+    seq BIGINT NOT NULL DEFAULT 0      -- Per-channel delivery sequence, used to replay missed messages
+);
+
+-- Messages pinned to a channel by its admins
+CREATE TABLE pinned_messages (
+    channel_name VARCHAR(50) REFERENCES channels(name) ON DELETE CASCADE,
+    message_id UUID REFERENCES messages(id) ON DELETE CASCADE,
+    pinned_by VARCHAR(50) REFERENCES users(username) ON DELETE SET NULL,
+    pinned_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (channel_name, message_id)
+);
+
+-- @mentions of channel members in text messages
+CREATE TABLE message_mentions (
+    message_id UUID NOT NULL,          -- No FK: mentions are recorded before the message leaves the chat buffer
+    channel_name VARCHAR(50) REFERENCES channels(name) ON DELETE CASCADE,
+    username VARCHAR(50) REFERENCES users(username) ON DELETE CASCADE,
+    mentioned_by VARCHAR(50) REFERENCES users(username) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    read_at TIMESTAMP,                 -- Set once the mentioned user reads past the message
+    PRIMARY KEY (message_id, username)
+);
+
+-- Emoji reactions; one row per (message, user, emoji)
+CREATE TABLE message_reactions (
+    message_id UUID REFERENCES messages(id) ON DELETE CASCADE,
+    username VARCHAR(50) REFERENCES users(username) ON DELETE CASCADE,
+    emoji VARCHAR(32) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (message_id, username, emoji)
 );
 
 -- Sketch table
@@ -43,9 +80,54 @@ CREATE TABLE sketches (
     height INTEGER NOT NULL,
     regions JSONB NOT NULL DEFAULT '{}',
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-    created_by VARCHAR(50) REFERENCES users(username) ON DELETE CASCADE
+    created_by VARCHAR(50) REFERENCES users(username) ON DELETE CASCADE,
+    thumbnail_url TEXT,                -- Rendered preview in the file store; NULL until first rendered
+    layers JSONB NOT NULL DEFAULT '[]', -- Named layers above regions, bottom to top, each with its own regions
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, -- Last change to regions or layers
+    compacted_at TIMESTAMP,            -- Last compaction; the sketch is due again once updated_at passes it
+    compacted_from_bytes INTEGER,      -- Stored size of regions and layers before and after the last compaction
+    compacted_to_bytes INTEGER
+);
+
+-- Committed sketch strokes, in order; undo and redo rebuild a region from the strokes not undone
+CREATE TABLE sketch_operations (
+    id UUID PRIMARY KEY,               -- The id of the message that committed the stroke
+    sketch_id UUID REFERENCES sketches(id) ON DELETE CASCADE,
+    seq BIGSERIAL,                     -- Log order
+    username VARCHAR(50) REFERENCES users(username) ON DELETE CASCADE,
+    layer_id VARCHAR(36) NOT NULL DEFAULT '', -- Layer drawn on; empty for sketches.regions
+    region_key VARCHAR(32) NOT NULL,   -- Key of the region in the layer's regions
+    region JSONB NOT NULL,             -- The stroke's region, holding only its own paths
+    undone_at TIMESTAMP,               -- Set while undone; cleared by redo
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Snapshots of sketch regions, kept up to a per-sketch limit
+CREATE TABLE sketch_versions (
+    id UUID PRIMARY KEY,
+    sketch_id UUID REFERENCES sketches(id) ON DELETE CASCADE,
+    regions JSONB NOT NULL DEFAULT '{}',
+    layers JSONB NOT NULL DEFAULT '[]',
+    reason VARCHAR(16) NOT NULL,       -- "auto", "manual" or "restore"
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    created_by VARCHAR(50) REFERENCES users(username) ON DELETE SET NULL
+);
+
+-- Cross-node hub events too large for a NOTIFY payload; announced by id and purged after a few minutes
+CREATE TABLE broker_events (
+    id BIGSERIAL PRIMARY KEY,
+    payload TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 );
 
 -- Indexes to speed up queries
-CREATE INDEX idx_messages_channel_timestamp ON messages(channel_name, timestamp);
+CREATE INDEX idx_messages_channel_timestamp ON messages(channel_name, timestamp, id);
+-- Must match the tsvector expression used by the SearchMessages statement
+CREATE INDEX idx_messages_content_fts ON messages USING GIN (to_tsvector('english', COALESCE(content->>'text', '')));
+CREATE UNIQUE INDEX idx_messages_channel_seq ON messages(channel_name, seq) WHERE seq > 0;
+CREATE INDEX idx_messages_reply_to ON messages(reply_to, timestamp, id) WHERE reply_to IS NOT NULL;
+CREATE INDEX idx_message_mentions_unread ON message_mentions(username, created_at) WHERE read_at IS NULL;
 CREATE INDEX idx_channels_created_by ON channels(created_by);
+CREATE INDEX idx_sketch_operations_sketch ON sketch_operations(sketch_id, username, seq);
+CREATE INDEX idx_sketch_versions_sketch ON sketch_versions(sketch_id, created_at);
+CREATE INDEX idx_broker_events_created_at ON broker_events(created_at);